@@ -1,5 +1,5 @@
 #!/bin/sh
 cp ../dumpfile.sql .
 strip server shell clientsimulator
-tar cvfz distro-linux64-`date +%F`.gz server shell clientsimulator dumpfile.sql readme.md config.ini
+tar cvfz distro-linux64-`date +%F`.gz server shell clientsimulator dumpfile.sql readme.md config.ini items.json loot.json monsters.json bosses.json abilities.json dialogs.json crafting.json achievements.json
 rm dumpfile.sql
@@ -24,6 +24,7 @@
 db.counters.drop()
 db.counters.insert({_id: "avatarId", c: 1}) // A document to produce avatar IDs. 0 is reserved.
 db.counters.insert({_id: "newsId", c: 0}) // A document to produce news IDs
+db.counters.insert({_id: "guildId", c: 1}) // A document to produce guild IDs. 0 means no guild.
 
 // Avatars: _id is used for the numerical avatar Id.
 db.avatars.drop()
@@ -35,3 +36,15 @@ db.avatars.ensureIndex({"tscoretotal":1}, {unique:false}) // Used for sorting
 
 // News: _id is used for the numerical unique id.
 db.news.drop()
+
+// Guilds: _id is used for the numerical guild id.
+db.guilds.drop()
+db.guilds.ensureIndex({"lname":1}, {unique:true}) // Lower case guild name must be unique
+
+// Mail: Offline messages, removed when delivered.
+db.mail.drop()
+db.mail.ensureIndex({"to":1}, {unique:false}) // Used to find the mail for a player
+
+// Trade log: An audit record of every trade between players.
+db.tradelog.drop()
+db.tradelog.ensureIndex({"ids":1}, {unique:false}) // Used to find the trades of a player
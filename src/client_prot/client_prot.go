@@ -63,20 +63,45 @@ const (
 	CMD_RESP_AGGRO_FROM_MONSTER    = 35 // The player got aggro from one or more monsters
 	CMD_VRFY_CHUNCK_CS             = 36 // Request server to verify checksum for one or more chunks. If wrong, the updated chunk will be sent.
 	CMD_USE_ITEM                   = 37 // The player uses an item from the inventory.
-	CMD_UPD_INV                    = 38 // Server updates the client about the amount of items.
-	CMD_EQUIPMENT                  = 39 // Report equipment
+	CMD_UPD_INV                    = 38 // Server updates the client about the amount of items, with instance data.
+	CMD_EQUIPMENT                  = 39 // Report equipment, with instance data
 	CMD_JELLY_BLOCKS               = 40 // Turn blocks transparent and permeable
 	CMD_PING                       = 41 // Used to measure communication delay.
-	CMD_DROP_ITEM                  = 42 // Drop an item from the inventory
+	CMD_DROP_ITEM                  = 42 // Sell an item from the inventory to the nearest vendor
 	CMD_LOGINFAILED                = 43 // The login failed.
 	CMD_REQ_PLAYER_INFO            = 44 // Request player information
 	CMD_RESP_PLAYER_NAME           = 45 // A name of a player
 	CMD_TELEPORT                   = 46 // Teleport player to a chunk coordinate.
 	CMD_ERROR_REPORT               = 47 // Send an error report to the server, in the form of a string.
-	CMD_Last                       = 48 // ONE HIGHER THAN LAST COMMAND! Add no commands after this one.
+	CMD_PARTY_LIST                 = 48 // List of party members, sent when the party changes.
+	CMD_TRADE                      = 49 // Trade request, offer, confirm or cancel. See Trade* in the server.
+	CMD_TRADE_STATE                = 50 // The current state of a trade session
+	CMD_CHEST_OPEN                 = 51 // Open a storage chest
+	CMD_CHEST_CONTENT              = 52 // The content of a storage chest
+	CMD_CHEST_MOVE                 = 53 // Move items between a storage chest and the inventory. See ChestMove* in the server.
+	CMD_PROJECTILE                 = 54 // A projectile was fired. Id, model, relative position, velocity and max flight time.
+	CMD_PROJECTILE_END             = 55 // A projectile is gone. Id, reason and relative position.
+	CMD_ABILITIES                  = 56 // The learned abilities, and the remaining cooldowns
+	CMD_STATUS_EFFECTS             = 57 // The active status effects of a player or a monster
+	CMD_ATTACK_PLAYER              = 58 // Initiate an attack on a player, in a duel or an arena
+	CMD_PVP_HIT                    = 59 // A player hit another player. Attacker uid, defender uid, and damage.
+	CMD_USE_BLOCK                  = 60 // Use a door or a lever. Chunk coordinate and position in the chunk.
+	CMD_NPC_TALK                   = 61 // Start talking with an NPC. The argument is the NPC id.
+	CMD_NPC_DIALOG                 = 62 // A dialog node from an NPC. NPC id, number of choices, the text and the choices.
+	CMD_NPC_ANSWER                 = 63 // The choice made by the player. NPC id and the index of the choice.
+	CMD_VENDOR_STOCK               = 64 // The stock of a vendor. NPC id, number of items, and code, level and price of every item.
+	CMD_VENDOR_BUY                 = 65 // Buy items from a vendor. NPC id, item code and count.
+	CMD_GOLD                       = 66 // The gold of the player
+	CMD_AUCTION_SEARCH             = 67 // Search the auction house. Item code, or zeroes for any, and min and max level.
+	CMD_AUCTION_LIST               = 68 // The result of an auction search. Number of listings, and the listings.
+	CMD_AUCTION_SELL               = 69 // List items in the auction house. Item code, level, count, price and hours.
+	CMD_AUCTION_BUY                = 70 // Buy a listing from the auction house. The listing id.
+	CMD_CRAFT                      = 71 // Use a crafting recipe. Count and the recipe id.
+	CMD_REPAIR                     = 72 // Repair the equipment. 0 at a vendor for gold, 1 with materials.
+	CMD_Last                       = 73 // ONE HIGHER THAN LAST COMMAND! Add no commands after this one.
 
-	ProtVersionMajor = 5
-	ProtVersionMinor = 2
+	ProtVersionMajor = 7
+	ProtVersionMinor = 0
 )
 
 //
@@ -86,6 +111,7 @@ const (
 	// Types used by OBJECT_LIST
 	ObjTypePlayer  = 0
 	ObjTypeMonster = 1
+	ObjTypeNPC     = 2
 
 	// States used by OBJECT_LIST
 	ObjStateRemove = 0
@@ -94,7 +120,8 @@ const (
 	NEAR_OBJECTS    = 64  // All objects within this distance are considered to be near, and reported to clients
 	BLOCK_COORD_RES = 100 // Fixed point resolution of coordinates
 
-	// Action used as argument for the CMD_PLAYER_ACTION
+	// Action used as argument for the CMD_PLAYER_ACTION. These are the ids of the built-in abilities,
+	// other abilities are defined by the server.
 	UserActionHeal       = 0
 	UserActionCombAttack = 1
 )
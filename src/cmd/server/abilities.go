@@ -0,0 +1,424 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Player abilities. The abilities are defined in a JSON file, loaded at startup and reloaded with the admin
+// command "/reload abilities". The client uses an ability with CMD_PLAYER_ACTION, where the argument is the
+// ability id.
+//
+// An ability is learned when the player reaches the required level, and the learned abilities are saved with
+// the player. Cooldowns and casts in progress are not saved. The client is told about the learned abilities,
+// and the remaining cooldowns, with CMD_ABILITIES.
+//
+
+import (
+	"client_prot"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// The target of an ability
+const (
+	AbilityTargetSelf    = "self"    // The player using the ability
+	AbilityTargetMonster = "monster" // The monster the player is attacking
+)
+
+// The effect of an ability
+const (
+	AbilityEffectDamage   = "damage"   // Hit the target, 'Amount' is the weapon damage
+	AbilityEffectHeal     = "heal"     // Heal the player, 'Amount' is the fraction of the hit points
+	AbilityEffectBuff     = "buff"     // Apply the status effect 'Status' to the player, default "strength"
+	AbilityEffectDebuff   = "debuff"   // Apply the status effect 'Status' to the target, default "vulnerable"
+	AbilityEffectTeleport = "teleport" // Teleport the player to the home spawn point
+)
+
+type abilityDef struct {
+	Id       uint8   // The id used by the client in CMD_PLAYER_ACTION
+	Name     string  // A descriptive name
+	Level    uint32  // The ability is learned when the player reaches this level
+	ManaCost float32 // Mana used, 0-1
+	Cooldown float64 // Seconds until the ability can be used again
+	CastTime float64 // Seconds from the start of the cast until the ability takes effect. 0 means instant.
+	Range    float64 // Max distance to a monster target. 0 means no limit other than the attack distance.
+	Target   string  // One of AbilityTarget*
+	Effect   string  // One of AbilityEffect*
+	Amount   float32 // Depends on the effect
+	Duration float64 // Seconds, for buffs and debuffs
+	Status   string  // The status effect of buffs and debuffs
+	status   uint8   // The status effect kind
+}
+
+// A cast in progress
+type abilityCast struct {
+	def    *abilityDef
+	target *monster
+	done   time.Time // When the ability takes effect
+}
+
+var (
+	abilitySem sync.RWMutex
+	abilities  = mustMakeAbilities(defaultAbilities)
+)
+
+// The abilities used when there is no ability file. These are the original heal and combination attack.
+var defaultAbilities = []abilityDef{
+	{Id: client_prot.UserActionHeal, Name: "Heal", ManaCost: CnfgManaForHealing, Target: AbilityTargetSelf, Effect: AbilityEffectHeal, Amount: CnfgHealthAtHealingSpell},
+	{Id: client_prot.UserActionCombAttack, Name: "Combination attack", ManaCost: CnfgManaForCombAttack, Target: AbilityTargetMonster, Effect: AbilityEffectDamage, Amount: CnfgWeaponDmgCombAttack},
+}
+
+// Verify the ability definitions, and build a map from id to definition.
+func makeAbilities(list []abilityDef) (map[uint8]*abilityDef, error) {
+	m := make(map[uint8]*abilityDef)
+	for i := range list {
+		def := &list[i]
+		if _, ok := m[def.Id]; ok {
+			return nil, fmt.Errorf("ability %d defined twice", def.Id)
+		}
+		if def.Name == "" {
+			return nil, fmt.Errorf("ability %d has no name", def.Id)
+		}
+		if def.ManaCost < 0 || def.ManaCost > 1 {
+			return nil, fmt.Errorf("ability '%s': mana cost must be 0-1", def.Name)
+		}
+		if def.Cooldown < 0 || def.CastTime < 0 || def.Range < 0 || def.Duration < 0 {
+			return nil, fmt.Errorf("ability '%s': negative attributes not allowed", def.Name)
+		}
+		var target string
+		switch def.Effect {
+		case AbilityEffectHeal, AbilityEffectBuff, AbilityEffectTeleport:
+			target = AbilityTargetSelf
+		case AbilityEffectDamage, AbilityEffectDebuff:
+			target = AbilityTargetMonster
+		default:
+			return nil, fmt.Errorf("ability '%s': unknown effect '%s'", def.Name, def.Effect)
+		}
+		if def.Target != target {
+			return nil, fmt.Errorf("ability '%s': effect '%s' needs target '%s'", def.Name, def.Effect, target)
+		}
+		if def.Effect != AbilityEffectTeleport && def.Amount <= 0 {
+			return nil, fmt.Errorf("ability '%s': no amount", def.Name)
+		}
+		if def.Effect == AbilityEffectBuff || def.Effect == AbilityEffectDebuff {
+			if def.Duration == 0 {
+				return nil, fmt.Errorf("ability '%s': no duration", def.Name)
+			}
+			if def.Status == "" {
+				def.Status = effectKinds[EffectStrength].Name
+				if def.Effect == AbilityEffectDebuff {
+					def.Status = effectKinds[EffectVulnerable].Name
+				}
+			}
+			kind, ok := FindEffectKind(def.Status)
+			if !ok {
+				return nil, fmt.Errorf("ability '%s': unknown status effect '%s'", def.Name, def.Status)
+			}
+			if def.Effect == AbilityEffectDebuff && !effectKinds[kind].Monster {
+				return nil, fmt.Errorf("ability '%s': status effect '%s' can't be used on monsters", def.Name, def.Status)
+			}
+			def.status = kind
+		}
+		m[def.Id] = def
+	}
+	return m, nil
+}
+
+func mustMakeAbilities(list []abilityDef) map[uint8]*abilityDef {
+	m, err := makeAbilities(list)
+	if err != nil {
+		log.Panicln("Built-in abilities:", err)
+	}
+	return m
+}
+
+// Load the abilities from file. The current abilities are kept if there is an error.
+func LoadAbilities(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var list []abilityDef
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("%s: %v", fileName, errors.New("no abilities defined"))
+	}
+	m, err := makeAbilities(list)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	abilitySem.Lock()
+	abilities = m
+	abilitySem.Unlock()
+	log.Println("Loaded", len(m), "abilities from", fileName)
+	return nil
+}
+
+// Find an ability definition. Return nil if there is no such ability.
+func FindAbility(id uint8) *abilityDef {
+	abilitySem.RLock()
+	defer abilitySem.RUnlock()
+	return abilities[id]
+}
+
+// Return true if the player has learned the ability
+func (up *user) knowsAbility(id uint8) bool {
+	for _, a := range up.Abilities {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Learn all abilities available at the current player level. Return true if something new was learned.
+func (up *user) learnAbilities_WLu() (learned bool) {
+	abilitySem.RLock()
+	var ids []int
+	for id, def := range abilities {
+		if def.Level <= up.Level && !up.knowsAbility(id) {
+			ids = append(ids, int(id))
+		}
+	}
+	abilitySem.RUnlock()
+	if len(ids) == 0 {
+		return false
+	}
+	sort.Ints(ids)
+	up.Lock()
+	for _, id := range ids {
+		up.Abilities = append(up.Abilities, uint8(id))
+	}
+	up.Unlock()
+	return true
+}
+
+// The remaining cooldown of an ability
+func (up *user) abilityCooldown(id uint8, now time.Time) time.Duration {
+	if t, ok := up.cooldowns[id]; ok && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Build the CMD_ABILITIES message, with the id and the remaining cooldown in ms of every learned ability.
+func abilitiesMessage(learned []uint8, cooldown func(id uint8) time.Duration) []byte {
+	const entryLen = 5
+	msgLen := 3 + len(learned)*entryLen
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_ABILITIES
+	p := b[3:]
+	for _, id := range learned {
+		p[0] = id
+		EncodeUint32(uint32(cooldown(id)/time.Millisecond), p[1:5])
+		p = p[entryLen:]
+	}
+	return b
+}
+
+// Tell the client about the learned abilities and their cooldowns
+func (up *user) ReportAbilities_Bl() {
+	now := time.Now()
+	up.writeBlocking_Bl(abilitiesMessage(up.Abilities, func(id uint8) time.Duration { return up.abilityCooldown(id, now) }))
+}
+
+// Check that the ability can be used now, and return the target. Return false if not possible.
+func (up *user) abilityReady_Bl(def *abilityDef, now time.Time) (mp *monster, ok bool) {
+	if up.Mana < def.ManaCost {
+		up.Printf_Bl("Not enough mana")
+		return nil, false
+	}
+	if cd := up.abilityCooldown(def.Id, now); cd > 0 {
+		up.Printf_Bl("%s is not ready, %.0f s left", def.Name, math.Ceil(cd.Seconds()))
+		return nil, false
+	}
+	switch def.Target {
+	case AbilityTargetMonster:
+		mp = up.aggro
+		if mp == nil || mp.dead {
+			up.Printf_Bl("Start attack first")
+			return nil, false
+		}
+		if def.Range > 0 {
+			dx, dy, dz := mp.Coord.X-up.Coord.X, mp.Coord.Y-up.Coord.Y, mp.Coord.Z-up.Coord.Z
+			if dx*dx+dy*dy+dz*dz > def.Range*def.Range {
+				up.Printf_Bl("Out of range")
+				return nil, false
+			}
+			from := up.Coord
+			from.Z += CnfgProjectileLaunchHeight
+			if !lineOfSight_WLwWLc(from, mp.aimPoint()) {
+				up.Printf_Bl("Not in line of sight")
+				return nil, false
+			}
+		}
+	case AbilityTargetSelf:
+		if def.Effect == AbilityEffectHeal && up.HitPoints == 1 {
+			up.Printf_Bl("Already full health")
+			return nil, false
+		}
+	}
+	return mp, true
+}
+
+// Manage player abilities
+func (up *user) CmdPlayerAction_WLuBl(userAction byte) {
+	if up.Dead {
+		up.Printf_Bl("Unable now\n")
+		return
+	}
+	def := FindAbility(userAction)
+	if def == nil {
+		up.Printf_Bl("#FAIL")
+		return
+	}
+	if !up.knowsAbility(def.Id) {
+		up.Printf_Bl("You don't know %s", def.Name)
+		return
+	}
+	if up.casting != nil {
+		up.Printf_Bl("Already casting %s", up.casting.def.Name)
+		return
+	}
+	now := time.Now()
+	if up.effects.has(EffectStun, now) {
+		up.Printf_Bl("You are stunned")
+		return
+	}
+	mp, ok := up.abilityReady_Bl(def, now)
+	if !ok {
+		return
+	}
+	if def.CastTime > 0 {
+		up.casting = &abilityCast{def: def, target: mp, done: now.Add(time.Duration(def.CastTime * 1e9))}
+		up.Printf_Bl("Casting %s", def.Name)
+		return
+	}
+	up.useAbility_WLuBl(def, mp, now)
+}
+
+// Complete the current cast, if it is done. The conditions are tested again, as they may have changed.
+func (up *user) ManageCasting_WLuBl(now time.Time) {
+	c := up.casting
+	if c == nil || now.Before(c.done) {
+		return
+	}
+	up.casting = nil
+	if up.Dead {
+		return
+	}
+	mp, ok := up.abilityReady_Bl(c.def, now)
+	if !ok {
+		return
+	}
+	if mp != c.target {
+		up.Printf_Bl("%s interrupted", c.def.Name)
+		return
+	}
+	up.useAbility_WLuBl(c.def, mp, now)
+}
+
+// Apply the effect of an ability, and start the cooldown
+func (up *user) useAbility_WLuBl(def *abilityDef, mp *monster, now time.Time) {
+	if def.Effect == AbilityEffectHeal {
+		up.Lock()
+		up.Heal(def.Amount, def.ManaCost)
+		up.Unlock()
+	} else {
+		up.Lock()
+		up.Mana -= def.ManaCost
+		up.updatedStats = true
+		up.Unlock()
+	}
+	duration := time.Duration(def.Duration * 1e9)
+	switch def.Effect {
+	case AbilityEffectDamage:
+		mp.Hit_WLuBl(up, def.Amount)
+	case AbilityEffectBuff:
+		up.ApplyEffect_WLu(def.status, def.Amount, duration, up.Id)
+		up.Printf_Bl("%s for %.0f s", def.Name, def.Duration)
+	case AbilityEffectDebuff:
+		mp.ApplyEffect_Bl(up, def.status, def.Amount, duration)
+		up.Printf_Bl("%s on the monster for %.0f s", def.Name, def.Duration)
+	case AbilityEffectTeleport:
+		up.Lock()
+		up.Coord = up.HomeSP
+		up.updatedStats = true
+		up.Unlock()
+	}
+	if def.Cooldown > 0 {
+		if up.cooldowns == nil {
+			up.cooldowns = make(map[uint8]time.Time)
+		}
+		up.cooldowns[def.Id] = now.Add(time.Duration(def.Cooldown * 1e9))
+		up.ReportAbilities_Bl()
+	}
+}
+
+// Admin command to manage abilities: "/ability", "/ability learn <id>", "/ability forget <id>"
+func (up *user) AbilityCommand_WLuBl(args []string) {
+	if len(args) == 0 || args[0] == "" {
+		now := time.Now()
+		for _, id := range up.Abilities {
+			if def := FindAbility(id); def != nil {
+				up.Printf_Bl("!%d %s: mana %.0f%%, cooldown %.0f s (%.0f s left)", id, def.Name, def.ManaCost*100, def.Cooldown, up.abilityCooldown(id, now).Seconds())
+			}
+		}
+		return
+	}
+	var id uint8
+	if len(args) != 2 || up.AdminLevel < 8 {
+		up.Printf_Bl("#FAIL !Usage: /ability [learn|forget id]")
+		return
+	}
+	if _, err := fmt.Sscan(args[1], &id); err != nil || FindAbility(id) == nil {
+		up.Printf_Bl("#FAIL !No such ability")
+		return
+	}
+	switch args[0] {
+	case "learn":
+		if !up.knowsAbility(id) {
+			up.Lock()
+			up.Abilities = append(up.Abilities, id)
+			up.Unlock()
+		}
+	case "forget":
+		up.Lock()
+		for i, a := range up.Abilities {
+			if a == id {
+				up.Abilities = append(up.Abilities[:i], up.Abilities[i+1:]...)
+				break
+			}
+		}
+		up.Unlock()
+	default:
+		up.Printf_Bl("#FAIL !Usage: /ability [learn|forget id]")
+		return
+	}
+	up.ReportAbilities_Bl()
+}
@@ -0,0 +1,204 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Achievements. Every achievement is a criterion over one kind of player event, see events.go: the event
+// must happen a number of times, or reach a total, at a minimum level. The achievements are defined in a
+// JSON file, loaded at startup and reloaded with the admin command "/reload achievements".
+//
+// The progress and the unlocked achievements are saved in the avatar. Unlocking is announced to the player
+// and the friends of the player from the client process, and is shown with "/achievements".
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+type achievementDef struct {
+	Id          string
+	Name        string
+	Description string
+	Event       string // The name of the event kind
+	Count       uint32 // The number of events needed, or the total for events that report totals
+	MinLevel    uint32 // Only events at this level or higher count
+}
+
+type achievementDefs struct {
+	Achievements []*achievementDef
+	byKind       [EventLast][]*achievementDef
+	byId         map[string]*achievementDef
+}
+
+// The achievements of a player, by achievement id
+type achievementLog struct {
+	Progress map[string]uint32    `bson:",omitempty"` // Achievements in progress
+	Unlocked map[string]time.Time `bson:",omitempty"`
+}
+
+var (
+	achievementSem sync.RWMutex
+	achievements   = &achievementDefs{} // No achievements unless there is an achievement file
+)
+
+func init() {
+	for kind := uint8(0); kind < EventLast; kind++ {
+		SubscribeEvent(kind, achievementEvent_WLu)
+	}
+}
+
+// Verify the definitions, give default values to undefined attributes, and build the indices.
+func (a *achievementDefs) verify() error {
+	a.byId = make(map[string]*achievementDef)
+	for _, def := range a.Achievements {
+		if def.Id == "" || strings.Contains(def.Id, " ") {
+			return fmt.Errorf("achievement id '%s' must be one word", def.Id)
+		}
+		if _, ok := a.byId[def.Id]; ok {
+			return fmt.Errorf("achievement '%s' defined twice", def.Id)
+		}
+		a.byId[def.Id] = def
+		kind, ok := FindEventKind(def.Event)
+		if !ok {
+			return fmt.Errorf("achievement '%s': unknown event '%s'", def.Id, def.Event)
+		}
+		if def.Count == 0 {
+			def.Count = 1
+		}
+		if def.Name == "" {
+			def.Name = def.Id
+		}
+		a.byKind[kind] = append(a.byKind[kind], def)
+	}
+	return nil
+}
+
+// Load the achievements from file. The current definitions are kept if there is an error.
+func LoadAchievements(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	a := new(achievementDefs)
+	if err = json.Unmarshal(data, a); err == nil {
+		err = a.verify()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	achievementSem.Lock()
+	achievements = a
+	achievementSem.Unlock()
+	log.Println("Loaded", len(a.Achievements), "achievements from", fileName)
+	return nil
+}
+
+func currentAchievements() *achievementDefs {
+	achievementSem.RLock()
+	defer achievementSem.RUnlock()
+	return achievements
+}
+
+// Update the progress of the achievements for an event. The player must be locked. Return the
+// achievements that were unlocked.
+func (l *achievementLog) update(defs []*achievementDef, ev playerEvent, now time.Time) (unlocked []*achievementDef) {
+	for _, def := range defs {
+		if ev.Level < def.MinLevel || !l.Unlocked[def.Id].IsZero() {
+			continue
+		}
+		n := ev.Amount
+		if !eventKinds[ev.Kind].total {
+			n += l.Progress[def.Id]
+		} else if n < l.Progress[def.Id] {
+			continue // A total can decrease, but the best is kept
+		}
+		if n < def.Count {
+			if l.Progress == nil {
+				l.Progress = make(map[string]uint32)
+			}
+			l.Progress[def.Id] = n
+			continue
+		}
+		delete(l.Progress, def.Id)
+		if l.Unlocked == nil {
+			l.Unlocked = make(map[string]time.Time)
+		}
+		l.Unlocked[def.Id] = now
+		unlocked = append(unlocked, def)
+	}
+	return
+}
+
+// The event handler for achievements. The unlocked achievements are announced later, from the client process.
+func achievementEvent_WLu(up *user, ev playerEvent) {
+	defs := currentAchievements().byKind[ev.Kind]
+	if len(defs) == 0 {
+		return
+	}
+	up.Lock()
+	unlocked := up.Achievements.update(defs, ev, time.Now())
+	up.newAchievements = append(up.newAchievements, unlocked...)
+	up.Unlock()
+}
+
+// Tell the player and the friends about unlocked achievements, if any. Must be called from the client process.
+func (up *user) ReportAchievements_WLuWLhRLaBl() {
+	up.Lock()
+	list := up.newAchievements
+	up.newAchievements = nil
+	up.Unlock()
+	if len(list) == 0 {
+		return
+	}
+	up.forceSave = true // Don't lose them
+	friends := findChannel_RLh(friendsChannelName(up.Id))
+	for _, def := range list {
+		up.Printf_Bl("!Achievement unlocked: %s. %s", def.Name, def.Description)
+		if friends != nil {
+			friends.Publish_WLhRLa("%s earned the achievement '%s'", up.Name, def.Name)
+		}
+	}
+}
+
+// Manage the "/achievements" command. Unlocked achievements are shown with the date, and the others with
+// the progress.
+func (up *user) AchievementsCommand_RLuBl() {
+	a := currentAchievements()
+	var lines []string
+	done := 0
+	up.RLock()
+	for _, def := range a.Achievements {
+		if t := up.Achievements.Unlocked[def.Id]; !t.IsZero() {
+			done++
+			lines = append(lines, fmt.Sprintf("!%s: %s (%s)", def.Name, def.Description, t.Format("2006-01-02")))
+		} else {
+			lines = append(lines, fmt.Sprintf("!%s: %s (%d/%d)", def.Name, def.Description, up.Achievements.Progress[def.Id], def.Count))
+		}
+	}
+	up.RUnlock()
+	for _, line := range lines {
+		up.Printf_Bl("%s", line)
+	}
+	up.Printf_Bl("!%d of %d achievements unlocked", done, len(a.Achievements))
+}
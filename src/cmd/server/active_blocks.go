@@ -23,6 +23,7 @@ package main
 
 import (
 	// "fmt"
+	"chunkdb"
 	"client_prot"
 	"keys"
 	"log"
@@ -55,6 +56,10 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 		if up.trapPrevBlock == BT_DeTrigger {
 			ignoreTrigger = true
 		}
+	case BT_Quest:
+		if up.trapPrevBlock == BT_Quest {
+			ignoreTrigger = true
+		}
 	default:
 		ignoreTrigger = true
 	}
@@ -74,14 +79,13 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 	y_off := uint8(int64(math.Floor(coord.Y)) - int64(cc.Y)*CHUNK_SIZE)
 	z_off := uint8(int64(math.Floor(coord.Z)) - int64(cc.Z)*CHUNK_SIZE)
 
+	// Logic circuits connected to the trigger are updated in the next logic tick
+	cp.Lock()
+	cp.pulseLogic(x_off, y_off, z_off)
+	cp.Unlock()
+
 	// Iterate hrough all triggers, find the activator blocks and activate them. A local list of activators is
 	// created, with the chunk read locked. Teh purpose of a copy in a local list is to be able to allow chunk to be unlocked.
-	type localActivatorList struct { // Information about one activator
-		msgList      []string // The list of strings for this activator
-		x, y, z      uint8    // The local coordinate in the chunk
-		index        int      // The index into the list of all activators
-		inhibitDelta int      // Number of seconds until next inhibitor
-	}
 	list := make([]localActivatorList, 0, 5) // Allocate a number of pointers, to avoid unneccesary reallocation to grow the vector.
 	now := time.Now()
 	cp.RLock()
@@ -106,12 +110,56 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 			var la localActivatorList
 			la.index = i
 			la.msgList = trig.msg.Message
+			la.vars = trig.msg.Vars.copy()
 			la.x, la.y, la.z = trig.x2, trig.y2, trig.z2
 			list = append(list, la)
 		}
 	}
 	cp.RUnlock()
 
+	if bl == BT_Quest {
+		up.QuestReach_WLuBl(owner)
+	}
+
+	up.runActivators_WLwWLuWLqWLmWLc(cp, owner, list, now)
+}
+
+// Activate a text activator on behalf of the player. This is used by logic circuits, where the
+// activator isn't connected to a trigger in the same chunk.
+func (up *user) ActivateTextActivator_WLwWLuWLqWLmWLc(cc chunkdb.CC, x, y, z uint8) {
+	if up.Dead {
+		return
+	}
+	cp := ChunkFindCached_WLwWLc(cc)
+	list := make([]localActivatorList, 0, 1)
+	now := time.Now()
+	cp.RLock()
+	owner := cp.owner
+	for i := range cp.triggerMsgs {
+		msg := &cp.triggerMsgs[i]
+		if msg.X == x && msg.Y == y && msg.Z == z && msg.inhibit.Before(now) {
+			list = append(list, localActivatorList{msgList: msg.Message, x: x, y: y, z: z, index: i, vars: msg.Vars.copy()})
+			break
+		}
+	}
+	cp.RUnlock()
+	up.runActivators_WLwWLuWLqWLmWLc(cp, owner, list, now)
+}
+
+// Information about one activator. A local list of these is used, to be able to allow the chunk to be unlocked.
+type localActivatorList struct {
+	msgList      []string   // The list of strings for this activator
+	x, y, z      uint8      // The local coordinate in the chunk
+	index        int        // The index into the list of all activators
+	inhibitDelta int        // Number of seconds until next inhibitor
+	vars         scriptVars // A copy of the activator script variables
+	varsChanged  bool
+}
+
+// Run the list of activators, and then update the inhibit time and the activator variables in the chunk.
+// Nothing is locked when this function is called.
+func (up *user) runActivators_WLwWLuWLqWLmWLc(cp *chunk, owner uint32, list []localActivatorList, now time.Time) {
+	ch_coord := cp.Coord
 	// Now that there is a list of activators, possibly empty, the chunk no longer need to be locked.
 	for i, _ := range list {
 		msg := &list[i]
@@ -123,6 +171,16 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 			log.Println("ActivateBlock", ch_coord, msg)
 		}
 		msg.inhibitDelta = CnfgDefaultTriggerBlockTime // Start with default, may be changed below
+		if isActivatorScript(msg.msgList) {
+			newDeltaTime, vars := up.RunActivatorScript_WLuWLqWLmWLc(msg.msgList, &activatorCoord, owner, msg.vars)
+			if newDeltaTime != -1 {
+				msg.inhibitDelta = newDeltaTime
+			}
+			if vars != nil {
+				msg.vars, msg.varsChanged = vars, true
+			}
+			continue
+		}
 		// Iterate through each message for this activator
 		for _, line := range msg.msgList {
 			// Default is that the list of recpeients is only the current user. But it may change if
@@ -142,6 +200,7 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 
 	// Update the new inhibit time, if there was an activator that was used
 	if len(list) > 0 {
+		save := false
 		cp.Lock()
 		for i, _ := range list {
 			selected := &list[i]
@@ -150,10 +209,18 @@ func (up *user) CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl block) {
 				if msg.X == selected.x && msg.Y == selected.y && msg.Z == selected.z {
 					// Found it.
 					msg.inhibit = now.Add(time.Duration(selected.inhibitDelta) * 1e9)
+					if selected.varsChanged {
+						msg.Vars = selected.vars
+						save = true
+					}
 					break
 				}
 			}
 		}
+		if save {
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
 		cp.Unlock()
 	}
 }
@@ -213,6 +280,8 @@ func (up *user) ActivatorMessage_WLuWLqWLmWLc(line string, ac *user_coord, recep
 			return
 		case strings.HasPrefix(split[0], "/monster"):
 			ActivatorMessageMonster_WLuWLqWLm(recepients, split[0][8:], ac)
+		case strings.HasPrefix(split[0], "/effect:"):
+			ActivatorMessageEffect_WLu(recepients, split[0][8:], ac)
 		case strings.HasPrefix(split[0], "/invadd:"):
 			newInhibit := ActivatorMessageInventoryAdd(recepients, split[0][8:], ac)
 			if newInhibit != -1 && inhibit == -1 {
@@ -244,6 +313,16 @@ func (up *user) ActivatorMessage_WLuWLqWLmWLc(line string, ac *user_coord, recep
 			}
 			ActivatorMessageAddKey_WLu(recepients, owner, split[0][8:], descr)
 			return
+		case strings.HasPrefix(split[0], "/quest:"):
+			// The rest of the line is consumed by this command
+			title := ""
+			if len(split) > 1 {
+				title = split[1]
+			}
+			up.ActivatorMessageQuest_WLuBl(recepients, owner, split[0][7:], title, ac)
+			return
+		case strings.HasPrefix(split[0], "/questtalk:"):
+			up.ActivatorMessageQuestTalk_WLuBl(recepients, owner, split[0][11:], ac)
 		case strings.HasPrefix(split[0], "/jelly:"):
 			// Only one charater is expected.
 			updatedRecep = playerQuadtree.FindNearObjects_RLq(&TwoF{ac.X, ac.Y}, client_prot.NEAR_OBJECTS)
@@ -381,20 +460,10 @@ func ActivatorMessageAddKey_WLu(recepients []quadtree.Object, owner uint32, modi
 // value and number of recipients.
 func ActivatorMessageInventoryAdd(recepients []quadtree.Object, modifier string, ac *user_coord) int {
 	code := ObjectCode(modifier)
-	var quality float64
-	if len(modifier) == 4 && modifier[3] <= '9' && modifier[3] >= '1' {
-		quality = float64(modifier[3]) - '0' // A value 0 to 4.
-	}
-	cost := math.Pow(2, quality-1) // Will give a value of 0,5, 1, 2, 4, or 8
+	cost := itemRewardCost(code)
 	f := func(up *user) {
 		cp := ChunkFindCached_WLwWLc(up.Coord.GetChunkCoord())
-		owner := cp.owner
-		costCovered := true
-		if owner != OWNER_NONE && owner != OWNER_RESERVED && owner != OWNER_TEST && up.Id != OWNER_TEST {
-			// This time, also include the case where owner of chunk is up.
-			costCovered = score.Pay(owner, cost)
-		}
-		if costCovered {
+		if ownerPays(cp.owner, up, cost) {
 			AddOneObjectToUser_WLuBl(up, code)
 			// up.Printf("Added object %#v to %v", obj, up.Name)
 		}
@@ -403,7 +472,45 @@ func ActivatorMessageInventoryAdd(recepients []quadtree.Object, modifier string,
 	return CnfgDefaultTriggerBlockTime + (1+int(cost))*numRecepients*50
 }
 
+// The score cost for a territory owner to give an item to a player. It depends on the quality, which is
+// the last digit of the item code.
+func itemRewardCost(code ObjectCode) float64 {
+	var quality float64
+	if len(code) == 4 && code[3] <= '9' && code[3] >= '1' {
+		quality = float64(code[3]) - '0' // A value 0 to 4.
+	}
+	return math.Pow(2, quality-1) // Will give a value of 0,5, 1, 2, 4, or 8
+}
+
+// Let the territory owner pay for a reward given to a player. Return true if the cost was covered.
+func ownerPays(owner uint32, up *user, cost float64) bool {
+	if owner != OWNER_NONE && owner != OWNER_RESERVED && owner != OWNER_TEST && up.Id != OWNER_TEST {
+		// This time, also include the case where owner of chunk is up.
+		return score.Pay(owner, cost)
+	}
+	return true
+}
+
+// Apply a status effect to all recepients. The modifier is "<name>,<amount>,<seconds>".
+func ActivatorMessageEffect_WLu(recepients []quadtree.Object, modifier string, ac *user_coord) {
+	kind, amount, duration, err := parseEffectModifier(modifier)
+	if err != nil {
+		if *verboseFlag > 1 {
+			log.Println("Effect error", err, "at", ac)
+		}
+		return
+	}
+	f := func(up *user) {
+		up.ApplyEffect_WLu(kind, amount, duration, 0)
+	}
+	ActivatorIterator(f, recepients)
+}
+
 func ActivatorMessageMonster_WLuWLqWLm(recepients []quadtree.Object, modifier string, ac *user_coord) {
+	if strings.HasPrefix(modifier, ":boss=") {
+		ActivatorMessageBoss_WLuWLqWLm(recepients, modifier[6:], ac)
+		return
+	}
 	deltaLevel := int32(0)
 	switch modifier {
 	case ":-1":
@@ -420,7 +527,7 @@ func ActivatorMessageMonster_WLuWLqWLm(recepients []quadtree.Object, modifier st
 		log.Println("Unknown monster spawn modifier", modifier)
 	}
 	f := func(up *user) {
-		mp := addMonsterToPlayerAtPos_WLuWLqWLm(up, ac, deltaLevel)
+		mp := addMonsterToPlayerAtPos_WLuWLqWLm(up, ac, deltaLevel, BT_Unused)
 		mp.aggro = up
 		mp.state = MD_ATTACKING
 	}
@@ -446,12 +553,12 @@ func (ch *chunk) ComputeLinks() {
 				bl := ch.rc[x][y][z]
 				if bl == BT_Text {
 					// Add an empty trigger message for this text block.
-					tm := textMsgActivator{uint8(x), uint8(y), uint8(z), nil, time.Unix(0, 0)}
+					tm := textMsgActivator{uint8(x), uint8(y), uint8(z), nil, time.Unix(0, 0), nil}
 					ch.triggerMsgs = append(ch.triggerMsgs, tm)
 					// fmt.Println("ComputeLinks text at", tm)
 					continue
 				}
-				if bl != BT_Trigger && bl != BT_DeTrigger {
+				if bl != BT_Trigger && bl != BT_DeTrigger && bl != BT_Quest {
 					continue
 				}
 				// fmt.Println("ComputeLinks trigger at", x, y, z)
@@ -469,6 +576,7 @@ func (ch *chunk) ComputeLinks() {
 	}
 	CopyActivatorListMessages(prevTextMsgActivator, ch.triggerMsgs)
 	ch.UpdateActivatorLinkMessages()
+	ch.computeLogic()
 }
 
 // The new activator list need to copy the mesages from the old activator list. After this
@@ -481,6 +589,7 @@ func CopyActivatorListMessages(sourceList, destList []textMsgActivator) {
 		for _, src := range sourceList {
 			if dest.X == src.X && dest.Y == src.Y && dest.Z == src.Z {
 				destList[i].Message = src.Message
+				destList[i].Vars = src.Vars
 				break
 			}
 		}
@@ -512,9 +621,9 @@ func (ch *chunk) FollowLink_WLwWLc(x, y, z int, tested map[uint32]bool) {
 	case y == CHUNK_SIZE:
 		fallthrough
 	case z == CHUNK_SIZE:
-		// Do not follow into next chunk. On the one hand, it would be nice to allow links
-		// that span more than one chunk. But on the other hand, we can't lock more than
-		// one chunk at a time, or risk dead lock.
+		// Do not follow into next chunk, as we can't lock more than one chunk at a time, or
+		// risk dead lock. Links that span more than one chunk are instead managed by the logic
+		// circuits, where computeLogic finds the ports into the neighbor chunk.
 		return
 	}
 	if tested[abKey(x, y, z)] {
@@ -0,0 +1,272 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Text activators with scripts. If the first line of a text activator is "/script", the rest of the lines
+// is a script, see the script package. Other text activators use the modifiers in active_blocks.go.
+//
+// Activator variables ("a.") are saved with the chunk. Player variables ("p.") are saved with the player,
+// separated by the owner of the activator, so scripts in different territories can't interfere. The number
+// of actions in one run is limited, as every action can send messages or spawn monsters.
+//
+// The actions are the same as the modifiers:
+//   say <text>                 Send a message to the recepients
+//   broadcast <distance>       All players near the activator become recepients
+//   monster <level diff>       Spawn a monster, -2 to 2 levels from normal, or "boss=<id>"
+//   invadd <code>              Give an item
+//   jelly <direction>          Turn the neighbor block into jelly, one of "n", "s", "w", "e", "u" or "d"
+//   addkey <id>, <view>, <name>
+//   effect <name>, <amount>, <seconds>
+//   inhibit <seconds>
+// The functions are level(), admin(), players(), random(n), haskey(id[, owner]) and quest(id).
+//
+
+import (
+	"client_prot"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"quadtree"
+	"script"
+	"strconv"
+	"strings"
+	. "twof"
+)
+
+// Variables of activators and players
+type scriptVars map[string]int64
+
+func (v scriptVars) copy() scriptVars {
+	if v == nil {
+		return nil
+	}
+	c := make(scriptVars, len(v))
+	for name, value := range v {
+		c[name] = value
+	}
+	return c
+}
+
+// Return true if the activator text is a script
+func isActivatorScript(msgList []string) bool {
+	return len(msgList) > 0 && msgList[0] == "/script"
+}
+
+// The script host for one run of an activator script
+type activatorScript struct {
+	up         *user
+	ac         *user_coord
+	owner      uint32
+	recepients []quadtree.Object
+	vars       scriptVars // The activator variables
+	changed    bool       // True if the activator variables were changed
+	inhibit    int        // -1 if not changed
+	actions    int        // The number of actions so far
+}
+
+// Player variables are separated by the owner
+func (as *activatorScript) playerVar(name string) string {
+	return fmt.Sprintf("%d:%s", as.owner, name)
+}
+
+// The number of player variables of the owner. The player must be locked.
+func (as *activatorScript) numPlayerVars() int {
+	prefix := as.playerVar("")
+	n := 0
+	for key := range as.up.Vars {
+		if strings.HasPrefix(key, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (as *activatorScript) Get(scope script.Scope, name string) int64 {
+	if scope == script.Activator {
+		return as.vars[name]
+	}
+	up := as.up
+	up.RLock()
+	defer up.RUnlock()
+	return up.Vars[as.playerVar(name)]
+}
+
+func (as *activatorScript) Set(scope script.Scope, name string, value int64) error {
+	if scope == script.Activator {
+		if _, ok := as.vars[name]; !ok && len(as.vars) >= CnfgScriptMaxVars {
+			return errors.New("too many activator variables")
+		}
+		if as.vars == nil {
+			as.vars = make(scriptVars)
+		}
+		as.vars[name] = value
+		as.changed = true
+		return nil
+	}
+	up := as.up
+	key := as.playerVar(name)
+	up.Lock()
+	defer up.Unlock()
+	if _, ok := up.Vars[key]; !ok && as.numPlayerVars() >= CnfgScriptMaxVars {
+		return errors.New("too many player variables")
+	}
+	if up.Vars == nil {
+		up.Vars = make(scriptVars)
+	}
+	up.Vars[key] = value
+	return nil
+}
+
+func (as *activatorScript) Call(name string, args []int64) (int64, error) {
+	up := as.up
+	switch {
+	case name == "level" && len(args) == 0:
+		return int64(up.Level), nil
+	case name == "admin" && len(args) == 0:
+		return int64(up.AdminLevel), nil
+	case name == "players" && len(args) == 0:
+		found := ActivatorIterator(func(*user) {}, as.recepients)
+		return int64(found), nil
+	case name == "random" && len(args) == 1:
+		if args[0] <= 0 {
+			return 0, errors.New("random: argument must be positive")
+		}
+		return rand.Int63n(args[0]), nil
+	case name == "haskey" && (len(args) == 1 || len(args) == 2):
+		owner := as.owner
+		if len(args) == 2 {
+			owner = uint32(args[1])
+		}
+		up.RLock()
+		res := up.Keys.Test(owner, uint(args[0]))
+		up.RUnlock()
+		if res {
+			return 1, nil
+		}
+		return 0, nil
+	case name == "quest" && len(args) == 1:
+		// 0 if not started, 1 if in progress and 2 if completed
+		up.RLock()
+		defer up.RUnlock()
+		switch q := up.Quests.find(as.owner, uint(args[0])); {
+		case q == nil:
+			return 0, nil
+		case q.Done:
+			return 2, nil
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unknown function %s with %d arguments", name, len(args))
+}
+
+func (as *activatorScript) Action(name string, args []string) error {
+	if as.actions++; as.actions > CnfgScriptMaxActions {
+		return errors.New("too many actions")
+	}
+	ac := as.ac
+	switch {
+	case name == "say":
+		for _, s := range args {
+			ActivatorMessageString(as.recepients, s)
+		}
+	case name == "broadcast" && len(args) == 1:
+		broadcastDistance, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		if broadcastDistance > 20 {
+			broadcastDistance = 20
+		}
+		as.recepients = playerQuadtree.FindNearObjects_RLq(&TwoF{ac.X, ac.Y}, broadcastDistance)
+	case name == "monster" && len(args) == 1:
+		modifier := ":" + args[0]
+		switch args[0] {
+		case "1", "2":
+			modifier = ":+" + args[0]
+		case "-1", "-2", "0":
+		default:
+			if len(args[0]) <= 5 || args[0][:5] != "boss=" {
+				return fmt.Errorf("monster: bad argument '%s'", args[0])
+			}
+		}
+		ActivatorMessageMonster_WLuWLqWLm(as.recepients, modifier, ac)
+	case name == "invadd" && len(args) == 1:
+		if ItemLookup(ObjectCode(args[0])) == nil {
+			return fmt.Errorf("invadd: unknown item '%s'", args[0])
+		}
+		newInhibit := ActivatorMessageInventoryAdd(as.recepients, args[0], ac)
+		if as.inhibit < newInhibit {
+			as.inhibit = newInhibit
+		}
+	case name == "jelly" && len(args) == 1:
+		switch args[0] {
+		case "n", "s", "w", "e", "u", "d":
+		default:
+			return fmt.Errorf("jelly: bad direction '%s'", args[0])
+		}
+		as.recepients = playerQuadtree.FindNearObjects_RLq(&TwoF{ac.X, ac.Y}, client_prot.NEAR_OBJECTS)
+		ActivatorMessageJellyblock_WLwWLc(as.recepients, args[0], *ac)
+		if as.inhibit < CnfgJellyTimeout {
+			// Do not allow open door again until it has closed
+			as.inhibit = CnfgJellyTimeout
+		}
+	case name == "addkey" && len(args) == 3:
+		ActivatorMessageAddKey_WLu(as.recepients, as.owner, args[0]+","+args[1], args[2])
+	case name == "effect" && len(args) == 3:
+		if _, _, _, err := parseEffectModifier(args[0] + "," + args[1] + "," + args[2]); err != nil {
+			return err
+		}
+		ActivatorMessageEffect_WLu(as.recepients, args[0]+","+args[1]+","+args[2], ac)
+	case name == "inhibit" && len(args) == 1:
+		i, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		as.inhibit = i
+	default:
+		return fmt.Errorf("unknown action %s with %d arguments", name, len(args))
+	}
+	return nil
+}
+
+// Run the script of an activator. 'vars' are the activator variables, which may be updated.
+// Return the new inhibit time, or -1, and the activator variables if they were changed.
+func (up *user) RunActivatorScript_WLuWLqWLmWLc(msgList []string, ac *user_coord, owner uint32, vars scriptVars) (inhibit int, changed scriptVars) {
+	as := &activatorScript{up: up, ac: ac, owner: owner, recepients: []quadtree.Object{up}, vars: vars, inhibit: -1}
+	// Replace the "/script" line, so that line numbers in errors are the same as in the activator
+	lines := append([]string{""}, msgList[1:]...)
+	prog, err := script.Compile(lines)
+	if err == nil {
+		_, err = prog.Run(as, CnfgScriptBudget)
+	}
+	if err != nil {
+		if up.Id == owner {
+			// Help the owner when testing the script
+			up.Printf_Bl("#FAIL !Script error: %v", err)
+		}
+		if *verboseFlag > 1 {
+			log.Println("Script error", err, "at", ac)
+		}
+	}
+	if as.changed {
+		changed = as.vars
+	}
+	return as.inhibit, changed
+}
@@ -0,0 +1,382 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// The auction house. A player lists items from the inventory with a price and a duration, and other
+// players can buy them also when the seller is offline. The listings are saved in the "auctions"
+// collection. The gold from a sale, less a cut, and the items of expired listings are returned to
+// the seller by mail, see chat.go.
+//
+// A listing is removed with an atomic find-and-remove in the database, which decides who gets the items.
+// The buyer pays before the listing is removed, and is refunded if someone else was first.
+//
+// The client searches with CMD_AUCTION_SEARCH, and gets the result in CMD_AUCTION_LIST. Items are listed
+// with CMD_AUCTION_SELL and bought with CMD_AUCTION_BUY. The same can be done with the "/auction" command.
+//
+
+import (
+	"client_prot"
+	"ephenationdb"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strconv"
+	"time"
+	"timerstats"
+)
+
+// Items for sale, saved in the "auctions" collection
+type auctionListing struct {
+	Id         bson.ObjectId `bson:"_id"`
+	Seller     uint32
+	SellerName string
+	Item       ObjectCode
+	Level      uint32
+	Count      uint32
+	Price      uint32 // The total price, in gold
+	Expires    time.Time
+	Inst       []*itemInstance `bson:",omitempty"` // The instances of the items, if any
+}
+
+// The size of one listing in CMD_AUCTION_LIST
+const auctionListingSize = 32
+
+const auctionHouseName = "Auction house"
+
+// The query for active listings. An empty code matches all items, and a 0 level means there is no limit.
+func auctionQuery(code ObjectCode, minLevel, maxLevel uint32) bson.M {
+	q := bson.M{"expires": bson.M{"$gt": time.Now()}}
+	if code != "" {
+		q["item"] = code
+	}
+	lvl := bson.M{}
+	if minLevel > 0 {
+		lvl["$gte"] = minLevel
+	}
+	if maxLevel > 0 {
+		lvl["$lte"] = maxLevel
+	}
+	if len(lvl) > 0 {
+		q["level"] = lvl
+	}
+	return q
+}
+
+// Build the CMD_AUCTION_LIST message. Every listing is the id, the item code, level, count, price and
+// the number of seconds until it expires.
+func auctionListMessage(list []auctionListing, now time.Time) []byte {
+	if len(list) > CnfgAuctionSearchMax {
+		list = list[:CnfgAuctionSearchMax]
+	}
+	msgLen := 4 + auctionListingSize*len(list)
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_AUCTION_LIST
+	b[3] = byte(len(list))
+	p := b[4:]
+	for _, a := range list {
+		left := a.Expires.Sub(now) / time.Second
+		if left < 0 {
+			left = 0
+		}
+		copy(p[0:12], a.Id)
+		copy(p[12:16], a.Item)
+		EncodeUint32(a.Level, p[16:20])
+		EncodeUint32(a.Count, p[20:24])
+		EncodeUint32(a.Price, p[24:28])
+		EncodeUint32(uint32(left), p[28:32])
+		p = p[auctionListingSize:]
+	}
+	return b
+}
+
+// Find active listings, the cheapest first
+func (up *user) findAuctions_Bl(code ObjectCode, minLevel, maxLevel uint32) ([]auctionListing, bool) {
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return nil, false
+	}
+	var list []auctionListing
+	if err := db.C("auctions").Find(auctionQuery(code, minLevel, maxLevel)).Sort("price").Limit(CnfgAuctionSearchMax).All(&list); err != nil {
+		log.Println("findAuctions", err)
+		up.Printf_Bl("#FAIL !The auction house is closed")
+		return nil, false
+	}
+	return list, true
+}
+
+// List items from the inventory in the auction house
+func (up *user) SellAuction_WLuBl(code ObjectCode, lvl, count, price, hours uint32) {
+	switch {
+	case ItemLookup(code) == nil:
+		up.Printf_Bl("#FAIL !Unknown item %s", code)
+		return
+	case count == 0 || price == 0:
+		up.Printf_Bl("#FAIL !Both the count and the price must be given")
+		return
+	case hours == 0 || hours > CnfgAuctionMaxHours:
+		up.Printf_Bl("#FAIL !The duration must be 1 to %d hours", CnfgAuctionMaxHours)
+		return
+	}
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return
+	}
+	if n, _ := db.C("auctions").Find(bson.M{"seller": up.Id}).Count(); n >= CnfgAuctionMaxListings {
+		up.Printf_Bl("#FAIL !You can only have %d listings", CnfgAuctionMaxListings)
+		return
+	}
+	up.Lock()
+	ok := up.Inventory.Count(code, lvl) >= count
+	var inst []*itemInstance
+	if ok {
+		inst = up.Inventory.takeInstances(code, lvl, count)
+	}
+	up.Unlock()
+	if !ok {
+		up.Printf_Bl("#FAIL !You don't have %d of %s", count, code)
+		return
+	}
+	a := auctionListing{Id: bson.NewObjectId(), Seller: up.Id, SellerName: up.Name, Item: code, Level: lvl, Count: count, Price: price,
+		Expires: time.Now().Add(time.Duration(hours) * time.Hour), Inst: inst}
+	if err := db.C("auctions").Insert(&a); err != nil {
+		log.Println("SellAuction", up.Name, err)
+		up.Lock()
+		up.Inventory.addInstances(code, lvl, count, inst)
+		up.Unlock()
+		up.Printf_Bl("#FAIL !The auction house is closed")
+		return
+	}
+	up.forceSave = true // The items are already in the auction house
+	ReportOneInventoryItem_WluBl(up, code, lvl)
+	up.Printf_Bl("!%dx%s listed for %d gold", count, code, price)
+}
+
+// Buy a listing from the auction house
+func (up *user) BuyAuction_WLuBl(id bson.ObjectId) {
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return
+	}
+	var a auctionListing
+	if err := db.C("auctions").FindId(id).One(&a); err != nil || !a.Expires.After(time.Now()) {
+		up.Printf_Bl("#FAIL !The items are no longer for sale")
+		return
+	}
+	if a.Seller == up.Id {
+		up.Printf_Bl("#FAIL !You can't buy your own items, cancel the listing instead")
+		return
+	}
+	// Pay first, so the gold can't be spent on something else in the meantime
+	var failure string
+	up.Lock()
+	switch {
+	case !up.Inventory.Room(a.Item, a.Level, a.Count):
+		failure = fmt.Sprintf("You can't carry more of %v", a.Item)
+	case !up.changeGold(-int64(a.Price)):
+		failure = fmt.Sprintf("You need %d gold", a.Price)
+	}
+	up.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	sel := bson.M{"_id": a.Id, "expires": bson.M{"$gt": time.Now()}}
+	if _, err := db.C("auctions").Find(sel).Apply(mgo.Change{Remove: true}, &a); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Println("BuyAuction", up.Name, err)
+		}
+		up.Lock()
+		up.changeGold(int64(a.Price)) // Refund
+		up.Unlock()
+		up.Printf_Bl("#FAIL !The items are no longer for sale")
+		return
+	}
+	up.Lock()
+	// There is a small chance that the room was used in the meantime
+	room := up.Inventory.Room(a.Item, a.Level, a.Count)
+	if room {
+		up.Inventory.addInstances(a.Item, a.Level, a.Count, a.Inst)
+	}
+	balance := up.Gold
+	up.Unlock()
+	up.forceSave = true // The listing is already removed
+	up.reportGold(-int64(a.Price), balance, fmt.Sprintf("auction buy %dx%s from %d", a.Count, a.Item, a.Seller))
+	if room {
+		ReportOneInventoryItem_WluBl(up, a.Item, a.Level)
+	} else {
+		auctionMail(&mail{To: up.Id, Text: fmt.Sprintf("Your %dx%s", a.Count, a.Item), Item: a.Item, Level: a.Level, Count: a.Count, Inst: a.Inst})
+	}
+	auctionMail(&mail{To: a.Seller, Text: fmt.Sprintf("Your %dx%s was sold to %s for %d gold", a.Count, a.Item, up.Name, a.Price),
+		Gold: a.Price - uint32(float64(a.Price)*CnfgAuctionCut)})
+	up.Printf_Bl("!You bought %dx%s for %d gold", a.Count, a.Item, a.Price)
+}
+
+// Cancel a listing of the player. The items are returned by mail.
+func (up *user) CancelAuction_Bl(id bson.ObjectId) {
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return
+	}
+	var a auctionListing
+	if _, err := db.C("auctions").Find(bson.M{"_id": id, "seller": up.Id}).Apply(mgo.Change{Remove: true}, &a); err != nil {
+		up.Printf_Bl("#FAIL !You have no such listing")
+		return
+	}
+	auctionMail(&mail{To: up.Id, Text: fmt.Sprintf("Your %dx%s was withdrawn", a.Count, a.Item), Item: a.Item, Level: a.Level, Count: a.Count, Inst: a.Inst})
+}
+
+// Send mail from the auction house. If it fails, the attachments are lost, so at least log it.
+func auctionMail(m *mail) {
+	m.From = auctionHouseName
+	if err := postMail(m); err != nil {
+		log.Printf("Auction mail %+v: %v\n", m, err)
+	}
+}
+
+// Return the items of expired listings to the sellers. This process never returns.
+func ProcAuctionExpiry() {
+	var elapsed time.Duration
+	timerstats.Add("ProcAuctionExpiry", CnfgAuctionExpiryPeriod, &elapsed)
+	for {
+		time.Sleep(CnfgAuctionExpiryPeriod)
+		start := time.Now()
+		db := ephenationdb.New()
+		if db == nil {
+			continue
+		}
+		var list []auctionListing
+		if err := db.C("auctions").Find(bson.M{"expires": bson.M{"$lte": start}}).All(&list); err != nil {
+			log.Println("ProcAuctionExpiry", err)
+			continue
+		}
+		for _, a := range list {
+			// A buyer may have been first
+			if _, err := db.C("auctions").FindId(a.Id).Apply(mgo.Change{Remove: true}, &a); err != nil {
+				continue
+			}
+			auctionMail(&mail{To: a.Seller, Text: fmt.Sprintf("Your %dx%s was not sold", a.Count, a.Item), Item: a.Item, Level: a.Level, Count: a.Count, Inst: a.Inst})
+		}
+		elapsed = time.Now().Sub(start)
+	}
+}
+
+// Decode CMD_AUCTION_SEARCH. The item code is all zeroes to match any item.
+func (up *user) CmdAuctionSearch_Bl(b []byte) {
+	if len(b) != 12 {
+		return
+	}
+	code := ObjectCode(b[0:4])
+	if code == "\x00\x00\x00\x00" {
+		code = ""
+	}
+	minLevel, _, _ := ParseUint32(b[4:8])
+	maxLevel, _, _ := ParseUint32(b[8:12])
+	if list, ok := up.findAuctions_Bl(code, minLevel, maxLevel); ok {
+		up.writeBlocking_Bl(auctionListMessage(list, time.Now()))
+	}
+}
+
+// Decode CMD_AUCTION_SELL
+func (up *user) CmdAuctionSell_WLuBl(b []byte) {
+	if len(b) != 17 {
+		return
+	}
+	lvl, _, _ := ParseUint32(b[4:8])
+	count, _, _ := ParseUint32(b[8:12])
+	price, _, _ := ParseUint32(b[12:16])
+	up.SellAuction_WLuBl(ObjectCode(b[0:4]), lvl, count, price, uint32(b[16]))
+}
+
+// Decode CMD_AUCTION_BUY
+func (up *user) CmdAuctionBuy_WLuBl(b []byte) {
+	if len(b) != 12 {
+		return
+	}
+	up.BuyAuction_WLuBl(bson.ObjectId(b))
+}
+
+// Parse the arguments of "/auction", where all but the first are numbers
+func parseAuctionArgs(args []string) ([]uint32, error) {
+	var res []uint32
+	for _, s := range args {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, uint32(v))
+	}
+	return res, nil
+}
+
+// Manage the "/auction" command
+func (up *user) AuctionCommand_WLuBl(args []string) {
+	switch {
+	case args[0] == "search" && len(args) <= 4:
+		var code ObjectCode
+		if len(args) > 1 && args[1] != "*" {
+			code = ObjectCode(args[1])
+		}
+		var lvl []uint32
+		var err error
+		if len(args) > 2 {
+			lvl, err = parseAuctionArgs(args[2:])
+		}
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		lvl = append(lvl, 0, 0)
+		list, ok := up.findAuctions_Bl(code, lvl[0], lvl[1])
+		if !ok {
+			return
+		}
+		if len(list) == 0 {
+			up.Printf_Bl("!Nothing found")
+		}
+		for _, a := range list {
+			up.Printf_Bl("!%s: %dx%s level %d for %d gold, by %s", a.Id.Hex(), a.Count, a.Item, a.Level, a.Price, a.SellerName)
+		}
+	case args[0] == "sell" && len(args) == 6:
+		v, err := parseAuctionArgs(args[2:])
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		up.SellAuction_WLuBl(ObjectCode(args[1]), v[0], v[1], v[2], v[3])
+	case (args[0] == "buy" || args[0] == "cancel") && len(args) == 2:
+		if !bson.IsObjectIdHex(args[1]) {
+			up.Printf_Bl("#FAIL !Bad listing id %s", args[1])
+			return
+		}
+		if args[0] == "buy" {
+			up.BuyAuction_WLuBl(bson.ObjectIdHex(args[1]))
+		} else {
+			up.CancelAuction_Bl(bson.ObjectIdHex(args[1]))
+		}
+	default:
+		up.Printf_Bl("#FAIL !Usage: /auction search [code|*] [min level] [max level]|sell [code] [level] [count] [price] [hours]|buy [id]|cancel [id]")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Boss monsters. The bosses are defined in a JSON file, loaded at startup and reloaded with the admin
+// command "/reload bosses". A boss is spawned from an activator, using "/monster:boss=<id>".
+//
+// A boss fight has phases, that start when the boss hit points drop below a limit. A phase can change the
+// damage, do area attacks and summon adds. If the fight lasts too long, the boss enrages. If the boss loses
+// its target, the fight is reset. The loot table is found using the boss id as the monster kind.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"math"
+	"quadtree"
+	"sort"
+	"time"
+	. "twof"
+)
+
+type bossPhase struct {
+	HitPoints   float32 // The phase starts when the hit points drop to this fraction
+	Announce    string  // Told to near players when the phase starts
+	Damage      float32 // Melee damage multiplier. Default 1.
+	AreaDamage  float32 // Damage to all players within AreaRadius. 0 means no area attack.
+	AreaRadius  float64 // Measured in blocks
+	AreaPeriod  float64 // Seconds between area attacks
+	Summon      string  // The species of the adds summoned when the phase starts
+	SummonCount int     // Number of adds
+}
+
+type bossDef struct {
+	Id           string      // Used in the activator text
+	Name         string      // Used in announcements
+	Species      string      // The species, deciding model and behavior. Empty means the default species.
+	LevelOffset  int32       // The level is the monster difficulty at the spawn point plus this offset
+	Toughness    float32     // Damage received is divided by this, in addition to the species toughness. Default 1.
+	Enrage       float64     // Seconds from the start of the fight until the boss enrages. 0 means never.
+	EnrageDamage float32     // Damage multiplier when enraged. Default 2.
+	Phases       []bossPhase // Sorted on falling hit points
+}
+
+// The boss state of a monster
+type bossState struct {
+	def      *bossDef
+	phase    int       // The current phase
+	started  time.Time // When the fight started. Zero when there is no fight.
+	enraged  bool
+	nextArea time.Time // The time for the next area attack
+}
+
+var (
+	bossSem sync.RWMutex
+	bosses  map[string]*bossDef // There are no bosses unless there is a boss file
+)
+
+type bossPhaseList []bossPhase
+
+func (l bossPhaseList) Len() int           { return len(l) }
+func (l bossPhaseList) Less(i, j int) bool { return l[i].HitPoints > l[j].HitPoints }
+func (l bossPhaseList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Verify the boss definitions, and give default values to undefined attributes.
+func verifyBosses(list []*bossDef) error {
+	ids := make(map[string]bool)
+	for _, def := range list {
+		if def.Id == "" {
+			return errors.New("boss without id")
+		}
+		if ids[def.Id] {
+			return fmt.Errorf("boss '%s' defined twice", def.Id)
+		}
+		ids[def.Id] = true
+		if def.Name == "" {
+			def.Name = def.Id
+		}
+		if def.Toughness < 0 || def.Enrage < 0 || def.EnrageDamage < 0 {
+			return fmt.Errorf("boss '%s': negative attributes not allowed", def.Id)
+		}
+		if def.Toughness == 0 {
+			def.Toughness = 1
+		}
+		if def.EnrageDamage == 0 {
+			def.EnrageDamage = 2
+		}
+		sort.Sort(bossPhaseList(def.Phases))
+		if len(def.Phases) == 0 || def.Phases[0].HitPoints < 1 {
+			// There must always be a phase that starts the fight
+			def.Phases = append([]bossPhase{{HitPoints: 1}}, def.Phases...)
+		}
+		for i := range def.Phases {
+			ph := &def.Phases[i]
+			if ph.Damage < 0 || ph.AreaDamage < 0 || ph.SummonCount < 0 {
+				return fmt.Errorf("boss '%s': negative attributes not allowed", def.Id)
+			}
+			if ph.Damage == 0 {
+				ph.Damage = 1
+			}
+			if ph.AreaDamage > 0 && (ph.AreaRadius <= 0 || ph.AreaPeriod <= 0) {
+				return fmt.Errorf("boss '%s': area attack needs a radius and a period", def.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// Load the bosses from file. The current bosses are kept if there is an error.
+func LoadBosses(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var list []*bossDef
+	if err = json.Unmarshal(data, &list); err == nil {
+		err = verifyBosses(list)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	m := make(map[string]*bossDef)
+	for _, def := range list {
+		m[def.Id] = def
+	}
+	bossSem.Lock()
+	bosses = m
+	bossSem.Unlock()
+	log.Println("Loaded", len(list), "bosses from", fileName)
+	return nil
+}
+
+// Find a boss definition. Return nil if there is no such boss.
+func FindBoss(id string) *bossDef {
+	bossSem.RLock()
+	defer bossSem.RUnlock()
+	return bosses[id]
+}
+
+// The melee damage multiplier of a monster
+func (mp *monster) damage() float32 {
+	dmg := mp.species.Damage
+	if b := mp.boss; b != nil {
+		mp.Lock()
+		defer mp.Unlock()
+		dmg *= b.def.Phases[b.phase].Damage
+		if b.enraged {
+			dmg *= b.def.EnrageDamage
+		}
+	}
+	return dmg
+}
+
+// Damage received by a monster is divided by this
+func (mp *monster) toughness() float32 {
+	t := mp.species.Toughness
+	if mp.boss != nil {
+		t *= mp.boss.def.Toughness
+	}
+	return t
+}
+
+// Update the fight state, depending on the hit points and the time. Return true if a new phase was
+// started, and true if the boss just enraged.
+func (b *bossState) advance(hitPoints float32, now time.Time) (newPhase, enraged bool) {
+	if b.started.IsZero() {
+		b.started = now
+		newPhase = true
+	}
+	for b.phase+1 < len(b.def.Phases) && hitPoints <= b.def.Phases[b.phase+1].HitPoints {
+		b.phase++
+		newPhase = true
+	}
+	if newPhase {
+		b.nextArea = now.Add(time.Duration(b.def.Phases[b.phase].AreaPeriod * 1e9))
+	}
+	if b.def.Enrage > 0 && !b.enraged && now.Sub(b.started) >= time.Duration(b.def.Enrage*1e9) {
+		b.enraged = true
+		enraged = true
+	}
+	return
+}
+
+// The fight is over without the boss being killed. Start over from the beginning.
+func (b *bossState) reset() {
+	b.phase = 0
+	b.started = time.Time{}
+	b.enraged = false
+}
+
+// Tell all near players something about the boss
+func (mp *monster) announce_RLq(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	for _, o := range playerQuadtree.FindNearObjects_RLq(mp.GetPreviousPos(), CnfgBossAnnounceDistance) {
+		if other, ok := o.(*user); ok {
+			other.Printf("!%s", msg)
+		}
+	}
+}
+
+// Manage the boss fights. The monster data is only locked to find the bosses, as adds may have to be created.
+func UpdateAllBosses_RLmWLqWLm() {
+	var list []*monster
+	monsterData.RLock()
+	for _, mp := range monsterData.m {
+		if mp.boss != nil && !mp.dead {
+			list = append(list, mp)
+		}
+	}
+	monsterData.RUnlock()
+	now := time.Now()
+	for _, mp := range list {
+		mp.bossUpdate_WLqWLm(now)
+	}
+}
+
+// The monster is locked while the hit points and the boss state are used, but not while players are hit
+// or adds are created.
+func (mp *monster) bossUpdate_WLqWLm(now time.Time) {
+	b := mp.boss
+	up := mp.aggro
+	mp.Lock()
+	if up == nil || up.Dead {
+		if !b.started.IsZero() && !mp.dead {
+			b.reset()
+			mp.HitPoints = 1
+			mp.updatedStats = true
+		}
+		mp.Unlock()
+		return
+	}
+	newPhase, enraged := b.advance(mp.HitPoints, now)
+	ph := &b.def.Phases[b.phase]
+	var areaDmg float32
+	if ph.AreaDamage > 0 && !now.Before(b.nextArea) {
+		b.nextArea = now.Add(time.Duration(ph.AreaPeriod * 1e9))
+		areaDmg = ph.AreaDamage
+		if b.enraged {
+			areaDmg *= b.def.EnrageDamage
+		}
+	}
+	mp.Unlock()
+	if newPhase {
+		if ph.Announce != "" {
+			mp.announce_RLq("%s: %s", b.def.Name, ph.Announce)
+		}
+		if ph.SummonCount > 0 {
+			sp := FindMonsterSpecies(ph.Summon)
+			if sp == nil {
+				log.Println("Boss", b.def.Id, "unknown species", ph.Summon)
+				sp = defaultMonsterSpecies[0]
+			}
+			for i := 0; i < ph.SummonCount; i++ {
+				add := addMonsterOfSpecies_WLuWLqWLm(&mp.Coord, mp.Level, sp)
+				add.startAttack(up)
+			}
+		}
+	}
+	if enraged {
+		mp.announce_RLq("%s becomes enraged!", b.def.Name)
+	}
+	if areaDmg > 0 {
+		for _, o := range playerQuadtree.FindNearObjects_RLq(mp.GetPreviousPos(), ph.AreaRadius) {
+			other, ok := o.(*user)
+			if !ok || other.Dead || math.Abs(other.Coord.Z-mp.Coord.Z) > ph.AreaRadius {
+				continue
+			}
+			other.Hit(mp.id, mp.Level, areaDmg, mp.Level)
+		}
+	}
+}
+
+// Spawn a boss at 'coord', attacking the first of the recipients. Only one boss of every kind can be
+// near at the same time.
+func ActivatorMessageBoss_WLuWLqWLm(recepients []quadtree.Object, id string, coord *user_coord) {
+	def := FindBoss(id)
+	if def == nil {
+		log.Println("Unknown boss", id, "at", coord)
+		return
+	}
+	var target *user
+	for _, o := range recepients {
+		if up, ok := o.(*user); ok && !up.Dead {
+			target = up
+			break
+		}
+	}
+	if target == nil {
+		return
+	}
+	for _, o := range monsterQuadtree.FindNearObjects_RLq(&TwoF{coord.X, coord.Y}, CnfgBossAnnounceDistance) {
+		if mp, ok := o.(*monster); ok && !mp.dead && mp.boss != nil && mp.boss.def.Id == id {
+			return // Already spawned
+		}
+	}
+	lvl := int32(MonsterDifficulty(coord)) + def.LevelOffset
+	if lvl < 0 {
+		lvl = 0
+	}
+	sp := FindMonsterSpecies(def.Species)
+	if sp == nil {
+		log.Println("Boss", id, "unknown species", def.Species)
+		sp = defaultMonsterSpecies[0]
+	}
+	mp := addMonsterOfSpecies_WLuWLqWLm(coord, uint32(lvl), sp)
+	mp.kind = def.Id // Used for the loot table
+	mp.boss = &bossState{def: def}
+	mp.startAttack(target)
+	mp.announce_RLq("%s has appeared!", def.Name)
+}
@@ -0,0 +1,449 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Chat channels and offline mail.
+//
+// A chat channel is a named group of players. Channels are not saved, they exist as long as someone is
+// a member. Every player also has a friends channel, where the members are the listeners of the player.
+// It is used for login and logout notifications. The friends channels can't be joined with a command.
+//
+// All chat channel data is protected by 'chatSem'. The lock is never held while locking a user.
+//
+
+import (
+	"ephenationdb"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type chatChannel struct {
+	name       string          // The name as it was first given
+	members    map[uint32]bool // Player id of all members.
+	moderators map[uint32]bool // Player id of moderators. The creator is always a moderator.
+	history    []string        // The last messages, replayed to new members
+}
+
+var (
+	chatSem      sync.RWMutex                    // Protects all chat channel data
+	chatChannels = make(map[string]*chatChannel) // From lower case name to channel
+)
+
+// Offline mail, saved in the "mail" collection. Mail sent by the game can have items or gold attached,
+// which are given to the receiver when the mail is delivered.
+type mail struct {
+	Id    bson.ObjectId `bson:"_id"`
+	To    uint32        // Player id of the receiver
+	From  string        // Name of the sender
+	Sent  time.Time
+	Text  string
+	Item  ObjectCode      // Attached item, if any
+	Level uint32          // The level of the attached item
+	Count uint32          // Number of attached items
+	Gold  uint32          // Attached gold
+	Inst  []*itemInstance `bson:",omitempty"` // The instances of the attached items, if any
+}
+
+// The name of the friends channel of a player. The ':' can't be used in names of normal channels.
+func friendsChannelName(uid uint32) string {
+	return fmt.Sprintf("friends:%d", uid)
+}
+
+// Return true if the name can be used for a channel
+func validChannelName(name string) bool {
+	if len(name) == 0 || len(name) > CnfgChatChannelNameMax {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Find a channel, and create it if it doesn't exist. A new channel gets the creator as moderator.
+func findOrCreateChannel_WLh(name string, creator uint32) (ch *chatChannel, created bool) {
+	key := strings.ToLower(name)
+	chatSem.Lock()
+	ch = chatChannels[key]
+	if ch == nil {
+		ch = &chatChannel{name: name, members: make(map[uint32]bool), moderators: map[uint32]bool{creator: true}}
+		chatChannels[key] = ch
+		created = true
+	}
+	chatSem.Unlock()
+	return
+}
+
+func findChannel_RLh(name string) *chatChannel {
+	chatSem.RLock()
+	defer chatSem.RUnlock()
+	return chatChannels[strings.ToLower(name)]
+}
+
+// Add a member to the channel. Return the history, to be replayed.
+func (ch *chatChannel) Join_WLh(uid uint32) []string {
+	chatSem.Lock()
+	ch.members[uid] = true
+	history := make([]string, len(ch.history))
+	copy(history, ch.history)
+	chatSem.Unlock()
+	return history
+}
+
+// Remove a member from the channel. The channel is removed when there are no members left.
+// Return true if the player was a member.
+func (ch *chatChannel) Leave_WLh(uid uint32) bool {
+	chatSem.Lock()
+	defer chatSem.Unlock()
+	if !ch.members[uid] {
+		return false
+	}
+	delete(ch.members, uid)
+	if len(ch.members) == 0 {
+		delete(chatChannels, strings.ToLower(ch.name))
+	}
+	return true
+}
+
+func (ch *chatChannel) IsMember_RLh(uid uint32) bool {
+	chatSem.RLock()
+	defer chatSem.RUnlock()
+	return ch.members[uid]
+}
+
+func (ch *chatChannel) IsModerator_RLh(uid uint32) bool {
+	chatSem.RLock()
+	defer chatSem.RUnlock()
+	return ch.moderators[uid]
+}
+
+// Get all members that are logged in.
+func (ch *chatChannel) OnlineMembers_RLhRLa() []*user {
+	chatSem.RLock()
+	ids := make([]uint32, 0, len(ch.members))
+	for uid := range ch.members {
+		ids = append(ids, uid)
+	}
+	chatSem.RUnlock()
+	ret := make([]*user, 0, len(ids))
+	allPlayersSem.RLock()
+	for _, uid := range ids {
+		if other, ok := allPlayerIdMap[uid]; ok {
+			ret = append(ret, other)
+		}
+	}
+	allPlayersSem.RUnlock()
+	return ret
+}
+
+// Send a message to all members that are logged in, and add it to the history.
+func (ch *chatChannel) Publish_WLhRLa(format string, a ...interface{}) {
+	str := fmt.Sprintf(format, a...)
+	chatSem.Lock()
+	ch.history = append(ch.history, str)
+	if len(ch.history) > CnfgChatHistoryLength {
+		ch.history = ch.history[len(ch.history)-CnfgChatHistoryLength:]
+	}
+	chatSem.Unlock()
+	for _, other := range ch.OnlineMembers_RLhRLa() {
+		other.Printf("%s", str)
+	}
+}
+
+// Create the friends channel when the player logs in. The members are the current listeners.
+func (up *user) CreateFriendsChannel_WLh() *chatChannel {
+	ch := &chatChannel{name: friendsChannelName(up.Id), members: make(map[uint32]bool), moderators: make(map[uint32]bool)}
+	for _, uid := range up.Listeners {
+		ch.members[uid] = true
+	}
+	chatSem.Lock()
+	chatChannels[ch.name] = ch
+	chatSem.Unlock()
+	return ch
+}
+
+// Update the membership of the friends channel of player 'uid', if the player is logged in.
+func updateFriendsChannel_WLh(uid uint32, listener uint32, add bool) {
+	chatSem.Lock()
+	if ch := chatChannels[friendsChannelName(uid)]; ch != nil {
+		if add {
+			ch.members[listener] = true
+		} else {
+			delete(ch.members, listener)
+		}
+	}
+	chatSem.Unlock()
+}
+
+// The player logs out. Tell friends, and leave all channels.
+func (up *user) LeaveAllChannels_WLhRLa() {
+	if ch := findChannel_RLh(friendsChannelName(up.Id)); ch != nil {
+		ch.Publish_WLhRLa("Logged out: %v", up.Name)
+	}
+	chatSem.Lock()
+	delete(chatChannels, friendsChannelName(up.Id))
+	for key, ch := range chatChannels {
+		if strings.HasPrefix(key, "friends:") {
+			continue // The friends channels are not left, as the listeners are saved with the player
+		}
+		delete(ch.members, up.Id)
+		if len(ch.members) == 0 {
+			delete(chatChannels, key)
+		}
+	}
+	chatSem.Unlock()
+}
+
+// Decode the /channel command
+func (up *user) ChannelCommand_WLhRLaBl(arg string) {
+	cmd := strings.Split(arg, " ")
+	switch cmd[0] {
+	case "join":
+		if len(cmd) != 2 || !validChannelName(cmd[1]) {
+			up.Printf_Bl("#FAIL !Usage: /channel join [name], using only letters and digits")
+			return
+		}
+		ch, created := findOrCreateChannel_WLh(cmd[1], up.Id)
+		for _, str := range ch.Join_WLh(up.Id) {
+			up.Printf_Bl("%s", str)
+		}
+		if created {
+			up.Printf_Bl("!Channel %s created, you are moderator", cmd[1])
+		} else {
+			ch.Publish_WLhRLa("[%s] %s joined", ch.name, up.Name)
+		}
+	case "leave":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /channel leave [name]")
+			return
+		}
+		ch := findChannel_RLh(cmd[1])
+		if ch == nil || !validChannelName(cmd[1]) || !ch.Leave_WLh(up.Id) {
+			up.Printf_Bl("#FAIL !Not in channel %s", cmd[1])
+			return
+		}
+		up.Printf_Bl("!You left %s", ch.name)
+		ch.Publish_WLhRLa("[%s] %s left", ch.name, up.Name)
+	case "who":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /channel who [name]")
+			return
+		}
+		ch := findChannel_RLh(cmd[1])
+		if ch == nil || !validChannelName(cmd[1]) || !ch.IsMember_RLh(up.Id) {
+			up.Printf_Bl("#FAIL !Not in channel %s", cmd[1])
+			return
+		}
+		for _, other := range ch.OnlineMembers_RLhRLa() {
+			if ch.IsModerator_RLh(other.Id) {
+				up.Printf_Bl("!%s (moderator)", other.Name)
+			} else {
+				up.Printf_Bl("!%s", other.Name)
+			}
+		}
+	case "list":
+		chatSem.RLock()
+		var names []string
+		for key, ch := range chatChannels {
+			if !strings.HasPrefix(key, "friends:") && ch.members[up.Id] {
+				names = append(names, ch.name)
+			}
+		}
+		chatSem.RUnlock()
+		up.Printf_Bl("!Channels: %s", strings.Join(names, ", "))
+	case "mod", "kick":
+		if len(cmd) != 3 {
+			up.Printf_Bl("#FAIL !Usage: /channel %s [channel] [player]", cmd[0])
+			return
+		}
+		ch := findChannel_RLh(cmd[1])
+		if ch == nil || !validChannelName(cmd[1]) || !ch.IsModerator_RLh(up.Id) {
+			up.Printf_Bl("#FAIL !You are not moderator of %s", cmd[1])
+			return
+		}
+		allPlayersSem.RLock()
+		other, ok := allPlayerNameMap[strings.ToLower(cmd[2])]
+		allPlayersSem.RUnlock()
+		if !ok || !ch.IsMember_RLh(other.Id) {
+			up.Printf_Bl("#FAIL !%s is not in %s", cmd[2], ch.name)
+			return
+		}
+		if cmd[0] == "mod" {
+			chatSem.Lock()
+			ch.moderators[other.Id] = true
+			chatSem.Unlock()
+			ch.Publish_WLhRLa("[%s] %s is now moderator", ch.name, other.Name)
+			return
+		}
+		if ch.IsModerator_RLh(other.Id) {
+			up.Printf_Bl("#FAIL !Can't kick a moderator")
+			return
+		}
+		ch.Leave_WLh(other.Id)
+		other.Printf("!You were kicked from %s", ch.name)
+		ch.Publish_WLhRLa("[%s] %s was kicked by %s", ch.name, other.Name, up.Name)
+	default:
+		up.Printf_Bl("#FAIL !Usage: /channel join|leave|who|list|mod|kick")
+	}
+}
+
+// Send a message to a channel. The argument is the channel name followed by the message.
+func (up *user) ChannelSay_WLhRLaBl(arg string) {
+	msg := strings.SplitN(arg, " ", 2)
+	if len(msg) != 2 {
+		up.Printf_Bl("#FAIL !Usage: /c [channel] [message]")
+		return
+	}
+	ch := findChannel_RLh(msg[0])
+	if ch == nil || !validChannelName(msg[0]) || !ch.IsMember_RLh(up.Id) {
+		up.Printf_Bl("#FAIL !Not in channel %s", msg[0])
+		return
+	}
+	ch.Publish_WLhRLa("[%s] %s: %s", ch.name, up.Name, msg[1])
+}
+
+// Send mail to a player. If the player is logged in, the message is delivered immediately.
+func (up *user) SendMail_RLaBl(arg string) {
+	msg := strings.SplitN(arg, " ", 2)
+	if len(msg) != 2 {
+		up.Printf_Bl("#FAIL !Usage: /mail [name] [message]")
+		return
+	}
+	allPlayersSem.RLock()
+	other, ok := allPlayerNameMap[strings.ToLower(msg[0])]
+	allPlayersSem.RUnlock()
+	if ok {
+		other.Printf("Mail from %s: %s", up.Name, msg[1])
+		up.Printf_Bl("!Mail delivered to %s", other.Name)
+		return
+	}
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return
+	}
+	var receiver struct {
+		Id uint32 `bson:"_id"`
+	}
+	if err := db.C("avatars").Find(bson.M{"name": avatarNamePattern(msg[0])}).Select(bson.M{"_id": 1}).One(&receiver); err != nil {
+		up.Printf_Bl("#FAIL !No player %s", msg[0])
+		return
+	}
+	if n, _ := db.C("mail").Find(bson.M{"to": receiver.Id}).Count(); n >= CnfgMailboxSize {
+		up.Printf_Bl("#FAIL !The mailbox of %s is full", msg[0])
+		return
+	}
+	m := mail{Id: bson.NewObjectId(), To: receiver.Id, From: up.Name, Sent: time.Now(), Text: msg[1]}
+	if err := db.C("mail").Insert(&m); err != nil {
+		log.Println("SendMail", err)
+		up.Printf_Bl("#FAIL !Failed to send mail")
+		return
+	}
+	up.Printf_Bl("!Mail sent to %s", msg[0])
+}
+
+// A DB query pattern matching a player name, ignoring case as the other player name lookups do.
+func avatarNamePattern(name string) bson.RegEx {
+	return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(name) + "$", Options: "i"}
+}
+
+// Send mail from the game. The mailbox limit doesn't apply, as the mail may have attachments that must
+// not be lost. If the receiver is logged in, the mail is delivered immediately.
+func postMail(m *mail) error {
+	db := ephenationdb.New()
+	if db == nil {
+		return errors.New("no database")
+	}
+	m.Id = bson.NewObjectId()
+	m.Sent = time.Now()
+	if err := db.C("mail").Insert(m); err != nil {
+		return err
+	}
+	allPlayersSem.RLock()
+	other, ok := allPlayerIdMap[m.To]
+	allPlayersSem.RUnlock()
+	if ok {
+		other.SendCommand(func(up *user) { up.DeliverMail_Bl() })
+	}
+	return nil
+}
+
+// Give the attachments of a mail to the player. Return false if there is no room for the items.
+func (up *user) takeAttachment_WLu(m *mail) bool {
+	if m.Count == 0 && m.Gold == 0 {
+		return true
+	}
+	up.Lock()
+	ok := m.Count == 0 || up.Inventory.Room(m.Item, m.Level, m.Count)
+	if ok {
+		ok = up.changeGold(int64(m.Gold))
+	}
+	if ok {
+		up.Inventory.addInstances(m.Item, m.Level, m.Count, m.Inst)
+	}
+	balance := up.Gold
+	up.Unlock()
+	if !ok {
+		return false
+	}
+	up.forceSave = true // The mail is already removed
+	if m.Gold > 0 {
+		up.reportGold(int64(m.Gold), balance, "mail from "+m.From)
+	}
+	if m.Count > 0 {
+		ReportOneInventoryItem_WluBl(up, m.Item, m.Level)
+	}
+	return true
+}
+
+// Deliver all mail waiting for the player. This is done at login, and when mail is posted to
+// a player that is logged in. Mail with attachments that can't be carried is kept.
+func (up *user) DeliverMail_Bl() {
+	db := ephenationdb.New()
+	if db == nil {
+		return
+	}
+	var list []mail
+	if err := db.C("mail").Find(bson.M{"to": up.Id}).Sort("sent").All(&list); err != nil {
+		log.Println("DeliverMail", up.Name, err)
+		return
+	}
+	for i := range list {
+		m := &list[i]
+		// Remove the mail first, so the attachments can't be given twice
+		if err := db.C("mail").RemoveId(m.Id); err != nil {
+			continue
+		}
+		if !up.takeAttachment_WLu(m) {
+			db.C("mail").Insert(m)
+			up.Printf_Bl("!Mail from %s is waiting, you can't carry %dx%s", m.From, m.Count, m.Item)
+			continue
+		}
+		up.Printf_Bl("Mail from %s (%s): %s", m.From, m.Sent.Format("2006-01-02 15:04"), m.Text)
+	}
+}
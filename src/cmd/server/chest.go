@@ -0,0 +1,294 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Storage chests. A chest is a BT_Chest block, and the content is saved with the chunk in the
+// PART_CHESTS partition. A chest can be opened by anyone allowed to build in the chunk, or by anyone
+// having the key (from the chunk owner) that has been assigned to the chest.
+//
+// To prevent dead locks, the user is always locked before the chunk.
+//
+
+import (
+	"chunkdb"
+	"client_prot"
+	"strconv"
+	"strings"
+)
+
+// There is one instance of this struct for each BT_Chest block that has been opened. This information is saved with the chunk.
+type storageChest struct {
+	X, Y, Z uint8     // Position of the BT_Chest inside the chunk
+	Key     uint      // The key id (from the chunk owner) that gives access. 0 means no key can be used.
+	Items   PlayerInv // The content
+}
+
+// Sub commands of CMD_CHEST_MOVE
+const (
+	ChestMoveToChest     = 0 // Move items from the inventory to the chest
+	ChestMoveToInventory = 1 // Move items from the chest to the inventory
+)
+
+// Identifies the last chest opened by a player
+type chestLocation struct {
+	cc      chunkdb.CC
+	x, y, z uint8
+	valid   bool
+}
+
+// Find the chest at the specified position. If there is none, and 'create' is true, an empty chest is created.
+// The chunk must be locked.
+func (cp *chunk) findChest(x, y, z uint8, create bool) *storageChest {
+	for i := range cp.chests {
+		if ch := &cp.chests[i]; ch.X == x && ch.Y == y && ch.Z == z {
+			return ch
+		}
+	}
+	if !create || cp.rc[x][y][z] != BT_Chest {
+		return nil
+	}
+	cp.chests = append(cp.chests, storageChest{X: x, Y: y, Z: z})
+	return &cp.chests[len(cp.chests)-1]
+}
+
+// Remove chests where the block is no longer a chest. The chunk must be locked.
+func (cp *chunk) pruneChests() {
+	remain := cp.chests[:0]
+	for _, ch := range cp.chests {
+		if cp.rc[ch.X][ch.Y][ch.Z] == BT_Chest {
+			remain = append(remain, ch)
+		}
+	}
+	if len(remain) == 0 {
+		remain = nil
+	}
+	cp.chests = remain
+}
+
+// Return true if the chest at the specified position has any items. The chunk must be locked.
+func (cp *chunk) chestHasItems(x, y, z uint8) bool {
+	ch := cp.findChest(x, y, z, false)
+	if ch == nil {
+		return false
+	}
+	for _, obj := range ch.Items {
+		if obj.Count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the player may open the chest.
+func (up *user) mayOpenChest(cp *chunk, ch *storageChest) bool {
+	if up.MayModifyChunk_RLg(cp) {
+		return true
+	}
+	return ch.Key != 0 && up.Keys.Test(cp.owner, ch.Key)
+}
+
+// Return true if the player is near enough to the block to use it.
+func (up *user) nearBlock(cc chunkdb.CC, x, y, z uint8) bool {
+	dx := float64(cc.X)*CHUNK_SIZE + float64(x) + 0.5 - up.Coord.X
+	dy := float64(cc.Y)*CHUNK_SIZE + float64(y) + 0.5 - up.Coord.Y
+	dz := float64(cc.Z)*CHUNK_SIZE + float64(z) + 0.5 - up.Coord.Z
+	return dx*dx+dy*dy+dz*dz <= CnfgChestMaxDistance*CnfgChestMaxDistance
+}
+
+// Build the CMD_CHEST_CONTENT message
+func chestContentMessage(cc chunkdb.CC, x, y, z uint8, items PlayerInv) []byte {
+	const itemLen = 12
+	msgLen := 18 + len(items)*itemLen
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_CHEST_CONTENT
+	EncodeUint32(uint32(cc.X), b[3:7])
+	EncodeUint32(uint32(cc.Y), b[7:11])
+	EncodeUint32(uint32(cc.Z), b[11:15])
+	b[15], b[16], b[17] = x, y, z
+	p := b[18:]
+	for _, obj := range items {
+		copy(p[0:4], obj.Type)
+		EncodeUint32(obj.Level, p[4:8])
+		EncodeUint32(obj.Count, p[8:12])
+		p = p[itemLen:]
+	}
+	return b
+}
+
+// Parse the block address used in CMD_CHEST_OPEN, CMD_CHEST_MOVE and CMD_USE_BLOCK. Return the remaining bytes.
+func parseBlockAddress(b []byte) (cc chunkdb.CC, x, y, z uint8, rest []byte, ok bool) {
+	if len(b) < 15 {
+		return
+	}
+	cc.X, b, _ = ParseInt32(b)
+	cc.Y, b, _ = ParseInt32(b)
+	cc.Z, b, _ = ParseInt32(b)
+	x, y, z = b[0], b[1], b[2]
+	if x >= CHUNK_SIZE || y >= CHUNK_SIZE || z >= CHUNK_SIZE {
+		return
+	}
+	return cc, x, y, z, b[3:], true
+}
+
+// Open a chest, and send the content to the player.
+func (up *user) OpenChest_WLwWLcBl(cc chunkdb.CC, x, y, z uint8) {
+	if !up.nearBlock(cc, x, y, z) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	cp.Lock()
+	ch := cp.findChest(x, y, z, true)
+	if ch == nil || !up.mayOpenChest(cp, ch) {
+		cp.Unlock()
+		up.Printf_Bl("#FAIL !You can't open this chest")
+		return
+	}
+	msg := chestContentMessage(cc, x, y, z, ch.Items)
+	cp.Unlock()
+	up.openChest = chestLocation{cc: cc, x: x, y: y, z: z, valid: true}
+	up.writeBlocking_Bl(msg)
+}
+
+// Move items between a chest and the inventory. The player and the chunk are locked at the same time,
+// to make sure items are never lost or duplicated.
+func (up *user) MoveChestItems_WLuWLwWLcBl(cc chunkdb.CC, x, y, z uint8, dir uint8, code ObjectCode, lvl uint32, count uint32) {
+	if !up.nearBlock(cc, x, y, z) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	var failure string
+	up.Lock()
+	cp.Lock()
+	ch := cp.findChest(x, y, z, true)
+	switch {
+	case ch == nil || !up.mayOpenChest(cp, ch):
+		failure = "You can't open this chest"
+	case dir == ChestMoveToChest && up.Inventory.Count(code, lvl) < count:
+		failure = "You don't have that many"
+	case dir == ChestMoveToChest && uint32(len(ch.Items))+ch.Items.slotsNeeded(code, lvl, count) > CnfgChestMaxSlots:
+		failure = "The chest is full"
+	case dir == ChestMoveToInventory && ch.Items.Count(code, lvl) < count:
+		failure = "The chest doesn't have that many"
+	case dir == ChestMoveToInventory && !up.Inventory.Room(code, lvl, count):
+		failure = "You can't carry that many"
+	case dir != ChestMoveToChest && dir != ChestMoveToInventory:
+		failure = "Bad request"
+	default:
+		from, to := &up.Inventory, &ch.Items
+		if dir == ChestMoveToInventory {
+			from, to = to, from
+		}
+		for i := uint32(0); i < count; i++ {
+			to.AddObject(from.Take(code, lvl))
+		}
+		cp.flag |= CHF_MODIFIED
+		cp.Write()
+	}
+	var msg []byte
+	if ch != nil {
+		msg = chestContentMessage(cc, x, y, z, ch.Items)
+	}
+	cp.Unlock()
+	up.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	up.forceSave = true // The chunk is already saved, the player should also be saved to be consistent.
+	up.writeBlocking_Bl(msg)
+	ReportOneInventoryItem_WluBl(up, code, lvl)
+}
+
+// Decode CMD_CHEST_OPEN
+func (up *user) CmdChestOpen_WLwWLcBl(b []byte) {
+	cc, x, y, z, _, ok := parseBlockAddress(b)
+	if ok {
+		up.OpenChest_WLwWLcBl(cc, x, y, z)
+	}
+}
+
+// Decode CMD_CHEST_MOVE
+func (up *user) CmdChestMove_WLuWLwWLcBl(b []byte) {
+	cc, x, y, z, b, ok := parseBlockAddress(b)
+	if !ok || len(b) != 13 {
+		return
+	}
+	lvl, _, _ := ParseUint32(b[5:9])
+	count, _, _ := ParseUint32(b[9:13])
+	up.MoveChestItems_WLuWLwWLcBl(cc, x, y, z, b[0], ObjectCode(b[1:5]), lvl, count)
+}
+
+// Decode the /chest command. It applies to the chest last opened.
+func (up *user) ChestCommand_WLwWLcBl(arg string) {
+	cmd := strings.Split(arg, " ")
+	loc := up.openChest
+	if !loc.valid {
+		up.Printf_Bl("#FAIL !Open a chest first")
+		return
+	}
+	switch cmd[0] {
+	case "key":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /chest key [key id], where 0 means no key")
+			return
+		}
+		kid, err := strconv.ParseUint(cmd[1], 10, 0)
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		cp := ChunkFind_WLwWLc(loc.cc)
+		cp.Lock()
+		ch := cp.findChest(loc.x, loc.y, loc.z, false)
+		ok := ch != nil && up.MayModifyChunk_RLg(cp)
+		if ok {
+			ch.Key = uint(kid)
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
+		cp.Unlock()
+		if !ok {
+			up.Printf_Bl("#FAIL !Only the owner can change the key")
+			return
+		}
+		up.Printf_Bl("!The chest now requires key %d", kid)
+	case "get", "put":
+		if len(cmd) != 4 || len(cmd[1]) != 4 {
+			up.Printf_Bl("#FAIL !Usage: /chest %s [item] [level] [count]", cmd[0])
+			return
+		}
+		lvl, err1 := strconv.ParseUint(cmd[2], 10, 32)
+		count, err2 := strconv.ParseUint(cmd[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			up.Printf_Bl("#FAIL !Usage: /chest %s [item] [level] [count]", cmd[0])
+			return
+		}
+		var dir uint8 = ChestMoveToChest
+		if cmd[0] == "get" {
+			dir = ChestMoveToInventory
+		}
+		up.MoveChestItems_WLuWLwWLcBl(loc.cc, loc.x, loc.y, loc.z, dir, ObjectCode(cmd[1]), uint32(lvl), uint32(count))
+	default:
+		up.Printf_Bl("#FAIL !Usage: /chest key|get|put")
+	}
+}
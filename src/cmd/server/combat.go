@@ -24,6 +24,7 @@ package main
 import (
 	"client_prot"
 	"math"
+	"time"
 	// "fmt"
 )
 
@@ -77,8 +78,7 @@ func (up *user) Hit(monster uint32, level uint32, weaponDmg float32, weaponLvl u
 	dmg := weaponDmg *
 		PlayerLevelDiffMultiplier(up.Level, level) *
 		WeaponLevelDiffMultiplier(level, weaponLvl, 1) /
-		ArmorLevelDiffMultiplier(up.Level, up.ArmorLvl, up.ArmorGrade) /
-		ArmorLevelDiffMultiplier(up.Level, up.HelmetLvl, up.HelmetGrade) /
+		up.armorDivisor() /
 		MonsterVsPlayerFactor(level)
 	if dmg > 1 {
 		dmg = 1
@@ -87,15 +87,19 @@ func (up *user) Hit(monster uint32, level uint32, weaponDmg float32, weaponLvl u
 	// This shouldn't be updated in the current process
 	f := func(up *user) {
 		up.Lock()
+		now := time.Now()
+		dmg = up.effects.absorb(dmg*up.effects.damageTaken(now), now)
 		up.HitPoints -= dmg
 		up.updatedStats = true // This leads to a message being generated.
 		if up.HitPoints <= 0 {
 			up.HitPoints = 0
 			up.Dead = true
 			up.Unlock() // Must unlock before calling a function that can block
+			up.Emit_WLu(EventDeath, 1, level)
 		} else {
 			up.Unlock()
 		}
+		up.Wear_WLu(EquipSlotArmor, EquipSlotHelmet)
 		cp := ChunkFindCached_WLwWLc(up.Coord.GetChunkCoord())
 		owner := cp.owner
 		if owner != up.Id && owner != OWNER_NONE && owner != OWNER_RESERVED && owner != OWNER_TEST {
@@ -114,32 +118,57 @@ func (up *user) Hit(monster uint32, level uint32, weaponDmg float32, weaponLvl u
 
 // The monster is hit by a player with the attributes as specified by the arguments
 func (mp *monster) Hit_WLuBl(up *user, weaponDmg float32) {
-	dmg := weaponDmg * PlayerLevelDiffMultiplier(mp.Level, up.Level) * WeaponLevelDiffMultiplier(up.Level, up.WeaponLvl, up.WeaponGrade) * MonsterVsPlayerFactor(mp.Level)
+	mp.HitWith_WLuBl(up, weaponDmg, up.weaponMultiplier())
+	up.Wear_WLu(EquipSlotWeapon)
+}
+
+// The monster is hit by a player, using a weapon with the multiplier 'weaponMult'
+func (mp *monster) HitWith_WLuBl(up *user, weaponDmg float32, weaponMult float32) {
+	dmg := weaponDmg * PlayerLevelDiffMultiplier(mp.Level, up.Level) * weaponMult * MonsterVsPlayerFactor(mp.Level)
+	now := time.Now()
+	up.RLock()
+	dmg *= up.effects.damageDone(now)
+	up.RUnlock()
+	mp.Lock()
+	dmg *= mp.effects.damageTaken(now)
+	dmg /= mp.toughness()
 	if dmg > 1 {
 		dmg = 1
 	}
+	alive := !mp.dead
 	mp.HitPoints -= dmg
 	mp.updatedStats = true
+	killed := alive && mp.HitPoints <= 0 // Only one player can kill the monster
 	if mp.HitPoints <= 0 {
-		pLevel := up.Level
 		mp.HitPoints = 0
 		mp.dead = true
-		experience := ExperienceForKill(pLevel, mp.Level)
+	}
+	mp.Unlock()
+	if killed {
 		up.Lock()
 		up.flags &= ^client_prot.UserFlagInFight
 		up.NumKill++
-		// Give more experience to low level players
-		switch up.Level {
-		case 0:
-			experience *= 5
-		case 1:
-			experience *= 2.5
-		case 2:
-			experience *= 1.5
-		}
-		up.AddExperience(experience) // Must be locked
 		up.Unlock()
-		up.MonsterDropWLu(combatExperienceSameLevel / experience) // Adjust probability, relative
+		// The experience is shared between all party members near enough. Every extra member gives a bonus.
+		members := up.PartyMembersNear_RLu()
+		share := (1 + CnfgPartyExpBonus*float32(len(members)-1)) / float32(len(members))
+		var experience float32
+		for _, other := range members {
+			exp := PlayerExperienceForKill(other.Level, mp.Level)
+			if other == up {
+				experience = exp // The drop probability depends on the killer only
+			}
+			other.Lock()
+			other.AddExperience(exp * share) // Must be locked
+			other.Unlock()
+		}
+		up.MonsterDropWLu(mp, combatExperienceSameLevel/experience) // Adjust probability, relative
+		up.QuestKill_WLuBl(mp.Level)
+		up.Emit_WLu(EventKill, 1, mp.Level)
+		up.AddGold_WLu(goldForKill(mp.Level), "kill")
+		if mp.boss != nil {
+			mp.announce_RLq("%s has been defeated by %s!", mp.boss.def.Name, up.Name)
+		}
 		// fmt.Printf("mp.Hit %#v\n", *mp)
 	}
 	var b [8]byte
@@ -151,6 +180,21 @@ func (mp *monster) Hit_WLuBl(up *user, weaponDmg float32) {
 	up.writeBlocking_Bl(b[:])
 }
 
+// The experience a player at level 'pLevel' gets for killing a monster at level 'mLevel'.
+// Low level players get more experience.
+func PlayerExperienceForKill(pLevel, mLevel uint32) float32 {
+	experience := ExperienceForKill(pLevel, mLevel)
+	switch pLevel {
+	case 0:
+		experience *= 5
+	case 1:
+		experience *= 2.5
+	case 2:
+		experience *= 1.5
+	}
+	return experience
+}
+
 // Compare levels l1 and l2 of two fighters, and return a multiplier used in combat.
 // Return a multiplier between 0 and 1.
 func PlayerLevelDiffMultiplier(l1, l2 uint32) float32 {
@@ -162,7 +206,7 @@ func PlayerLevelDiffMultiplier(l1, l2 uint32) float32 {
 // Return a multiplier near 1. The same algorithm is used by the client in the inventory
 // screen. If it is changed here, make sure it is also changed in the client.
 // See https://docs.google.com/drawings/d/1cmObDuDgBvYhpsQagfjHPlckXjluU3CR9utVkTSh_rE/edit?hl=en_US
-func WeaponLevelDiffMultiplier(pLevel, wLevel uint32, wepType uint8) (ret float32) {
+func WeaponLevelDiffMultiplier(pLevel, wLevel uint32, wepType uint8) float32 {
 	var detract uint8
 	if pLevel > wLevel+uint32(wepType) {
 		detract = uint8(pLevel-wLevel) - wepType // This will be greater than zero
@@ -175,27 +219,13 @@ func WeaponLevelDiffMultiplier(pLevel, wLevel uint32, wepType uint8) (ret float3
 	}
 	// fmt.Println("WeaponLevelDiffMultiplier: detract ", detract)
 	wepType -= detract
-	switch wepType {
-	case 0:
-		ret = 0.9
-	case 1:
-		ret = 1.0
-	case 2:
-		ret = 1.1
-	case 3:
-		ret = 1.2
-	case 4:
-		ret = 1.3
-	default:
-		ret = 1.0 // Shouldn't happen
-	}
-	return
+	return ItemGradeModifier(ItemCategoryWeapon, wepType)
 }
 
 // Compensate for a fighter at level 'pLevel' using an armor at level 'aLevel'. This is also used
-// for helmets.
+// for helmets, with 'category' ItemCategoryHelmet.
 // The same principle (but not same value) is used as for a weapon, see above. The damage is divided by this factor.
-func ArmorLevelDiffMultiplier(pLevel, aLevel uint32, armType uint8) float32 {
+func ArmorLevelDiffMultiplier(category string, pLevel, aLevel uint32, armType uint8) float32 {
 	var detract uint8
 	if pLevel > aLevel+uint32(armType) {
 		detract = uint8(pLevel-aLevel) - armType // This will be greater than zero
@@ -208,19 +238,7 @@ func ArmorLevelDiffMultiplier(pLevel, aLevel uint32, armType uint8) float32 {
 	}
 	// fmt.Println("WeaponLevelDiffMultiplier: detract ", detract)
 	armType -= detract
-	modifier := float32(1.0) // Default value
-	switch armType {
-	case 0:
-		modifier = 0.9
-	case 1:
-		modifier = 1.0
-	case 2:
-		modifier = 1.1
-	case 3:
-		modifier = 1.2
-	case 4:
-		modifier = 1.3
-	}
+	modifier := ItemGradeModifier(category, armType)
 	return (modifier-1)*COMB_ArmorModifierCal + 1
 }
 
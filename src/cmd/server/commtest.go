@@ -91,6 +91,7 @@ func (dc *dummyConn) Write(b []byte) (n int, err error) {
 	case client_prot.CMD_REPORT_COORDINATE: // Ignore
 	case client_prot.CMD_RESP_PLAYER_HIT_MONSTER: // Ignore
 	case client_prot.CMD_EQUIPMENT: // Ignore
+	case client_prot.CMD_PARTY_LIST: // Ignore
 	default:
 		fmt.Printf("dummyConn:Write unexpected %d: %v\n", len(buff), buff)
 	}
@@ -28,6 +28,7 @@ const (
 	MonstersUpdateTargetPeriod  = 5e9       // How frequently the monster looks reevaluate when to switch target (aggro)
 	MonstersUpdateDirPeriod     = 1e9       // How frequent the monster will evaluate what direction to move
 	CnfgAttackPeriod            = 1e9       // How frequently attacks are updated, or healing if no attack
+	CnfgEffectMaxDuration       = 300e9     // Status effects can't last longer than this
 	CnfgAutosavePeriod          = 3e11      // Autosave players
 	CnfgDefaultTriggerBlockTime = 10        // Default seconds until an activation block can be used again
 	PURGE_MONSTER_PERIOD        = 3e10      // 30s second between every purge
@@ -41,8 +42,48 @@ const (
 	DefaultMonsterSpawnDistance = 25        // Number of blocks away that random monsters will spawn
 	CheckMonsterDistForSpawn    = 40        // Monsters inside this distance are counted when deciding whether to spawn more
 	CnfgMonsterAggroDistance    = 20        // How close you have to be to a monser to get aggro
+	CnfgMonsterPackRadius       = 15        // Monsters of a pack within this distance join an attack
+	CnfgSpawnerEditDistance     = 5         // Max distance to a BT_Spawn block to configure it
+	CnfgSpawnerMaxCap           = 10        // Max number of monsters alive from one spawner
+	CnfgSpawnerMaxRadius        = 32        // Max activation radius of a spawner, limited to one chunk
+	CnfgSpawnerMinInterval      = 10        // Min seconds between spawner waves
+	CnfgSpawnerMaxLevelOffset   = 3         // Spawner monsters can't be more than this from the normal level
+	CnfgBossAnnounceDistance    = 40        // Players within this distance are told about boss events
+	CnfgPathBudgetPerTick       = 2000      // Max number of path finding nodes searched, for all monsters, every monster state update
+	CnfgPathMaxNodes            = 500       // Max number of path finding nodes searched for one monster
+	CnfgPathMaxHeight           = 3         // The height used when finding paths for big monsters
+	CnfgPathMaxDrop             = 3         // The number of blocks a monster is willing to fall down
+	CnfgPathGoalTolerance       = 2         // Number of blocks the target can move before a new path is needed
+	CnfgPathWaypointDist        = 0.3       // How near the center of a block a monster has to be to have reached it
 	CnfgMonsterFieldOfView      = 1.40      // The viewing angle for a monster, in radians
 	CnfgMeleeDistLimit          = 4         // Max block distance to be allowed to hit
+	CnfgPvPDamageFactor         = 0.5       // Damage multiplier when players fight each other
+	CnfgDuelEndHitPoints        = 0.05      // A duel is lost when the hit points drop to this
+	CnfgDuelMaxDistance         = 30        // A duel is cancelled if the players are further apart than this
+	CnfgScriptBudget            = 1000      // Max number of instructions for one run of an activator script
+	CnfgScriptMaxVars           = 100       // Max number of script variables for an activator, or for a player and owner
+	CnfgScriptMaxActions        = 10        // Max number of actions for one run of an activator script
+	CnfgLogicTick               = 250e6     // How often logic circuits are evaluated
+	CnfgLogicDefaultTicks       = 4         // The default number of ticks for delays and pulses
+	CnfgLogicMaxParam           = 32        // Max parameter of a logic gate, limited by the delay history
+	CnfgLogicEditDistance       = 5         // Max distance to a logic gate to configure it
+	CnfgLogicActivatorDistance  = 20        // A player must be this near to a text activator activated by logic
+	CnfgNPCTalkDistance         = 4         // Max distance to an NPC to talk with it
+	CnfgNPCMaxPerChunk          = 4         // Max number of NPCs in one chunk
+	CnfgQuestMaxActive          = 10        // Max number of quests in progress for a player
+	CnfgQuestMaxExp             = 0.5       // Max experience reward of a quest, as a fraction of a level
+	CnfgQuestMaxGold            = 1000      // Max gold reward of a quest
+	CnfgGoldRewardCost          = 0.01      // Territory score paid by the quest giver for every gold given as a reward
+	CnfgExpRewardCost           = 20        // Territory score paid by the quest giver for every level of experience given as a reward
+	CnfgGoldPerKillLevel        = 0.5       // Gold for killing a monster, per monster level, in addition to 1
+	CnfgGoldPerDropValue        = 10        // Gold paid by a vendor for an item not in stock, per drop value
+	CnfgVendorBuyBack           = 0.25      // The default fraction of the price paid by a vendor for items in the stock
+	CnfgGoldLogQueue            = 1000      // Number of gold transactions that can wait for being saved
+	CnfgProjectileLaunchHeight  = 3         // Projectiles start at this height above the player feet
+	CnfgProjectileStep          = 0.5       // Max distance, in blocks, a projectile moves between collision tests
+	CnfgProjectileHitRadius     = 0.3       // Horizontal radius of a monster, in addition to what depends on the size
+	CnfgProjectileSearchRadius  = 2         // Monsters within this distance are tested for projectile hits
+	CnfgProjectileRangeFactor   = 1.2       // Projectiles fly this much further than the weapon range before they expire
 	CnfgMaxChunkReqDist         = 6         // Client can not request chunks further away than this (in one dimension). Max view distance is 160 blocks, which correspopnds to 5 chunks.
 	MaxMonsterSpawnHeightDiff   = 6         // The monster will not spawn outside of this diff to the player (in blocks)
 	MonsterLimitForRespawn      = 3         // If there is at least this many monsters near, no new will be spawned.
@@ -63,9 +104,28 @@ const (
 	CnfgWeaponDmgCombAttack     = 1.5       // Damage for the extra attack
 	CnfgMaxOwnChunk             = 10        // The number of chunks a normal player can own. It can be overriden.
 	CnfgJellyTimeout            = 15        // Number of seconds a block will be in jelly state
-	CnfgItemRewardNormalizer    = 0.02      // How much experience to get for a dropped item of lowest grade at player level
 	CnfgScoreMoveFact           = 1.0 / 128 // This means that a player need to move 64 blocs in a chunk to award 1 point
 	CnfgScoreDamageFact         = 1.0 / 5   // Number of monsters that need to be killed for one point
+	CnfgMaxPartySize            = 5         // Maximum number of players in a party
+	CnfgPartyShareDistance      = 64        // Party members must be within this distance to share experience and loot
+	CnfgPartyExpBonus           = 0.1       // Experience bonus for every extra party member sharing a kill
+	CnfgMaxGuildChunks          = 20        // The number of chunks a guild can own
+	CnfgChatHistoryLength       = 10        // Number of messages in a chat channel that are replayed to new members
+	CnfgChatChannelNameMax      = 20        // Max length of chat channel names
+	CnfgMailboxSize             = 50        // Max number of unread mails for a player
+	CnfgCraftMax                = 20        // Max number of times a recipe can be used at once
+	CnfgAffixChance             = 0.3       // The chance of an affix on new equipment, for every grade
+	CnfgDurabilityLoss          = 0.002     // Durability lost by an equipped item for every hit
+	CnfgRepairGoldPerLevel      = 0.5       // Gold to repair a broken item, for every grade and item level
+	CnfgAuctionMaxListings      = 20        // Max number of items a player can have in the auction house
+	CnfgAuctionMaxHours         = 72        // Max duration of an auction listing
+	CnfgAuctionSearchMax        = 50        // Max number of listings in a search result
+	CnfgAuctionCut              = 0.05      // The fraction of the price kept by the auction house
+	CnfgAuctionExpiryPeriod     = 6e10      // How often expired auction listings are returned to the sellers
+	CnfgTradeMaxDistance        = 10        // Max number of blocks between two players that trade
+	CnfgChestMaxDistance        = 5         // Max number of blocks between a player and a chest, door or lever being used
+	CnfgChestMaxSlots           = 20        // Max number of different item types in a storage chest
+	CnfgEventMoveDistance       = 10        // Number of blocks moved before a movement event is emitted
 	CnfgChunkFolder             = "DB"      // The folder where all chunks are stored
 	CnfgSuperChunkFolder        = "SDB"     // The folder where all super chunks are stored
 )
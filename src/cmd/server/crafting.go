@@ -0,0 +1,326 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Gathering and crafting. Removing a block gives the material of the block type, if it has one, and
+// recipes turn materials and other items into new items. Both are defined in a JSON file, loaded at
+// startup and reloaded with the admin command "/reload crafting". Materials are items of the "material"
+// category in the item catalog, and are always of level 0. Other crafted items get the level of the player.
+//
+// In survival mode, see the flag "-survival", removing a block gives the material of the block type, and
+// building a block consumes it. Blocks without a material, like activators and triggers, are free. When not
+// in survival mode, building is free, so nothing is gathered either.
+//
+// The client crafts with CMD_CRAFT, the same as the "/craft" command.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+type materialDef struct {
+	Block block  // The block type
+	Item  string // The material, gathered from the block and used to build it
+}
+
+type recipeInput struct {
+	Item  string
+	Count uint32
+}
+
+type recipeDef struct {
+	Id       string
+	Inputs   []recipeInput // Taken from the inventory, at any level
+	Item     string        // The item made
+	Count    uint32        // Number of items made. Default 1.
+	MinLevel uint32        // The lowest player level that can use the recipe
+}
+
+// The materials needed to repair a broken item of a category, see instances.go. Less is needed for
+// items that are not completely broken.
+type repairDef struct {
+	Category string
+	Item     string
+	Count    uint32
+}
+
+type craftingDefs struct {
+	Materials []materialDef
+	Recipes   []*recipeDef
+	Repairs   []repairDef
+	byBlock   map[block]ObjectCode
+	byId      map[string]*recipeDef
+}
+
+var (
+	craftingSem sync.RWMutex
+	crafting    = &craftingDefs{} // Nothing can be gathered or crafted unless there is a crafting file
+)
+
+// Return true if the item is a material
+func isMaterial(code ObjectCode) bool {
+	def := ItemLookup(code)
+	return def != nil && def.Category == ItemCategoryMaterial
+}
+
+// Verify the definitions, give default values to undefined attributes, and build the indices.
+func (c *craftingDefs) verify() error {
+	c.byBlock = make(map[block]ObjectCode)
+	c.byId = make(map[string]*recipeDef)
+	for _, m := range c.Materials {
+		if m.Block == BT_Air || m.Block == BT_Unused {
+			return fmt.Errorf("material '%s' for block %d", m.Item, m.Block)
+		}
+		if _, ok := c.byBlock[m.Block]; ok {
+			return fmt.Errorf("block %d has two materials", m.Block)
+		}
+		c.byBlock[m.Block] = ObjectCode(m.Item)
+	}
+	for _, r := range c.Recipes {
+		if r.Id == "" || strings.Contains(r.Id, " ") {
+			return fmt.Errorf("recipe id '%s' must be one word", r.Id)
+		}
+		if _, ok := c.byId[r.Id]; ok {
+			return fmt.Errorf("recipe '%s' defined twice", r.Id)
+		}
+		c.byId[r.Id] = r
+		if r.Count == 0 {
+			r.Count = 1
+		}
+		if len(r.Inputs) == 0 {
+			return fmt.Errorf("recipe '%s' has no inputs", r.Id)
+		}
+		for _, in := range r.Inputs {
+			if in.Count == 0 {
+				return fmt.Errorf("recipe '%s': bad input '%s'", r.Id, in.Item)
+			}
+		}
+	}
+	for _, r := range c.Repairs {
+		if r.Count == 0 {
+			return fmt.Errorf("repair of '%s': bad item '%s'", r.Category, r.Item)
+		}
+	}
+	return c.verifyItems(currentItemCatalog())
+}
+
+// Verify that all items used by the definitions are found in the item catalog. Nothing is changed,
+// so it can also be used for the current definitions, when the item catalog is reloaded.
+func (c *craftingDefs) verifyItems(cat *itemCatalog) error {
+	for _, m := range c.Materials {
+		if def := cat.byCode[ObjectCode(m.Item)]; def == nil || def.Category != ItemCategoryMaterial {
+			return fmt.Errorf("item '%s' is not a material", m.Item)
+		}
+	}
+	for _, r := range c.Recipes {
+		if cat.byCode[ObjectCode(r.Item)] == nil {
+			return fmt.Errorf("recipe '%s': unknown item '%s'", r.Id, r.Item)
+		}
+		for _, in := range r.Inputs {
+			if cat.byCode[ObjectCode(in.Item)] == nil {
+				return fmt.Errorf("recipe '%s': bad input '%s'", r.Id, in.Item)
+			}
+		}
+	}
+	for _, r := range c.Repairs {
+		if cat.byCode[ObjectCode(r.Item)] == nil {
+			return fmt.Errorf("repair of '%s': bad item '%s'", r.Category, r.Item)
+		}
+	}
+	return nil
+}
+
+// Load the materials and recipes from file. The current definitions are kept if there is an error.
+func LoadCrafting(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	c := new(craftingDefs)
+	if err = json.Unmarshal(data, c); err == nil {
+		err = c.verify()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(c.Materials) == 0 && len(c.Recipes) == 0 {
+		return fmt.Errorf("%s: nothing defined", fileName)
+	}
+	craftingSem.Lock()
+	crafting = c
+	craftingSem.Unlock()
+	log.Println("Loaded", len(c.Materials), "materials and", len(c.Recipes), "recipes from", fileName)
+	return nil
+}
+
+func currentCrafting() *craftingDefs {
+	craftingSem.RLock()
+	defer craftingSem.RUnlock()
+	return crafting
+}
+
+// The material of a block type, or an empty string if it has none
+func materialOf(bl block) ObjectCode {
+	return currentCrafting().byBlock[bl]
+}
+
+// The materials used to repair items of a category. Return nil if they can't be repaired with materials.
+func (c *craftingDefs) repairOf(category string) *repairDef {
+	for i := range c.Repairs {
+		if c.Repairs[i].Category == category {
+			return &c.Repairs[i]
+		}
+	}
+	return nil
+}
+
+// Find a recipe. Return nil if there is no such recipe.
+func FindRecipe(id string) *recipeDef {
+	return currentCrafting().byId[id]
+}
+
+// The player removed a block of type 'bl'. Give the material, if any, in survival mode.
+func (up *user) Gather_WLuBl(bl block) {
+	if !*survivalMode {
+		return
+	}
+	if code := materialOf(bl); code != "" {
+		AddObjectToUser_WLuBl(up, code, 0)
+	}
+}
+
+// Take the material needed to build a block of type 'bl'. Return the material, which is empty if nothing
+// was needed, and false if the player doesn't have it.
+func (up *user) takeMaterial_WLu(bl block) (ObjectCode, bool) {
+	if !*survivalMode {
+		return "", true
+	}
+	code := materialOf(bl)
+	if code == "" {
+		return "", true
+	}
+	up.Lock()
+	ok := up.Inventory.Count(code, 0) > 0
+	if ok {
+		up.Inventory.Remove(code, 0)
+	}
+	up.Unlock()
+	return code, ok
+}
+
+// Use a recipe 'count' times
+func (up *user) Craft_WLuBl(id string, count uint32) {
+	r := FindRecipe(id)
+	if r == nil {
+		up.Printf_Bl("#FAIL !Unknown recipe '%s'", id)
+		return
+	}
+	if count == 0 || count > CnfgCraftMax {
+		up.Printf_Bl("#FAIL !You can make 1 to %d at a time", CnfgCraftMax)
+		return
+	}
+	code := ObjectCode(r.Item)
+	type changed struct {
+		code ObjectCode
+		lvl  uint32
+	}
+	var report []changed
+	var failure string
+	up.Lock()
+	lvl := up.Level
+	if isMaterial(code) {
+		lvl = 0
+	}
+	if up.Level < r.MinLevel {
+		failure = fmt.Sprintf("You must be level %d", r.MinLevel)
+	} else if !up.Inventory.Room(code, lvl, r.Count*count) {
+		failure = fmt.Sprintf("You can't carry more of %v", code)
+	}
+	for _, in := range r.Inputs {
+		if failure == "" && up.Inventory.countAll(ObjectCode(in.Item)) < in.Count*count {
+			failure = fmt.Sprintf("You need %dx%s", in.Count*count, in.Item)
+		}
+	}
+	if failure == "" {
+		for _, in := range r.Inputs {
+			for _, l := range up.Inventory.removeAll(ObjectCode(in.Item), in.Count*count) {
+				report = append(report, changed{ObjectCode(in.Item), l})
+			}
+		}
+		for i := uint32(0); i < r.Count*count; i++ {
+			up.Inventory.AddOneObject(code, lvl)
+		}
+		report = append(report, changed{code, lvl})
+	}
+	up.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	reported := make(map[changed]bool)
+	for _, c := range report {
+		if !reported[c] {
+			reported[c] = true
+			ReportOneInventoryItem_WluBl(up, c.code, c.lvl)
+		}
+	}
+	up.Printf_Bl("!You made %dx%s", r.Count*count, code)
+}
+
+// Decode CMD_CRAFT. The count is followed by the recipe id.
+func (up *user) CmdCraft_WLuBl(b []byte) {
+	if len(b) < 2 {
+		return
+	}
+	up.Craft_WLuBl(string(b[1:]), uint32(b[0]))
+}
+
+// Manage the "/craft" command
+func (up *user) CraftCommand_WLuBl(args []string) {
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		c := currentCrafting()
+		if len(c.Recipes) == 0 {
+			up.Printf_Bl("!There are no recipes")
+		}
+		for _, r := range c.Recipes {
+			var inputs []string
+			for _, in := range r.Inputs {
+				inputs = append(inputs, fmt.Sprintf("%dx%s", in.Count, in.Item))
+			}
+			up.Printf_Bl("!%s: %s makes %dx%s", r.Id, strings.Join(inputs, ", "), r.Count, r.Item)
+		}
+	case len(args) == 1 || len(args) == 2:
+		var count uint32 = 1
+		if len(args) == 2 {
+			if _, err := fmt.Sscan(args[1], &count); err != nil {
+				up.Printf_Bl("#FAIL !%v", err)
+				return
+			}
+		}
+		up.Craft_WLuBl(args[0], count)
+	default:
+		up.Printf_Bl("#FAIL !Usage: /craft list|[recipe] [count]")
+	}
+}
@@ -29,8 +29,11 @@ import (
 	"fmt"
 	"github.com/larspensjo/Go-simplex-noise/simplexnoise"
 	"keys"
+	"labix.org/v2/mgo/bson"
 	"math"
+	"pathfind"
 	"quadtree"
+	"regexp"
 	"time"
 	"twof"
 )
@@ -58,6 +61,31 @@ func DoTest() {
 	DoTestCoordinates()
 	DoTestCombat_WLuBl()
 	DoTestFriends_WLaWLwWLuWLqBlWLc()
+	DoTestParty_WLaWLwWLuWLqBlWLc()
+	DoTestGuildPermissions()
+	DoTestChatChannels()
+	DoTestTrade_WLaWLwWLuWLqBlWLc()
+	DoTestChests()
+	DoTestItemCatalog()
+	DoTestLootTables()
+	DoTestMonsterSpecies()
+	DoTestMonsterPath()
+	DoTestBosses()
+	DoTestSpawners()
+	DoTestRanged()
+	DoTestAbilities()
+	DoTestStatusEffects()
+	DoTestPvP()
+	DoTestQuests()
+	DoTestActivatorScripts()
+	DoTestLogic()
+	DoTestDoors()
+	DoTestNPCs()
+	DoTestVendors()
+	DoTestAuction()
+	DoTestCrafting()
+	DoTestInstances()
+	DoTestAchievements()
 	DoTestKeyRing()
 	DoTestJellyBlocks()
 	fmt.Printf("Tests done. %d tests (%d successful + %d failures)\n", testCount, testSuccess, testFailed)
@@ -330,20 +358,20 @@ func DoTestTextActivators() {
 	)
 	var src []textMsgActivator
 	var dest []textMsgActivator
-	src = append(src, textMsgActivator{5, 5, 5, []string{STR1}, zeroTime})
-	dest = append(dest, textMsgActivator{5, 5, 5, nil, zeroTime})
+	src = append(src, textMsgActivator{5, 5, 5, []string{STR1}, zeroTime, nil})
+	dest = append(dest, textMsgActivator{5, 5, 5, nil, zeroTime, nil})
 	CopyActivatorListMessages(src, dest)
 	DoTestCheck("DoTestTextActivators length test1", len(src) == 1 && len(dest) == 1)
 	DoTestCheck("DoTestTextActivators copy1", len(dest[0].Message) == 1 && dest[0].Message[0] == STR1)
 
 	// Add an ativator to src, but not for dest.
-	src = append(src, textMsgActivator{5, 5, 6, []string{STR2}, zeroTime})
+	src = append(src, textMsgActivator{5, 5, 6, []string{STR2}, zeroTime, nil})
 	CopyActivatorListMessages(src, dest)
 	DoTestCheck("DoTestTextActivators length2", len(src) == 2 && len(dest) == 1)
 	DoTestCheck("DoTestTextActivators copy2", len(dest[0].Message) == 1 && dest[0].Message[0] == STR1)
 
 	// Add an ativator to dest also.
-	dest = append(dest, textMsgActivator{5, 5, 6, nil, zeroTime})
+	dest = append(dest, textMsgActivator{5, 5, 6, nil, zeroTime, nil})
 	CopyActivatorListMessages(src, dest)
 	DoTestCheck("DoTestTextActivators length3", len(src) == 2 && len(dest) == 2)
 	DoTestCheck("DoTestTextActivators copy3", len(dest[1].Message) == 1 && dest[1].Message[0] == STR2)
@@ -529,6 +557,7 @@ func DoTestCoordinates() {
 func DoTestCombat_WLuBl() {
 	var u user
 	var m monster
+	m.species = defaultMonsterSpecies[0]
 
 	u.Level = 0
 	conn := MakeDummyConn()
@@ -570,6 +599,8 @@ func DoTestFriends_WLaWLwWLuWLqBlWLc() {
 	// fmt.Printf("notFound %v, alreadyIn %v\n", notFound, alreadyIn)
 	DoTestCheck("DoTestFriends: AddToListener success", notFound == false && alreadyIn == false)
 	DoTestCheck("DoTestFriends: One entry listener list", len(up.Listeners) == 1 && up.Listeners[0] == ID1)
+	friendsChannel := findChannel_RLh(friendsChannelName(up.Id))
+	DoTestCheck("DoTestFriends: friends channel", friendsChannel != nil && friendsChannel.IsMember_RLh(ID1))
 
 	notFound, alreadyIn = up2.AddToListener_RLaWLu(name)
 	DoTestCheck("DoTestFriends: AddToListener duplicate", notFound == false && alreadyIn == true)
@@ -599,6 +630,7 @@ func DoTestFriends_WLaWLwWLuWLqBlWLc() {
 	notFound, notIn = up2.RemoveFromListener_RLaWLu(name)
 	DoTestCheck("DoTestFriends: RemoveFromListener ID2 success again", notFound == false && notIn == false)
 	DoTestCheck("DoTestFriends: Empty listener list after clean-up", len(up.Listeners) == 0)
+	DoTestCheck("DoTestFriends: friends channel after clean-up", !friendsChannel.IsMember_RLh(ID1) && !friendsChannel.IsMember_RLh(ID2))
 
 	// Remove ID2 again, which shall fail
 	notFound, notIn = up2.RemoveFromListener_RLaWLu(name)
@@ -607,6 +639,155 @@ func DoTestFriends_WLaWLwWLuWLqBlWLc() {
 	CmdClose_BlWLqWLuWLa(index)
 }
 
+// Test party management, and that experience and loot is shared.
+func DoTestParty_WLaWLwWLuWLqBlWLc() {
+	conn1 := MakeDummyConn()
+	_, index1 := NewClientConnection_WLa(conn1)
+	up1 := allPlayers[index1]
+	up1.CmdLogin_WLwWLuWLqBlWLc("test0")
+	conn2 := MakeDummyConn()
+	_, index2 := NewClientConnection_WLa(conn2)
+	up2 := allPlayers[index2]
+	up2.CmdLogin_WLwWLuWLqBlWLc("test1")
+	DoTestCheck("DoTestParty: two players", numPlayers == 2)
+
+	up1.PartyCommand_RLaWLuBl("invite test1")
+	DoTestCheck("DoTestParty: invited", up1.party == nil && up2.partyInvite == up1 && up2.party == nil)
+	up2.PartyCommand_RLaWLuBl("accept")
+	DoTestCheck("DoTestParty: accepted", up2.party == up1.party && len(up1.party.Members()) == 2 && up1.party.Leader() == up1)
+	DoTestCheck("DoTestParty: member list length", len(up1.party.ListMessage()) == 3+2*10)
+	up1.ReportParty_RLuBl()
+	DoTestCheck("DoTestParty: member list", conn1.TestCommandSeen(client_prot.CMD_PARTY_LIST))
+	up2.PartyCommand_RLaWLuBl("kick test0")
+	DoTestCheck("DoTestParty: only leader can kick", len(up1.party.Members()) == 2)
+
+	up2.Coord = up1.Coord
+	DoTestCheck("DoTestParty: near members", len(up1.PartyMembersNear_RLu()) == 2)
+	up1.PartyCommand_RLaWLuBl("loot rr")
+	r1, r2 := up1.LootReceiver_RLu(), up1.LootReceiver_RLu()
+	DoTestCheck("DoTestParty: round robin loot", r1 != r2)
+	up1.PartyCommand_RLaWLuBl("loot ffa")
+	DoTestCheck("DoTestParty: free for all loot", up1.LootReceiver_RLu() == up1 && up1.LootReceiver_RLu() == up1)
+
+	var m monster
+	m.species = defaultMonsterSpecies[0]
+	up1.Level, up2.Level = 5, 5
+	up1.Exp, up2.Exp = 0, 0
+	m.Level = 5
+	m.HitPoints = 0.01
+	m.Hit_WLuBl(up1, 1)
+	DoTestCheck("DoTestParty: monster killed", m.dead)
+	DoTestCheck("DoTestParty: experience shared", up1.Exp > 0 && up1.Exp == up2.Exp && up1.Exp < PlayerExperienceForKill(5, 5))
+
+	up2.PartyCommand_RLaWLuBl("leave")
+	DoTestCheck("DoTestParty: party dissolved", up1.party == nil && up2.party == nil)
+
+	CmdClose_BlWLqWLuWLa(index2)
+	CmdClose_BlWLqWLuWLa(index1)
+}
+
+// Test the permission to change blocks in guild territory. No DB is used.
+func DoTestGuildPermissions() {
+	const gid = 17
+	gp := &guild{Id: gid, Name: "TestGuild", Members: []GuildMember{{Id: 1, Rank: GuildRankLeader}, {Id: 2, Rank: GuildRankMember}}}
+	guildSem.Lock()
+	addGuildToCache(gp)
+	guildSem.Unlock()
+	ch := dBCreateChunk(chunkdb.CC{X: 0, Y: 0, Z: 0})
+	ch.owner = GuildOwnerId(gid)
+	DoTestCheck("DoTestGuildPermissions guild owner", IsGuildOwner(ch.owner) && !IsGuildOwner(1) && !IsGuildOwner(OWNER_TEST) && !IsGuildOwner(OWNER_RESERVED))
+	var leader, member, other user
+	leader.Id, leader.Guild = 1, gid
+	member.Id, member.Guild = 2, gid
+	other.Id = 3
+	DoTestCheck("DoTestGuildPermissions leader may build", leader.MayModifyChunk_RLg(ch))
+	DoTestCheck("DoTestGuildPermissions member may not build", !member.MayModifyChunk_RLg(ch))
+	DoTestCheck("DoTestGuildPermissions others may not build", !other.MayModifyChunk_RLg(ch))
+	gp.Members[1].Rank = GuildRankBuilder
+	DoTestCheck("DoTestGuildPermissions builder may build", member.MayModifyChunk_RLg(ch))
+	ch.owner = 2
+	DoTestCheck("DoTestGuildPermissions own chunk", member.MayModifyChunk_RLg(ch) && !leader.MayModifyChunk_RLg(ch))
+	leader.connState = PlayerConnStateDisc
+	leader.Coord = user_coord{0, 1e6, 0}
+	leader.GuildClaim_WLgWLwWLc(gp, nil)
+	DoTestCheck("DoTestGuildPermissions claim level", len(gp.Territory) == 0)
+	guildSem.Lock()
+	delete(allGuilds, gid)
+	delete(guildNames, "testguild")
+	guildSem.Unlock()
+}
+
+func DoTestChatChannels() {
+	p := avatarNamePattern("Bo.b")
+	re := regexp.MustCompile("(?" + p.Options + ")" + p.Pattern)
+	DoTestCheck("DoTestChatChannels mail name", re.MatchString("bo.B") && !re.MatchString("boxb") && !re.MatchString("bo.bb"))
+	const name = "TestChannel"
+	DoTestCheck("DoTestChatChannels valid names", validChannelName(name) && !validChannelName("friends:1") && !validChannelName(""))
+	ch, created := findOrCreateChannel_WLh(name, 1)
+	DoTestCheck("DoTestChatChannels created", created && ch.IsModerator_RLh(1) && !ch.IsModerator_RLh(2))
+	ch.Join_WLh(1)
+	for i := 0; i < CnfgChatHistoryLength+2; i++ {
+		ch.Publish_WLhRLa("msg %d", i)
+	}
+	history := ch.Join_WLh(2)
+	DoTestCheck("DoTestChatChannels history", len(history) == CnfgChatHistoryLength && history[len(history)-1] == fmt.Sprintf("msg %d", CnfgChatHistoryLength+1))
+	ch2, created := findOrCreateChannel_WLh("testchannel", 2)
+	DoTestCheck("DoTestChatChannels same channel", ch2 == ch && !created)
+	DoTestCheck("DoTestChatChannels leave", ch.Leave_WLh(1) && !ch.Leave_WLh(1) && ch.IsMember_RLh(2))
+	ch.Leave_WLh(2)
+	DoTestCheck("DoTestChatChannels removed", findChannel_RLh(name) == nil)
+}
+
+// Test a complete trade session between two players
+func DoTestTrade_WLaWLwWLuWLqBlWLc() {
+	_, index1 := NewClientConnection_WLa(MakeDummyConn())
+	up1 := allPlayers[index1]
+	up1.CmdLogin_WLwWLuWLqBlWLc("test0")
+	_, index2 := NewClientConnection_WLa(MakeDummyConn())
+	up2 := allPlayers[index2]
+	up2.CmdLogin_WLwWLuWLqBlWLc("test1")
+	up2.Coord = up1.Coord
+	up1.Inventory.AddOneObject(ItemHealthPotionID, 3)
+	up1.Inventory.AddOneObject(ItemHealthPotionID, 3)
+	up2.Inventory.AddOneObject(ItemWeapon2ID, 7)
+
+	up1.TradeCommand_WLuRLaBl("test1")
+	DoTestCheck("DoTestTrade request", up1.trade != nil && up2.trade == nil)
+	up1.TradeOffer_RLuBl(ItemHealthPotionID, 3, 2)
+	DoTestCheck("DoTestTrade no offer before accept", len(up1.trade.offers[0]) == 0)
+	up2.TradeCommand_WLuRLaBl("test0")
+	DoTestCheck("DoTestTrade accept", up2.trade == up1.trade && up1.trade.accepted)
+	up1.TradeOffer_RLuBl(ItemHealthPotionID, 3, 3)
+	DoTestCheck("DoTestTrade can't offer more than owned", len(up1.trade.offers[0]) == 0)
+	up1.TradeOffer_RLuBl(ItemHealthPotionID, 3, 2)
+	up2.TradeOffer_RLuBl(ItemWeapon2ID, 7, 1)
+	up1.TradeConfirm_WLuBl()
+	up2.TradeOffer_RLuBl(ItemWeapon2ID, 7, 1)
+	DoTestCheck("DoTestTrade changed offer clears confirmation", !up1.trade.confirmed[0])
+	up1.TradeConfirm_WLuBl()
+	up2.TradeConfirm_WLuBl()
+	DoTestCheck("DoTestTrade session closed", up1.trade == nil && up2.trade == nil)
+	DoTestCheck("DoTestTrade items exchanged",
+		up1.Inventory.Count(ItemHealthPotionID, 3) == 0 && up1.Inventory.Count(ItemWeapon2ID, 7) == 1 &&
+			up2.Inventory.Count(ItemHealthPotionID, 3) == 2 && up2.Inventory.Count(ItemWeapon2ID, 7) == 0)
+
+	// No trade if the receiver has no room
+	def := ItemLookup(ItemHealthPotionID)
+	limit := def.StackLimit
+	def.StackLimit = 2
+	up1.Inventory.AddOneObject(ItemHealthPotionID, 3)
+	up1.TradeCommand_WLuRLaBl("test1")
+	up2.TradeCommand_WLuRLaBl("test0")
+	up1.TradeOffer_RLuBl(ItemHealthPotionID, 3, 1)
+	up1.TradeConfirm_WLuBl()
+	up2.TradeConfirm_WLuBl()
+	def.StackLimit = limit
+	DoTestCheck("DoTestTrade no room", up1.trade == nil && up1.Inventory.Count(ItemHealthPotionID, 3) == 1 && up2.Inventory.Count(ItemHealthPotionID, 3) == 2)
+
+	CmdClose_BlWLqWLuWLa(index2)
+	CmdClose_BlWLqWLuWLa(index1)
+}
+
 func DoTestChunkCompare(ch1, ch2 *chunk) bool {
 	equal := ch1.checkSum == ch2.checkSum && ch1.Coord.Equal(ch2.Coord) && ch1.flag == ch2.flag && ch1.owner == ch2.owner && len(ch1.ch_comp) == len(ch2.ch_comp)
 	if !equal {
@@ -641,6 +822,237 @@ func DoTestChunkSaveRestore() {
 	DoTestCheck("DoTestChunkSaverestore Compare ", DoTestChunkCompare(ch1, ch2))
 }
 
+// Test storage chest access, and that the content is saved with the chunk
+func DoTestChests() {
+	const kid = uint(5)
+	coord := chunkdb.CC{X: 0, Y: 0, Z: 0}
+	ch1 := dBCreateChunk(coord)
+	ch1.owner = 1
+	ch1.rc[1][2][3] = BT_Chest
+	DoTestCheck("DoTestChests no chest on other blocks", ch1.findChest(0, 0, 0, true) == nil)
+	chest := ch1.findChest(1, 2, 3, true)
+	DoTestCheck("DoTestChests created", chest != nil && len(ch1.chests) == 1 && ch1.findChest(1, 2, 3, true) == chest)
+	chest.Items.AddOneObject(ItemHealthPotionID, 2)
+	chest.Key = kid
+	DoTestCheck("DoTestChests has items", ch1.chestHasItems(1, 2, 3))
+
+	var owner, other user
+	owner.Id, other.Id = 1, 2
+	DoTestCheck("DoTestChests owner access", owner.mayOpenChest(ch1, chest))
+	DoTestCheck("DoTestChests no access without key", !other.mayOpenChest(ch1, chest))
+	other.Keys = other.Keys.Add(keys.Make(1, kid, "Chest key", 0))
+	DoTestCheck("DoTestChests access with key", other.mayOpenChest(ch1, chest))
+
+	ch1.compressAndChecksum()
+	var buf bytes.Buffer
+	DoTestCheck("DoTestChests Write ok", ch1.WriteFS(&buf))
+	ch2 := dBReadChunk(coord, &buf, int64(buf.Len()))
+	restored := ch2.findChest(1, 2, 3, false)
+	DoTestCheck("DoTestChests restored", restored != nil && restored.Key == kid && restored.Items.Count(ItemHealthPotionID, 2) == 1)
+
+	ch2.rc[1][2][3] = BT_Air
+	ch2.pruneChests()
+	DoTestCheck("DoTestChests pruned", ch2.chests == nil)
+}
+
+func DoTestItemCatalog() {
+	DoTestCheck("DoTestItemCatalog built-in", ItemLookup(ItemWeapon2ID) != nil && ItemLookup("XXXX") == nil)
+	DoTestCheck("DoTestItemCatalog by grade", ConvertArmorTypeToID(3) == ItemArmor3ID && ConvertHelmetTypeToID(0) == ItemHelmetNoneId)
+	DoTestCheck("DoTestItemCatalog weapon modifier", WeaponLevelDiffMultiplier(5, 5, 2) == 1.1 && WeaponLevelDiffMultiplier(5, 5, 0) == 0.9)
+	DoTestCheck("DoTestItemCatalog drop value", ItemValueAsDrop(5, 5, ItemHealthPotionID) == 0 && ItemValueAsDrop(5, 5, ItemWeapon1ID) == 1.5)
+	const file = `[
+		{"Code": "WEP0", "Category": "weapon", "Grade": 0, "Modifier": 0.8},
+		{"Code": "ARM0", "Category": "armor"},
+		{"Code": "HLM0", "Category": "helmet", "Modifier": 0.7},
+		{"Code": "POTX", "Category": "potion", "Use": "heal", "Amount": 0.5, "StackLimit": 2}
+	]`
+	cat, err := parseItemCatalog([]byte(file))
+	DoTestCheck("DoTestItemCatalog parse", err == nil && cat.byCode["POTX"].Amount == 0.5 && cat.byGrade[ItemCategoryWeapon][0].Modifier == 0.8)
+	_, err = parseItemCatalog([]byte(`[{"Code": "POTX", "Category": "potion", "Use": "fly"}]`))
+	DoTestCheck("DoTestItemCatalog bad use", err != nil)
+	_, err = parseItemCatalog([]byte(`[{"Code": "WEP", "Category": "weapon"}]`))
+	DoTestCheck("DoTestItemCatalog bad code", err != nil)
+
+	// Install the test catalog temporarily
+	itemCatalogSem.Lock()
+	saved := items
+	items = cat
+	itemCatalogSem.Unlock()
+	var inv PlayerInv
+	inv.AddOneObject("POTX", 1)
+	DoTestCheck("DoTestItemCatalog stack limit", inv.Room("POTX", 1, 1) && !inv.Room("POTX", 1, 2) && inv.Room("POTX", 2, 2))
+	DoTestCheck("DoTestItemCatalog removed items", ItemLookup(ItemWeapon1ID) == nil)
+	DoTestCheck("DoTestItemCatalog helmet modifier", ArmorLevelDiffMultiplier(ItemCategoryHelmet, 5, 5, 0) < ArmorLevelDiffMultiplier(ItemCategoryArmor, 5, 5, 0))
+	DoTestCheck("DoTestItemCatalog loot needs removed items", verifyLootTables(defaultLootTables, cat) != nil)
+	recipes := &craftingDefs{Recipes: []*recipeDef{{Id: "potx", Item: "POTX", Inputs: []recipeInput{{Item: "WEP0", Count: 1}}}}}
+	DoTestCheck("DoTestItemCatalog recipes", recipes.verifyItems(cat) == nil && recipes.verifyItems(saved) != nil)
+	vendor := &dialogDef{Id: "v", Stock: []vendorItem{{Code: ItemWeapon1ID, Price: 1}}}
+	giver := &dialogDef{Id: "g", Nodes: []dialogNode{{Choices: []dialogChoice{{Give: "POTX"}}}}}
+	DoTestCheck("DoTestItemCatalog dialogs", vendor.verifyItems(cat) != nil && vendor.verifyItems(saved) == nil && giver.verifyItems(cat) == nil && giver.verifyItems(saved) != nil)
+	q := &quest{Title: "q", Steps: []questStep{{Kind: QuestStepItem, Item: ItemHealthPotionID}}}
+	DoTestCheck("DoTestItemCatalog quests", q.verifyItems(cat) != nil && q.verifyItems(saved) == nil)
+	itemCatalogSem.Lock()
+	items = saved
+	itemCatalogSem.Unlock()
+}
+
+func DoTestLootTables() {
+	tables := []lootTable{
+		{Monster: "", Groups: []lootGroup{{Chance: 0.5, Entries: []lootEntry{{Item: ItemHealthPotionID, Weight: 1}}}}},
+		{Monster: "boss", MinLevel: 10, MaxLevel: 20, Groups: []lootGroup{
+			{Guaranteed: true, Entries: []lootEntry{{Item: ItemWeapon3ID, Weight: 3, LevelOffset: 2}, {Item: ItemWeapon4ID, Weight: 1, Rare: true}}},
+		}},
+	}
+	cat := currentItemCatalog()
+	DoTestCheck("DoTestLootTables verify", verifyLootTables(tables, cat) == nil && verifyLootTables(defaultLootTables, cat) == nil)
+	bad := []lootTable{{Groups: []lootGroup{{Chance: 1, Entries: []lootEntry{{Item: "XXXX", Weight: 1}}}}}}
+	DoTestCheck("DoTestLootTables unknown item", verifyLootTables(bad, cat) != nil)
+	DoTestCheck("DoTestLootTables default equipment chance", defaultLootTables[0].Groups[2].Chance > 0 && defaultLootTables[0].Groups[2].Chance == combatExperienceSameLevel)
+
+	lootTablesSem.Lock()
+	saved := lootTables
+	lootTables = tables
+	lootTablesSem.Unlock()
+	DoTestCheck("DoTestLootTables default kind", FindLootTable("rat", 15) == &tables[0])
+	DoTestCheck("DoTestLootTables specific kind", FindLootTable("boss", 15) == &tables[1])
+	DoTestCheck("DoTestLootTables outside band", FindLootTable("boss", 21) == &tables[0])
+	drops, _ := tables[1].Roll(15, 100)
+	DoTestCheck("DoTestLootTables guaranteed", len(drops) == 1 && (drops[0].Type == ItemWeapon3ID && drops[0].Level == 17 || drops[0].Type == ItemWeapon4ID && drops[0].Level == 15))
+	exp := tables[1].Expected(15, 15)
+	DoTestCheck("DoTestLootTables expected", len(exp) == 2 && exp[0].Item == ItemWeapon3ID && exp[0].Expected == 0.75 && exp[1].Expected == 0.25)
+	exp = tables[0].Expected(0, 0)
+	DoTestCheck("DoTestLootTables expected scaled", len(exp) == 1 && exp[0].Expected > 0.5) // Low level players get a bonus
+	lootTablesSem.Lock()
+	lootTables = saved
+	lootTablesSem.Unlock()
+}
+
+func DoTestMonsterSpecies() {
+	list := []*monsterSpecies{
+		{Name: "rabbit", Behavior: BehaviorPassive, MaxLevel: 5, Biomes: []string{"grassland"}},
+		{Name: "troll", Behavior: BehaviorTerritorial, MinLevel: 8, MinHeight: 10, MaxHeight: 20, Territory: 10, Weight: 2},
+	}
+	DoTestCheck("DoTestMonsterSpecies verify", verifyMonsterSpecies(list) == nil && list[0].Weight == 1 && list[0].Persistence == 100)
+	DoTestCheck("DoTestMonsterSpecies bad behavior", verifyMonsterSpecies([]*monsterSpecies{{Behavior: "lazy"}}) != nil)
+	DoTestCheck("DoTestMonsterSpecies ranged too short", verifyMonsterSpecies([]*monsterSpecies{{Behavior: BehaviorRanged, Range: 1}}) != nil)
+	DoTestCheck("DoTestMonsterSpecies level band", list[0].fits(5, 0, BT_Soil) && !list[0].fits(6, 0, BT_Soil))
+	DoTestCheck("DoTestMonsterSpecies biome", !list[0].fits(1, 0, BT_Sand) && list[0].fits(1, 0, BT_Unused))
+	DoTestCheck("DoTestMonsterSpecies height", list[1].fits(9, 15, BT_Sand) && !list[1].fits(9, 25, BT_Sand))
+
+	speciesSem.Lock()
+	saved := allSpecies
+	allSpecies = list
+	speciesSem.Unlock()
+	DoTestCheck("DoTestMonsterSpecies select", SelectMonsterSpecies(1, 0, BT_Soil) == list[0] && SelectMonsterSpecies(9, 15, BT_Stone) == list[1])
+	DoTestCheck("DoTestMonsterSpecies select fallback", SelectMonsterSpecies(6, 0, BT_Soil) == defaultMonsterSpecies[0])
+	speciesSem.Lock()
+	allSpecies = saved
+	speciesSem.Unlock()
+
+	var m monster
+	var pl player
+	m.Level = 9
+	m.setSpecies(list[1])
+	DoTestCheck("DoTestMonsterSpecies traits", m.kind == "troll" && m.persistence == 100 && m.species.attackDistance() == CnfgMeleeDistLimit)
+	m.Coord = user_coord{1e6, 1e6, 1e6}
+	target := user_coord{1e6 + 10, 1e6, 1e6}
+	DoTestCheck("DoTestMonsterSpecies line of sight", m.canSee_RLw(&target, 1) && !m.canSee_RLw(&target, 100))
+	pl.Coord = user_coord{5, 5, 0}
+	DoTestCheck("DoTestMonsterSpecies in territory", m.wantsToAttack(&pl))
+	pl.Coord = user_coord{15, 0, 0}
+	DoTestCheck("DoTestMonsterSpecies outside territory", !m.wantsToAttack(&pl))
+	m.setSpecies(list[0])
+	DoTestCheck("DoTestMonsterSpecies passive", !m.wantsToAttack(&pl))
+}
+
+func DoTestMonsterPath() {
+	DoTestCheck("DoTestMonsterPath coordinate", coordToPoint(&user_coord{-0.5, 1.2, 3}) == pathfind.Point{X: -1, Y: 1, Z: 3})
+	var m monster
+	m.Coord = user_coord{0.5, 0.5, 0}
+	m.path = []pathfind.Point{{X: 1, Y: 0, Z: 0}, {X: 2, Y: 0, Z: 0}}
+	m.steerAlongPath(0)
+	DoTestCheck("DoTestMonsterPath first waypoint", len(m.path) == 2 && m.dirHor == math.Pi/2)
+	m.Coord = user_coord{1.4, 0.5, 0}
+	m.steerAlongPath(0.2)
+	DoTestCheck("DoTestMonsterPath waypoint reached", len(m.path) == 1 && m.path[0].X == 2)
+	m.path = []pathfind.Point{{X: 2, Y: 0, Z: 1}}
+	m.Coord = user_coord{2.5, 0.5, 0}
+	m.steerAlongPath(0)
+	DoTestCheck("DoTestMonsterPath waypoint above", len(m.path) == 1)
+	m.Coord.Z = 1
+	m.steerAlongPath(0)
+	DoTestCheck("DoTestMonsterPath end of path", m.path == nil)
+	_, loaded := DBGetBlockIfLoaded_RLw(user_coord{1e6, 1e6, 1e6})
+	DoTestCheck("DoTestMonsterPath unloaded chunk", !loaded && !(monsterWorld{}).Passable(pathfind.Point{X: 1e6, Y: 1e6, Z: 1e6}))
+}
+
+func DoTestBosses() {
+	list := []*bossDef{{Id: "b", Enrage: 60, Phases: []bossPhase{
+		{HitPoints: 0.3, Damage: 2, Summon: "x", SummonCount: 2},
+		{HitPoints: 0.6, AreaDamage: 0.1, AreaRadius: 5, AreaPeriod: 2},
+	}}}
+	DoTestCheck("DoTestBosses verify", verifyBosses(list) == nil && list[0].Name == "b" && list[0].Toughness == 1)
+	DoTestCheck("DoTestBosses phases", len(list[0].Phases) == 3 && list[0].Phases[0].HitPoints == 1 && list[0].Phases[2].HitPoints == 0.3)
+	DoTestCheck("DoTestBosses duplicate", verifyBosses([]*bossDef{{Id: "a"}, {Id: "a"}}) != nil)
+	DoTestCheck("DoTestBosses area radius", verifyBosses([]*bossDef{{Id: "a", Phases: []bossPhase{{AreaDamage: 1}}}}) != nil)
+
+	var m monster
+	m.species = defaultMonsterSpecies[0]
+	m.boss = &bossState{def: list[0]}
+	now := time.Now()
+	newPhase, enraged := m.boss.advance(1, now)
+	DoTestCheck("DoTestBosses start", newPhase && !enraged && m.boss.phase == 0 && m.damage() == 1)
+	newPhase, _ = m.boss.advance(0.9, now)
+	DoTestCheck("DoTestBosses same phase", !newPhase)
+	newPhase, _ = m.boss.advance(0.2, now.Add(1e9))
+	DoTestCheck("DoTestBosses skip phase", newPhase && m.boss.phase == 2 && m.damage() == 2)
+	_, enraged = m.boss.advance(0.2, now.Add(61e9))
+	DoTestCheck("DoTestBosses enrage", enraged && m.damage() == 4)
+	m.boss.reset()
+	DoTestCheck("DoTestBosses reset", m.boss.phase == 0 && !m.boss.enraged && m.boss.started.IsZero())
+}
+
+func DoTestSpawners() {
+	_, msg := parseSpawnerArgs([]string{"3", "2", "30", "10", "1"})
+	DoTestCheck("DoTestSpawners parse", msg == "")
+	_, msg = parseSpawnerArgs([]string{"3", "2", "1", "10", "1"})
+	DoTestCheck("DoTestSpawners interval too short", msg != "")
+	_, msg = parseSpawnerArgs([]string{"3", "2", "30", "10", "9"})
+	DoTestCheck("DoTestSpawners level offset", msg != "")
+	_, msg = parseSpawnerArgs([]string{"3", "2", "30", "10", "0", "no", "such"})
+	DoTestCheck("DoTestSpawners species", msg != "")
+
+	sp := monsterSpawner{Cap: 3, Wave: 2, Interval: 30}
+	var rt spawnerRuntime
+	now := time.Now()
+	DoTestCheck("DoTestSpawners first wave", rt.due(now, &sp) == 2)
+	DoTestCheck("DoTestSpawners wait for interval", rt.due(now.Add(29e9), &sp) == 0)
+	rt.monsters = []*monster{{}, {}}
+	DoTestCheck("DoTestSpawners cap", rt.due(now.Add(30e9), &sp) == 1)
+	rt.monsters[0].dead = true
+	rt.prune()
+	DoTestCheck("DoTestSpawners prune", len(rt.monsters) == 1)
+	DoTestCheck("DoTestSpawners keep monsters", !rt.idle(now.Add(60e9)))
+	rt.monsters[0].purge = true
+	rt.prune()
+	DoTestCheck("DoTestSpawners keep interval", !rt.idle(now.Add(29e9)) && rt.idle(now.Add(60e9)))
+
+	coord := chunkdb.CC{X: 0, Y: 0, Z: 0}
+	ch1 := dBCreateChunk(coord)
+	ch1.rc[4][5][6] = BT_Spawn
+	sp.X, sp.Y, sp.Z = 4, 5, 6
+	ch1.spawners = append(ch1.spawners, sp)
+	ch1.compressAndChecksum()
+	var buf bytes.Buffer
+	DoTestCheck("DoTestSpawners Write ok", ch1.WriteFS(&buf))
+	ch2 := dBReadChunk(coord, &buf, int64(buf.Len()))
+	restored := ch2.findSpawner(4, 5, 6)
+	DoTestCheck("DoTestSpawners restored", restored != nil && restored.Cap == 3 && restored.Interval == 30)
+	ch2.rc[4][5][6] = BT_Air
+	ch2.pruneSpawners()
+	DoTestCheck("DoTestSpawners pruned", ch2.spawners == nil)
+}
+
 func DoTestKeyRing() {
 	var keyRing keys.KeyRing
 	const (
@@ -683,3 +1095,603 @@ func DoTestJellyBlocks() {
 	DoTestCheck("DoTestJellyBlocks jelly 1 still reverted", ch.rc[0][0][0] == BT_Stone)
 	DoTestCheck("DoTestJellyBlocks jelly 2 also reverted", ch.rc[0][0][1] == BT_Stone)
 }
+
+func DoTestRanged() {
+	bow := ItemLookup(ItemBow1ID)
+	DoTestCheck("DoTestRanged built-in", bow != nil && bow.Category == ItemCategoryRanged && bow.Range > CnfgMeleeDistLimit)
+	_, err := parseItemCatalog([]byte(`[{"Code": "BOWX", "Category": "ranged", "Range": 2, "Speed": 10}]`))
+	DoTestCheck("DoTestRanged melee range", err != nil)
+	_, err = parseItemCatalog([]byte(`[{"Code": "BOWX", "Category": "ranged", "Range": 10}]`))
+	DoTestCheck("DoTestRanged no speed", err != nil)
+
+	var m monster
+	m.Coord = user_coord{10, 10, 5}
+	m.size = 2
+	DoTestCheck("DoTestRanged aim", m.aimPoint() == user_coord{10, 10, 6})
+	DoTestCheck("DoTestRanged hit", m.hitBy(&user_coord{10.5, 10, 6}) && m.hitBy(&user_coord{10, 10, 7}))
+	DoTestCheck("DoTestRanged miss", !m.hitBy(&user_coord{11, 10, 6}) && !m.hitBy(&user_coord{10, 10, 7.5}) && !m.hitBy(&user_coord{10, 10, 4.9}))
+}
+
+func DoTestAbilities() {
+	_, err := makeAbilities(defaultAbilities)
+	DoTestCheck("DoTestAbilities built-in", err == nil && FindAbility(client_prot.UserActionHeal) != nil)
+	_, err = makeAbilities([]abilityDef{{Id: 7, Name: "x", Target: AbilityTargetSelf, Effect: AbilityEffectDamage, Amount: 1}})
+	DoTestCheck("DoTestAbilities wrong target", err != nil)
+	_, err = makeAbilities([]abilityDef{{Id: 7, Name: "x", Target: AbilityTargetSelf, Effect: AbilityEffectBuff, Amount: 1.2}})
+	DoTestCheck("DoTestAbilities no duration", err != nil)
+	_, err = makeAbilities([]abilityDef{{Id: 7, Name: "x", Target: AbilityTargetSelf, Effect: AbilityEffectTeleport}, {Id: 7, Name: "y", Target: AbilityTargetSelf, Effect: AbilityEffectTeleport}})
+	DoTestCheck("DoTestAbilities duplicate", err != nil)
+
+	var up user
+	up.Level = 5
+	DoTestCheck("DoTestAbilities learn", up.learnAbilities_WLu() && up.knowsAbility(client_prot.UserActionCombAttack) && !up.learnAbilities_WLu())
+	now := time.Now()
+	up.cooldowns = map[uint8]time.Time{client_prot.UserActionHeal: now.Add(2 * time.Second)}
+	DoTestCheck("DoTestAbilities cooldown", up.abilityCooldown(client_prot.UserActionHeal, now) == 2*time.Second && up.abilityCooldown(client_prot.UserActionCombAttack, now) == 0)
+	b := abilitiesMessage(up.Abilities, func(id uint8) time.Duration { return up.abilityCooldown(id, now) })
+	cd, _, _ := ParseUint32(b[4:8])
+	DoTestCheck("DoTestAbilities message", len(b) == 3+5*len(up.Abilities) && b[2] == client_prot.CMD_ABILITIES && b[3] == 0 && cd == 2000 && b[8] == 1)
+	m, err := makeAbilities([]abilityDef{{Id: 7, Name: "x", Target: AbilityTargetMonster, Effect: AbilityEffectDebuff, Amount: 0.5, Duration: 3, Status: "slow"}})
+	DoTestCheck("DoTestAbilities debuff status", err == nil && m[7].status == EffectSlow)
+	_, err = makeAbilities([]abilityDef{{Id: 7, Name: "x", Target: AbilityTargetMonster, Effect: AbilityEffectDebuff, Amount: 0.5, Duration: 3, Status: "shield"}})
+	DoTestCheck("DoTestAbilities debuff on monster", err != nil)
+}
+
+func DoTestStatusEffects() {
+	now := time.Now()
+	var list statusEffects
+	list.apply(EffectPoison, 0.01, 10*time.Second, 7, now)
+	list.apply(EffectPoison, 0.02, 5*time.Second, 7, now)
+	DoTestCheck("DoTestStatusEffects stack", len(list) == 1 && list[0].stacks == 2 && list.amount(EffectPoison, now) == 0.04 && list[0].end == now.Add(10*time.Second))
+	for i := 0; i < 10; i++ {
+		list.apply(EffectPoison, 0.01, time.Second, 7, now)
+	}
+	DoTestCheck("DoTestStatusEffects max stacks", list[0].stacks == effectKinds[EffectPoison].MaxStacks)
+	list.apply(EffectSlow, 0.5, time.Hour, 0, now)
+	DoTestCheck("DoTestStatusEffects max duration", list[1].end == now.Add(CnfgEffectMaxDuration) && list.speedFactor(now) == 0.5)
+	list.apply(EffectStun, 1, time.Second, 0, now)
+	DoTestCheck("DoTestStatusEffects stun", list.speedFactor(now) == 0 && list.speedFactor(now.Add(2*time.Second)) == 0.5)
+	DoTestCheck("DoTestStatusEffects expire", list.expire(now.Add(20*time.Second)) && len(list) == 1 && !list.expire(now.Add(20*time.Second)))
+
+	list = nil
+	list.apply(EffectShield, 0.3, time.Minute, 0, now)
+	DoTestCheck("DoTestStatusEffects absorb", list.absorb(0.2, now) == 0 && list.amount(EffectShield, now) > 0.09)
+	rest := list.absorb(0.2, now)
+	DoTestCheck("DoTestStatusEffects shield depleted", rest > 0.09 && rest < 0.11 && !list.has(EffectShield, now))
+	list.apply(EffectStrength, 1.5, time.Minute, 0, now)
+	DoTestCheck("DoTestStatusEffects damage", list.damageDone(now) == 1.5 && list.damageTaken(now) == 1)
+
+	b := statusEffectsMessage(42, list, now)
+	id, _, _ := ParseUint32(b[3:7])
+	DoTestCheck("DoTestStatusEffects message", len(b) == 13 && b[2] == client_prot.CMD_STATUS_EFFECTS && id == 42 && b[7] == EffectStrength && b[8] == 1)
+
+	kind, amount, duration, err := parseEffectModifier("slow,0.4,3")
+	DoTestCheck("DoTestStatusEffects modifier", err == nil && kind == EffectSlow && amount == 0.4 && duration == 3*time.Second)
+	_, _, _, err = parseEffectModifier("fly,1,3")
+	DoTestCheck("DoTestStatusEffects bad modifier", err != nil)
+	_, err = parseItemCatalog([]byte(`[{"Code": "POTX", "Category": "potion", "Use": "effect", "Effect": "fly", "Amount": 1, "Duration": 3}]`))
+	DoTestCheck("DoTestStatusEffects bad potion", err != nil)
+	DoTestCheck("DoTestStatusEffects potion", ItemLookup(ItemRegenPotionID) != nil && ItemLookup(ItemRegenPotionID).Use == ItemUseEffect)
+}
+
+func DoTestPvP() {
+	DoTestCheck("DoTestPvP mode", pvpMode(true, false, false) == PvPDuel && pvpMode(false, true, true) == PvPArena && pvpMode(false, true, false) == PvPNotAllowed)
+	var a, d player
+	a.Level, d.Level = 5, 5
+	same := pvpDamage(&a, &d, 1)
+	d.ArmorGrade, d.ArmorLvl = 3, 5
+	armored := pvpDamage(&a, &d, 1)
+	a.Level = 8
+	higher := pvpDamage(&a, &d, 1)
+	DoTestCheck("DoTestPvP damage", same > 0 && same < 1 && armored < same && higher > armored)
+	b := pvpHitMessage(1, 2, 1)
+	uid, _, _ := ParseUint32(b[7:11])
+	DoTestCheck("DoTestPvP message", len(b) == 12 && b[2] == client_prot.CMD_PVP_HIT && uid == 2 && b[11] == 255)
+
+	var up1, up2 user
+	ds := &duelSession{players: [2]*user{&up1, &up2}}
+	up1.duel, up2.duel = ds, ds
+	up1.pvpTarget, up2.pvpTarget = &up2, &up1
+	DoTestCheck("DoTestPvP opponent", ds.opponent(&up1) == &up2 && ds.opponent(&up2) == &up1)
+	DoTestCheck("DoTestPvP end", ds.end(&up2, "test") && !ds.end(&up1, "test"))
+	DoTestCheck("DoTestPvP result", up1.DuelLosses == 1 && up2.DuelWins == 1 && up1.duel == nil && up2.pvpTarget == nil)
+}
+
+func DoTestQuests() {
+	_, err := parseQuestModifier(1, "1:fly", "")
+	DoTestCheck("DoTestQuests bad step", err != nil)
+	_, err = parseQuestModifier(1, "x:talk", "")
+	DoTestCheck("DoTestQuests bad id", err != nil)
+	q, err := parseQuestModifier(7, "3:talk,kill2x4,item2xPOTH,reach:exp9,key5x1", "The test")
+	DoTestCheck("DoTestQuests parse", err == nil && q.Owner == 7 && q.Id == 3 && q.Title == "The test" && len(q.Steps) == 4 && len(q.Rewards) == 2)
+	DoTestCheck("DoTestQuests steps", q.Steps[1].Kind == QuestStepKill && q.Steps[1].Count == 2 && q.Steps[1].Level == 4 && q.Steps[2].Item == ItemHealthPotionID)
+	DoTestCheck("DoTestQuests exp limit", q.Rewards[0].Exp == CnfgQuestMaxExp && q.Rewards[1].Key == 5 && q.Rewards[1].View == 1)
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Id = OWNER_TEST // The quest giver doesn't pay the rewards of the test player
+	up.StartQuest_WLuBl(q)
+	up.StartQuest_WLuBl(q)
+	DoTestCheck("DoTestQuests start once", len(up.Quests) == 1 && up.Quests.active() == 1)
+	up.QuestReach_WLuBl(7)
+	up.QuestTalk_WLuBl(8, 3)
+	DoTestCheck("DoTestQuests wrong step", up.Quests[0].Step == 0)
+	up.QuestTalk_WLuBl(7, 3)
+	up.QuestKill_WLuBl(3)
+	up.QuestKill_WLuBl(4)
+	DoTestCheck("DoTestQuests kill progress", up.Quests[0].Step == 1 && up.Quests[0].Count == 1)
+	up.QuestKill_WLuBl(5)
+	up.Inventory.AddOneObject(ItemHealthPotionID, 1)
+	up.ManageQuests_WLuBl()
+	DoTestCheck("DoTestQuests collect missing", up.Quests[0].Step == 2)
+	up.Inventory.AddOneObject(ItemHealthPotionID, 2)
+	up.Inventory.AddOneObject(ItemHealthPotionID, 2)
+	up.ManageQuests_WLuBl()
+	DoTestCheck("DoTestQuests collect", up.Quests[0].Step == 3 && up.Inventory.countAll(ItemHealthPotionID) == 1)
+	up.QuestReach_WLuBl(7)
+	DoTestCheck("DoTestQuests done", up.Quests[0].Done && up.Quests.active() == 0)
+	DoTestCheck("DoTestQuests rewards", up.Exp == CnfgQuestMaxExp && up.Keys.Test(7, 5))
+	up.StartQuest_WLuBl(q)
+	DoTestCheck("DoTestQuests not again", len(up.Quests) == 1 && up.Quests[0].Done)
+}
+
+func DoTestActivatorScripts() {
+	DoTestCheck("DoTestActivatorScripts detect", isActivatorScript([]string{"/script", "say 1"}) && !isActivatorScript([]string{"/level>3 Hello"}))
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Level = 4
+	up.Id = 3
+	src := []string{
+		"/script",
+		"set p.visits = p.visits + 1",
+		"set a.total = a.total + 1",
+		"if level() > 3 && p.visits > 1",
+		"	inhibit 2",
+		"end",
+	}
+	var ac user_coord
+	inhibit, vars := up.RunActivatorScript_WLuWLqWLmWLc(src, &ac, 7, nil)
+	DoTestCheck("DoTestActivatorScripts first", inhibit == -1 && vars["total"] == 1 && up.Vars["7:visits"] == 1)
+	inhibit, vars = up.RunActivatorScript_WLuWLqWLmWLc(src, &ac, 7, vars)
+	DoTestCheck("DoTestActivatorScripts second", inhibit == 2 && vars["total"] == 2 && up.Vars["7:visits"] == 2)
+	up.RunActivatorScript_WLuWLqWLmWLc(src, &ac, 8, nil)
+	DoTestCheck("DoTestActivatorScripts owners", up.Vars["7:visits"] == 2 && up.Vars["8:visits"] == 1)
+	_, vars = up.RunActivatorScript_WLuWLqWLmWLc([]string{"/script", "say \"hi\"", "if quest(1) == 0", "inhibit 5", "end"}, &ac, 7, nil)
+	DoTestCheck("DoTestActivatorScripts no change", vars == nil)
+	inhibit, _ = up.RunActivatorScript_WLuWLqWLmWLc([]string{"/script", "while 1", "end", "inhibit 5"}, &ac, 7, nil)
+	DoTestCheck("DoTestActivatorScripts budget", inhibit == -1)
+	_, vars = up.RunActivatorScript_WLuWLqWLmWLc([]string{"/script", "while a.n < 20", "set a.n = a.n + 1", "inhibit 7", "end"}, &ac, 7, nil)
+	DoTestCheck("DoTestActivatorScripts max actions", vars["n"] == CnfgScriptMaxActions+1)
+	for i := 0; i < CnfgScriptMaxVars; i++ {
+		up.Vars[fmt.Sprintf("9:v%d", i)] = 1
+	}
+	up.RunActivatorScript_WLuWLqWLmWLc([]string{"/script", "set p.more = 1"}, &ac, 9, nil)
+	up.RunActivatorScript_WLuWLqWLmWLc([]string{"/script", "set p.more = 1"}, &ac, 7, nil)
+	DoTestCheck("DoTestActivatorScripts max vars per owner", up.Vars["7:more"] == 1 && up.Vars["9:more"] == 0)
+}
+
+func DoTestLogic() {
+	var g logicGate
+	DoTestCheck("DoTestLogic and", !g.tick(BT_And, []bool{true, false}) && !g.Out && !g.tick(BT_And, []bool{true, true}) && g.Out)
+	g = logicGate{}
+	g.tick(BT_Not, []bool{false})
+	DoTestCheck("DoTestLogic not", g.Out)
+	g = logicGate{Param: 2}
+	g.tick(BT_Delay, []bool{true})
+	out1 := g.Out
+	g.tick(BT_Delay, []bool{false})
+	DoTestCheck("DoTestLogic delay", !out1 && g.Out)
+	g = logicGate{Param: 2}
+	save1 := g.tick(BT_Counter, []bool{true})
+	g.tick(BT_Counter, []bool{false})
+	save2 := g.tick(BT_Counter, []bool{true})
+	DoTestCheck("DoTestLogic counter", save1 && save2 && g.Out && g.Count == 0)
+	g = logicGate{Param: 2}
+	g.tick(BT_Pulse, []bool{true})
+	out1 = g.Out
+	g.tick(BT_Pulse, []bool{true})
+	out2 := g.Out
+	g.tick(BT_Pulse, []bool{true})
+	DoTestCheck("DoTestLogic pulse", out1 && out2 && !g.Out)
+	g = logicGate{}
+	DoTestCheck("DoTestLogic latch", g.tick(BT_Latch, []bool{true}) && g.Out && !g.tick(BT_Latch, []bool{true}) && !g.tick(BT_Latch, []bool{false}) && g.tick(BT_Latch, []bool{true}) && !g.Out)
+
+	// A trigger connected to an and gate, with the output to a text activator. Another trigger
+	// is connected to a text activator in the neighbor chunk.
+	a := &chunk{Coord: chunkdb.CC{X: 1000, Y: 1000, Z: 3}, rc: new(raw_chunk)}
+	b := &chunk{Coord: chunkdb.CC{X: 1001, Y: 1000, Z: 3}, rc: new(raw_chunk)}
+	a.rc[1][1][1] = BT_Trigger
+	a.rc[2][1][1] = BT_Link
+	a.rc[3][1][1] = BT_And
+	a.rc[3][1][2] = BT_Link
+	a.rc[3][1][3] = BT_Text
+	a.rc[CHUNK_SIZE-1][5][5] = BT_Trigger
+	b.rc[0][5][5] = BT_Link
+	b.rc[1][5][5] = BT_Text
+	a.ComputeLinks()
+	b.ComputeLinks()
+	DoTestCheck("DoTestLogic gates", len(a.gates) == 1 && len(a.logic.gateIn[0]) == 1 && a.logic.gateOut[0] >= 0 && len(a.logic.nets) == 3)
+	DoTestCheck("DoTestLogic ports", len(b.logic.nets) == 1 && len(b.logic.nets[0].ports) == 1 && b.gates == nil)
+
+	a.pulseLogic(1, 1, 1)
+	a.pulseLogic(CHUNK_SIZE-1, 5, 5)
+	snaps := []*logicSnap{a.snapLogic(), b.snapLogic()}
+	solveLogic(snaps)
+	border := a.logic.members[abKey(CHUNK_SIZE-1, 5, 5)]
+	DoTestCheck("DoTestLogic joined", snaps[0].level[border] && snaps[1].level[0] && snaps[1].activate[0] && !snaps[0].activate[border])
+	out := a.logic.gateOut[0]
+	DoTestCheck("DoTestLogic gate delay", !snaps[0].level[out])
+	a.gates[0].tick(BT_And, []bool{snaps[0].level[a.logic.gateIn[0][0]]})
+	snaps = []*logicSnap{a.snapLogic(), b.snapLogic()}
+	solveLogic(snaps)
+	DoTestCheck("DoTestLogic gate output", snaps[0].level[out] && snaps[0].activate[out] && !snaps[1].level[0])
+
+	// Nets in chunks of different owners are not joined
+	b.owner = 17
+	a.pulseLogic(CHUNK_SIZE-1, 5, 5)
+	snaps = []*logicSnap{a.snapLogic(), b.snapLogic()}
+	solveLogic(snaps)
+	DoTestCheck("DoTestLogic different owners", snaps[0].level[border] && !snaps[1].level[0])
+
+	// A chunk released from the cache is removed from the logic process
+	worldCacheLock.Lock()
+	AddChunkToHashTable(b)
+	RemoveChunkFromHashTable(b)
+	worldCacheLock.Unlock()
+	logicChunksMutex.Lock()
+	_, found := logicChunks[b.Coord]
+	logicChunksMutex.Unlock()
+	DoTestCheck("DoTestLogic released", !found)
+
+	// Remove the test chunks from the logic process
+	a.logic, b.logic = nil, nil
+	registerLogicChunk(a)
+	registerLogicChunk(b)
+}
+
+func DoTestDoors() {
+	ch := &chunk{Coord: chunkdb.CC{X: 1000, Y: 1002, Z: 3}, rc: new(raw_chunk)}
+	ch.rc[1][1][1] = BT_LeverOn
+	ch.rc[2][1][1] = BT_Link
+	ch.rc[3][1][1] = BT_Door
+	ch.rc[5][5][5] = BT_Plate
+	ch.rc[6][5][5] = BT_Text
+	ch.doorLocks = []doorLock{{X: 3, Y: 1, Z: 1, Key: 4}, {X: 4, Y: 1, Z: 1, Key: 4}, {X: 3, Y: 1, Z: 1}}
+	ch.pruneDoorLocks()
+	DoTestCheck("DoTestDoors prune", len(ch.doorLocks) == 1 && ch.findDoorLock(3, 1, 1) != nil && ch.findDoorLock(4, 1, 1) == nil)
+
+	ch.ComputeLinks()
+	lever := ch.logic.members[abKey(1, 1, 1)]
+	plate := ch.logic.members[abKey(5, 5, 5)]
+	DoTestCheck("DoTestDoors nets", len(ch.logic.nets) == 2 && len(ch.logic.nets[lever].doors) == 1 && len(ch.logic.nets[plate].sinks) == 1)
+	DoTestCheck("DoTestDoors plates", len(ch.logic.plates) == 1 && ch.logic.plates[0] == abKey(5, 5, 5))
+	s := ch.snapLogic()
+	DoTestCheck("DoTestDoors lever drives", s.driven[lever] && s.gateDriven[lever] && !s.driven[plate])
+
+	// The level of the nets shall survive a change of the chunk
+	ch.logic.nets[lever].prev = true
+	ch.rc[3][1][1] = BT_DoorOpen
+	ch.ComputeLinks()
+	DoTestCheck("DoTestDoors keep level", ch.logic.nets[ch.logic.members[abKey(1, 1, 1)]].prev)
+	ch.rc[1][1][1] = BT_Lever
+	ch.ComputeLinks()
+	DoTestCheck("DoTestDoors lever off", len(ch.logic.levers) == 0)
+
+	// A lever in the territory of someone else shall not open a door that requires a key
+	ch.owner = 1
+	ch.rc[3][1][1] = BT_Door
+	ch.rc[CHUNK_SIZE-1][1][1] = BT_Link
+	other := &chunk{Coord: chunkdb.CC{X: 1001, Y: 1002, Z: 3}, rc: new(raw_chunk), owner: 2}
+	other.rc[0][1][1] = BT_LeverOn
+	other.ComputeLinks()
+	for i := 4; i < CHUNK_SIZE-1; i++ {
+		ch.rc[i][1][1] = BT_Link
+	}
+	ch.ComputeLinks()
+	snaps := []*logicSnap{ch.snapLogic(), other.snapLogic()}
+	solveLogic(snaps)
+	door := ch.logic.members[abKey(3, 1, 1)]
+	DoTestCheck("DoTestDoors foreign lever", len(ch.logic.nets[door].ports) == 1 && !snaps[0].level[door])
+	DoTestCheck("DoTestDoors locked", ch.logicMayUseDoor(3, 1, 1, 1) && !ch.logicMayUseDoor(3, 1, 1, 2))
+	ch.doorLocks = nil
+	DoTestCheck("DoTestDoors not locked", ch.logicMayUseDoor(3, 1, 1, 2))
+
+	// Remove the test chunks from the logic process
+	ch.logic, other.logic = nil, nil
+	registerLogicChunk(ch)
+	registerLogicChunk(other)
+}
+
+func DoTestNPCs() {
+	bad := []*dialogDef{{Id: "a", Nodes: []dialogNode{{Id: "start", Choices: []dialogChoice{{Text: "x", Next: "none"}}}}}}
+	DoTestCheck("DoTestNPCs unknown node", verifyDialogs(bad) != nil)
+	bad = []*dialogDef{{Id: "a", Nodes: []dialogNode{{Id: "start", Choices: []dialogChoice{{Text: "x", Quest: "1:fly"}}}}}}
+	DoTestCheck("DoTestNPCs bad quest", verifyDialogs(bad) != nil)
+	DoTestCheck("DoTestNPCs no nodes", verifyDialogs([]*dialogDef{{Id: "a"}}) != nil)
+	def := &dialogDef{Id: "doTestNPCs", Nodes: []dialogNode{
+		{Id: "start", Text: "Hello", Choices: []dialogChoice{
+			{Text: "Quest", Next: "bye", Quest: "4:talk", QuestTitle: "Test"},
+			{Text: "Secret", MinLevel: 5},
+			{Text: "Key", Key: 3},
+		}},
+		{Id: "bye", Text: "Bye"},
+	}}
+	DoTestCheck("DoTestNPCs verify", verifyDialogs([]*dialogDef{def}) == nil && def.Name == def.Id)
+
+	b := dialogMessage(9, "Hi", []*dialogChoice{&def.Nodes[0].Choices[0]})
+	id, _, _ := ParseUint32(b[3:7])
+	DoTestCheck("DoTestNPCs message", len(b) == 17 && b[2] == client_prot.CMD_NPC_DIALOG && id == 9 && b[7] == 1 && b[8] == 2 && string(b[9:11]) == "Hi" && b[11] == 5)
+
+	dialogSem.Lock()
+	prev := dialogs
+	dialogs = map[string]*dialogDef{def.Id: def}
+	dialogSem.Unlock()
+
+	ch := &chunk{Coord: chunkdb.CC{X: 1000, Y: 1004, Z: 3}, rc: new(raw_chunk), owner: 6}
+	ch.npcs = []npcPlacement{{X: 1, Y: 2, Z: 3, Dialog: def.Id}}
+	list := registerNPCs(ch)
+	DoTestCheck("DoTestNPCs register", len(list) == 1 && findNPC(list[0].id) == list[0] && list[0].owner == 6 && list[0].model() == 0)
+	n := list[0]
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Level = 1
+	up.Coord = n.coord
+	up.TalkNPC_RLuBl(n.id)
+	DoTestCheck("DoTestNPCs talk", up.npcDialog.npc == n && len(up.npcDialog.choices) == 1)
+	up.AnswerNPC_WLuBl(n.id, 1)
+	DoTestCheck("DoTestNPCs bad answer", up.npcDialog.npc == n && len(up.Quests) == 0)
+	up.AnswerNPC_WLuBl(n.id, 0)
+	DoTestCheck("DoTestNPCs answer", up.npcDialog.node == &def.Nodes[1] && len(up.Quests) == 1 && up.Quests[0].Owner == 6)
+	up.Keys = up.Keys.Add(keys.Make(6, 3, "Test", 0))
+	up.TalkNPC_RLuBl(n.id)
+	DoTestCheck("DoTestNPCs key", len(up.npcDialog.choices) == 2)
+	up.Coord.X += CnfgNPCTalkDistance + 1
+	up.npcDialog = npcDialogState{}
+	up.TalkNPC_RLuBl(n.id)
+	DoTestCheck("DoTestNPCs too far", up.npcDialog.npc == nil)
+
+	ch.npcs = nil
+	registerNPCs(ch)
+	DoTestCheck("DoTestNPCs unregister", findNPC(n.id) == nil)
+	dialogSem.Lock()
+	dialogs = prev
+	dialogSem.Unlock()
+	DoTestCheck("DoTestNPCs data file", FindDialog("healer") != nil)
+}
+
+func DoTestVendors() {
+	bad := []*dialogDef{{Id: "a", Stock: []vendorItem{{Code: "none", Price: 1}}, Nodes: []dialogNode{{Id: "start"}}}}
+	DoTestCheck("DoTestVendors unknown item", verifyDialogs(bad) != nil)
+	bad = []*dialogDef{{Id: "a", Stock: []vendorItem{{Code: ItemWeapon1ID}}, Nodes: []dialogNode{{Id: "start"}}}}
+	DoTestCheck("DoTestVendors no price", verifyDialogs(bad) != nil)
+	bad = []*dialogDef{{Id: "a", Nodes: []dialogNode{{Id: "start", Choices: []dialogChoice{{Text: "x", Trade: true}}}}}}
+	DoTestCheck("DoTestVendors trade without stock", verifyDialogs(bad) != nil)
+	def := &dialogDef{Id: "doTestVendors", Stock: []vendorItem{{Code: ItemWeapon1ID, Price: 20}}, Nodes: []dialogNode{
+		{Id: "start", Choices: []dialogChoice{{Text: "Trade", Trade: true}}},
+	}}
+	DoTestCheck("DoTestVendors verify", verifyDialogs([]*dialogDef{def}) == nil && def.BuyBack == CnfgVendorBuyBack)
+	DoTestCheck("DoTestVendors sell price", def.sellPrice(ItemWeapon1ID, 1, 1) == uint32(20*CnfgVendorBuyBack) && def.sellPrice(ItemArmor1ID, 1, 1) > 0)
+
+	b := stockMessage(9, def, 7)
+	id, _, _ := ParseUint32(b[3:7])
+	lvl, _, _ := ParseUint32(b[12:16])
+	price, _, _ := ParseUint32(b[16:20])
+	DoTestCheck("DoTestVendors message", len(b) == 20 && b[2] == client_prot.CMD_VENDOR_STOCK && id == 9 && b[7] == 1 && string(b[8:12]) == ItemWeapon1ID && lvl == 7 && price == 20)
+
+	r, err := parseQuestReward("gold100000")
+	DoTestCheck("DoTestVendors quest reward", err == nil && r.Kind == QuestRewardGold && r.Gold == CnfgQuestMaxGold)
+	DoTestCheck("DoTestVendors kill", goldForKill(0) == 1 && goldForKill(10) > goldForKill(1))
+
+	dialogSem.Lock()
+	prev := dialogs
+	dialogs = map[string]*dialogDef{def.Id: def}
+	dialogSem.Unlock()
+
+	ch := &chunk{Coord: chunkdb.CC{X: 1000, Y: 1008, Z: 3}, rc: new(raw_chunk), owner: 6}
+	ch.npcs = []npcPlacement{{X: 1, Y: 2, Z: 3, Dialog: def.Id}}
+	n := registerNPCs(ch)[0]
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Level = 1
+	up.Coord = n.coord
+	DoTestCheck("DoTestVendors no gold", !up.changeGold(-1) && up.Gold == 0)
+	up.BuyItem_WLuBl(n.id, ItemWeapon1ID, 2)
+	DoTestCheck("DoTestVendors can't afford", up.Inventory.Count(ItemWeapon1ID, 1) == 0)
+	up.AddGold_WLu(50, "test")
+	up.BuyItem_WLuBl(n.id, ItemWeapon1ID, 2)
+	DoTestCheck("DoTestVendors buy", up.Inventory.Count(ItemWeapon1ID, 1) == 2 && up.Gold == 10)
+	up.SellItem_WLuBl(ItemWeapon1ID, 1, 3)
+	DoTestCheck("DoTestVendors sell too many", up.Inventory.Count(ItemWeapon1ID, 1) == 2 && up.Gold == 10)
+	up.SellItem_WLuBl(ItemWeapon1ID, 1, 1)
+	DoTestCheck("DoTestVendors sell", up.Inventory.Count(ItemWeapon1ID, 1) == 1 && up.Gold == 10+uint32(20*CnfgVendorBuyBack))
+	up.Coord.X += CnfgNPCTalkDistance + 1
+	up.SellItem_WLuBl(ItemWeapon1ID, 1, 1)
+	DoTestCheck("DoTestVendors too far", up.Inventory.Count(ItemWeapon1ID, 1) == 1)
+	up.DropItem_WLuBl(ItemWeapon1ID, 1)
+	DoTestCheck("DoTestVendors drop without vendor", up.Inventory.Count(ItemWeapon1ID, 1) == 0 && up.Gold == 10+uint32(20*CnfgVendorBuyBack))
+	up.Coord = n.coord
+	up.Inventory.AddOneObject(ItemWeapon1ID, 1)
+	up.DropItem_WLuBl(ItemWeapon1ID, 1)
+	DoTestCheck("DoTestVendors drop to vendor", up.Inventory.Count(ItemWeapon1ID, 1) == 0 && up.Gold == 10+2*uint32(20*CnfgVendorBuyBack))
+
+	ch.npcs = nil
+	registerNPCs(ch)
+	dialogSem.Lock()
+	dialogs = prev
+	dialogSem.Unlock()
+	DoTestCheck("DoTestVendors data file", FindDialog("trader") != nil && len(FindDialog("trader").Stock) > 0)
+}
+
+func DoTestAuction() {
+	q := auctionQuery("", 0, 0)
+	DoTestCheck("DoTestAuction query all", len(q) == 1 && q["expires"] != nil)
+	q = auctionQuery(ItemWeapon1ID, 3, 0)
+	lvl, ok := q["level"].(bson.M)
+	DoTestCheck("DoTestAuction query", ok && q["item"] == ObjectCode(ItemWeapon1ID) && lvl["$gte"] == uint32(3) && lvl["$lte"] == nil)
+
+	now := time.Now()
+	a := auctionListing{Id: bson.NewObjectId(), Item: ItemWeapon1ID, Level: 4, Count: 2, Price: 30, Expires: now.Add(time.Hour)}
+	b := auctionListMessage([]auctionListing{a}, now)
+	price, _, _ := ParseUint32(b[28:32])
+	left, _, _ := ParseUint32(b[32:36])
+	DoTestCheck("DoTestAuction message", len(b) == 4+auctionListingSize && b[2] == client_prot.CMD_AUCTION_LIST && b[3] == 1 &&
+		bson.ObjectId(b[4:16]) == a.Id && string(b[16:20]) == ItemWeapon1ID && price == 30 && left == 3600)
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	m := mail{From: auctionHouseName, Item: ItemWeapon1ID, Level: 4, Count: 2, Gold: 25}
+	DoTestCheck("DoTestAuction attachment", up.takeAttachment_WLu(&m) && up.Inventory.Count(ItemWeapon1ID, 4) == 2 && up.Gold == 25)
+	up.Gold = math.MaxUint32
+	m = mail{From: auctionHouseName, Item: ItemArmor1ID, Level: 1, Count: 1, Gold: 25}
+	DoTestCheck("DoTestAuction too much gold", !up.takeAttachment_WLu(&m) && up.Inventory.Count(ItemArmor1ID, 1) == 0)
+}
+
+func DoTestCrafting() {
+	bad := &craftingDefs{Materials: []materialDef{{Block: BT_Stone, Item: ItemWeapon1ID}}}
+	DoTestCheck("DoTestCrafting not a material", bad.verify() != nil)
+	bad = &craftingDefs{Recipes: []*recipeDef{{Id: "a", Item: ItemWeapon1ID}}}
+	DoTestCheck("DoTestCrafting no inputs", bad.verify() != nil)
+	bad = &craftingDefs{Recipes: []*recipeDef{{Id: "a", Item: "none", Inputs: []recipeInput{{Item: ItemWeapon1ID, Count: 1}}}}}
+	DoTestCheck("DoTestCrafting unknown item", bad.verify() != nil)
+	DoTestCheck("DoTestCrafting data file", materialOf(BT_Stone) == "MSTN" && materialOf(BT_Air) == "" && FindRecipe("bricks") != nil)
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Level = 3
+	up.Gather_WLuBl(BT_Stone)
+	DoTestCheck("DoTestCrafting no gathering", len(up.Inventory) == 0)
+	*survivalMode = true
+	up.Gather_WLuBl(BT_Stone)
+	up.Gather_WLuBl(BT_Stone)
+	up.Gather_WLuBl(BT_Trigger)
+	*survivalMode = false
+	DoTestCheck("DoTestCrafting gather", up.Inventory.Count("MSTN", 0) == 2 && len(up.Inventory) == 1)
+	up.Craft_WLuBl("bricks", 2)
+	DoTestCheck("DoTestCrafting missing input", up.Inventory.Count("MSTN", 0) == 2 && up.Inventory.Count("MBRK", 0) == 0)
+	up.Craft_WLuBl("bricks", 1)
+	DoTestCheck("DoTestCrafting craft", up.Inventory.Count("MSTN", 0) == 0 && up.Inventory.Count("MBRK", 0) == 1)
+	up.Inventory.AddOneObject(ItemWeapon1ID, 1)
+	up.Inventory.AddOneObject(ItemWeapon1ID, 2)
+	for i := 0; i < 10; i++ {
+		up.Inventory.AddOneObject("MSTN", 0)
+	}
+	up.Craft_WLuBl("goodweapon", 1)
+	DoTestCheck("DoTestCrafting min level", up.Inventory.countAll(ItemWeapon1ID) == 2)
+	up.Level = 5
+	up.Craft_WLuBl("goodweapon", 1)
+	DoTestCheck("DoTestCrafting level", up.Inventory.countAll(ItemWeapon1ID) == 0 && up.Inventory.Count("WEP2", 5) == 1)
+
+	_, ok := up.takeMaterial_WLu(BT_Brick)
+	DoTestCheck("DoTestCrafting building", ok && up.Inventory.Count("MBRK", 0) == 1)
+	*survivalMode = true
+	code, ok := up.takeMaterial_WLu(BT_Brick)
+	DoTestCheck("DoTestCrafting survival", ok && code == "MBRK" && up.Inventory.Count("MBRK", 0) == 0)
+	_, ok = up.takeMaterial_WLu(BT_Brick)
+	DoTestCheck("DoTestCrafting no material", !ok)
+	code, ok = up.takeMaterial_WLu(BT_Trigger)
+	DoTestCheck("DoTestCrafting free block", ok && code == "")
+	*survivalMode = false
+}
+
+func DoTestInstances() {
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Level = 3
+	up.Inventory.AddOneObject(ItemWeapon1ID, 3)
+	up.Inventory.AddOneObject(ItemWeapon1ID, 3)
+	up.Inventory.AddOneObject(ItemHealthPotionID, 3)
+	up.Inventory.AddOneObject(ItemHealthPotionID, 3)
+	inv := up.Inventory
+	DoTestCheck("DoTestInstances add", len(inv) == 3 && inv.Count(ItemWeapon1ID, 3) == 2 && inv.Count(ItemHealthPotionID, 3) == 2)
+	DoTestCheck("DoTestInstances unique", inv[0].Inst != nil && inv[1].Inst != nil && inv[0].Inst.Id != inv[1].Inst.Id &&
+		inv[0].Inst.Durability == 1 && inv[2].Inst == nil)
+	DoTestCheck("DoTestInstances slots", inv.slotsNeeded(ItemWeapon1ID, 3, 3) == 3 && inv.slotsNeeded(ItemHealthPotionID, 3, 3) == 0)
+
+	id := inv[1].Inst.Id
+	DoTestCheck("DoTestInstances select", up.Inventory.Select(id) && up.Inventory[up.Inventory.Find(ItemWeapon1ID, 3)].Inst.Id == id)
+	UseWeapon_Wlu(&up, ItemLookup(ItemWeapon1ID), 3)
+	DoTestCheck("DoTestInstances equip", up.WeaponGrade == 1 && up.WeaponInst != nil && up.WeaponInst.Id == id &&
+		up.Inventory.Count(ItemWeapon1ID, 3) == 1)
+
+	up.WeaponInst.Affixes = []itemAffix{{Kind: AffixDamage, Amount: 0.1}}
+	base := WeaponLevelDiffMultiplier(up.Level, up.WeaponLvl, up.WeaponGrade)
+	DoTestCheck("DoTestInstances affix", math.Abs(float64(up.weaponMultiplier()-base*1.1)) < 1e-5)
+	up.WeaponInst.Durability = CnfgDurabilityLoss / 2
+	up.Wear_WLu(EquipSlotWeapon)
+	DoTestCheck("DoTestInstances broken", up.WeaponInst.broken() && up.reportEquipment &&
+		math.Abs(float64(up.weaponMultiplier()-WeaponLevelDiffMultiplier(up.Level, up.WeaponLvl, 0)*1.1)) < 1e-5)
+	DoTestCheck("DoTestInstances replace broken", replacesEquipment(10, 1, up.WeaponInst, ItemLookup(ItemWeapon1ID)))
+
+	up.Repair_WLuBl(true)
+	DoTestCheck("DoTestInstances no materials", up.WeaponInst.broken())
+	for i := 0; i < 4; i++ {
+		up.Inventory.AddOneObject("MSTN", 0)
+	}
+	up.Repair_WLuBl(true)
+	DoTestCheck("DoTestInstances repair", up.WeaponInst.Durability == 1 && up.Inventory.Count("MSTN", 0) == 0)
+
+	list := up.Inventory.takeInstances(ItemWeapon1ID, 3, 1)
+	DoTestCheck("DoTestInstances take", len(list) == 1 && up.Inventory.Count(ItemWeapon1ID, 3) == 0)
+	up.Inventory.addInstances(ItemWeapon1ID, 3, 1, list)
+	DoTestCheck("DoTestInstances return", up.Inventory.Count(ItemWeapon1ID, 3) == 1 &&
+		up.Inventory[up.Inventory.Find(ItemWeapon1ID, 3)].Inst == list[0])
+
+	b := appendInstance(nil, nil)
+	DoTestCheck("DoTestInstances no instance", len(b) == 14 && b[12] == 0 && b[13] == 0)
+	b = appendInstance(nil, up.WeaponInst)
+	DoTestCheck("DoTestInstances message", len(b) == 17 && bson.ObjectId(b[0:12]) == id && b[12] == 255 && b[13] == 1 &&
+		b[14] == AffixDamage && uint16(b[15])|uint16(b[16])<<8 == 1000)
+
+	var pl player
+	pl.ArmorGrade, pl.ArmorLvl = 1, 2
+	pl.Inventory = PlayerInv{{Type: ItemWeapon2ID, Level: 1, Count: 2}, {Type: ItemHealthPotionID, Level: 1, Count: 3}}
+	pl.upgradeInstances()
+	DoTestCheck("DoTestInstances upgrade", pl.ArmorInst != nil && pl.WeaponInst == nil && len(pl.Inventory) == 3 &&
+		pl.Inventory.Count(ItemWeapon2ID, 1) == 2 && pl.Inventory.Count(ItemHealthPotionID, 1) == 3)
+}
+
+func DoTestAchievements() {
+	bad := &achievementDefs{Achievements: []*achievementDef{{Id: "a", Event: "none"}}}
+	DoTestCheck("DoTestAchievements unknown event", bad.verify() != nil)
+	bad = &achievementDefs{Achievements: []*achievementDef{{Id: "a", Event: "kill"}, {Id: "a", Event: "death"}}}
+	DoTestCheck("DoTestAchievements defined twice", bad.verify() != nil)
+	DoTestCheck("DoTestAchievements data file", currentAchievements().byId["hunter"] != nil)
+	DoTestCheck("DoTestAchievements subscribed", len(eventHandlers[EventKill]) > 0 && len(eventHandlers[EventDig]) > 0)
+
+	a := &achievementDefs{Achievements: []*achievementDef{
+		{Id: "kills", Event: "kill", Count: 2, MinLevel: 5},
+		{Id: "land", Event: "territory", Count: 3},
+	}}
+	DoTestCheck("DoTestAchievements verify", a.verify() == nil && a.Achievements[0].Name == "kills")
+	achievementSem.Lock()
+	prev := achievements
+	achievements = a
+	achievementSem.Unlock()
+
+	var up user
+	up.connState = PlayerConnStateDisc
+	up.Emit_WLu(EventKill, 1, 3)
+	DoTestCheck("DoTestAchievements low level", up.Achievements.Progress["kills"] == 0)
+	up.Emit_WLu(EventKill, 1, 5)
+	DoTestCheck("DoTestAchievements progress", up.Achievements.Progress["kills"] == 1 && len(up.newAchievements) == 0)
+	up.Emit_WLu(EventKill, 1, 8)
+	DoTestCheck("DoTestAchievements unlocked", !up.Achievements.Unlocked["kills"].IsZero() && len(up.newAchievements) == 1 &&
+		up.Achievements.Progress["kills"] == 0)
+	up.Emit_WLu(EventKill, 1, 8)
+	DoTestCheck("DoTestAchievements only once", len(up.newAchievements) == 1)
+
+	up.Emit_WLu(EventTerritory, 2, 0)
+	up.Emit_WLu(EventTerritory, 1, 0)
+	DoTestCheck("DoTestAchievements total", up.Achievements.Progress["land"] == 2)
+	up.Emit_WLu(EventTerritory, 3, 0)
+	DoTestCheck("DoTestAchievements total reached", !up.Achievements.Unlocked["land"].IsZero() && len(up.newAchievements) == 2)
+
+	up.ReportAchievements_WLuWLhRLaBl()
+	DoTestCheck("DoTestAchievements reported", up.newAchievements == nil && up.forceSave)
+
+	achievementSem.Lock()
+	achievements = prev
+	achievementSem.Unlock()
+}
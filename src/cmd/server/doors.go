@@ -0,0 +1,216 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Doors, levers and pressure plates. The state is the block type, BT_Door or BT_DoorOpen and BT_Lever or
+// BT_LeverOn, which means it is saved with the chunk and sent to the clients as block updates. A player
+// uses a door or a lever with CMD_USE_BLOCK. The owner of the chunk can require a key (from the owner)
+// to open a door, which is saved with the chunk in the PART_DOOR_LOCKS partition.
+//
+// Doors, levers and plates are also part of the logic circuits, see logic.go. A lever that is on, or a
+// plate that a player stands on, drives the net. A door opens when the net goes high, and closes when
+// it goes low. A door that requires a key only follows nets that come entirely from chunks with the same
+// owner as the door, or anyone could open it with a lever in a neighbor territory.
+//
+
+import (
+	"chunkdb"
+	"client_prot"
+	"math"
+	"strconv"
+	. "twof"
+)
+
+// There is one instance for each door that requires a key. This information is saved with the chunk.
+type doorLock struct {
+	X, Y, Z uint8 // Position of the door inside the chunk
+	Key     uint  // The key id (from the chunk owner) that is needed to open the door
+}
+
+// Return true if the block is a door
+func isDoor(bl block) bool {
+	return bl == BT_Door || bl == BT_DoorOpen
+}
+
+// Find the lock of the door at the specified position. Return nil if the door has no lock.
+// The chunk must be locked.
+func (cp *chunk) findDoorLock(x, y, z uint8) *doorLock {
+	for i := range cp.doorLocks {
+		if dl := &cp.doorLocks[i]; dl.X == x && dl.Y == y && dl.Z == z {
+			return dl
+		}
+	}
+	return nil
+}
+
+// Remove locks where the block is no longer a door. The chunk must be locked.
+func (cp *chunk) pruneDoorLocks() {
+	remain := cp.doorLocks[:0]
+	for _, dl := range cp.doorLocks {
+		if isDoor(cp.rc[dl.X][dl.Y][dl.Z]) && dl.Key != 0 {
+			remain = append(remain, dl)
+		}
+	}
+	if len(remain) == 0 {
+		remain = nil
+	}
+	cp.doorLocks = remain
+}
+
+// Change the state of a door or a lever, and save the chunk. Unlike UpdateBlock_WLcWLw, neither the old nor
+// the new block type is air. The chunk must be locked.
+func (cp *chunk) setBlockState(x, y, z uint8, bl block) {
+	if cp.jellyBlocks != nil {
+		cp.RestoreJellyBlocks(true)
+	}
+	cp.rc[x][y][z] = bl
+	cp.compressAndChecksum()
+	cp.flag |= CHF_MODIFIED
+	if !*inhibitCreateChunks {
+		cp.Write()
+	}
+	cp.ComputeLinks()
+}
+
+// Tell all players near the block that it has changed.
+func blockStateUpdate_RLq(cc chunkdb.CC, x, y, z uint8, bl block) {
+	pos := TwoF{float64(cc.X)*CHUNK_SIZE + float64(x), float64(cc.Y)*CHUNK_SIZE + float64(y)}
+	for _, o := range playerQuadtree.FindNearObjects_RLq(&pos, client_prot.NEAR_OBJECTS) {
+		if other, ok := o.(*user); ok {
+			other.SendMessageBlockUpdate(cc, x, y, z, bl)
+		}
+	}
+}
+
+// Return true if the logic circuits may open or close the door. 'owner' is the owner of the chunks of the
+// net. The chunk must be locked.
+func (cp *chunk) logicMayUseDoor(x, y, z uint8, owner uint32) bool {
+	return cp.findDoorLock(x, y, z) == nil || cp.owner == owner
+}
+
+// Open or close a door, as requested by the logic circuits. 'owner' is the owner of the chunks of the net.
+func SetDoor_WLwWLcRLq(cc chunkdb.CC, x, y, z uint8, open bool, owner uint32) {
+	bl := BT_Door
+	if open {
+		bl = BT_DoorOpen
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	cp.Lock()
+	changed := isDoor(cp.rc[x][y][z]) && cp.rc[x][y][z] != bl && cp.logicMayUseDoor(x, y, z, owner)
+	if changed {
+		cp.setBlockState(x, y, z, bl)
+	}
+	cp.Unlock()
+	if changed {
+		blockStateUpdate_RLq(cc, x, y, z, bl)
+	}
+}
+
+// Toggle a door or a lever used by the player.
+func (up *user) UseBlock_WLwWLcRLqBl(cc chunkdb.CC, x, y, z uint8) {
+	if !up.nearBlock(cc, x, y, z) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	var failure string
+	var bl block
+	cp.Lock()
+	switch bl = cp.rc[x][y][z]; bl {
+	case BT_Door, BT_DoorOpen:
+		if dl := cp.findDoorLock(x, y, z); dl != nil && !up.MayModifyChunk_RLg(cp) && !up.Keys.Test(cp.owner, dl.Key) {
+			failure = "The door is locked"
+			break
+		}
+		bl = BT_Door + BT_DoorOpen - bl
+		cp.setBlockState(x, y, z, bl)
+	case BT_Lever, BT_LeverOn:
+		bl = BT_Lever + BT_LeverOn - bl
+		cp.setBlockState(x, y, z, bl)
+	default:
+		failure = "There is nothing to use"
+	}
+	cp.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	blockStateUpdate_RLq(cc, x, y, z, bl)
+}
+
+// Decode CMD_USE_BLOCK
+func (up *user) CmdUseBlock_WLwWLcRLqBl(b []byte) {
+	cc, x, y, z, _, ok := parseBlockAddress(b)
+	if ok {
+		up.UseBlock_WLwWLcRLqBl(cc, x, y, z)
+	}
+}
+
+// Return true if a player stands on the pressure plate.
+func plateOccupied_RLq(cc chunkdb.CC, x, y, z uint8) bool {
+	bx := float64(cc.X)*CHUNK_SIZE + float64(x)
+	by := float64(cc.Y)*CHUNK_SIZE + float64(y)
+	bz := float64(cc.Z)*CHUNK_SIZE + float64(z)
+	for _, o := range playerQuadtree.FindNearObjects_RLq(&TwoF{bx + 0.5, by + 0.5}, 1) {
+		other, ok := o.(*user)
+		// There is a theoretical chance that the coordinate is updated at the same time, but the worst
+		// consequence is that the plate is missed one tick.
+		if ok && !other.Dead && math.Floor(other.Coord.X) == bx && math.Floor(other.Coord.Y) == by && math.Floor(other.Coord.Z) == bz {
+			return true
+		}
+	}
+	return false
+}
+
+// Manage the "/door" command, for the nearest door.
+func (up *user) DoorCommand_WLwWLcBl(args []string) {
+	if args[0] != "key" || len(args) != 2 {
+		up.Printf_Bl("#FAIL !Usage: /door key [key id], where 0 means no key")
+		return
+	}
+	kid, err := strconv.ParseUint(args[1], 10, 0)
+	if err != nil {
+		up.Printf_Bl("#FAIL !%v", err)
+		return
+	}
+	cc, x, y, z, ok := up.findNearBlock_WLwWLc(CnfgChestMaxDistance, isDoor)
+	if !ok {
+		up.Printf_Bl("#FAIL !There is no door near")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	cp.Lock()
+	allowed := up.MayModifyChunk_RLg(cp)
+	if allowed {
+		if dl := cp.findDoorLock(x, y, z); dl != nil {
+			dl.Key = uint(kid)
+		} else {
+			cp.doorLocks = append(cp.doorLocks, doorLock{X: x, Y: y, Z: z, Key: uint(kid)})
+		}
+		cp.pruneDoorLocks() // Removes the lock if there is no key
+		cp.flag |= CHF_MODIFIED
+		cp.Write()
+	}
+	cp.Unlock()
+	if !allowed {
+		up.Printf_Bl("#FAIL !Only the owner can change the key")
+		return
+	}
+	up.Printf_Bl("!The door now requires key %d", kid)
+}
@@ -0,0 +1,344 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Status effects on players and monsters. An effect has a kind, an amount and an end time. Effects are applied
+// by potions, abilities and activators. The effects of a player are protected by the player lock, and ticked
+// by the client process every attack period. Effects on monsters are protected by the monster lock, and
+// damage over time on a monster is ticked by the client process of the player that applied it.
+//
+// The client is told about the effects with CMD_STATUS_EFFECTS.
+//
+
+import (
+	"client_prot"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of status effects. The values are used in the protocol.
+const (
+	EffectPoison       = 0 // Lose 'Amount' hit points per second, for every stack
+	EffectRegeneration = 1 // Gain 'Amount' hit points per second
+	EffectSlow         = 2 // Movement speed is reduced by the fraction 'Amount'
+	EffectStun         = 3 // No movement and no attacks
+	EffectShield       = 4 // Absorb damage, 'Amount' is what remains of the shield
+	EffectStrength     = 5 // Damage done is multiplied by 'Amount'
+	EffectVulnerable   = 6 // Damage received is multiplied by 'Amount'
+)
+
+// How a new effect is combined with an existing effect of the same kind
+const (
+	EffectStackRefresh = iota // The strongest amount is kept, and the duration is extended
+	EffectStackAdd            // Another stack is added, up to a limit, and the duration is extended
+)
+
+type effectKind struct {
+	Name      string
+	Stacking  int     // One of EffectStack*
+	MaxStacks uint8   // Only used for EffectStackAdd
+	MaxAmount float32 // Amounts are limited to this
+	Monster   bool    // True if the effect can be applied to monsters
+}
+
+var effectKinds = []effectKind{
+	EffectPoison:       {Name: "poison", Stacking: EffectStackAdd, MaxStacks: 5, MaxAmount: 0.05, Monster: true},
+	EffectRegeneration: {Name: "regeneration", Stacking: EffectStackRefresh, MaxAmount: 0.05},
+	EffectSlow:         {Name: "slow", Stacking: EffectStackRefresh, MaxAmount: 0.9, Monster: true},
+	EffectStun:         {Name: "stun", Stacking: EffectStackRefresh, MaxAmount: 1, Monster: true},
+	EffectShield:       {Name: "shield", Stacking: EffectStackRefresh, MaxAmount: 1},
+	EffectStrength:     {Name: "strength", Stacking: EffectStackRefresh, MaxAmount: 2},
+	EffectVulnerable:   {Name: "vulnerable", Stacking: EffectStackRefresh, MaxAmount: 2, Monster: true},
+}
+
+// Find an effect kind from the name. Return false if there is no such kind.
+func FindEffectKind(name string) (uint8, bool) {
+	for i, k := range effectKinds {
+		if k.Name == name {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+type statusEffect struct {
+	kind   uint8
+	amount float32
+	stacks uint8
+	end    time.Time
+	source uint32 // The id of the player that applied the effect, or 0
+}
+
+type statusEffects []statusEffect
+
+// Apply an effect, using the stacking rules. The amount and duration are limited.
+func (list *statusEffects) apply(kind uint8, amount float32, duration time.Duration, source uint32, now time.Time) {
+	k := &effectKinds[kind]
+	if amount > k.MaxAmount {
+		amount = k.MaxAmount
+	}
+	if duration > CnfgEffectMaxDuration {
+		duration = CnfgEffectMaxDuration
+	}
+	end := now.Add(duration)
+	for i := range *list {
+		e := &(*list)[i]
+		if e.kind != kind || !e.end.After(now) {
+			continue
+		}
+		if k.Stacking == EffectStackAdd && e.stacks < k.MaxStacks {
+			e.stacks++
+		}
+		if amount > e.amount {
+			e.amount = amount
+		}
+		if end.After(e.end) {
+			e.end = end
+		}
+		e.source = source
+		return
+	}
+	*list = append(*list, statusEffect{kind: kind, amount: amount, stacks: 1, end: end, source: source})
+}
+
+// Remove expired effects. Return true if something was removed.
+func (list *statusEffects) expire(now time.Time) bool {
+	remain := (*list)[:0]
+	for _, e := range *list {
+		if e.end.After(now) {
+			remain = append(remain, e)
+		}
+	}
+	changed := len(remain) != len(*list)
+	*list = remain
+	return changed
+}
+
+// Return the total amount of an active effect, or 0.
+func (list statusEffects) amount(kind uint8, now time.Time) float32 {
+	for _, e := range list {
+		if e.kind == kind && e.end.After(now) {
+			return e.amount * float32(e.stacks)
+		}
+	}
+	return 0
+}
+
+func (list statusEffects) has(kind uint8, now time.Time) bool {
+	return list.amount(kind, now) > 0
+}
+
+// Damage done is multiplied by this
+func (list statusEffects) damageDone(now time.Time) float32 {
+	if a := list.amount(EffectStrength, now); a > 0 {
+		return a
+	}
+	return 1
+}
+
+// Damage received is multiplied by this
+func (list statusEffects) damageTaken(now time.Time) float32 {
+	if a := list.amount(EffectVulnerable, now); a > 0 {
+		return a
+	}
+	return 1
+}
+
+// Movement speed is multiplied by this
+func (list statusEffects) speedFactor(now time.Time) float64 {
+	if list.has(EffectStun, now) {
+		return 0
+	}
+	return 1 - float64(list.amount(EffectSlow, now))
+}
+
+// Let a shield absorb damage. Return the damage that remains.
+func (list statusEffects) absorb(dmg float32, now time.Time) float32 {
+	for i := range list {
+		e := &list[i]
+		if e.kind != EffectShield || !e.end.After(now) {
+			continue
+		}
+		if e.amount > dmg {
+			e.amount -= dmg
+			return 0
+		}
+		dmg -= e.amount
+		e.end = now // Depleted, will be removed at the next expire
+	}
+	return dmg
+}
+
+// Build the CMD_STATUS_EFFECTS message, with the kind, the stacks and the remaining time in ms of every
+// active effect. 'id' is the player or monster id.
+func statusEffectsMessage(id uint32, list statusEffects, now time.Time) []byte {
+	const entryLen = 6
+	var active statusEffects
+	for _, e := range list {
+		if e.end.After(now) {
+			active = append(active, e)
+		}
+	}
+	msgLen := 7 + len(active)*entryLen
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_STATUS_EFFECTS
+	EncodeUint32(id, b[3:7])
+	p := b[7:]
+	for _, e := range active {
+		p[0] = e.kind
+		p[1] = e.stacks
+		EncodeUint32(uint32(e.end.Sub(now)/time.Millisecond), p[2:6])
+		p = p[entryLen:]
+	}
+	return b
+}
+
+// Apply an effect to the player. Can be called from any process, the client is told later.
+func (up *user) ApplyEffect_WLu(kind uint8, amount float32, duration time.Duration, source uint32) {
+	up.Lock()
+	up.effects.apply(kind, amount, duration, source, time.Now())
+	up.reportEffects = true
+	up.Unlock()
+}
+
+// Apply an effect to a monster, and tell the player that applied it.
+func (mp *monster) ApplyEffect_Bl(up *user, kind uint8, amount float32, duration time.Duration) {
+	now := time.Now()
+	mp.Lock()
+	mp.effects.apply(kind, amount, duration, up.Id, now)
+	b := statusEffectsMessage(mp.id, mp.effects, now)
+	mp.Unlock()
+	up.writeBlocking_Bl(b)
+}
+
+// The speed factor of the monster, from the effects
+func (mp *monster) speedFactor(now time.Time) float64 {
+	mp.Lock()
+	defer mp.Unlock()
+	return mp.effects.speedFactor(now)
+}
+
+// Return true if the monster is stunned
+func (mp *monster) stunned(now time.Time) bool {
+	mp.Lock()
+	defer mp.Unlock()
+	return mp.effects.has(EffectStun, now)
+}
+
+// Tell the client about the player effects, if they have changed
+func (up *user) ReportEffects_RLuBl() {
+	if !up.reportEffects {
+		return
+	}
+	up.RLock()
+	up.reportEffects = false
+	b := statusEffectsMessage(up.Id, up.effects, time.Now())
+	up.RUnlock()
+	up.writeBlocking_Bl(b)
+}
+
+// Tick the status effects of the player, and the damage over time done by the player on the monster being
+// attacked. 'delta' is the time since the last tick.
+func (up *user) TickEffects_WLuBl(delta time.Duration) {
+	now := time.Now()
+	seconds := float32(delta.Seconds())
+	died := false
+	up.Lock()
+	if up.effects.expire(now) {
+		up.reportEffects = true
+	}
+	if up.Dead && len(up.effects) > 0 {
+		up.effects = nil // All effects are lost when dying
+		up.reportEffects = true
+	}
+	if !up.Dead {
+		regen := up.effects.amount(EffectRegeneration, now) + up.affixTotal(AffixRegen)
+		hp := up.HitPoints + (regen-up.effects.amount(EffectPoison, now))*seconds
+		if hp > 1 {
+			hp = 1
+		}
+		if hp <= 0 {
+			hp = 0
+			up.Dead = true
+			died = true
+		}
+		if hp != up.HitPoints {
+			up.HitPoints = hp
+			up.updatedStats = true
+		}
+		if mana := up.affixTotal(AffixMana); mana > 0 {
+			up.AddMana(mana * seconds)
+		}
+	}
+	up.Unlock()
+	if died {
+		up.Emit_WLu(EventDeath, 1, 0)
+	}
+	mp := up.aggro
+	if mp == nil || mp.dead {
+		return
+	}
+	var b []byte
+	var poison float32
+	mp.Lock()
+	if mp.effects.expire(now) {
+		b = statusEffectsMessage(mp.id, mp.effects, now)
+	}
+	for _, e := range mp.effects {
+		if e.kind == EffectPoison && e.source == up.Id {
+			poison += e.amount * float32(e.stacks)
+		}
+	}
+	mp.Unlock()
+	if b != nil {
+		up.writeBlocking_Bl(b)
+	}
+	if poison > 0 {
+		mp.HitWith_WLuBl(up, poison*seconds, 1)
+	}
+}
+
+// Parse the argument of the activator modifier "/effect:<name>,<amount>,<seconds>"
+func parseEffectModifier(modifier string) (kind uint8, amount float32, duration time.Duration, err error) {
+	args := strings.Split(modifier, ",")
+	if len(args) != 3 {
+		err = fmt.Errorf("effect '%s': expected name,amount,seconds", modifier)
+		return
+	}
+	var ok bool
+	if kind, ok = FindEffectKind(args[0]); !ok {
+		err = fmt.Errorf("unknown effect '%s'", args[0])
+		return
+	}
+	a, err := strconv.ParseFloat(args[1], 32)
+	if err != nil || a <= 0 {
+		err = fmt.Errorf("effect '%s': bad amount", modifier)
+		return
+	}
+	s, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || s <= 0 {
+		err = fmt.Errorf("effect '%s': bad duration", modifier)
+		return
+	}
+	return kind, float32(a), time.Duration(s * 1e9), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// The player event bus. Gameplay code emits events when something happens to a player, and the
+// handlers subscribed to the event kind are called. This way, features like achievements don't have to
+// poll the player state, and the gameplay code doesn't have to know about them.
+//
+// Handlers are subscribed at initialization, and called in the process that emits the event, which is
+// usually the client process. The player must not be locked when emitting, and the handlers must not block.
+//
+
+import (
+	"fmt"
+	"log"
+)
+
+// The kinds of events
+const (
+	EventKill      = 0 // A monster was killed. The level is the monster level.
+	EventDeath     = 1 // The player died
+	EventMove      = 2 // The player moved. The amount is the distance in blocks.
+	EventTerritory = 3 // The number of chunks owned by the player changed. The amount is the new number.
+	EventQuest     = 4 // A quest was completed
+	EventBuild     = 5 // A block was added. The amount is the total number of blocks added.
+	EventDig       = 6 // A block was removed. The amount is the total number of blocks removed.
+	EventLast      = 7 // One higher than the last event kind
+)
+
+var eventKinds = [EventLast]struct {
+	name  string
+	total bool // The amount is a total, not an increment
+}{
+	EventKill:      {"kill", false},
+	EventDeath:     {"death", false},
+	EventMove:      {"move", false},
+	EventTerritory: {"territory", true},
+	EventQuest:     {"quest", false},
+	EventBuild:     {"build", true},
+	EventDig:       {"dig", true},
+}
+
+type playerEvent struct {
+	Kind   uint8
+	Amount uint32
+	Level  uint32 // The level of the monster, when relevant
+}
+
+type eventHandler func(up *user, ev playerEvent)
+
+// The handlers, by event kind. Only changed at initialization, so no lock is needed.
+var eventHandlers [EventLast][]eventHandler
+
+// Find an event kind by name
+func FindEventKind(name string) (uint8, bool) {
+	for i, k := range eventKinds {
+		if k.name == name {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+func (ev playerEvent) String() string {
+	return fmt.Sprintf("%s %d level %d", eventKinds[ev.Kind].name, ev.Amount, ev.Level)
+}
+
+// Subscribe a handler to an event kind. Must only be called at initialization.
+func SubscribeEvent(kind uint8, h eventHandler) {
+	eventHandlers[kind] = append(eventHandlers[kind], h)
+}
+
+// Tell all handlers about an event of the player
+func (up *user) Emit_WLu(kind uint8, amount uint32, level uint32) {
+	ev := playerEvent{Kind: kind, Amount: amount, Level: level}
+	if *verboseFlag > 1 {
+		log.Println("Event", up.Name, ev)
+	}
+	for _, h := range eventHandlers[kind] {
+		h(up, ev)
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"client_prot"
 	"fmt"
 	"log"
-	"math"
 	"quadtree"
 	. "twof"
 )
@@ -104,29 +103,21 @@ func (up *user) SendMessageBlockUpdate(cc chunkdb.CC, dx uint8, dy uint8, dz uin
 
 // Report the inventory for one item to a player.
 // The amount can be 0. The purpose of this function is to update the client for a specific
-// inventory item.
+// inventory item. All instances of the item are sent, and replace the ones the client had.
 func ReportOneInventoryItem_WluBl(up *user, code ObjectCode, lvl uint32) {
-	const msgLen = 12
-	b := make([]byte, msgLen)
-	b[0] = byte(msgLen)
-	// b[1] = 0
-	b[2] = client_prot.CMD_UPD_INV
-	for j := 0; j < 4; j++ {
-		b[3+j] = code[j]
-	}
-	// b[7] = 0 // Default count is 0
-	EncodeUint32(lvl, b[8:12])
+	b := []byte{0, 0, client_prot.CMD_UPD_INV}
 	up.RLock()
-	inv := up.Inventory
-	i := inv.Find(code, lvl)
-	if i >= 0 {
-		count := inv[i].Count
-		if count > math.MaxUint8 {
-			count = math.MaxUint8 // This is what can be shown to the client
+	for i := range up.Inventory {
+		if obj := &up.Inventory[i]; obj.Type == code && obj.Level == lvl {
+			b = appendInventoryEntry(b, obj)
 		}
-		b[7] = byte(count)
 	}
 	up.RUnlock()
+	if len(b) == 3 {
+		// Default count is 0
+		b = appendInventoryEntry(b, &Object{Type: code, Level: lvl})
+	}
+	b = setMessageLength(b)
 	// Wait with the actual writing until after unlocking the player.
 	up.writeNonBlocking(b)
 	// log.Println(b)
@@ -135,8 +126,18 @@ func ReportOneInventoryItem_WluBl(up *user, code ObjectCode, lvl uint32) {
 // Add an object to the player inventory. It will automatically get a level that corresponds
 // to the current position.
 func AddOneObjectToUser_WLuBl(up *user, Type ObjectCode) {
-	up.Lock()
 	level := MonsterDifficulty(&up.Coord) // We want an object of a level corresponding to the monsters at this place.
+	AddObjectToUser_WLuBl(up, Type, level)
+}
+
+// Add one object of the specified level to the player inventory, if there is room for it
+func AddObjectToUser_WLuBl(up *user, Type ObjectCode, level uint32) {
+	up.Lock()
+	if !up.Inventory.Room(Type, level, 1) {
+		up.Unlock()
+		up.Printf("!You can't carry more of %v", Type)
+		return
+	}
 	up.Inventory.AddOneObject(Type, level)
 	up.Unlock()
 	ReportOneInventoryItem_WluBl(up, Type, level)
@@ -0,0 +1,110 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Gold is the currency of the players, saved in the avatar. It is earned from monster kills and quest
+// rewards, and is used to buy items from vendors, see vendor.go. Gold must only be changed with
+// changeGold, followed by reportGold when the player is unlocked, so that every change is recorded in the
+// transaction log. The log is saved in the "transactions" collection of the database by ProcGoldLog,
+// so that the game never has to wait for the database.
+//
+
+import (
+	"client_prot"
+	"ephenationdb"
+	"log"
+	"math"
+	"time"
+)
+
+// One change of the gold of a player
+type goldTransaction struct {
+	Time    time.Time
+	Uid     uint32
+	Amount  int64  // Positive when gold is earned, negative when it is spent
+	Balance uint32 // The gold after the change
+	Reason  string
+}
+
+var goldLog = make(chan goldTransaction, CnfgGoldLogQueue)
+
+// Change the gold of the player. Return false, and change nothing, if there isn't enough gold.
+// The player must be locked, and the change reported with reportGold after unlocking.
+func (up *user) changeGold(amount int64) bool {
+	bal := int64(up.Gold) + amount
+	if bal < 0 || bal > math.MaxUint32 {
+		return false
+	}
+	up.Gold = uint32(bal)
+	return true
+}
+
+// Build the CMD_GOLD message
+func goldMessage(balance uint32) []byte {
+	var b [7]byte
+	b[0] = byte(len(b))
+	b[1] = 0
+	b[2] = client_prot.CMD_GOLD
+	EncodeUint32(balance, b[3:7])
+	return b[:]
+}
+
+// Record a change of gold in the transaction log, and tell the client about the new balance.
+// The player must not be locked.
+func (up *user) reportGold(amount int64, balance uint32, reason string) {
+	t := goldTransaction{Time: time.Now(), Uid: up.Id, Amount: amount, Balance: balance, Reason: reason}
+	select {
+	case goldLog <- t:
+	default:
+		// The log process can't keep up. Don't lose the transaction.
+		log.Printf("Gold transaction %+v\n", t)
+	}
+	up.writeNonBlocking(goldMessage(balance))
+}
+
+// Give gold to the player, or take it if 'amount' is negative. Return false if there isn't enough gold.
+func (up *user) AddGold_WLu(amount int64, reason string) bool {
+	up.Lock()
+	ok := up.changeGold(amount)
+	balance := up.Gold
+	up.Unlock()
+	if ok {
+		up.reportGold(amount, balance, reason)
+	}
+	return ok
+}
+
+// The gold a player gets for killing a monster at level 'mLevel'
+func goldForKill(mLevel uint32) int64 {
+	return 1 + int64(float64(mLevel)*CnfgGoldPerKillLevel)
+}
+
+// Save the gold transactions in the database. This process never returns.
+func ProcGoldLog() {
+	for t := range goldLog {
+		db := ephenationdb.New()
+		if db == nil {
+			log.Printf("Gold transaction %+v\n", t)
+			continue
+		}
+		if err := db.C("transactions").Insert(&t); err != nil {
+			log.Printf("Gold transaction %+v: %v\n", t, err)
+		}
+	}
+}
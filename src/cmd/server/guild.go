@@ -0,0 +1,560 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Management of guilds. A guild is a persistent group of players, saved in the "guilds" collection.
+// Guilds can own territory. The owner of such a chunk is the guild id plus GuildOwnerOffset, which
+// can never be the id of a player.
+//
+// All guild data is protected by 'guildSem'. A user must not be locked while guildSem is locked.
+//
+
+import (
+	"chunkdb"
+	"ephenationdb"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strings"
+)
+
+// Guild ranks. A higher rank has all the rights of the lower ranks.
+const (
+	GuildRankMember  = iota // Can use guild chat
+	GuildRankBuilder        // Can change blocks in guild territory
+	GuildRankOfficer        // Can invite and kick members, and set the message of the day
+	GuildRankLeader         // Can promote, demote and claim territory
+)
+
+const GuildOwnerOffset = 1 << 31 // Chunk owners at this value or above are guilds. Players are always below.
+
+var guildRankNames = []string{"member", "builder", "officer", "leader"}
+
+type GuildMember struct {
+	Id   uint32
+	Name string
+	Rank uint8
+}
+
+// This is what is saved in the DB.
+type guild struct {
+	Id        uint32 `bson:"_id"`
+	Name      string
+	Motd      string        // Message of the day
+	Members   []GuildMember // The first member is not necessarily the leader
+	Invites   []uint32      // Players that have been invited, but not yet accepted
+	Territory []chunkdb.CC  // Chunks owned by the guild
+}
+
+var (
+	guildSem   sync.RWMutex              // Protects all guild data
+	allGuilds  = make(map[uint32]*guild) // Guilds that have been loaded, from guild id.
+	guildNames = make(map[string]*guild) // Guilds that have been loaded, from lower case name.
+)
+
+// Return true if the chunk owner is a guild
+func IsGuildOwner(owner uint32) bool {
+	return owner >= GuildOwnerOffset && owner < OWNER_TEST-MAX_PLAYERS // Test players use the ids just below OWNER_TEST
+}
+
+// The chunk owner id used for a guild
+func GuildOwnerId(gid uint32) uint32 {
+	return gid + GuildOwnerOffset
+}
+
+// Add a loaded guild to the cache. guildSem must be locked.
+func addGuildToCache(gp *guild) {
+	allGuilds[gp.Id] = gp
+	guildNames[strings.ToLower(gp.Name)] = gp
+}
+
+// Find a guild from the id, loading it from the DB if needed. Return nil if not found.
+func FindGuild_WLg(gid uint32) *guild {
+	if gid == 0 {
+		return nil
+	}
+	guildSem.RLock()
+	gp := allGuilds[gid]
+	guildSem.RUnlock()
+	if gp != nil {
+		return gp
+	}
+	db := ephenationdb.New()
+	if db == nil {
+		return nil
+	}
+	gp = new(guild)
+	if err := db.C("guilds").FindId(gid).One(gp); err != nil {
+		log.Println("FindGuild", gid, err)
+		return nil
+	}
+	guildSem.Lock()
+	if prev := allGuilds[gid]; prev != nil {
+		gp = prev // Someone else loaded it in the mean time
+	} else {
+		addGuildToCache(gp)
+	}
+	guildSem.Unlock()
+	return gp
+}
+
+// Find a guild from the name, loading it from the DB if needed. Return nil if not found.
+func FindGuildByName_WLg(name string) *guild {
+	guildSem.RLock()
+	gp := guildNames[strings.ToLower(name)]
+	guildSem.RUnlock()
+	if gp != nil {
+		return gp
+	}
+	db := ephenationdb.New()
+	if db == nil {
+		return nil
+	}
+	var g struct {
+		Id uint32 `bson:"_id"`
+	}
+	if err := db.C("guilds").Find(bson.M{"lname": strings.ToLower(name)}).Select(bson.M{"_id": 1}).One(&g); err != nil {
+		return nil
+	}
+	return FindGuild_WLg(g.Id)
+}
+
+// Save the guild. guildSem must be locked.
+func (gp *guild) save() bool {
+	db := ephenationdb.New()
+	if db == nil {
+		return false
+	}
+	_, err := db.C("guilds").UpsertId(gp.Id, bson.M{"$set": bson.M{"name": gp.Name, "lname": strings.ToLower(gp.Name),
+		"motd": gp.Motd, "members": gp.Members, "invites": gp.Invites, "territory": gp.Territory}})
+	if err != nil {
+		log.Println("Save guild", gp.Name, err)
+		return false
+	}
+	return true
+}
+
+// Get the index of a member, or -1 if not found. guildSem must be locked.
+func (gp *guild) findMember(uid uint32) int {
+	for i, m := range gp.Members {
+		if m.Id == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get the index of a member from the name, or -1 if not found. guildSem must be locked.
+func (gp *guild) findMemberName(name string) int {
+	for i, m := range gp.Members {
+		if strings.ToLower(m.Name) == strings.ToLower(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get the rank of a player in the guild. Return -1 if not a member.
+func (gp *guild) Rank_RLg(uid uint32) int {
+	guildSem.RLock()
+	defer guildSem.RUnlock()
+	if i := gp.findMember(uid); i >= 0 {
+		return int(gp.Members[i].Rank)
+	}
+	return -1
+}
+
+// Send a message to all guild members that are logged in.
+func (gp *guild) Printf_RLgRLa(format string, a ...interface{}) {
+	guildSem.RLock()
+	ids := make([]uint32, len(gp.Members))
+	for i, m := range gp.Members {
+		ids[i] = m.Id
+	}
+	guildSem.RUnlock()
+	allPlayersSem.RLock()
+	for _, uid := range ids {
+		if other, ok := allPlayerIdMap[uid]; ok {
+			other.Printf(format, a...)
+		}
+	}
+	allPlayersSem.RUnlock()
+}
+
+// Return true if the player may change blocks in the chunk. This is the common permission test
+// used for all changes of blocks.
+func (up *user) MayModifyChunk_RLg(cp *chunk) bool {
+	if cp.owner == up.Id || up.AdminLevel >= 1 {
+		return true
+	}
+	if !IsGuildOwner(cp.owner) || up.Guild == 0 || GuildOwnerId(up.Guild) != cp.owner {
+		return false
+	}
+	guildSem.RLock()
+	gp := allGuilds[up.Guild]
+	guildSem.RUnlock()
+	return gp != nil && gp.Rank_RLg(up.Id) >= GuildRankBuilder
+}
+
+// Called when the player logs in. Verify the guild membership and show the message of the day.
+func (up *user) GuildLogin_WLgBl() {
+	if up.Guild == 0 {
+		return
+	}
+	gp := FindGuild_WLg(up.Guild)
+	if gp == nil || gp.Rank_RLg(up.Id) < 0 {
+		// The player was kicked or the guild disbanded while being offline
+		up.Guild = 0
+		return
+	}
+	guildSem.RLock()
+	name, motd := gp.Name, gp.Motd
+	guildSem.RUnlock()
+	if motd != "" {
+		up.Printf_Bl("[%s] %s", name, motd)
+	}
+	gp.Printf_RLgRLa("[%s] %s logged in", name, up.Name)
+}
+
+// Decode the /guild command
+func (up *user) GuildCommand_WLgBlWLwWLcWLu(arg string) {
+	if up.Id >= GuildOwnerOffset {
+		up.Printf_Bl("#FAIL !Test players can't use guilds") // They are not saved in the DB
+		return
+	}
+	cmd := strings.SplitN(arg, " ", 2)
+	var gp *guild
+	if up.Guild != 0 {
+		gp = FindGuild_WLg(up.Guild)
+	}
+	if cmd[0] != "create" && cmd[0] != "accept" && gp == nil {
+		up.Printf_Bl("#FAIL !You are not in a guild")
+		return
+	}
+	rank := -1
+	if gp != nil {
+		rank = gp.Rank_RLg(up.Id)
+	}
+	switch cmd[0] {
+	case "create":
+		if len(cmd) != 2 || strings.Contains(cmd[1], " ") {
+			up.Printf_Bl("#FAIL !Usage: /guild create [name]")
+			return
+		}
+		if gp != nil {
+			up.Printf_Bl("#FAIL !You are already in a guild")
+			return
+		}
+		up.GuildCreate_WLg(cmd[1])
+	case "accept":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /guild accept [guild]")
+			return
+		}
+		if gp != nil {
+			up.Printf_Bl("#FAIL !You are already in a guild")
+			return
+		}
+		up.GuildAccept_WLg(cmd[1])
+	case "invite":
+		if len(cmd) != 2 || rank < GuildRankOfficer {
+			up.Printf_Bl("#FAIL !Usage: /guild invite [name] (officer only)")
+			return
+		}
+		allPlayersSem.RLock()
+		other, ok := allPlayerNameMap[strings.ToLower(cmd[1])]
+		allPlayersSem.RUnlock()
+		if !ok || other.Guild != 0 {
+			up.Printf_Bl("#FAIL !%v must be logged in and not in a guild", cmd[1])
+			return
+		}
+		guildSem.Lock()
+		gp.Invites = append(gp.Invites, other.Id) // Duplicates are harmless
+		name := gp.Name
+		gp.save()
+		guildSem.Unlock()
+		other.Printf("!%s invites you to the guild %s. Use '/guild accept %s' to join.", up.Name, name, name)
+		up.Printf_Bl("!%s invited", other.Name)
+	case "leave":
+		up.GuildLeave_WLgWLwWLc(gp, rank)
+	case "kick":
+		if len(cmd) != 2 || rank < GuildRankOfficer {
+			up.Printf_Bl("#FAIL !Usage: /guild kick [name] (officer only)")
+			return
+		}
+		guildSem.Lock()
+		i := gp.findMemberName(cmd[1])
+		if i < 0 || int(gp.Members[i].Rank) >= rank {
+			guildSem.Unlock()
+			up.Printf_Bl("#FAIL !Can't kick %s", cmd[1])
+			return
+		}
+		kicked := gp.Members[i]
+		gp.Members = append(gp.Members[:i], gp.Members[i+1:]...)
+		gp.save()
+		guildSem.Unlock()
+		allPlayersSem.RLock()
+		other, ok := allPlayerIdMap[kicked.Id]
+		allPlayersSem.RUnlock()
+		if ok {
+			other.Lock()
+			if other.Guild == gp.Id {
+				other.Guild = 0
+				other.forceSave = true
+			}
+			other.Unlock()
+			other.Printf("!You were kicked from the guild")
+		}
+		gp.Printf_RLgRLa("!%s was kicked from the guild by %s", kicked.Name, up.Name)
+	case "promote", "demote":
+		if len(cmd) != 2 || rank < GuildRankLeader {
+			up.Printf_Bl("#FAIL !Usage: /guild %s [name] (leader only)", cmd[0])
+			return
+		}
+		guildSem.Lock()
+		i := gp.findMemberName(cmd[1])
+		if i < 0 || gp.Members[i].Id == up.Id {
+			guildSem.Unlock()
+			up.Printf_Bl("#FAIL !No such member %s", cmd[1])
+			return
+		}
+		m := &gp.Members[i]
+		if cmd[0] == "promote" && m.Rank < GuildRankLeader {
+			m.Rank++
+		} else if cmd[0] == "demote" && m.Rank > GuildRankMember {
+			m.Rank--
+		}
+		if m.Rank == GuildRankLeader {
+			// There can only be one leader, which means the leadership is transferred.
+			gp.Members[gp.findMember(up.Id)].Rank = GuildRankOfficer
+		}
+		name, newRank := m.Name, guildRankNames[m.Rank]
+		gp.save()
+		guildSem.Unlock()
+		gp.Printf_RLgRLa("!%s is now %s", name, newRank)
+	case "motd":
+		if len(cmd) == 1 {
+			guildSem.RLock()
+			motd := gp.Motd
+			guildSem.RUnlock()
+			up.Printf_Bl("!%s", motd)
+			return
+		}
+		if rank < GuildRankOfficer {
+			up.Printf_Bl("#FAIL !Only officers can set the message of the day")
+			return
+		}
+		guildSem.Lock()
+		gp.Motd = cmd[1]
+		gp.save()
+		guildSem.Unlock()
+		gp.Printf_RLgRLa("!New message of the day: %s", cmd[1])
+	case "say":
+		if len(cmd) == 2 {
+			up.GuildSay_RLgRLa(cmd[1])
+		}
+	case "claim":
+		if rank < GuildRankLeader {
+			up.Printf_Bl("#FAIL !Only the guild leader can claim territory")
+			return
+		}
+		var dir []string
+		if len(cmd) == 2 {
+			dir = []string{cmd[1]}
+		}
+		up.GuildClaim_WLgWLwWLc(gp, dir)
+	case "show":
+		guildSem.RLock()
+		lines := []string{fmt.Sprintf("!!Guild %s, %d chunks", gp.Name, len(gp.Territory))}
+		for _, m := range gp.Members {
+			lines = append(lines, fmt.Sprintf("!%s (%s)", m.Name, guildRankNames[m.Rank]))
+		}
+		guildSem.RUnlock()
+		for _, line := range lines {
+			up.Printf_Bl("%s", line)
+		}
+	default:
+		up.Printf_Bl("#FAIL !Usage: /guild create|accept|invite|leave|kick|promote|demote|motd|say|claim|show")
+	}
+}
+
+// Send a message on the guild chat
+func (up *user) GuildSay_RLgRLa(msg string) {
+	gp := FindGuild_WLg(up.Guild)
+	if gp == nil {
+		up.Printf_Bl("#FAIL Not in a guild")
+		return
+	}
+	gp.Printf_RLgRLa("[Guild] %s: %s", up.Name, msg)
+}
+
+// Create a new guild, with 'up' as the leader.
+func (up *user) GuildCreate_WLg(name string) {
+	db := ephenationdb.New()
+	if db == nil {
+		up.Printf_Bl("#FAIL !No database")
+		return
+	}
+	if FindGuildByName_WLg(name) != nil {
+		up.Printf_Bl("#FAIL !The name %s is already in use", name)
+		return
+	}
+	var id struct {
+		C uint32
+	}
+	change := mgo.Change{
+		Update: bson.M{"$inc": bson.M{"c": 1}},
+	}
+	if _, err := db.C("counters").FindId("guildId").Apply(change, &id); err != nil {
+		log.Println("Failed to update unique counter 'guildId' in collection 'counter'", err)
+		up.Printf_Bl("#FAIL !Failed to create guild")
+		return
+	}
+	gp := &guild{Id: id.C, Name: name, Members: []GuildMember{{Id: up.Id, Name: up.Name, Rank: GuildRankLeader}}}
+	guildSem.Lock()
+	addGuildToCache(gp)
+	ok := gp.save()
+	guildSem.Unlock()
+	if !ok {
+		up.Printf_Bl("#FAIL !Failed to create guild")
+		return
+	}
+	up.Guild = gp.Id
+	up.forceSave = true
+	up.Printf_Bl("!Guild %s created", name)
+}
+
+// Accept an invitation to a guild
+func (up *user) GuildAccept_WLg(name string) {
+	gp := FindGuildByName_WLg(name)
+	if gp == nil {
+		up.Printf_Bl("#FAIL !No guild %s", name)
+		return
+	}
+	guildSem.Lock()
+	invited := false
+	for i, uid := range gp.Invites {
+		if uid == up.Id {
+			gp.Invites = append(gp.Invites[:i], gp.Invites[i+1:]...)
+			invited = true
+			break
+		}
+	}
+	if invited && gp.findMember(up.Id) < 0 {
+		gp.Members = append(gp.Members, GuildMember{Id: up.Id, Name: up.Name, Rank: GuildRankMember})
+		gp.save()
+	}
+	guildSem.Unlock()
+	if !invited {
+		up.Printf_Bl("#FAIL !You are not invited to %s", name)
+		return
+	}
+	up.Guild = gp.Id
+	up.forceSave = true
+	gp.Printf_RLgRLa("!%s joined the guild", up.Name)
+}
+
+// Leave the guild. The leader can only leave as the last member, in which case the guild is
+// disbanded and the territory released.
+func (up *user) GuildLeave_WLgWLwWLc(gp *guild, rank int) {
+	guildSem.Lock()
+	if rank == GuildRankLeader && len(gp.Members) > 1 {
+		guildSem.Unlock()
+		up.Printf_Bl("#FAIL !Promote a new leader first")
+		return
+	}
+	if i := gp.findMember(up.Id); i >= 0 {
+		gp.Members = append(gp.Members[:i], gp.Members[i+1:]...)
+	}
+	var territory []chunkdb.CC
+	if len(gp.Members) == 0 {
+		territory = gp.Territory
+		gp.Territory = nil
+		delete(allGuilds, gp.Id)
+		delete(guildNames, strings.ToLower(gp.Name))
+		if db := ephenationdb.New(); db != nil {
+			db.C("guilds").RemoveId(gp.Id)
+		}
+	} else {
+		gp.save()
+	}
+	guildSem.Unlock()
+	for _, cc := range territory {
+		cp := ChunkFind_WLwWLc(cc)
+		cp.Lock()
+		cp.owner = OWNER_NONE
+		cp.flag |= CHF_MODIFIED
+		cp.Write()
+		cp.Unlock()
+	}
+	up.Guild = 0
+	up.forceSave = true
+	up.Printf_Bl("!You left the guild")
+	gp.Printf_RLgRLa("!%s left the guild", up.Name)
+}
+
+// Claim a chunk for the guild. It must be adjacent to existing guild territory, unless it is the first chunk.
+func (up *user) GuildClaim_WLgWLwWLc(gp *guild, arg []string) {
+	if MonsterDifficulty(&up.Coord) > up.Level && up.AdminLevel == 0 {
+		up.Printf_Bl("#FAIL !You are too low level for this area")
+		return
+	}
+	cc, ok := up.territoryClaimCoord(arg)
+	if !ok {
+		return
+	}
+	guildSem.RLock()
+	numChunks := len(gp.Territory)
+	guildSem.RUnlock()
+	if numChunks >= CnfgMaxGuildChunks {
+		up.Printf_Bl("#FAIL !The guild is not allowed more chunks than %d", CnfgMaxGuildChunks)
+		return
+	}
+	owner := GuildOwnerId(gp.Id)
+	cp := ChunkFind_WLwWLc(cc)
+	cp.Lock()
+	if cp.owner != OWNER_NONE {
+		cp.Unlock()
+		up.Printf_Bl("#FAIL !Chunk %v is already allocated to ID %d", cc, cp.owner)
+		return
+	}
+	approved := numChunks == 0
+	for _, adj := range dBGetAdjacentChunks(&cc) {
+		if adj.owner == owner {
+			approved = true
+			break
+		}
+	}
+	if !approved {
+		cp.Unlock()
+		up.Printf_Bl("#FAIL !You must allocate adjacent to another of the guild chunks")
+		return
+	}
+	cp.owner = owner
+	cp.flag |= CHF_MODIFIED
+	cp.Write()
+	cp.Unlock()
+	guildSem.Lock()
+	gp.Territory = append(gp.Territory, cc)
+	gp.save()
+	guildSem.Unlock()
+	gp.Printf_RLgRLa("!The guild now owns chunk %v", cc)
+}
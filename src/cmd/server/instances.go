@@ -0,0 +1,404 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Item instances. Equipment of grade 1 and higher, that is weapons, armors, helmets and ranged weapons,
+// are individual items with a unique id, a durability and random affixes. Other items are only counted.
+// An instance is created when the item is first added to an inventory, see PlayerInv.AddOneObject, and
+// follows the item when it is equipped, traded, stored in a chest or sold in the auction house.
+//
+// The durability goes from 1, as new, to 0, when the item is broken. Weapons wear when hitting monsters,
+// and armors and helmets when being hit by monsters. A broken item works as an item of grade 0. Items are
+// repaired by a vendor, for gold, or with materials as defined in the crafting file. See "/repair".
+//
+// The affixes of all equipped items add up, and feed into the combat multipliers and the regeneration.
+//
+
+import (
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// The kinds of affixes
+const (
+	AffixDamage = 0 // Bonus damage, as a fraction
+	AffixRegen  = 1 // Hit points restored per second
+	AffixMana   = 2 // Mana restored per second
+)
+
+var affixKinds = []struct {
+	name     string
+	min, max float32 // The range of the random amount, for every grade of the item
+}{
+	AffixDamage: {"damage", 0.01, 0.03},
+	AffixRegen:  {"regeneration", 0.0005, 0.002},
+	AffixMana:   {"mana", 0.001, 0.004},
+}
+
+// The equipment slots, as used in CMD_EQUIPMENT
+const (
+	EquipSlotWeapon = 0
+	EquipSlotArmor  = 1
+	EquipSlotHelmet = 2
+	EquipSlotRanged = 3
+)
+
+type itemAffix struct {
+	Kind   uint8 // One of Affix*
+	Amount float32
+}
+
+type itemInstance struct {
+	Id         bson.ObjectId
+	Durability float32 // 1 is new, 0 is broken
+	Affixes    []itemAffix
+}
+
+// Return true if the items of this type are instances
+func isInstanceItem(def *itemDef) bool {
+	switch def.Category {
+	case ItemCategoryWeapon, ItemCategoryArmor, ItemCategoryHelmet, ItemCategoryRanged:
+		return def.Grade > 0
+	}
+	return false
+}
+
+// Create a new instance of an item. Every grade gives a chance of an affix.
+func newItemInstance(def *itemDef) *itemInstance {
+	inst := &itemInstance{Id: bson.NewObjectId(), Durability: 1}
+	for i := uint8(0); i < def.Grade; i++ {
+		if rand.Float32() >= CnfgAffixChance {
+			continue
+		}
+		kind := uint8(rand.Intn(len(affixKinds)))
+		k := &affixKinds[kind]
+		amount := (k.min + rand.Float32()*(k.max-k.min)) * float32(def.Grade)
+		inst.Affixes = append(inst.Affixes, itemAffix{Kind: kind, Amount: amount})
+	}
+	return inst
+}
+
+// The sum of all affixes of a kind. The instance may be nil.
+func (inst *itemInstance) affix(kind uint8) (sum float32) {
+	if inst == nil {
+		return 0
+	}
+	for _, a := range inst.Affixes {
+		if a.Kind == kind {
+			sum += a.Amount
+		}
+	}
+	return
+}
+
+// Return true if the item is broken. The instance may be nil.
+func (inst *itemInstance) broken() bool {
+	return inst != nil && inst.Durability <= 0
+}
+
+func (inst *itemInstance) String() string {
+	if inst == nil {
+		return ""
+	}
+	var list []string
+	for _, a := range inst.Affixes {
+		list = append(list, fmt.Sprintf("%s %.4f", affixKinds[a.Kind].name, a.Amount))
+	}
+	return fmt.Sprintf("durability %.0f%% [%s]", inst.Durability*100, strings.Join(list, ", "))
+}
+
+// The grade that an item works as. A broken item works as grade 0.
+func effectiveGrade(grade uint8, inst *itemInstance) uint8 {
+	if inst.broken() {
+		return 0
+	}
+	return grade
+}
+
+// The item in an equipment slot, and where the instance is stored
+func (pl *player) slot(slot uint8) (code ObjectCode, lvl uint32, inst **itemInstance) {
+	switch slot {
+	case EquipSlotWeapon:
+		return ConvertWeaponTypeToID(pl.WeaponGrade), pl.WeaponLvl, &pl.WeaponInst
+	case EquipSlotArmor:
+		return ConvertArmorTypeToID(pl.ArmorGrade), pl.ArmorLvl, &pl.ArmorInst
+	case EquipSlotHelmet:
+		return ConvertHelmetTypeToID(pl.HelmetGrade), pl.HelmetLvl, &pl.HelmetInst
+	case EquipSlotRanged:
+		return pl.Ranged, pl.RangedLvl, &pl.RangedInst
+	}
+	return "", 0, nil
+}
+
+// The sum of an affix kind for all equipped items
+func (pl *player) affixTotal(kind uint8) (sum float32) {
+	for _, inst := range []*itemInstance{pl.WeaponInst, pl.ArmorInst, pl.HelmetInst, pl.RangedInst} {
+		sum += inst.affix(kind)
+	}
+	return
+}
+
+// The damage multiplier of the melee weapon
+func (pl *player) weaponMultiplier() float32 {
+	return WeaponLevelDiffMultiplier(pl.Level, pl.WeaponLvl, effectiveGrade(pl.WeaponGrade, pl.WeaponInst)) * (1 + pl.affixTotal(AffixDamage))
+}
+
+// The damage multiplier of the ranged weapon, defined by 'def'
+func (pl *player) rangedMultiplier(def *itemDef) float32 {
+	return WeaponLevelDiffMultiplier(pl.Level, pl.RangedLvl, effectiveGrade(def.Grade, pl.RangedInst)) * (1 + pl.affixTotal(AffixDamage))
+}
+
+// The damage taken is divided by this, depending on the armor and the helmet
+func (pl *player) armorDivisor() float32 {
+	return ArmorLevelDiffMultiplier(ItemCategoryArmor, pl.Level, pl.ArmorLvl, effectiveGrade(pl.ArmorGrade, pl.ArmorInst)) *
+		ArmorLevelDiffMultiplier(ItemCategoryHelmet, pl.Level, pl.HelmetLvl, effectiveGrade(pl.HelmetGrade, pl.HelmetInst))
+}
+
+// Reduce the durability of equipped items. The client is updated from the client process, when the
+// durability passes a tenth or the item breaks.
+func (up *user) Wear_WLu(slots ...uint8) {
+	var broken []ObjectCode
+	up.Lock()
+	for _, s := range slots {
+		code, _, p := up.slot(s)
+		inst := *p
+		if inst == nil || inst.Durability <= 0 {
+			continue
+		}
+		old := inst.Durability
+		inst.Durability -= CnfgDurabilityLoss
+		if inst.Durability <= 0 {
+			inst.Durability = 0
+			broken = append(broken, code)
+			up.reportEquipment = true
+		}
+		if math.Floor(float64(old*10)) != math.Floor(float64(inst.Durability*10)) {
+			up.reportEquipment = true
+		}
+	}
+	up.Unlock()
+	for _, code := range broken {
+		up.Printf("!Your %s is broken", code)
+	}
+}
+
+// Create instances for equipment that was saved before there were instances. They get no affixes.
+// The player must be locked, or not yet available to others.
+func (pl *player) upgradeInstances() {
+	for s := uint8(EquipSlotWeapon); s <= EquipSlotRanged; s++ {
+		code, _, p := pl.slot(s)
+		if def := ItemLookup(code); *p == nil && def != nil && isInstanceItem(def) {
+			*p = &itemInstance{Id: bson.NewObjectId(), Durability: 1}
+		}
+	}
+	var inv PlayerInv
+	for _, obj := range pl.Inventory {
+		def := ItemLookup(obj.Type)
+		if obj.Inst != nil || def == nil || !isInstanceItem(def) {
+			inv = append(inv, obj)
+			continue
+		}
+		for i := uint32(0); i < obj.Count; i++ {
+			inv = append(inv, Object{Type: obj.Type, Level: obj.Level, Count: 1, Inst: &itemInstance{Id: bson.NewObjectId(), Durability: 1}})
+		}
+	}
+	pl.Inventory = inv
+}
+
+// Append the instance data to a message: the id, the durability (0-255) and the affixes. Every affix is the
+// kind and the amount in units of 1/10000. Items that are not instances have a zero id and no affixes.
+func appendInstance(b []byte, inst *itemInstance) []byte {
+	var id [12]byte
+	if inst == nil {
+		b = append(b, id[:]...)
+		return append(b, 0, 0)
+	}
+	copy(id[:], inst.Id)
+	b = append(b, id[:]...)
+	b = append(b, byte(inst.Durability*255+0.5), byte(len(inst.Affixes)))
+	for _, a := range inst.Affixes {
+		amount := uint16(math.Min(float64(a.Amount)*10000+0.5, math.MaxUint16))
+		b = append(b, a.Kind, byte(amount), byte(amount>>8))
+	}
+	return b
+}
+
+// Append an inventory entry to a CMD_UPD_INV message: the code, the count, the level and the instance data.
+func appendInventoryEntry(b []byte, obj *Object) []byte {
+	count := obj.Count
+	if count > math.MaxUint8 {
+		count = math.MaxUint8 // This is what can be shown to the client
+	}
+	var lvl [4]byte
+	EncodeUint32(obj.Level, lvl[:])
+	b = append(b, obj.Type[0:4]...)
+	b = append(b, byte(count))
+	b = append(b, lvl[:]...)
+	return appendInstance(b, obj.Inst)
+}
+
+// Set the length of a message built with append
+func setMessageLength(b []byte) []byte {
+	b[0] = byte(len(b))
+	b[1] = byte(len(b) >> 8)
+	return b
+}
+
+// The cost in gold to repair an item at a vendor
+func repairCost(grade uint8, lvl uint32, inst *itemInstance) uint32 {
+	return uint32(math.Ceil(float64((1 - inst.Durability) * float32(grade) * float32(lvl+1) * CnfgRepairGoldPerLevel)))
+}
+
+// Repair all equipped items, at a vendor for gold or with materials
+func (up *user) Repair_WLuBl(withMaterials bool) {
+	if !withMaterials {
+		if _, def := up.nearestVendor_RLq(); def == nil {
+			up.Printf_Bl("#FAIL !There is no vendor near")
+			return
+		}
+	}
+	var failure string
+	var gold uint32
+	need := make(map[ObjectCode]uint32) // Materials
+	var repaired []*itemInstance
+	up.Lock()
+	for s := uint8(EquipSlotWeapon); s <= EquipSlotRanged; s++ {
+		code, lvl, p := up.slot(s)
+		inst := *p
+		def := ItemLookup(code)
+		if inst == nil || inst.Durability >= 1 || def == nil {
+			continue
+		}
+		repaired = append(repaired, inst)
+		if !withMaterials {
+			gold += repairCost(def.Grade, lvl, inst)
+			continue
+		}
+		r := currentCrafting().repairOf(def.Category)
+		if r == nil {
+			failure = fmt.Sprintf("There is no way to repair %s with materials", code)
+			break
+		}
+		need[ObjectCode(r.Item)] += uint32(math.Ceil(float64(float32(r.Count) * (1 - inst.Durability))))
+	}
+	for code, n := range need {
+		if failure == "" && up.Inventory.countAll(code) < n {
+			failure = fmt.Sprintf("You need %dx%s", n, code)
+		}
+	}
+	if failure == "" && !up.changeGold(-int64(gold)) {
+		failure = fmt.Sprintf("You need %d gold", gold)
+	}
+	type changed struct {
+		code ObjectCode
+		lvl  uint32
+	}
+	var report []changed
+	if failure == "" {
+		for code, n := range need {
+			for _, l := range up.Inventory.removeAll(code, n) {
+				report = append(report, changed{code, l})
+			}
+		}
+		for _, inst := range repaired {
+			inst.Durability = 1
+		}
+	}
+	balance := up.Gold
+	up.Unlock()
+	switch {
+	case failure != "":
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	case len(repaired) == 0:
+		up.Printf_Bl("!Nothing needs to be repaired")
+		return
+	}
+	if gold > 0 {
+		up.reportGold(-int64(gold), balance, "repair")
+	}
+	reported := make(map[changed]bool)
+	for _, c := range report {
+		if !reported[c] {
+			reported[c] = true
+			ReportOneInventoryItem_WluBl(up, c.code, c.lvl)
+		}
+	}
+	up.ReportEquipment_Bl(up)
+	up.Printf_Bl("!%d items repaired", len(repaired))
+}
+
+// Decode CMD_REPAIR. The argument is 0 to repair at a vendor, and 1 to repair with materials.
+func (up *user) CmdRepair_WLuBl(b []byte) {
+	if len(b) != 1 {
+		return
+	}
+	up.Repair_WLuBl(b[0] == 1)
+}
+
+// Manage the "/repair" command
+func (up *user) RepairCommand_WLuBl(args []string) {
+	switch {
+	case len(args) == 0 || args[0] == "gold":
+		up.Repair_WLuBl(false)
+	case args[0] == "materials":
+		up.Repair_WLuBl(true)
+	case args[0] == "show":
+		up.RLock()
+		for s := uint8(EquipSlotWeapon); s <= EquipSlotRanged; s++ {
+			if code, lvl, p := up.slot(s); *p != nil {
+				up.Printf("!%s level %d: %v", code, lvl, *p)
+			}
+		}
+		up.RUnlock()
+	default:
+		up.Printf_Bl("#FAIL !Usage: /repair [gold|materials|show]")
+	}
+}
+
+// Return true if an item of type 'def' and rank 'newRank' shall replace the equipped item. A better item
+// always does. Another instance of the same rank does, as it may have other affixes, and anything replaces
+// a broken item.
+func replacesEquipment(oldRank, newRank uint32, old *itemInstance, def *itemDef) bool {
+	return oldRank < newRank || oldRank == newRank && isInstanceItem(def) || old.broken()
+}
+
+// Make an item instance the next one to be used, as requested by the client. The id is optional.
+func (up *user) SelectInstance_WLu(id []byte) {
+	if len(id) != 12 {
+		return
+	}
+	up.Lock()
+	up.Inventory.Select(bson.ObjectId(id))
+	up.Unlock()
+}
+
+// Tell the client about the equipment, if the durability has changed
+func (up *user) ReportWear_WLuBl() {
+	up.Lock()
+	report := up.reportEquipment
+	up.reportEquipment = false
+	up.Unlock()
+	if report {
+		up.ReportEquipment_Bl(up)
+	}
+}
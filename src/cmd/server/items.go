@@ -0,0 +1,278 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// The item catalog. All item types are defined in a JSON file, loaded at startup. The file can be
+// reloaded while the server is running, using the admin command "/reload items".
+// If there is no file, a built-in catalog is used, equivalent to the original hard-coded items.
+//
+// The catalog is never modified once created, a reload replaces it completely. That means an
+// *itemDef can be used without locking.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// Item categories. The category decides how an item is used.
+const (
+	ItemCategoryPotion   = "potion"
+	ItemCategoryWeapon   = "weapon"
+	ItemCategoryArmor    = "armor"
+	ItemCategoryHelmet   = "helmet"
+	ItemCategoryScroll   = "scroll"
+	ItemCategoryRanged   = "ranged"
+	ItemCategoryMaterial = "material" // Used for building and crafting, see crafting.go
+)
+
+// Use effects, for categories where there are more than one possibility.
+const (
+	ItemUseHeal        = "heal"        // Restore hit points, 'Amount' is the fraction
+	ItemUseMana        = "mana"        // Restore mana, 'Amount' is the fraction
+	ItemUseRevivePoint = "revivepoint" // Set the revive point to the current position
+	ItemUseEffect      = "effect"      // Apply the status effect 'Effect', 'Amount' is the amount
+)
+
+// The definition of one item type, as found in the item file.
+type itemDef struct {
+	Code       ObjectCode // Unique 4 character code. This is what the client uses to identify the item.
+	Name       string     // A descriptive name
+	Category   string     // One of ItemCategory*
+	Grade      uint8      // Used for equipment. Higher grades are better.
+	Modifier   float32    // The combat modifier for equipment of this grade, near 1
+	Use        string     // One of ItemUse*, if applicable
+	Amount     float32    // Depends on 'Use'
+	StackLimit uint32     // Max number of items of the same type and level in the inventory. 0 means no limit.
+	DropValue  float32    // Value when sold to a vendor, see ItemValueAsDrop. 0 means it has no value.
+	Range      float64    // Ranged weapons: max distance to the target, in blocks
+	Speed      float64    // Ranged weapons: projectile speed, in blocks per second
+	ManaCost   float32    // Ranged weapons: mana used for every projectile
+	Projectile uint8      // Ranged weapons: the model the client shall use for the projectile
+	Effect     string     // Effect potions: the status effect
+	Duration   float64    // Effect potions: the duration of the status effect, in seconds
+}
+
+type itemCatalog struct {
+	byCode  map[ObjectCode]*itemDef
+	byGrade map[string]map[uint8]*itemDef // Equipment, indexed by category and grade
+}
+
+var (
+	itemCatalogSem sync.RWMutex
+	items          *itemCatalog = mustMakeItemCatalog(defaultItemDefs)
+)
+
+// The item definitions used when there is no item file.
+var defaultItemDefs = []itemDef{
+	{Code: ItemHealthPotionID, Name: "Health potion", Category: ItemCategoryPotion, Use: ItemUseHeal, Amount: 0.3},
+	{Code: ItemManaPotionID, Name: "Mana potion", Category: ItemCategoryPotion, Use: ItemUseMana, Amount: 0.3},
+	{Code: ItemRegenPotionID, Name: "Regeneration potion", Category: ItemCategoryPotion, Use: ItemUseEffect, Effect: "regeneration", Amount: 0.02, Duration: 30},
+	{Code: ItemShieldPotionID, Name: "Shield potion", Category: ItemCategoryPotion, Use: ItemUseEffect, Effect: "shield", Amount: 0.3, Duration: 60},
+	{Code: ItemWpnHandsID, Name: "Bare hands", Category: ItemCategoryWeapon, Grade: 0, Modifier: 0.9, DropValue: 1},
+	{Code: ItemWeapon1ID, Name: "Basic weapon", Category: ItemCategoryWeapon, Grade: 1, Modifier: 1.0, DropValue: 1},
+	{Code: ItemWeapon2ID, Name: "Good weapon", Category: ItemCategoryWeapon, Grade: 2, Modifier: 1.1, DropValue: 1},
+	{Code: ItemWeapon3ID, Name: "Fine weapon", Category: ItemCategoryWeapon, Grade: 3, Modifier: 1.2, DropValue: 1},
+	{Code: ItemWeapon4ID, Name: "Epic weapon", Category: ItemCategoryWeapon, Grade: 4, Modifier: 1.3, DropValue: 1},
+	{Code: ItemArmorNoneId, Name: "No armor", Category: ItemCategoryArmor, Grade: 0, Modifier: 0.9, DropValue: 1},
+	{Code: ItemArmor1ID, Name: "Basic armor", Category: ItemCategoryArmor, Grade: 1, Modifier: 1.0, DropValue: 1},
+	{Code: ItemArmor2ID, Name: "Good armor", Category: ItemCategoryArmor, Grade: 2, Modifier: 1.1, DropValue: 1},
+	{Code: ItemArmor3ID, Name: "Fine armor", Category: ItemCategoryArmor, Grade: 3, Modifier: 1.2, DropValue: 1},
+	{Code: ItemArmor4ID, Name: "Epic armor", Category: ItemCategoryArmor, Grade: 4, Modifier: 1.3, DropValue: 1},
+	{Code: ItemHelmetNoneId, Name: "No helmet", Category: ItemCategoryHelmet, Grade: 0, Modifier: 0.9, DropValue: 1},
+	{Code: ItemHelmet1ID, Name: "Basic helmet", Category: ItemCategoryHelmet, Grade: 1, Modifier: 1.0, DropValue: 1},
+	{Code: ItemHelmet2ID, Name: "Good helmet", Category: ItemCategoryHelmet, Grade: 2, Modifier: 1.1, DropValue: 1},
+	{Code: ItemHelmet3ID, Name: "Fine helmet", Category: ItemCategoryHelmet, Grade: 3, Modifier: 1.2, DropValue: 1},
+	{Code: ItemHelmet4ID, Name: "Epic helmet", Category: ItemCategoryHelmet, Grade: 4, Modifier: 1.3, DropValue: 1},
+	{Code: ItemScrollRessID, Name: "Resurrection scroll", Category: ItemCategoryScroll, Grade: 1, Use: ItemUseRevivePoint, DropValue: 1},
+	{Code: ItemBow1ID, Name: "Short bow", Category: ItemCategoryRanged, Grade: 1, Modifier: 0.8, DropValue: 1, Range: 15, Speed: 20},
+	{Code: ItemWand1ID, Name: "Apprentice wand", Category: ItemCategoryRanged, Grade: 1, Modifier: 1.0, DropValue: 1, Range: 12, Speed: 15, ManaCost: 0.05, Projectile: 1},
+}
+
+// Build a catalog from a list of definitions, and verify that they are consistent.
+func makeItemCatalog(defs []itemDef) (*itemCatalog, error) {
+	cat := &itemCatalog{byCode: make(map[ObjectCode]*itemDef), byGrade: make(map[string]map[uint8]*itemDef)}
+	for i := range defs {
+		def := &defs[i]
+		if len(def.Code) != 4 {
+			return nil, fmt.Errorf("item code '%s' must be 4 characters", def.Code)
+		}
+		if _, ok := cat.byCode[def.Code]; ok {
+			return nil, fmt.Errorf("item code '%s' defined twice", def.Code)
+		}
+		switch def.Category {
+		case ItemCategoryWeapon, ItemCategoryArmor, ItemCategoryHelmet:
+			if cat.byGrade[def.Category] == nil {
+				cat.byGrade[def.Category] = make(map[uint8]*itemDef)
+			}
+			if _, ok := cat.byGrade[def.Category][def.Grade]; ok {
+				return nil, fmt.Errorf("item '%s': %s grade %d defined twice", def.Code, def.Category, def.Grade)
+			}
+			cat.byGrade[def.Category][def.Grade] = def
+		case ItemCategoryRanged:
+			if def.Range <= CnfgMeleeDistLimit || def.Range > CnfgMonsterAggroDistance || def.Speed <= 0 {
+				return nil, fmt.Errorf("item '%s': ranged weapon needs a range beyond melee and a speed", def.Code)
+			}
+			if def.ManaCost < 0 || def.ManaCost > 1 {
+				return nil, fmt.Errorf("item '%s': mana cost must be 0-1", def.Code)
+			}
+		case ItemCategoryPotion:
+			if def.Use == ItemUseEffect {
+				if _, ok := FindEffectKind(def.Effect); !ok || def.Amount <= 0 || def.Duration <= 0 {
+					return nil, fmt.Errorf("item '%s': potion needs a known effect, an amount and a duration", def.Code)
+				}
+			} else if def.Use != ItemUseHeal && def.Use != ItemUseMana {
+				return nil, fmt.Errorf("item '%s': unknown potion use '%s'", def.Code, def.Use)
+			}
+		case ItemCategoryScroll:
+			if def.Use != ItemUseRevivePoint {
+				return nil, fmt.Errorf("item '%s': unknown scroll use '%s'", def.Code, def.Use)
+			}
+		case ItemCategoryMaterial:
+		default:
+			return nil, fmt.Errorf("item '%s': unknown category '%s'", def.Code, def.Category)
+		}
+		cat.byCode[def.Code] = def
+	}
+	// The "none" items, of grade 0, are needed as they represent no equipment at all.
+	for _, c := range []string{ItemCategoryWeapon, ItemCategoryArmor, ItemCategoryHelmet} {
+		if cat.byGrade[c][0] == nil {
+			return nil, fmt.Errorf("missing %s of grade 0", c)
+		}
+	}
+	return cat, nil
+}
+
+func mustMakeItemCatalog(defs []itemDef) *itemCatalog {
+	cat, err := makeItemCatalog(defs)
+	if err != nil {
+		log.Panicln("Built-in item catalog:", err)
+	}
+	return cat
+}
+
+// Parse an item file in JSON format.
+func parseItemCatalog(data []byte) (*itemCatalog, error) {
+	var defs []itemDef
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, err
+	}
+	if len(defs) == 0 {
+		return nil, errors.New("no items defined")
+	}
+	return makeItemCatalog(defs)
+}
+
+func readItemCatalog(fileName string) (*itemCatalog, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	cat, err := parseItemCatalog(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return cat, nil
+}
+
+// Load the item catalog from file, replacing the current one. The current catalog is kept if there is an error.
+func LoadItemCatalog(fileName string) error {
+	cat, err := readItemCatalog(fileName)
+	if err != nil {
+		return err
+	}
+	installItemCatalog(cat, fileName)
+	return nil
+}
+
+// Reload the item catalog from file. The catalog is only replaced if the current loot tables, recipes,
+// dialogs and active quests can still be used with it.
+func ReloadItemCatalog_RLaRLu(fileName string) error {
+	cat, err := readItemCatalog(fileName)
+	if err != nil {
+		return err
+	}
+	if err = verifyLootTables(currentLootTables(), cat); err != nil {
+		return fmt.Errorf("%s: loot %v", fileName, err)
+	}
+	if err = currentCrafting().verifyItems(cat); err != nil {
+		return fmt.Errorf("%s: crafting %v", fileName, err)
+	}
+	if err = verifyDialogItems(cat); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	if err = verifyQuestItems_RLaRLu(cat); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	installItemCatalog(cat, fileName)
+	return nil
+}
+
+func installItemCatalog(cat *itemCatalog, fileName string) {
+	itemCatalogSem.Lock()
+	items = cat
+	itemCatalogSem.Unlock()
+	log.Println("Loaded", len(cat.byCode), "items from", fileName)
+}
+
+func currentItemCatalog() *itemCatalog {
+	itemCatalogSem.RLock()
+	defer itemCatalogSem.RUnlock()
+	return items
+}
+
+// Find the definition of an item. Return nil if there is no such item.
+func ItemLookup(code ObjectCode) *itemDef {
+	return currentItemCatalog().byCode[code]
+}
+
+// Find the equipment of a category and grade. Return nil if there is no such item.
+func ItemByGrade(category string, grade uint8) *itemDef {
+	return currentItemCatalog().byGrade[category][grade]
+}
+
+// Get the combat modifier of an equipment category and grade.
+func ItemGradeModifier(category string, grade uint8) float32 {
+	if def := ItemByGrade(category, grade); def != nil && def.Modifier != 0 {
+		return def.Modifier
+	}
+	return 1.0
+}
+
+// Get a sorted list of all item codes
+func ItemCodes() []string {
+	cat := currentItemCatalog()
+	ret := make([]string, 0, len(cat.byCode))
+	for code := range cat.byCode {
+		ret = append(ret, string(code))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Return true if 'n' more items of the type and level can be added to the inventory.
+func (inv PlayerInv) Room(t ObjectCode, lvl uint32, n uint32) bool {
+	def := ItemLookup(t)
+	return def == nil || def.StackLimit == 0 || inv.Count(t, lvl)+n <= def.StackLimit
+}
@@ -129,11 +129,16 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 				}
 				// Tell everyone near if the player moved
 				up.checkOnePlayerPosChanged_RLuWLqBl(fullReport)
+				up.ManageCasting_WLuBl(now)
+				up.ReportEffects_RLuBl()
+				up.ReportWear_WLuBl()
+				up.ReportAchievements_WLuWLhRLaBl()
 			}
 			delta = now.Sub(previousAttack)
 			if delta > CnfgAttackPeriod {
 				previousAttack = now
 				up.ManageAttackPeriod_WLuBl(delta) // Manage general attacking tasks
+				up.ReportParty_RLuBl()
 			}
 		}
 		if up.updatedStats {
@@ -300,6 +305,12 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 				return
 			}
 			up.CmdAttackMonster_WLuRLm(buff[3:7])
+		case CMD_ATTACK_PLAYER:
+			if length != 7 {
+				log.Printf("CMD_ATTACK_PLAYER illegal length: %v\n", buff[0:length])
+				return
+			}
+			up.CmdAttackPlayer_WLuBl(buff[3:7])
 		case CMD_PLAYER_ACTION:
 			if length != 4 {
 				log.Printf("CMD_PLAYER_ACTION illegal length: %v\n", buff[0:length])
@@ -352,7 +363,7 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 				bl := block(b[3])
 				if bl == BT_Teleport {
 					cp := ChunkFind_WLwWLc(cc)
-					cp.SetTeleport(cc, up, b[0], b[1], b[2])
+					cp.SetTeleport_RLg(cc, up, b[0], b[1], b[2])
 				} else {
 					// log.Printf("Attach block %v at chunk %v\n", bl, cc)
 					CmdAttachBlock_WLwWLcRLq(cc, b[0], b[1], b[2], bl, i)
@@ -388,27 +399,22 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 		case CMD_USE_ITEM:
 			code := ObjectCode(buff[3:7])
 			lvl := uint32(0)
-			if length == 11 {
+			if length >= 11 {
 				// This is the new proper way, where a level of the item is also provided,
 				// but some clients remains with the old format. TODO: Clean up.
 				lvl, _, _ = ParseUint32(buff[7:11])
 			}
+			if length > 11 {
+				up.SelectInstance_WLu(buff[11:length]) // Optional instance id
+			}
 			up.Inventory.Use_WluBl(up, code, lvl)
 		case CMD_DROP_ITEM:
 			code := ObjectCode(buff[3:7])
 			lvl, _, _ := ParseUint32(buff[7:11])
-			up.Lock()
-			// The Use function will not really do anything, only return a function. That way, only a read lock is needed.
-			// The reason for this is that the Use function will do callbacks that will, in turn, lock what is needed. As this is
-			// not known now, except that we know the user has to be read locked.
-			val := ItemValueAsDrop(up.Level, lvl, code) * CnfgItemRewardNormalizer
-			if val >= 0 {
-				up.Inventory.Remove(code, lvl)
-				up.AddExperience(val)
+			if length > 11 {
+				up.SelectInstance_WLu(buff[11:length]) // Optional instance id
 			}
-			up.Unlock()
-			// log.Println("CMD_DROP_ITEM", code, lvl, val)
-			ReportOneInventoryItem_WluBl(up, code, lvl)
+			up.DropItem_WLuBl(code, lvl)
 		case CMD_REQ_PLAYER_INFO:
 			uid, _, _ := ParseUint32(buff[3:7])
 			allPlayersSem.RLock()
@@ -437,6 +443,30 @@ func ManageOneClient2_WLuWLqWLmBlWLcWLw(conn net.Conn, i int) {
 			}
 		case CMD_TELEPORT:
 			up.Teleport(buff[3:length])
+		case CMD_TRADE:
+			up.CmdTrade_WLuBl(buff[3:length])
+		case CMD_CHEST_OPEN:
+			up.CmdChestOpen_WLwWLcBl(buff[3:length])
+		case CMD_CHEST_MOVE:
+			up.CmdChestMove_WLuWLwWLcBl(buff[3:length])
+		case CMD_USE_BLOCK:
+			up.CmdUseBlock_WLwWLcRLqBl(buff[3:length])
+		case CMD_NPC_TALK:
+			up.CmdNPCTalk_RLuBl(buff[3:length])
+		case CMD_NPC_ANSWER:
+			up.CmdNPCAnswer_WLuBl(buff[3:length])
+		case CMD_VENDOR_BUY:
+			up.CmdVendorBuy_WLuBl(buff[3:length])
+		case CMD_AUCTION_SEARCH:
+			up.CmdAuctionSearch_Bl(buff[3:length])
+		case CMD_AUCTION_SELL:
+			up.CmdAuctionSell_WLuBl(buff[3:length])
+		case CMD_AUCTION_BUY:
+			up.CmdAuctionBuy_WLuBl(buff[3:length])
+		case CMD_CRAFT:
+			up.CmdCraft_WLuBl(buff[3:length])
+		case CMD_REPAIR:
+			up.CmdRepair_WLuBl(buff[3:length])
 		case CMD_ERROR_REPORT:
 			log.Printf("Error message for %v: %s\n", up.Name, string(buff[3:length]))
 		default:
@@ -476,6 +506,17 @@ func MakeDirectionsCommand(i int, b []byte) {
 }
 
 func (up *user) ManageAttackPeriod_WLuBl(delta time.Duration) {
+	if up.Level != up.learnedLevel {
+		up.learnedLevel = up.Level
+		if up.learnAbilities_WLu() {
+			up.ReportAbilities_Bl()
+		}
+	}
+	up.TickEffects_WLuBl(delta)
+	up.ManageQuests_WLuBl()
+	if up.ManagePvP_WLuBl() {
+		return
+	}
 	mp := up.aggro
 	dist2 := float64(0) // Distance to monster, squared
 	if mp != nil {
@@ -493,10 +534,14 @@ func (up *user) ManageAttackPeriod_WLuBl(delta time.Duration) {
 			up.flags &= ^UserFlagInFight
 			up.Unlock()
 			up.updatedStats = true
+		} else if up.effects.has(EffectStun, time.Now()) {
+			// Can't attack
 		} else {
 			if dist2 <= CnfgMeleeDistLimit*CnfgMeleeDistLimit {
 				// Close enough to hit
 				mp.Hit_WLuBl(up, 1)
+			} else {
+				up.FireProjectile_WLuBl(mp)
 			}
 		}
 	} else if !up.Dead && up.aggro == nil && (up.HitPoints != 1 || up.Mana != 1) {
@@ -0,0 +1,610 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Logic circuits. Connected links, triggers and activators form a net. A net is high when it is driven
+// by a trigger (for one tick, when a player pass through it), by the output of a logic gate, by a lever
+// that is on or by a pressure plate that a player stands on. Nets continue into neighbor chunks of the same
+// owner, through the border ports found by ComputeLinks. Doors in a net open when the net goes high, and
+// close when it goes low, see doors.go.
+//
+// A logic gate has its output in the block above, and the inputs in the other five neighbor blocks.
+// The gates are evaluated every tick, and the outputs are used in the next tick. Text activators in a
+// net are activated when the net goes high, on behalf of the nearest player. Text activators connected
+// directly to a trigger in the same chunk are activated by the trigger as before, and not again here.
+//
+// The configuration and the state of counters and latches are saved with the chunk in the PART_LOGIC
+// partition. The nets are recomputed when the chunk is changed. Every chunk with logic gates or border
+// ports is registered, and the logic process locks one chunk at a time.
+//
+
+import (
+	"chunkdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"math"
+	"strconv"
+	"time"
+	"timerstats"
+	. "twof"
+)
+
+// There is one instance for each logic gate in a chunk. The exported fields are saved with the chunk.
+type logicGate struct {
+	X, Y, Z uint8 // Position inside the chunk
+	Param   uint8 // Delay: number of ticks. Counter: inputs for every output. Pulse: number of ticks.
+	Out     bool  // The current output
+	Count   uint8 // Counter: number of inputs so far. Pulse: remaining ticks.
+	in      bool  // The input in the previous tick
+	history uint32
+}
+
+// Global block coordinate
+type logicPos struct {
+	X, Y, Z int32
+}
+
+// A net that continues into the neighbor chunk
+type logicPort struct {
+	inside, outside logicPos
+}
+
+type logicNet struct {
+	ports []logicPort
+	sinks []uint32 // The text activators in the net, see abKey
+	doors []uint32 // The doors in the net, see abKey
+	prev  bool     // The level in the previous tick
+}
+
+// The logic of a chunk, computed by ComputeLinks
+type logicGraph struct {
+	nets    []logicNet
+	members map[uint32]int // The net of every conductor, see abKey. It is not changed after it has been computed.
+	gateIn  [][]int        // The input nets of every gate in chunk.gates
+	gateOut []int          // The output net of every gate, or -1
+	levers  []int          // Nets driven by levers that are on
+	plates  []uint32       // The pressure plates, see abKey
+	pulses  []int          // Nets pulsed by triggers since the last tick
+}
+
+// Return true if the block is a logic gate
+func isLogicGate(bl block) bool {
+	return bl >= BT_Latch && bl <= BT_And
+}
+
+// Return true if the block is part of a net
+func isLogicConductor(bl block) bool {
+	switch bl {
+	case BT_Link, BT_Trigger, BT_DeTrigger, BT_Quest, BT_Text, BT_Spawn:
+		return true
+	case BT_Door, BT_DoorOpen, BT_Lever, BT_LeverOn, BT_Plate:
+		return true
+	}
+	return false
+}
+
+// The default parameter of a gate
+func logicDefaultParam(bl block) uint8 {
+	switch bl {
+	case BT_Delay, BT_Pulse:
+		return CnfgLogicDefaultTicks
+	case BT_Counter:
+		return 2
+	}
+	return 0
+}
+
+// Update the gate from the input levels. The kind is the block type of the gate.
+// Return true if the saved state changed.
+func (g *logicGate) tick(kind block, inputs []bool) bool {
+	high, any := 0, false
+	for _, in := range inputs {
+		if in {
+			high++
+			any = true
+		}
+	}
+	rising := any && !g.in
+	g.in = any
+	out, count := g.Out, g.Count
+	switch kind {
+	case BT_And:
+		g.Out = len(inputs) > 0 && high == len(inputs)
+	case BT_Or:
+		g.Out = any
+	case BT_Not:
+		g.Out = !any
+	case BT_Delay:
+		g.history <<= 1
+		if any {
+			g.history |= 1
+		}
+		g.Out = g.history&(1<<(g.Param-1)) != 0
+	case BT_Counter:
+		g.Out = false
+		if rising {
+			g.Count++
+			if g.Count >= g.Param {
+				g.Count = 0
+				g.Out = true
+			}
+		}
+	case BT_Pulse:
+		if rising {
+			g.Count = g.Param
+		}
+		g.Out = g.Count > 0
+		if g.Count > 0 {
+			g.Count--
+		}
+	case BT_Latch:
+		if rising {
+			g.Out = !g.Out
+		}
+	}
+	// Only counters and latches have a state that is worth saving
+	return (kind == BT_Counter || kind == BT_Latch) && (out != g.Out || count != g.Count)
+}
+
+// Find the gate at the specified position. Return nil if there is none. The chunk must be locked.
+func (cp *chunk) findGate(x, y, z uint8) *logicGate {
+	for i := range cp.gates {
+		if g := &cp.gates[i]; g.X == x && g.Y == y && g.Z == z {
+			return g
+		}
+	}
+	return nil
+}
+
+// Find all nets and gates in the chunk. Nets that reach the chunk border get ports. The chunk must be locked.
+func (ch *chunk) computeLogic() {
+	net := make(map[uint32]int) // The net of every conductor, see abKey
+	var g logicGraph
+	var seeds []uint32 // The first conductor of every net
+	var gates []logicGate
+	ports := 0
+	base := logicPos{ch.Coord.X * CHUNK_SIZE, ch.Coord.Y * CHUNK_SIZE, ch.Coord.Z * CHUNK_SIZE}
+	for x := 0; x < CHUNK_SIZE; x++ {
+		for y := 0; y < CHUNK_SIZE; y++ {
+			for z := 0; z < CHUNK_SIZE; z++ {
+				bl := ch.rc[x][y][z]
+				if isLogicGate(bl) {
+					gate := logicGate{X: uint8(x), Y: uint8(y), Z: uint8(z), Param: logicDefaultParam(bl)}
+					if old := ch.findGate(uint8(x), uint8(y), uint8(z)); old != nil {
+						gate = *old
+					}
+					gates = append(gates, gate)
+					continue
+				}
+				if !isLogicConductor(bl) {
+					continue
+				}
+				if _, ok := net[abKey(x, y, z)]; ok {
+					continue
+				}
+				// A new net, find all connected conductors
+				n := len(g.nets)
+				g.nets = append(g.nets, logicNet{})
+				ln := &g.nets[n]
+				net[abKey(x, y, z)] = n
+				seeds = append(seeds, abKey(x, y, z))
+				stack := []logicPos{{int32(x), int32(y), int32(z)}}
+				for len(stack) > 0 {
+					p := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					switch key := abKey(int(p.X), int(p.Y), int(p.Z)); ch.rc[p.X][p.Y][p.Z] {
+					case BT_Text:
+						ln.sinks = append(ln.sinks, key)
+					case BT_Door, BT_DoorOpen:
+						ln.doors = append(ln.doors, key)
+					case BT_LeverOn:
+						g.levers = append(g.levers, n)
+					case BT_Plate:
+						g.plates = append(g.plates, key)
+					}
+					for _, d := range logicNeighbors {
+						q := logicPos{p.X + d.X, p.Y + d.Y, p.Z + d.Z}
+						if q.X < 0 || q.Y < 0 || q.Z < 0 || q.X >= CHUNK_SIZE || q.Y >= CHUNK_SIZE || q.Z >= CHUNK_SIZE {
+							// The net may continue in the neighbor chunk
+							inside := logicPos{base.X + p.X, base.Y + p.Y, base.Z + p.Z}
+							outside := logicPos{base.X + q.X, base.Y + q.Y, base.Z + q.Z}
+							ln.ports = append(ln.ports, logicPort{inside, outside})
+							ports++
+							continue
+						}
+						key := abKey(int(q.X), int(q.Y), int(q.Z))
+						if _, ok := net[key]; ok || !isLogicConductor(ch.rc[q.X][q.Y][q.Z]) {
+							continue
+						}
+						net[key] = n
+						stack = append(stack, q)
+					}
+				}
+			}
+		}
+	}
+	// Connect the gates. Neighbors outside of the chunk are not used.
+	for _, gate := range gates {
+		out := -1
+		var in []int
+		for _, d := range logicNeighbors {
+			x, y, z := int(gate.X)+int(d.X), int(gate.Y)+int(d.Y), int(gate.Z)+int(d.Z)
+			if x < 0 || y < 0 || z < 0 || x >= CHUNK_SIZE || y >= CHUNK_SIZE || z >= CHUNK_SIZE {
+				continue
+			}
+			n, ok := net[abKey(x, y, z)]
+			switch {
+			case !ok:
+			case d.Z == 1:
+				out = n
+			default:
+				in = append(in, n)
+			}
+		}
+		g.gateIn = append(g.gateIn, in)
+		g.gateOut = append(g.gateOut, out)
+	}
+	g.members = net
+	// Keep the levels from the previous computation, to prevent activators from being activated again
+	if old := ch.logic; old != nil {
+		for n, key := range seeds {
+			if on, ok := old.members[key]; ok {
+				g.nets[n].prev = old.nets[on].prev
+			}
+		}
+	}
+	ch.gates = gates
+	if len(gates) == 0 && ports == 0 && len(g.levers) == 0 && len(g.plates) == 0 && !logicHasDoors(&g) {
+		ch.logic = nil
+	} else {
+		ch.logic = &g
+	}
+	registerLogicChunk(ch)
+}
+
+// Return true if there are doors in any of the nets
+func logicHasDoors(g *logicGraph) bool {
+	for _, n := range g.nets {
+		if len(n.doors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// The six neighbor directions
+var logicNeighbors = []logicPos{{1, 0, 0}, {-1, 0, 0}, {0, 1, 0}, {0, -1, 0}, {0, 0, 1}, {0, 0, -1}}
+
+var (
+	logicChunks      = make(map[chunkdb.CC]*chunk) // All chunks with logic
+	logicChunksMutex sync.Mutex
+)
+
+// Add or remove the chunk from the list of chunks with logic.
+func registerLogicChunk(ch *chunk) {
+	logicChunksMutex.Lock()
+	if ch.logic != nil {
+		logicChunks[ch.Coord] = ch
+	} else if logicChunks[ch.Coord] == ch {
+		delete(logicChunks, ch.Coord)
+	}
+	logicChunksMutex.Unlock()
+}
+
+// Remove the chunk from the list of chunks with logic, when it is released from the cache.
+func unregisterLogicChunk(ch *chunk) {
+	logicChunksMutex.Lock()
+	if logicChunks[ch.Coord] == ch {
+		delete(logicChunks, ch.Coord)
+	}
+	logicChunksMutex.Unlock()
+}
+
+// A trigger was passed by a player. The chunk must be locked.
+func (ch *chunk) pulseLogic(x, y, z uint8) {
+	if ch.logic == nil {
+		return
+	}
+	if n, ok := ch.logic.members[abKey(int(x), int(y), int(z))]; ok {
+		ch.logic.pulses = append(ch.logic.pulses, n)
+	}
+}
+
+// A copy of the logic of one chunk, used to compute the levels of all nets without locking the chunks.
+type logicSnap struct {
+	cp         *chunk
+	owner      uint32 // Nets are only joined with nets in chunks of the same owner
+	graph      *logicGraph
+	ports      [][]logicPort // The ports of every net
+	driven     []bool        // Nets driven by a gate, a lever, a plate or a trigger
+	gateDriven []bool        // Nets driven by a gate, a lever or a plate
+	pulsed     []bool        // Nets pulsed by a trigger
+	plates     []uint32      // The pressure plates, see abKey
+	level      []bool        // Computed: the level of the net, including connected nets in other chunks
+	activate   []bool        // Computed: the text activators of the net shall be activated, if the level rises
+}
+
+// Make a copy of the nets of the chunk, and find out what drives them. The pulses from triggers are consumed.
+// Return nil if there is no logic in the chunk.
+func (cp *chunk) snapLogic() *logicSnap {
+	cp.Lock()
+	defer cp.Unlock()
+	g := cp.logic
+	if g == nil {
+		return nil
+	}
+	s := &logicSnap{cp: cp, owner: cp.owner, graph: g, plates: g.plates}
+	s.ports = make([][]logicPort, len(g.nets))
+	s.driven = make([]bool, len(g.nets))
+	s.gateDriven = make([]bool, len(g.nets))
+	s.pulsed = make([]bool, len(g.nets))
+	for n := range g.nets {
+		s.ports[n] = g.nets[n].ports
+	}
+	for _, n := range g.pulses {
+		s.driven[n], s.pulsed[n] = true, true
+	}
+	g.pulses = nil
+	for i := range cp.gates {
+		if out := g.gateOut[i]; out >= 0 && cp.gates[i].Out {
+			s.driven[out], s.gateDriven[out] = true, true
+		}
+	}
+	for _, n := range g.levers {
+		s.driven[n], s.gateDriven[n] = true, true
+	}
+	return s
+}
+
+// Compute the levels of all nets, where connected nets in different chunks are joined. Nets are only joined
+// if the chunks have the same owner, or a player could control the logic in the territory of someone else.
+func solveLogic(snaps []*logicSnap) {
+	// Union-find, where every net has an id
+	var parent []int
+	first := make([]int, len(snaps)) // The id of the first net of every snap
+	for i, s := range snaps {
+		first[i] = len(parent)
+		for range s.ports {
+			parent = append(parent, len(parent))
+		}
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	inside := make(map[logicPos]int)
+	owner := make([]uint32, len(parent)) // The owner of the chunk of every net
+	for i, s := range snaps {
+		for n, ports := range s.ports {
+			owner[first[i]+n] = s.owner
+			for _, p := range ports {
+				inside[p.inside] = first[i] + n
+			}
+		}
+	}
+	for i, s := range snaps {
+		for n, ports := range s.ports {
+			for _, p := range ports {
+				if other, ok := inside[p.outside]; ok && owner[other] == s.owner {
+					parent[find(first[i]+n)] = find(other)
+				}
+			}
+		}
+	}
+	level := make([]bool, len(parent))
+	gateDriven := make([]bool, len(parent))
+	pulsed := make([]int, len(parent)) // Number of pulsed nets
+	for i, s := range snaps {
+		for n := range s.ports {
+			r := find(first[i] + n)
+			level[r] = level[r] || s.driven[n]
+			gateDriven[r] = gateDriven[r] || s.gateDriven[n]
+			if s.pulsed[n] {
+				pulsed[r]++
+			}
+		}
+	}
+	for i, s := range snaps {
+		s.level = make([]bool, len(s.ports))
+		s.activate = make([]bool, len(s.ports))
+		for n := range s.ports {
+			r := find(first[i] + n)
+			s.level[n] = level[r]
+			// A trigger in the same net has already activated the text activators
+			others := pulsed[r]
+			if s.pulsed[n] {
+				others--
+			}
+			s.activate[n] = gateDriven[r] || others > 0
+		}
+	}
+}
+
+// A text activator that shall be activated, or a door that shall be opened or closed, by the logic
+type logicSink struct {
+	cc      chunkdb.CC
+	x, y, z uint8
+	high    bool   // The new level of the net
+	owner   uint32 // The owner of the chunks of the net
+}
+
+// Evaluate all logic circuits one tick.
+func UpdateLogic_WLwWLcRLq() {
+	logicChunksMutex.Lock()
+	chunks := make([]*chunk, 0, len(logicChunks))
+	for _, cp := range logicChunks {
+		chunks = append(chunks, cp)
+	}
+	logicChunksMutex.Unlock()
+
+	// Make a copy of the nets, and find out what drives them
+	var snaps []*logicSnap
+	for _, cp := range chunks {
+		if s := cp.snapLogic(); s != nil {
+			snaps = append(snaps, s)
+		}
+	}
+	// Pressure plates drive the net as long as a player stands on them. The members map is never changed.
+	for _, s := range snaps {
+		for _, key := range s.plates {
+			if plateOccupied_RLq(s.cp.Coord, uint8(key>>16), uint8(key>>8), uint8(key)) {
+				n := s.graph.members[key]
+				s.driven[n], s.gateDriven[n] = true, true
+			}
+		}
+	}
+
+	solveLogic(snaps)
+
+	// Update the gates, and find the text activators to activate and the doors to open or close
+	var sinks, doors []logicSink
+	for _, s := range snaps {
+		cp := s.cp
+		save := false
+		cp.Lock()
+		if cp.logic != s.graph {
+			// The chunk was changed, and the nets are no longer the same
+			cp.Unlock()
+			continue
+		}
+		for i := range cp.gates {
+			gate := &cp.gates[i]
+			inputs := make([]bool, len(s.graph.gateIn[i]))
+			for j, n := range s.graph.gateIn[i] {
+				inputs[j] = s.level[n]
+			}
+			if gate.tick(cp.rc[gate.X][gate.Y][gate.Z], inputs) {
+				save = true
+			}
+		}
+		for n := range s.graph.nets {
+			net := &s.graph.nets[n]
+			if s.level[n] && !net.prev && s.activate[n] {
+				for _, key := range net.sinks {
+					sinks = append(sinks, logicSink{cp.Coord, uint8(key >> 16), uint8(key >> 8), uint8(key), true, s.owner})
+				}
+			}
+			if s.level[n] != net.prev {
+				for _, key := range net.doors {
+					doors = append(doors, logicSink{cp.Coord, uint8(key >> 16), uint8(key >> 8), uint8(key), s.level[n], s.owner})
+				}
+			}
+			net.prev = s.level[n]
+		}
+		if save {
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
+		cp.Unlock()
+	}
+
+	// A door changes the block, which recomputes the logic of the chunk, so it is done after the update
+	for _, door := range doors {
+		SetDoor_WLwWLcRLq(door.cc, door.x, door.y, door.z, door.high, door.owner)
+	}
+
+	// The text activators are activated by the nearest player, in the process of that player.
+	for _, sink := range sinks {
+		coord := user_coord{
+			float64(sink.cc.X)*CHUNK_SIZE + float64(sink.x) + 0.5,
+			float64(sink.cc.Y)*CHUNK_SIZE + float64(sink.y) + 0.5,
+			float64(sink.cc.Z)*CHUNK_SIZE + float64(sink.z)}
+		var nearest *user
+		best := math.MaxFloat64
+		for _, o := range playerQuadtree.FindNearObjects_RLq(&TwoF{coord.X, coord.Y}, CnfgLogicActivatorDistance) {
+			other, ok := o.(*user)
+			if !ok || other.Dead {
+				continue
+			}
+			dx, dy, dz := other.Coord.X-coord.X, other.Coord.Y-coord.Y, other.Coord.Z-coord.Z
+			if d := dx*dx + dy*dy + dz*dz; d < best {
+				best, nearest = d, other
+			}
+		}
+		if nearest == nil {
+			continue
+		}
+		sink := sink
+		nearest.SendCommand(func(up *user) {
+			up.ActivateTextActivator_WLwWLuWLqWLmWLc(sink.cc, sink.x, sink.y, sink.z)
+		})
+	}
+}
+
+// Manage the "/logic" command, for the nearest logic gate.
+func (up *user) LogicCommand_WLwWLcBl(args []string) {
+	cc, x, y, z, ok := up.findNearBlock_WLwWLc(CnfgLogicEditDistance, isLogicGate)
+	if !ok {
+		up.Printf_Bl("#FAIL !There is no logic gate near")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	switch {
+	case args[0] == "show":
+		cp.RLock()
+		var info logicGate
+		g := cp.findGate(x, y, z)
+		if g != nil {
+			info = *g
+		}
+		cp.RUnlock()
+		if g == nil {
+			up.Printf_Bl("#FAIL !The logic gate is not ready")
+			return
+		}
+		up.Printf_Bl("!Logic gate: parameter %d, output %v, count %d", info.Param, info.Out, info.Count)
+	case args[0] == "set" && len(args) == 2:
+		param, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil || param == 0 || param > CnfgLogicMaxParam {
+			up.Printf_Bl("#FAIL !The parameter must be 1 to %d", CnfgLogicMaxParam)
+			return
+		}
+		cp.Lock()
+		allowed := up.MayModifyChunk_RLg(cp)
+		g := cp.findGate(x, y, z)
+		if allowed && g != nil {
+			g.Param = uint8(param)
+			g.Count = 0
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
+		cp.Unlock()
+		if !allowed {
+			up.Printf_Bl("#FAIL !Only the owner can change logic gates")
+			return
+		}
+		up.Printf_Bl("!Logic gate updated")
+	default:
+		up.Printf_Bl("#FAIL !Usage: /logic show|set [param]")
+	}
+}
+
+// Evaluate the logic circuits regularly
+func ProcLogic_WLwWLcRLq() {
+	var elapsed time.Duration
+	timerstats.Add("ProcLogic", CnfgLogicTick, &elapsed)
+	for {
+		start := time.Now()
+		time.Sleep(CnfgLogicTick)
+		UpdateLogic_WLwWLcRLq()
+		elapsed = time.Now().Sub(start)
+	}
+}
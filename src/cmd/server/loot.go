@@ -0,0 +1,250 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Loot tables for monster drops. The tables are defined in a JSON file, loaded at startup and
+// reloaded with the admin command "/reload loot". If there is no file, a built-in table is used.
+//
+// A table applies to a monster kind and a level band. Every table has a list of groups, and every group
+// may drop one item. The item is selected from a weighted list of entries.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+)
+
+type lootEntry struct {
+	Item        ObjectCode // Code from the item catalog
+	Weight      float32    // Relative weight within the group
+	LevelOffset int32      // The item level is the monster level plus this offset
+	Rare        bool       // Rare drops are announced to the party
+}
+
+type lootGroup struct {
+	Chance     float32 // Probability of a drop, for a monster at the same level as the player
+	Guaranteed bool    // Always drop something from this group
+	Entries    []lootEntry
+}
+
+type lootTable struct {
+	Monster  string // The monster kind. An empty string is used for all kinds that have no table of their own.
+	MinLevel uint32 // The level band, inclusive
+	MaxLevel uint32 // 0 means no upper limit
+	Groups   []lootGroup
+}
+
+var (
+	lootTablesSem sync.RWMutex
+	lootTables    = defaultLootTables
+)
+
+// The loot table used when there is no loot file. The weapon, armor and helmet chances are the
+// probability of a drop from a monster at the same level, which is also the experience for such a kill.
+var defaultLootTables = []lootTable{{
+	Groups: []lootGroup{
+		{Chance: 0.05, Entries: []lootEntry{{Item: ItemHealthPotionID, Weight: 1}}},
+		{Chance: 0.05, Entries: []lootEntry{{Item: ItemManaPotionID, Weight: 1}}},
+		{Chance: combatExperienceSameLevel, Entries: []lootEntry{{Item: ItemWeapon1ID, Weight: 89.9}, {Item: ItemWeapon2ID, Weight: 9}, {Item: ItemWeapon3ID, Weight: 1}, {Item: ItemWeapon4ID, Weight: 0.1, Rare: true}}},
+		{Chance: combatExperienceSameLevel, Entries: []lootEntry{{Item: ItemArmor1ID, Weight: 89.9}, {Item: ItemArmor2ID, Weight: 9}, {Item: ItemArmor3ID, Weight: 1}, {Item: ItemArmor4ID, Weight: 0.1, Rare: true}}},
+		{Chance: combatExperienceSameLevel, Entries: []lootEntry{{Item: ItemHelmet1ID, Weight: 89.9}, {Item: ItemHelmet2ID, Weight: 9}, {Item: ItemHelmet3ID, Weight: 1}, {Item: ItemHelmet4ID, Weight: 0.1, Rare: true}}},
+	},
+}}
+
+// Verify that the tables are consistent, and that all items exist in the item catalog.
+func verifyLootTables(tables []lootTable, cat *itemCatalog) error {
+	if len(tables) == 0 {
+		return errors.New("no loot tables defined")
+	}
+	for i, t := range tables {
+		if t.MaxLevel != 0 && t.MaxLevel < t.MinLevel {
+			return fmt.Errorf("table %d (%s): bad level band %d-%d", i, t.Monster, t.MinLevel, t.MaxLevel)
+		}
+		for _, g := range t.Groups {
+			if g.Chance < 0 || len(g.Entries) == 0 {
+				return fmt.Errorf("table %d (%s): bad group", i, t.Monster)
+			}
+			for _, e := range g.Entries {
+				if cat.byCode[e.Item] == nil {
+					return fmt.Errorf("table %d (%s): unknown item '%s'", i, t.Monster, e.Item)
+				}
+				if e.Weight <= 0 {
+					return fmt.Errorf("table %d (%s): item '%s' must have a positive weight", i, t.Monster, e.Item)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Load the loot tables from file. The current tables are kept if there is an error.
+func LoadLootTables(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var tables []lootTable
+	if err = json.Unmarshal(data, &tables); err == nil {
+		err = verifyLootTables(tables, currentItemCatalog())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	lootTablesSem.Lock()
+	lootTables = tables
+	lootTablesSem.Unlock()
+	log.Println("Loaded", len(tables), "loot tables from", fileName)
+	return nil
+}
+
+func currentLootTables() []lootTable {
+	lootTablesSem.RLock()
+	defer lootTablesSem.RUnlock()
+	return lootTables
+}
+
+// Find the loot table for a monster kind and level. A table for the specific kind is preferred.
+// Return nil if there is none.
+func FindLootTable(kind string, level uint32) *lootTable {
+	tables := currentLootTables()
+	var fallback *lootTable
+	for i := range tables {
+		t := &tables[i]
+		if level < t.MinLevel || (t.MaxLevel != 0 && level > t.MaxLevel) {
+			continue
+		}
+		if t.Monster == kind {
+			return t
+		}
+		if t.Monster == "" && fallback == nil {
+			fallback = t
+		}
+	}
+	return fallback
+}
+
+// The probability that a group drops something. 'modifier' is the relative difficulty of the kill,
+// where 1 is a monster at the same level as the player. Higher numbers means easier kills.
+func (g *lootGroup) probability(modifier float32) float32 {
+	if g.Guaranteed {
+		return 1
+	}
+	p := g.Chance / modifier
+	if p > 1 {
+		p = 1
+	}
+	return p
+}
+
+// Select one entry, using the weights
+func (g *lootGroup) pick() *lootEntry {
+	var total float32
+	for _, e := range g.Entries {
+		total += e.Weight
+	}
+	r := rand.Float32() * total
+	for i := range g.Entries {
+		r -= g.Entries[i].Weight
+		if r < 0 {
+			return &g.Entries[i]
+		}
+	}
+	return &g.Entries[len(g.Entries)-1] // Rounding errors
+}
+
+// The level of an item dropped by a monster of level 'mLevel'
+func (e *lootEntry) itemLevel(mLevel uint32) uint32 {
+	lvl := int64(mLevel) + int64(e.LevelOffset)
+	if lvl < 0 {
+		lvl = 0
+	}
+	return uint32(lvl)
+}
+
+// Roll the loot table, and return the items that shall be dropped.
+func (t *lootTable) Roll(mLevel uint32, modifier float32) (drops []Object, rare []bool) {
+	for i := range t.Groups {
+		g := &t.Groups[i]
+		if rand.Float32() >= g.probability(modifier) {
+			continue
+		}
+		e := g.pick()
+		drops = append(drops, Object{Type: e.Item, Level: e.itemLevel(mLevel), Count: 1})
+		rare = append(rare, e.Rare)
+	}
+	return
+}
+
+// The expected number of drops per kill of every item.
+type lootExpectation struct {
+	Item     ObjectCode
+	Level    uint32
+	Expected float32
+}
+
+// Compute the expected drops for a kill of a monster at level 'mLevel' by a player at level 'pLevel'.
+func (t *lootTable) Expected(pLevel, mLevel uint32) []lootExpectation {
+	modifier := combatExperienceSameLevel / PlayerExperienceForKill(pLevel, mLevel)
+	sum := make(map[Object]float32)
+	for i := range t.Groups {
+		g := &t.Groups[i]
+		var total float32
+		for _, e := range g.Entries {
+			total += e.Weight
+		}
+		p := g.probability(modifier)
+		for j := range g.Entries {
+			e := &g.Entries[j]
+			sum[Object{Type: e.Item, Level: e.itemLevel(mLevel)}] += p * e.Weight / total
+		}
+	}
+	ret := make([]lootExpectation, 0, len(sum))
+	for obj, exp := range sum {
+		ret = append(ret, lootExpectation{obj.Type, obj.Level, exp})
+	}
+	sort.Sort(lootExpectationList(ret))
+	return ret
+}
+
+type lootExpectationList []lootExpectation
+
+func (l lootExpectationList) Len() int           { return len(l) }
+func (l lootExpectationList) Less(i, j int) bool { return l[i].Item < l[j].Item }
+func (l lootExpectationList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Print the expected drop rates for a player and monster level. Usage: /loot [player level] [monster level] [monster kind]
+func (up *user) LootSimulate_Bl(pLevel, mLevel uint32, kind string) {
+	t := FindLootTable(kind, mLevel)
+	if t == nil {
+		up.Printf_Bl("#FAIL !No loot table for '%s' level %d", kind, mLevel)
+		return
+	}
+	up.Printf_Bl("!Expected drops per kill, player level %d, monster level %d:", pLevel, mLevel)
+	for _, e := range t.Expected(pLevel, mLevel) {
+		if e.Expected > 0 {
+			up.Printf_Bl("!%s level %d: %.3f%% (one in %.0f)", e.Item, e.Level, e.Expected*100, 1/e.Expected)
+		}
+	}
+}
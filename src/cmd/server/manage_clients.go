@@ -18,7 +18,6 @@
 package main
 
 import (
-	"bytes"
 	"chunkdb"
 	"client_prot"
 	cryptrand "crypto/rand"
@@ -32,7 +31,6 @@ import (
 	"license"
 	"log"
 	"math"
-	"math/rand"
 	"net"
 	"quadtree"
 	"score"
@@ -79,7 +77,29 @@ type user struct {
 	aggro                      *monster // The monster we are attacking, if any
 	flags                      uint32   // Bit mapped flags that the client always have to know about. See UserFlag* in client_prot.
 	// Data for trap management
-	trapPrevBlock block // The previous block type. A trap shall trig only when going into it from outside
+	trapPrevBlock block          // The previous block type. A trap shall trig only when going into it from outside
+	party         *party         // The party this player is a member of, if any
+	partyInvite   *user          // The player that invited to a party, if any
+	trade         *tradeSession  // The current trade session, if any
+	openChest     chestLocation  // The chest last opened
+	npcDialog     npcDialogState // The current dialog with an NPC, if any
+	// Data for abilities
+	cooldowns    map[uint8]time.Time // When abilities can be used again
+	casting      *abilityCast        // The ability being cast, if any
+	learnedLevel uint32              // The level when abilities were last learned
+	// Status effects, protected by the lock
+	effects       statusEffects // The active effects
+	reportEffects bool          // The effects have changed, and the client must be told
+	// The durability of the equipment has changed, and the client must be told. Protected by the lock.
+	reportEquipment bool
+	// Achievements unlocked but not yet announced, protected by the lock
+	newAchievements []*achievementDef
+	// Distance moved that is not yet reported as an event. Only used by the client process.
+	moved float64
+	// Data for PvP
+	pvpTarget  *user        // The player we are attacking, if any
+	duel       *duelSession // The current duel, if any
+	duelInvite *duelSession // A pending duel challenge
 }
 
 // This the part of the user that shall be loaded from the DB
@@ -250,6 +270,9 @@ func (up *user) CmdPassword_WLwWLuWLqBlWLc(encrPass []byte) bool {
 // A user has been accepted as a player. Send ack and inform near objects
 func (up *user) loginAck_WLuWLqBlWLa() {
 	up.ReportAllInventory_WluBl()
+	up.learnAbilities_WLu()
+	up.learnedLevel = up.Level
+	up.ReportAbilities_Bl()
 	// Don't need lock yet, as the used data until now is constant.
 	const msgLen = 12
 	var b [msgLen]byte
@@ -261,6 +284,7 @@ func (up *user) loginAck_WLuWLqBlWLa() {
 	EncodeUint16(uint16(up.DirVert*100), b[9:11])
 	b[11] = up.AdminLevel
 	up.writeBlocking_Bl(b[:])
+	up.writeBlocking_Bl(goldMessage(up.Gold))
 	up.prevCoord = up.Coord
 	// Find all near players and tell them
 	near := playerQuadtree.FindNearObjects_RLq(up.GetPreviousPos(), client_prot.NEAR_OBJECTS)
@@ -290,25 +314,22 @@ func (up *user) loginAck_WLuWLqBlWLa() {
 	up.updatedStats = true // Make sure the client gets to know the player stats.
 	// fmt.Println("LoginCommand OCTREE: ", playerQuadtree)
 
-	var friends bytes.Buffer
 	allPlayersSem.Lock()
 	allPlayerNameMap[strings.ToLower(up.Name)] = up
 	allPlayerIdMap[up.Id] = up
+	allPlayersSem.Unlock()
 	// Look for friends and tell them
-	for _, uid := range up.Listeners {
-		other, ok := allPlayerIdMap[uid]
-		if ok {
-			other.Printf("Logged in: %v", up.Name)
-			if friends.Len() > 0 {
-				friends.WriteString(", ")
-			}
-			friends.WriteString(other.Name)
-		}
+	friendsChannel := up.CreateFriendsChannel_WLh()
+	friendsChannel.Publish_WLhRLa("Logged in: %v", up.Name)
+	var friends []string
+	for _, other := range friendsChannel.OnlineMembers_RLhRLa() {
+		friends = append(friends, other.Name)
 	}
-	allPlayersSem.Unlock()
-	if friends.Len() > 0 {
-		up.Printf_Bl("Friends %s", friends.String())
+	if len(friends) > 0 {
+		up.Printf_Bl("Friends %s", strings.Join(friends, ", "))
 	}
+	up.DeliverMail_Bl()
+	up.GuildLogin_WLgBl()
 }
 
 func CmdClose_BlWLqWLuWLa(i int) {
@@ -326,21 +347,19 @@ func CmdClose_BlWLqWLuWLa(i int) {
 		playerQuadtree.Remove_WLq(up)
 	}
 	// TODO: Should tell near players of this?
+	up.LeaveParty_WLu()
+	up.TradeCancel_WLu()
+	up.DuelCancel()
 	up.Lock()
 	up.conn.Close()
 	up.connState = PlayerConnStateLogin // Default, even though this one is going to be disconnected.
 	up.Unlock()
 
+	up.LeaveAllChannels_WLhRLa()
 	allPlayersSem.Lock()
 	numPlayers--
 	delete(allPlayerNameMap, strings.ToLower(up.Name)) // Clear association from player name to index
 	delete(allPlayerIdMap, up.Id)                      // Cleanh assocition from player uid to index
-	for _, uid := range up.Listeners {
-		other, ok := allPlayerIdMap[uid]
-		if ok {
-			other.Printf("Logged out: %v", up.Name)
-		}
-	}
 	allPlayers[i] = nil
 	allPlayersSem.Unlock()
 }
@@ -388,14 +407,26 @@ func (up *user) CmdReportCoordinate_RLuBl(lockedElsewhere bool) {
 func CmdAttachBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8, blType block, index int) {
 	cp := ChunkFind_WLwWLc(cc)
 	from := allPlayers[index]
-	if cp.owner != from.Id && from.AdminLevel < 1 {
+	if !from.MayModifyChunk_RLg(cp) {
 		from.Printf("Not owner of chunk. See help for territory")
 		return
 	}
+	material, ok := from.takeMaterial_WLu(blType)
+	if !ok {
+		from.Printf("#FAIL !You need %s to build this", material)
+		return
+	}
 	if !cp.UpdateBlock_WLcWLw(dx, dy, dz, blType) {
+		if material != "" {
+			AddObjectToUser_WLuBl(from, material, 0) // Give it back
+		}
 		return
 	}
+	if material != "" {
+		ReportOneInventoryItem_WluBl(from, material, 0)
+	}
 	from.BlockAdd += 1
+	from.Emit_WLu(EventBuild, from.BlockAdd, 0)
 	// fmt.Println("CmdAttachBlock: ", abc.index, "Chunk: ", abc.cc, "Offset: ", abc.dx, abc.dy, abc.dz, "type: ", abc.blType)
 	// Send command of updated block to the player.
 	near := playerQuadtree.FindNearObjects_RLq(from.GetPreviousPos(), client_prot.NEAR_OBJECTS)
@@ -431,7 +462,7 @@ func (up *user) SendMsgUpdatedStats_Bl(ans []byte) {
 func (up *user) HitBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8) {
 	// TODO: Check distance to player, only allow digging near blocks.
 	cp := ChunkFind_WLwWLc(cc)
-	if cp.owner != up.Id && up.AdminLevel < 1 {
+	if !up.MayModifyChunk_RLg(cp) {
 		up.Printf_Bl("#FAIL Not owner of chunk. See help for territory")
 		return
 	}
@@ -449,10 +480,21 @@ func (up *user) HitBlock_WLwWLcRLq(cc chunkdb.CC, dx, dy, dz uint8) {
 		return
 	}
 
+	cp.RLock()
+	removed := cp.rc[dx][dy][dz]
+	fullChest := removed == BT_Chest && cp.chestHasItems(dx, dy, dz)
+	cp.RUnlock()
+	if fullChest {
+		up.Printf_Bl("#FAIL !The chest must be emptied first")
+		return
+	}
+
 	if !cp.UpdateBlock_WLcWLw(dx, dy, dz, BT_Air) {
 		return
 	}
 	up.BlockRem += 1
+	up.Gather_WLuBl(removed) // Only in survival mode
+	up.Emit_WLu(EventDig, up.BlockRem, 0)
 	// fmt.Println("CmdHitBlock: ", hbc.index, "Chunk: ", hbc.cc, "Offset: ", hbc.dx, hbc.dy, hbc.dz)
 	// fmt.Println(ans)
 	// Find near players and tell them about the change.
@@ -662,6 +704,12 @@ func (up *user) cmdUpdatePosition_WLuWLqWLmWLwWLc() (bl block, swimming bool) {
 	checktrigger, bl, swimming = up.cmdUpdatePosition2_WLwWLc()
 	up.Unlock()
 
+	if up.moved >= CnfgEventMoveDistance {
+		n := uint32(up.moved)
+		up.moved -= float64(n)
+		up.Emit_WLu(EventMove, n, 0)
+	}
+
 	if checktrigger {
 		up.CheckAndActivateTriggers_WLwWLuWLqWLmWLc(bl)
 	}
@@ -686,6 +734,7 @@ var delayMovementScoreUpdate uint16
 // * true if the player moved
 // * the new block type at the feet (if moved)
 // * true if swimming
+// The player must be locked by the caller.
 func (up *user) cmdUpdatePosition2_WLwWLc() (bool, block, bool) {
 	// TODO: This function is called very frequently (10 times/s), for every player. If the player isn't moving, and the environment
 	// doesn't change (trap door opening), there is no need to update the position.
@@ -750,6 +799,7 @@ func (up *user) cmdUpdatePosition2_WLwWLc() (bool, block, bool) {
 	// Normalize the xyz vector.
 	d := math.Sqrt(x*x + y*y + z*z)
 	dist := float64(deltaTime) / 1e9 * RUNNING_SPEED // Now scale distance
+	dist *= up.effects.speedFactor(now) // The player is locked by the caller
 	if up.Flying {
 		dist *= FlyingSpeedFactor // Flying is quicker than running
 	}
@@ -791,6 +841,7 @@ func (up *user) cmdUpdatePosition2_WLwWLc() (bool, block, bool) {
 		}
 		// The move has now been approved.
 		up.Coord = newCoord
+		up.moved += dist
 
 		// Update the score of this place, but not every time (to save some performance)
 		const DelayMovementReportFactor = 10
@@ -853,40 +904,6 @@ func (up *user) Heal(heal, manaCost float32) (ret bool) {
 	return
 }
 
-// Manage player spells
-func (up *user) CmdPlayerAction_WLuBl(userAction byte) {
-	if up.Dead {
-		up.Printf_Bl("Unable now\n")
-		return
-	}
-	switch userAction {
-	case client_prot.UserActionHeal:
-		if up.Mana < CnfgManaForHealing {
-			up.Printf_Bl("Not enough mana")
-		} else if up.HitPoints == 1 {
-			up.Printf_Bl("Already full health")
-		} else {
-			heal := float32(CnfgHealthAtHealingSpell)
-			up.Lock()
-			up.Heal(heal, CnfgManaForHealing)
-			up.Unlock()
-		}
-	case client_prot.UserActionCombAttack:
-		mp := up.aggro
-		if mp == nil {
-			up.Printf_Bl("Start attack first")
-		} else if up.Mana < CnfgManaForCombAttack {
-			up.Printf_Bl("Not enough mana")
-		} else if !mp.dead {
-			up.Lock()
-			up.Mana -= CnfgManaForCombAttack
-			up.updatedStats = true
-			up.Unlock()
-			mp.Hit_WLuBl(up, CnfgWeaponDmgCombAttack)
-		}
-	}
-}
-
 // Inititate attack on a monster
 func (up *user) CmdAttackMonster_WLuRLm(b []byte) {
 	monsterId, b, ok := ParseUint32(b)
@@ -918,6 +935,7 @@ func (up *user) CmdAttackMonster_WLuRLm(b []byte) {
 		mp.aggro = up
 		mp.speed = ASSAULT_FACTOR * mp.maxSpeed // Increase speed of monster while attacking
 		mp.state = MD_DEFENDING
+		mp.callPack_RLq(up)
 	}
 	if up.aggro == mp {
 		// Attack has already been initiated with this specific monster.
@@ -999,13 +1017,14 @@ func clientTellMovedObjects_Bl(up *user) {
 	b := make([]byte, MaxListLength)
 	length := 3 // Initial value, counting the header of the message
 	b[2] = client_prot.CMD_OBJECT_LIST
-	const lengthPerObject = 18
+	const lengthPerObject = 19
 	for _, o := range listMoved {
 		EncodeUint32(o.GetId(), b[length:length+4])
 		b[length+4] = client_prot.ObjStateInGame
 		b[length+5] = o.GetType()
 		var objLevel uint32 = 0
 		var objHP uint8 = 0
+		var objModel uint8 = 0
 		switch o2 := o.(type) {
 		case *user:
 			objLevel = o2.Level
@@ -1013,7 +1032,11 @@ func clientTellMovedObjects_Bl(up *user) {
 		case *monster:
 			objLevel = o2.Level
 			objHP = uint8(o2.HitPoints * 255)
+			objModel = o2.species.Model
 			// fmt.Printf("clientTellMovedObjects: %#v\n", o)
+		case *npc:
+			objHP = 255
+			objModel = o2.model()
 		}
 		b[length+6] = objHP
 		EncodeUint32(objLevel, b[length+7:length+11])
@@ -1023,6 +1046,7 @@ func clientTellMovedObjects_Bl(up *user) {
 		EncodeUint16(uint16(int16((pos[1]-up.Coord.Y)*client_prot.BLOCK_COORD_RES)), b[length+13:length+15])
 		EncodeUint16(uint16(int16((o.GetZ()-up.Coord.Z)*client_prot.BLOCK_COORD_RES)), b[length+15:length+17])
 		b[length+17] = byte(256 / 2 / math.Pi * o.GetDir()) // Convert direction into range 0-255
+		b[length+18] = objModel                             // The monster species model, to let the client know what to draw
 		length += lengthPerObject
 		if length+lengthPerObject > cap(b) {
 			// Can't fit another object in the list, send what there is
@@ -1134,6 +1158,9 @@ func (up *user) AddToListener_RLaWLu(name string) (notFound bool, alreadyIn bool
 			ok = false
 		}
 		other.Unlock()
+		if ok && !alreadyIn {
+			updateFriendsChannel_WLh(other.Id, up.Id, true)
+		}
 	}
 	notFound = !ok
 	return
@@ -1168,6 +1195,9 @@ func (up *user) RemoveFromListener_RLaWLu(name string) (notFound bool, notIn boo
 			ok = false
 		}
 		other.Unlock()
+		if ok && !notIn {
+			updateFriendsChannel_WLh(other.Id, up.Id, false)
+		}
 	}
 	notFound = !ok
 	return
@@ -1193,27 +1223,14 @@ func (up *user) ReportAllInventory_WluBl() {
 	up.RLock()
 	inv := up.Inventory
 	l := len(inv)
-	const N = 9
-	msgLen := l*N + 3
-	var b = make([]byte, msgLen)
-	b[0] = byte(msgLen & 0xff)
-	b[1] = byte(msgLen >> 8)
-	b[2] = client_prot.CMD_UPD_INV
+	b := []byte{0, 0, client_prot.CMD_UPD_INV}
 	for i := 0; i < l; i++ {
-		str := []byte(inv[i].Type)
 		if *verboseFlag > 1 {
 			log.Printf("%#v\n", inv[i])
 		}
-		for j := 0; j < 4; j++ {
-			b[i*N+3+j] = str[j]
-		}
-		count := inv[i].Count
-		if count > math.MaxUint8 {
-			count = math.MaxUint8 // This is what can be shown to the client
-		}
-		b[i*N+7] = byte(count)
-		EncodeUint32(inv[i].Level, b[i*N+8:i*N+12])
+		b = appendInventoryEntry(b, &inv[i])
 	}
+	b = setMessageLength(b)
 	up.RUnlock()
 	if l > 0 {
 		// Don't bother sending a message if there was no inventory
@@ -1224,71 +1241,52 @@ func (up *user) ReportAllInventory_WluBl() {
 	}
 }
 
-// Create any items that was dropped by a monster.
+// Create any items that was dropped by a monster, as defined by the loot table of the monster.
 // 'modifier' is a probability modifier. 1 is normal probabilities, less than 1 is higher.
 // Using 'combatExperienceSameLevel' as a base reference should produce one drop on average every level.
-func (up *user) MonsterDropWLu(modifier float32) {
-	// log.Println("Modifier", modifier, "exp same level", combatExperienceSameLevel)
-	if rand.Float32()*modifier < 0.05 {
-		AddOneObjectToUser_WLuBl(up, ItemHealthPotionID)
-	}
-	if rand.Float32()*modifier < 0.05 {
-		AddOneObjectToUser_WLuBl(up, ItemManaPotionID)
-	}
-
-	// Make weapons
-	prob := rand.Float32() * modifier
-	if prob < combatExperienceSameLevel/100 {
-		AddOneObjectToUser_WLuBl(up, ItemWeapon3ID)
-	} else if prob < combatExperienceSameLevel/10 {
-		AddOneObjectToUser_WLuBl(up, ItemWeapon2ID)
-	} else if prob < combatExperienceSameLevel {
-		AddOneObjectToUser_WLuBl(up, ItemWeapon1ID)
-	}
-
-	// Make armors
-	prob = rand.Float32() * modifier
-	if prob < combatExperienceSameLevel/100 {
-		AddOneObjectToUser_WLuBl(up, ItemArmor3ID)
-	} else if prob < combatExperienceSameLevel/10 {
-		AddOneObjectToUser_WLuBl(up, ItemArmor2ID)
-	} else if prob < combatExperienceSameLevel {
-		AddOneObjectToUser_WLuBl(up, ItemArmor1ID)
-	}
-
-	// Make helmets
-	prob = rand.Float32() * modifier
-	if prob < combatExperienceSameLevel/100 {
-		AddOneObjectToUser_WLuBl(up, ItemHelmet3ID)
-	} else if prob < combatExperienceSameLevel/10 {
-		AddOneObjectToUser_WLuBl(up, ItemHelmet2ID)
-	} else if prob < combatExperienceSameLevel {
-		AddOneObjectToUser_WLuBl(up, ItemHelmet1ID)
+func (up *user) MonsterDropWLu(mp *monster, modifier float32) {
+	t := FindLootTable(mp.kind, mp.Level)
+	if t == nil {
+		return
+	}
+	drops, rare := t.Roll(mp.Level, modifier)
+	for i, obj := range drops {
+		receiver := up.LootReceiver_RLu()
+		AddObjectToUser_WLuBl(receiver, obj.Type, obj.Level)
+		if rare[i] {
+			if pp := receiver.Party_RLu(); pp != nil {
+				pp.Printf("!%s found a rare %s", receiver.Name, obj.Type)
+			} else {
+				receiver.Printf("!You found a rare %s", obj.Type)
+			}
+		}
 	}
 }
 
 // Report current equipment of 'up' to 'target'.
 func (target *user) ReportEquipment_Bl(up *user) {
 	// No lock is used. That means that the equipment can change over time, but this is not fatal.
-	const msgLen = 34
-	var b [msgLen]byte
-	b[0] = msgLen
-	b[1] = 0
-	b[2] = client_prot.CMD_EQUIPMENT
+	// Every slot is the slot number, the code, the level and the instance data. The ranged weapon
+	// is only included if there is one.
+	b := []byte{0, 0, client_prot.CMD_EQUIPMENT, 0, 0, 0, 0}
 	EncodeUint32(up.Id, b[3:7])
-	b[7] = 0 // Slot, 0 means weapon
-	copy(b[8:12], ConvertWeaponTypeToID(up.WeaponGrade))
-	EncodeUint32(up.WeaponLvl, b[12:16])
-	b[16] = 1 // Slot, 1 means armor
-	copy(b[17:21], ConvertArmorTypeToID(up.ArmorGrade))
-	EncodeUint32(up.ArmorLvl, b[21:25])
-	b[25] = 2 // Slot, 2 means helmet
-	copy(b[26:30], ConvertHelmetTypeToID(up.HelmetGrade))
-	EncodeUint32(up.HelmetLvl, b[30:34])
+	for s := uint8(EquipSlotWeapon); s <= EquipSlotRanged; s++ {
+		code, lvl, inst := up.slot(s)
+		if code == "" {
+			continue
+		}
+		var l [4]byte
+		EncodeUint32(lvl, l[:])
+		b = append(b, s)
+		b = append(b, code[0:4]...)
+		b = append(b, l[:]...)
+		b = appendInstance(b, *inst)
+	}
+	b = setMessageLength(b)
 	if target == up {
-		target.writeBlocking_Bl(b[:])
+		target.writeBlocking_Bl(b)
 	} else {
-		target.writeNonBlocking(b[:])
+		target.writeNonBlocking(b)
 	}
 	// log.Println("From", up.Name, "to", target.Name, b)
 }
@@ -1308,6 +1306,9 @@ func (up *user) Write(p []byte) (n int, err error) {
 }
 
 func (up *user) AddScore(owner uint32, points float64) {
+	if IsGuildOwner(owner) {
+		return // Guilds have no score
+	}
 	score.Add(owner, points)
 }
 
@@ -33,6 +33,7 @@ import (
 	"log"
 	"math"
 	"math/rand"
+	"pathfind"
 	"quadtree"
 	"time"
 )
@@ -65,12 +66,15 @@ const (
 type monster struct {
 	id uint32 // An ID for the client to refer to.
 
-	Level       uint32  // The level of the monster
-	HitPoints   float32 // HP of the monster, from 0 to 1
-	size        float32 // How high the monster is
-	maxSpeed    float32 // Maximum speed
-	persistence float32 // How long a monster will keep on chasing a target
-	aggression  float32 // How aggressive the monster is
+	Level       uint32          // The level of the monster
+	kind        string          // The kind of monster, used to find loot tables. Empty for the default kind.
+	species     *monsterSpecies // The species, deciding the traits and behavior
+	boss        *bossState      // Only used for bosses
+	HitPoints   float32         // HP of the monster, from 0 to 1
+	size        float32         // How high the monster is
+	maxSpeed    float32         // Maximum speed
+	persistence float32         // How long a monster will keep on chasing a target
+	aggression  float32         // How aggressive the monster is
 
 	Coord      user_coord // The current monster coordinates
 	prevCoord  user_coord // Keep track of when moving
@@ -80,6 +84,11 @@ type monster struct {
 
 	turningDir float32 // Turning direction for monsters that are turning away from an obstacle
 
+	path     []pathfind.Point // The remaining waypoints when pursuing or going home
+	pathGoal pathfind.Point   // The goal the path was computed for
+
+	effects statusEffects // The active status effects
+
 	state MonsterState // Monster state
 
 	aggro   *user   // The user that has aggro. The monster will follow it, and attack it when possible.
@@ -92,6 +101,8 @@ type monster struct {
 	invalid      bool // True if this monster is no longer valid. This is used if there would be other references, not using the map.
 	dead         bool // True if this monster is dead
 	updatedStats bool // Information about this monster has changed, and nearby clients need to know
+
+	sync.Mutex // Protects the hit points, the effects and the boss state, which are changed by the player processes
 }
 
 // This struct manages a set of monsters. There is only one semaphore for the whole struct, which means only a limited number
@@ -138,18 +149,23 @@ func (this *monster) GetDir() float32 {
 // TODO: More processes could be needed when there are many monsters.
 func ManageMonsters_WLwWLuWLqWLmBlWLc() {
 	go ProcSpawnMonsters_WLwWLuWLqWLmBlWLc()
-	go ProcUpdateMonsterState()
+	go ProcUpdateMonsterState_WLwWLc()
 	go ProcUpdateMonsterPos_RLmWLwWLqBlWLuWLc()
 	go ProcUpdateMonstersTarget_RLmRLqBl()
 	// go ProcUpdateMonstersDir_RLmBlRLu()
 	go ProcMonsterMelee_RLmBl()
+	go ProcUpdateBosses_RLmWLqWLm()
+	go ProcUpdateProjectiles_WLwWLcRLq()
+	go ProcLogic_WLwWLcRLq()
 	ProcPurgeMonsters_WLmWLqBl() // Will not return
 }
 
-func UpdateAllMonstersState() {
+func UpdateAllMonstersState_WLwWLc() {
 	monsterData.Lock() // Write Lock monster data
 	// fmt.Printf("Monster State Update\n")
 
+	budget := CnfgPathBudgetPerTick // Path finding budget for all monsters
+
 	for _, mp := range monsterData.m {
 		if mp.dead {
 			continue
@@ -158,7 +174,7 @@ func UpdateAllMonstersState() {
 		case MD_NORMAL:
 			//#fmt.Printf("Monster %v in state MD_NORMAL\n", mp.id)
 			// TODO: Add GO HOME state
-			if rand.Float32() > MonsterMovingProb {
+			if rand.Float32() > mp.species.Wander {
 				// Update dir as a function of previous dir, in order to avoid sharp turns
 				// TODO: This is too small
 				mp.dirHor += (0.5 - rand.Float32()) * math.Pi / 60 // 30 degrees
@@ -176,7 +192,7 @@ func UpdateAllMonstersState() {
 		case MD_STROLLING:
 			//#fmt.Printf("Monster %v in state MD_STROLLING\n", mp.id)
 			// TODO: Monster will not turn once it has started moving
-			if rand.Float32() <= MonsterMovingProb {
+			if rand.Float32() <= mp.species.Wander {
 				mp.mvFwd = false
 				mp.state = MD_NORMAL
 			}
@@ -192,7 +208,7 @@ func UpdateAllMonstersState() {
 		case MD_HOSTILE:
 			//#fmt.Printf("Monster %v in state MD_HOSTILE\n", mp.id)
 
-		case MD_ATTACKING:
+		case MD_ATTACKING, MD_PURSUING:
 			//#fmt.Printf("Monster %v in state MD_ATTACKING\n", mp.id)
 			up := mp.aggro
 			if up == nil {
@@ -207,6 +223,11 @@ func UpdateAllMonstersState() {
 				// The player disappeared, lower speed to walk
 				mp.speed = WALKING_FACTOR * mp.maxSpeed
 				mp.state = MD_NORMAL
+			} else if mp.species.Behavior == BehaviorTerritorial && !mp.inTerritory(&up.Coord) {
+				// The player left the territory, give up and go home
+				mp.aggro = nil
+				mp.speed = WALKING_FACTOR * mp.maxSpeed
+				mp.state = MD_GOHOME
 			} else {
 				var dist2 float64
 				// TODO: Check if turned in the right direction
@@ -244,11 +265,19 @@ func UpdateAllMonstersState() {
 					mp.state = MD_RECOVERING
 				}
 
-				// Continue moving until inside melee distance
-				if dist2 > CnfgMeleeDistLimit*CnfgMeleeDistLimit {
+				// Continue moving until inside attack distance
+				if dist := mp.species.attackDistance(); dist2 > dist*dist || !mp.canSee_RLw(&up.Coord, dist2) {
+					mp.steerTowards_RLw(&up.Coord, &budget)
 					mp.mvFwd = true
+					if mp.state == MD_ATTACKING {
+						mp.state = MD_PURSUING
+					}
 				} else {
+					mp.path = nil
 					mp.mvFwd = false // Don't go too close to the player that has aggro
+					if mp.state == MD_PURSUING {
+						mp.state = MD_ATTACKING
+					}
 				}
 			}
 			up.RUnlock()
@@ -272,6 +301,18 @@ func UpdateAllMonstersState() {
 				mp.state = MD_NORMAL
 			}
 
+		case MD_GOHOME:
+			dx := mp.spawnCoord.X - mp.Coord.X
+			dy := mp.spawnCoord.Y - mp.Coord.Y
+			if dx*dx+dy*dy < 2*2 {
+				mp.mvFwd = false
+				mp.path = nil
+				mp.state = MD_NORMAL
+				break
+			}
+			mp.steerTowards_RLw(&mp.spawnCoord, &budget)
+			mp.mvFwd = true
+
 		default:
 			// This is an unknown state, return to normal
 			mp.state = MD_NORMAL
@@ -313,7 +354,7 @@ func UpdateAllMonstersTarget_RLmRLq() {
 		//#fmt.Printf("M:%d Aggro task\n",mp.id)
 		for _, o := range nearObjects {
 			up, ok := o.(*user)
-			if !ok || up.Dead {
+			if !ok || up.Dead || !mp.wantsToAttack(&up.player) {
 				continue // Only aggro on alive players
 			}
 			// Aggro on first near player found. TODO: Do something more sophisticated
@@ -334,18 +375,8 @@ func UpdateAllMonstersTarget_RLmRLq() {
 					mp.dirHor = dir
 					mp.mvFwd = false
 				} else if deltaDir < CnfgMonsterFieldOfView { // Make sure that the monster can "see" the player
-					// Send a message to tell the client that the player has aggro from this monster
-					var b [7]byte
-					b[0] = 7
-					b[1] = 0
-					b[2] = client_prot.CMD_RESP_AGGRO_FROM_MONSTER
-					EncodeUint32(mp.id, b[3:7])
-					up.writeNonBlocking(b[:])
-					mp.aggro = up
-					mp.state = MD_ATTACKING
-					// The monster should chase the player
-					mp.speed = ASSAULT_FACTOR * mp.maxSpeed // Accelerate monster in aggro mode!
-					//fmt.Printf("Monster %v: Speed:%v\n", mp.id, mp.speed)
+					mp.startAttack(up)
+					mp.callPack_RLq(up)
 				}
 				break
 			}
@@ -354,11 +385,34 @@ func UpdateAllMonstersTarget_RLmRLq() {
 	monsterData.RUnlock()
 }
 
+// The monster starts to attack player 'up'
+func (mp *monster) startAttack(up *user) {
+	// Send a message to tell the client that the player has aggro from this monster
+	var b [7]byte
+	b[0] = 7
+	b[1] = 0
+	b[2] = client_prot.CMD_RESP_AGGRO_FROM_MONSTER
+	EncodeUint32(mp.id, b[3:7])
+	up.writeNonBlocking(b[:])
+	mp.aggro = up
+	mp.state = MD_ATTACKING
+	// The monster should chase the player
+	mp.speed = ASSAULT_FACTOR * mp.maxSpeed // Accelerate monster in aggro mode!
+	//fmt.Printf("Monster %v: Speed:%v\n", mp.id, mp.speed)
+}
+
 // Compute the direction and distance (squared) the monster 'mp' should use to face a player 'up'
 func (mp *monster) ComputeDir(pl *player) (dir float32, dist2 float64) {
 	dx := pl.Coord.X - mp.Coord.X
 	dy := pl.Coord.Y - mp.Coord.Y
 	dz := pl.Coord.Z - mp.Coord.Z
+	dir = directionTo(dx, dy)
+	dist2 = dx*dx + dy*dy + dz*dz
+	return
+}
+
+// Compute the horisontal direction to a relative position
+func directionTo(dx, dy float64) (dir float32) {
 	if dy == 0 {
 		if dx > 0 {
 			dir = math.Pi / 2
@@ -372,7 +426,6 @@ func (mp *monster) ComputeDir(pl *player) (dir float32, dist2 float64) {
 	if dir < 0 {
 		dir += 2 * math.Pi // Avoid negative angles (will be a problem for the protocol with the client
 	}
-	dist2 = dx*dx + dy*dy + dz*dz
 	return
 }
 
@@ -392,14 +445,20 @@ func CmdMonsterMelee_RLm() {
 		dy := up.Coord.Y - mp.Coord.Y
 		dz := up.Coord.Z - mp.Coord.Z
 		dist := dx*dx + dy*dy + dz*dz // Skip the square root
-		if dist > CnfgMeleeDistLimit*CnfgMeleeDistLimit {
+		if limit := mp.species.attackDistance(); dist > limit*limit {
 			if dist > CnfgMonsterAggroDistance*CnfgMonsterAggroDistance {
 				// Player is too far away to hold aggro.
 				mp.aggro = nil
 			}
 			continue // Not near enough to be able to hit
 		}
-		up.Hit(mp.id, mp.Level, 1, mp.Level)
+		if !mp.canSee_RLw(&up.Coord, dist) {
+			continue // A ranged attack needs a line of sight
+		}
+		if mp.stunned(time.Now()) {
+			continue
+		}
+		up.Hit(mp.id, mp.Level, mp.damage(), mp.Level)
 	}
 	monsterData.RUnlock()
 }
@@ -509,29 +568,45 @@ func addMonsterToPlayer_WLwWLuWLqWLmWLc(up *user) {
 		// Couldn't find a valid spawn point.
 		return
 	}
+	ground := DBGetBlockCached_WLwWLc(user_coord{coord.X, coord.Y, coord.Z - 1}) // Used to find the biome
 
 	// Check if chunk is owned by someone, in which case no monster should be spawned
 	// Owner OWNER_NONE is the "world" and owner OWNER_RESERVED is the starting area
 	cc := coord.GetChunkCoord()
 	cp := ChunkFind_WLwWLc(cc)
-	if (cp.owner == OWNER_NONE) || (cp.owner == OWNER_RESERVED) || (cp.owner == OWNER_TEST) {
-		addMonsterToPlayerAtPos_WLuWLqWLm(up, &coord, 0)
+	if ((cp.owner == OWNER_NONE) || (cp.owner == OWNER_RESERVED) || (cp.owner == OWNER_TEST)) && ambientSpawnAllowed_WLwWLc(cc) {
+		mp := addMonsterToPlayerAtPos_WLuWLqWLm(up, &coord, 0, ground)
+		// The rest of a pack is spawned next to the first one
+		for i := 1; i < mp.species.PackSize; i++ {
+			a, b := math.Sincos(rand.Float64() * math.Pi * 2)
+			c := user_coord{coord.X + b*2, coord.Y + a*2, coord.Z}
+			if ValidSpawnPoint_WLwWLc(c, 3) {
+				addMonsterOfSpecies_WLuWLqWLm(&c, mp.Level, mp.species)
+			}
+		}
 	}
 }
 
-// This is the second part, where a monster is added to a player.
-func addMonsterToPlayerAtPos_WLuWLqWLm(up *user, coord *user_coord, deltaLevel int32) *monster {
+// This is the second part, where a monster is added to a player. The species is selected depending on the
+// level, the height and the ground block. Use BT_Unused for the ground if the biome shall not matter.
+func addMonsterToPlayerAtPos_WLuWLqWLm(up *user, coord *user_coord, deltaLevel int32, ground block) *monster {
 	baseLevel := MonsterDifficulty(coord)
 	lvl := int32(baseLevel) + deltaLevel
 	if lvl < 0 {
 		// Sanity check
 		lvl = 0
 	}
+	sp := SelectMonsterSpecies(uint32(lvl), coord.Z, ground)
+	return addMonsterOfSpecies_WLuWLqWLm(coord, uint32(lvl), sp)
+}
+
+// Create a monster of a specific species and level, and tell near players about it.
+func addMonsterOfSpecies_WLuWLqWLm(coord *user_coord, lvl uint32, sp *monsterSpecies) *monster {
 	m := new(monster)
 	m.Coord = *coord
 	m.prevCoord = m.Coord
 	m.spawnCoord = *coord // The same as the initial coordinate
-	m.Level = uint32(lvl)
+	m.Level = lvl
 	m.HitPoints = 1.0
 	m.ZSpeed = 0
 	m.dirHor = rand.Float32() * math.Pi * 2 // initial heading direction
@@ -545,12 +620,9 @@ func addMonsterToPlayerAtPos_WLuWLqWLm(up *user, coord *user_coord, deltaLevel i
 
 	// Init monster data used to determine special traits
 	m.state = MD_NORMAL
-	m.maxSpeed = RUNNING_SPEED // Running speed of player TODO: Add variation, from slower than a player to faster
-	m.maxSpeed *= -m.size*0.1 + 1.35
+	m.setSpecies(sp)
 	m.speed = WALKING_FACTOR * m.maxSpeed // Start in walking mode
-	m.persistence = 100.0                 // Persistence
 	m.fatigue = 100.0                     // 100% is the starting fatigue, when this gets close to 0 the monster will stop chasing
-	m.aggression = 50.0 + float32(m.Level%5)*10.0
 
 	//#fmt.Printf("NEW M: lvl %d siz %.1f per %.1f agg %.1f spd %.1f\n", lvl, m.size, m.persistence, m.aggression, m.maxSpeed)
 
@@ -655,14 +727,21 @@ func UpdateAllMonsterPos_RLmWLwWLqWLuWLc(fullReport bool) {
 
 // Move the monster, if it wants to.
 func (mp *monster) Move_WLwWLc(deltaTime time.Duration) {
+	followPath := mp.mvFwd && (mp.state == MD_PURSUING || mp.state == MD_GOHOME)
+	if followPath && mp.climb_RLw(deltaTime) {
+		return
+	}
 	mp.ZSpeed = UpdateZPos_WLwWLc(deltaTime, mp.ZSpeed, &mp.Coord)
 	// fmt.Println("New monster falling speed ", mp.ZSpeed, " at pos ", mp.Coord.Z)
 	if !mp.mvFwd {
 		return // Monsters aren't strafing, only moving in the direction they are looking
 	}
+	dist := float64(mp.speed) * float64(deltaTime) / 1e9 * mp.speedFactor(time.Now())
+	if followPath {
+		mp.steerAlongPath(dist)
+	}
 	coord := mp.Coord
 	s, c := math.Sincos(float64(mp.dirHor))
-	dist := float64(mp.speed) * float64(deltaTime) / 1e9
 	// fmt.Println("Monster move ", dist)
 	dx := s * dist
 	dy := c * dist
@@ -683,6 +762,13 @@ func (mp *monster) Move_WLwWLc(deltaTime time.Duration) {
 		return
 	}
 
+	if followPath {
+		// The path is no longer valid, or the monster went astray. Stop and wait for a new path.
+		mp.path = nil
+		mp.mvFwd = false
+		return
+	}
+
 	// TODO: There is a wall, and monster should follow the wall instead of stopping.
 	mp.turningDir = math.Pi / 12 // 15 degrees TODO: Fix random component
 	// TODO: Monsters will only turn in one direction, allow both
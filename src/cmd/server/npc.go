@@ -0,0 +1,577 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Non-player characters. A territory owner places an NPC with "/npc add <dialog>", which is saved with the
+// chunk in the PART_NPCS partition. The NPCs of a chunk are created when the chunk is loaded, and are kept
+// in the NPC quadtree. They are reported to near players in CMD_OBJECT_LIST, using ObjTypeNPC.
+//
+// The dialogs are defined in a JSON file, loaded at startup and reloaded with the admin command
+// "/reload dialogs". A dialog is a tree of nodes, where every node has a text and a list of choices.
+// A choice can require a level or a key from the owner of the NPC, and can give an item (paid by the
+// owner), start a quest or advance a talk step of a quest. The quests are the same as started by
+// activators, with the owner of the NPC as the quest giver. An NPC with a stock is a vendor, see vendor.go.
+//
+// The client starts talking with CMD_NPC_TALK, the server presents a node with CMD_NPC_DIALOG and the
+// client answers with CMD_NPC_ANSWER.
+//
+
+import (
+	"chunkdb"
+	"client_prot"
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"math"
+	"quadtree"
+	"strings"
+	. "twof"
+)
+
+type dialogChoice struct {
+	Text       string // Shown to the player
+	Next       string // The id of the next node. Empty ends the dialog.
+	MinLevel   uint32 // Only offered to players of at least this level
+	Key        uint   // Only offered to players with this key from the owner of the NPC. 0 means no key is needed.
+	Give       string // The code of an item given to the player, paid by the owner of the NPC
+	Quest      string // Start a quest, "<id>:<steps>:<rewards>" as for the activator modifier "/quest:"
+	QuestTitle string
+	QuestTalk  uint // Advance a talk step in the quest with this id
+	Trade      bool // Show the stock of a vendor
+}
+
+type dialogNode struct {
+	Id      string
+	Text    string
+	Choices []dialogChoice
+}
+
+type dialogDef struct {
+	Id      string       // Used in "/npc add"
+	Name    string       // The name of the NPC
+	Model   uint8        // Tells the client what to draw
+	Nodes   []dialogNode // The dialog starts with the first node
+	Stock   []vendorItem // The items sold, if the NPC is a vendor. See vendor.go.
+	BuyBack float32      // The fraction of the price paid by a vendor for items in the stock
+}
+
+var (
+	dialogSem sync.RWMutex
+	dialogs   map[string]*dialogDef // There are no dialogs unless there is a dialog file
+)
+
+// Find a node in the dialog. Return nil if there is no such node.
+func (def *dialogDef) node(id string) *dialogNode {
+	for i := range def.Nodes {
+		if def.Nodes[i].Id == id {
+			return &def.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// Verify the dialog definitions, and give default values to undefined attributes.
+func verifyDialogs(list []*dialogDef) error {
+	ids := make(map[string]bool)
+	for _, def := range list {
+		if def.Id == "" {
+			return errors.New("dialog without id")
+		}
+		if ids[def.Id] {
+			return fmt.Errorf("dialog '%s' defined twice", def.Id)
+		}
+		ids[def.Id] = true
+		if def.Name == "" {
+			def.Name = def.Id
+		}
+		if len(def.Nodes) == 0 {
+			return fmt.Errorf("dialog '%s' has no nodes", def.Id)
+		}
+		nodes := make(map[string]bool)
+		for _, n := range def.Nodes {
+			if nodes[n.Id] {
+				return fmt.Errorf("dialog '%s': node '%s' defined twice", def.Id, n.Id)
+			}
+			nodes[n.Id] = true
+		}
+		if err := def.verifyStock(); err != nil {
+			return err
+		}
+		for _, n := range def.Nodes {
+			for _, c := range n.Choices {
+				if c.Next != "" && !nodes[c.Next] {
+					return fmt.Errorf("dialog '%s': unknown node '%s'", def.Id, c.Next)
+				}
+				if c.Trade && len(def.Stock) == 0 {
+					return fmt.Errorf("dialog '%s': trade without stock", def.Id)
+				}
+				if c.Quest != "" {
+					if _, err := parseQuestModifier(0, c.Quest, c.QuestTitle); err != nil {
+						return fmt.Errorf("dialog '%s': %v", def.Id, err)
+					}
+				}
+			}
+		}
+		if err := def.verifyItems(currentItemCatalog()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify that all items sold, given or used by quests are found in the item catalog. Nothing is changed,
+// so it can also be used for the current dialogs, when the item catalog is reloaded.
+func (def *dialogDef) verifyItems(cat *itemCatalog) error {
+	for _, it := range def.Stock {
+		if cat.byCode[ObjectCode(it.Code)] == nil {
+			return fmt.Errorf("dialog '%s': unknown item '%s' in stock", def.Id, it.Code)
+		}
+	}
+	for _, n := range def.Nodes {
+		for _, c := range n.Choices {
+			if c.Give != "" && cat.byCode[ObjectCode(c.Give)] == nil {
+				return fmt.Errorf("dialog '%s': unknown item '%s'", def.Id, c.Give)
+			}
+			if c.Quest == "" {
+				continue
+			}
+			q, err := parseQuestModifier(0, c.Quest, c.QuestTitle)
+			if err == nil {
+				err = q.verifyItems(cat)
+			}
+			if err != nil {
+				return fmt.Errorf("dialog '%s': %v", def.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Verify the items of all current dialogs
+func verifyDialogItems(cat *itemCatalog) error {
+	dialogSem.RLock()
+	defer dialogSem.RUnlock()
+	for _, def := range dialogs {
+		if err := def.verifyItems(cat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the dialogs from file. The current dialogs are kept if there is an error.
+func LoadDialogs(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var list []*dialogDef
+	if err = json.Unmarshal(data, &list); err == nil {
+		err = verifyDialogs(list)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	m := make(map[string]*dialogDef)
+	for _, def := range list {
+		m[def.Id] = def
+	}
+	dialogSem.Lock()
+	dialogs = m
+	dialogSem.Unlock()
+	log.Println("Loaded", len(list), "dialogs from", fileName)
+	return nil
+}
+
+// Find a dialog definition. Return nil if there is no such dialog.
+func FindDialog(id string) *dialogDef {
+	dialogSem.RLock()
+	defer dialogSem.RUnlock()
+	return dialogs[id]
+}
+
+// The placement of an NPC in a chunk. This information is saved with the chunk.
+type npcPlacement struct {
+	X, Y, Z uint8  // Position of the feet inside the chunk
+	Dir     uint8  // The looking direction, where 256 is a full turn
+	Dialog  string // The id of the dialog
+}
+
+// An NPC in the world
+type npc struct {
+	id     uint32
+	cc     chunkdb.CC // The chunk where the NPC was placed
+	owner  uint32     // The owner of the chunk
+	dialog string
+	coord  user_coord
+	dir    float32
+}
+
+func (n *npc) GetPreviousPos() *TwoF {
+	return &TwoF{n.coord.X, n.coord.Y}
+}
+
+func (n *npc) GetType() uint8 {
+	return client_prot.ObjTypeNPC
+}
+
+func (n *npc) GetZ() float64 {
+	return n.coord.Z
+}
+
+func (n *npc) GetId() uint32 {
+	return n.id
+}
+
+func (n *npc) GetDir() float32 {
+	return n.dir
+}
+
+// The model shown by the client
+func (n *npc) model() uint8 {
+	if def := FindDialog(n.dialog); def != nil {
+		return def.Model
+	}
+	return 0
+}
+
+// There can only be one instance of the NPC quadtree.
+var npcQuadtree = quadtree.MakeQuadtree(lowerLeftNearCorner, upperLeftFarCorner, 1)
+
+// All NPCs. They are kept also when the chunk is released from the cache.
+var npcData struct {
+	nextId       uint32
+	m            map[uint32]*npc
+	chunks       map[chunkdb.CC][]*npc // The NPCs of every chunk
+	sync.RWMutex                       // Provide a lock for accessing this structure
+}
+
+func init() {
+	npcData.m = make(map[uint32]*npc)
+	npcData.chunks = make(map[chunkdb.CC][]*npc)
+}
+
+// Create the NPCs of the chunk, replacing the old ones. Return the new NPCs.
+// The chunk must be locked, or not yet available to others.
+func registerNPCs(ch *chunk) []*npc {
+	var list []*npc
+	npcData.Lock()
+	for _, n := range npcData.chunks[ch.Coord] {
+		npcQuadtree.Remove_WLq(n)
+		delete(npcData.m, n.id)
+	}
+	for _, pl := range ch.npcs {
+		id := npcData.nextId
+		for ; ; id++ {
+			if _, ok := npcData.m[id]; !ok {
+				break
+			}
+		}
+		npcData.nextId = id + 1
+		n := &npc{id: id, cc: ch.Coord, owner: ch.owner, dialog: pl.Dialog, dir: float32(pl.Dir) * 2 * math.Pi / 256}
+		n.coord = user_coord{
+			float64(ch.Coord.X)*CHUNK_SIZE + float64(pl.X) + 0.5,
+			float64(ch.Coord.Y)*CHUNK_SIZE + float64(pl.Y) + 0.5,
+			float64(ch.Coord.Z)*CHUNK_SIZE + float64(pl.Z)}
+		npcData.m[id] = n
+		npcQuadtree.Add_WLq(n, n.GetPreviousPos())
+		list = append(list, n)
+	}
+	if list == nil {
+		delete(npcData.chunks, ch.Coord)
+	} else {
+		npcData.chunks[ch.Coord] = list
+	}
+	npcData.Unlock()
+	return list
+}
+
+// Tell near players about the NPCs.
+func reportNPCs_RLqWLu(list []*npc) {
+	for _, n := range list {
+		for _, o := range playerQuadtree.FindNearObjects_RLq(n.GetPreviousPos(), client_prot.NEAR_OBJECTS) {
+			if other, ok := o.(*user); ok {
+				other.Lock()
+				other.SomeoneMoved(n)
+				other.Unlock()
+			}
+		}
+	}
+}
+
+// Tell near players about all NPCs. This is done now and then, as the NPCs never move.
+func ReportAllNPCs_RLqWLu() {
+	npcData.RLock()
+	list := make([]*npc, 0, len(npcData.m))
+	for _, n := range npcData.m {
+		list = append(list, n)
+	}
+	npcData.RUnlock()
+	reportNPCs_RLqWLu(list)
+}
+
+// Find an NPC. Return nil if there is no such NPC.
+func findNPC(id uint32) *npc {
+	npcData.RLock()
+	defer npcData.RUnlock()
+	return npcData.m[id]
+}
+
+// The dialog a player has with an NPC
+type npcDialogState struct {
+	npc     *npc
+	node    *dialogNode
+	choices []*dialogChoice // The choices offered to the player, in the order they were presented
+}
+
+// Return true if the player is near enough to the NPC to talk
+func (up *user) nearNPC(n *npc) bool {
+	dx, dy, dz := n.coord.X-up.Coord.X, n.coord.Y-up.Coord.Y, n.coord.Z-up.Coord.Z
+	return dx*dx+dy*dy+dz*dz <= CnfgNPCTalkDistance*CnfgNPCTalkDistance
+}
+
+// Find the nearest NPC, within talking distance, that satisfies 'match'. Return nil if there is none.
+func (up *user) nearestNPC_RLq(match func(*npc) bool) *npc {
+	var nearest *npc
+	best := math.MaxFloat64
+	for _, o := range npcQuadtree.FindNearObjects_RLq(&TwoF{up.Coord.X, up.Coord.Y}, CnfgNPCTalkDistance) {
+		n := o.(*npc)
+		dx, dy, dz := n.coord.X-up.Coord.X, n.coord.Y-up.Coord.Y, n.coord.Z-up.Coord.Z
+		if d := dx*dx + dy*dy + dz*dz; d <= CnfgNPCTalkDistance*CnfgNPCTalkDistance && d < best && match(n) {
+			best, nearest = d, n
+		}
+	}
+	return nearest
+}
+
+// Find the choices of the node that are offered to the player
+func (up *user) offeredChoices_RLu(owner uint32, node *dialogNode) []*dialogChoice {
+	var list []*dialogChoice
+	up.RLock()
+	for i := range node.Choices {
+		c := &node.Choices[i]
+		if up.Level < c.MinLevel || c.Key != 0 && !up.Keys.Test(owner, c.Key) {
+			continue
+		}
+		list = append(list, c)
+	}
+	up.RUnlock()
+	return list
+}
+
+// Build the CMD_NPC_DIALOG message. The strings are preceded by the length. A message without
+// text and choices ends the dialog.
+func dialogMessage(id uint32, text string, choices []*dialogChoice) []byte {
+	strs := []string{text}
+	for _, c := range choices {
+		strs = append(strs, c.Text)
+	}
+	msgLen := 8
+	for i, s := range strs {
+		if len(s) > math.MaxUint8 {
+			strs[i] = s[:math.MaxUint8]
+		}
+		msgLen += 1 + len(strs[i])
+	}
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_NPC_DIALOG
+	EncodeUint32(id, b[3:7])
+	b[7] = byte(len(choices))
+	p := b[8:]
+	for _, s := range strs {
+		p[0] = byte(len(s))
+		copy(p[1:], s)
+		p = p[1+len(s):]
+	}
+	return b
+}
+
+// Present a node of the dialog to the player. A nil node ends the dialog.
+func (up *user) showDialogNode_RLuBl(n *npc, node *dialogNode) {
+	if node == nil {
+		up.npcDialog = npcDialogState{}
+		up.writeBlocking_Bl(dialogMessage(n.id, "", nil))
+		return
+	}
+	choices := up.offeredChoices_RLu(n.owner, node)
+	up.npcDialog = npcDialogState{npc: n, node: node, choices: choices}
+	up.writeBlocking_Bl(dialogMessage(n.id, node.Text, choices))
+}
+
+// Start talking with an NPC
+func (up *user) TalkNPC_RLuBl(id uint32) {
+	n := findNPC(id)
+	if n == nil {
+		return
+	}
+	if !up.nearNPC(n) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	def := FindDialog(n.dialog)
+	if def == nil {
+		up.Printf_Bl("#FAIL !There is no answer")
+		return
+	}
+	up.showDialogNode_RLuBl(n, &def.Nodes[0])
+}
+
+// The player selected one of the offered choices
+func (up *user) AnswerNPC_WLuBl(id uint32, answer uint8) {
+	st := up.npcDialog
+	n := st.npc
+	if n == nil || n.id != id || int(answer) >= len(st.choices) {
+		return
+	}
+	if !up.nearNPC(n) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	c := st.choices[answer]
+	if c.Give != "" {
+		code := ObjectCode(c.Give)
+		if ownerPays(n.owner, up, itemRewardCost(code)) {
+			AddOneObjectToUser_WLuBl(up, code)
+		} else {
+			up.Printf_Bl("!The owner can't afford %s", c.Give)
+		}
+	}
+	if c.Quest != "" {
+		if q, err := parseQuestModifier(n.owner, c.Quest, c.QuestTitle); err == nil {
+			up.StartQuest_WLuBl(q)
+		}
+	}
+	if c.QuestTalk != 0 {
+		up.QuestTalk_WLuBl(n.owner, c.QuestTalk)
+	}
+	var next *dialogNode
+	if def := FindDialog(n.dialog); def != nil {
+		if c.Trade && len(def.Stock) > 0 {
+			up.showStock_Bl(n, def)
+		}
+		if c.Next != "" {
+			next = def.node(c.Next)
+		}
+	}
+	up.showDialogNode_RLuBl(n, next)
+}
+
+// Decode CMD_NPC_TALK
+func (up *user) CmdNPCTalk_RLuBl(b []byte) {
+	if len(b) != 4 {
+		return
+	}
+	id, _, _ := ParseUint32(b)
+	up.TalkNPC_RLuBl(id)
+}
+
+// Decode CMD_NPC_ANSWER
+func (up *user) CmdNPCAnswer_WLuBl(b []byte) {
+	if len(b) != 5 {
+		return
+	}
+	id, _, _ := ParseUint32(b)
+	up.AnswerNPC_WLuBl(id, b[4])
+}
+
+// Manage the "/npc" command
+func (up *user) NPCCommand_WLwWLcWLqBl(args []string) {
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		def := FindDialog(args[1])
+		if def == nil {
+			up.Printf_Bl("#FAIL !Unknown dialog '%s'", args[1])
+			return
+		}
+		cc := up.Coord.GetChunkCoord()
+		pl := npcPlacement{
+			X:      uint8(int32(math.Floor(up.Coord.X)) - cc.X*CHUNK_SIZE),
+			Y:      uint8(int32(math.Floor(up.Coord.Y)) - cc.Y*CHUNK_SIZE),
+			Z:      uint8(int32(math.Floor(up.Coord.Z)) - cc.Z*CHUNK_SIZE),
+			Dir:    uint8(up.DirHor * 256 / 2 / math.Pi),
+			Dialog: def.Id,
+		}
+		var failure string
+		var list []*npc
+		cp := ChunkFind_WLwWLc(cc)
+		cp.Lock()
+		switch {
+		case !up.MayModifyChunk_RLg(cp):
+			failure = "Only the owner can place NPCs"
+		case len(cp.npcs) >= CnfgNPCMaxPerChunk:
+			failure = fmt.Sprintf("There can only be %d NPCs in a chunk", CnfgNPCMaxPerChunk)
+		default:
+			cp.npcs = append(cp.npcs, pl)
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+			list = registerNPCs(cp)
+		}
+		cp.Unlock()
+		if failure != "" {
+			up.Printf_Bl("#FAIL !%s", failure)
+			return
+		}
+		reportNPCs_RLqWLu(list)
+		up.Printf_Bl("!%s was placed", def.Name)
+	case args[0] == "remove" && len(args) == 1:
+		nearest := up.nearestNPC_RLq(func(*npc) bool { return true })
+		if nearest == nil {
+			up.Printf_Bl("#FAIL !There is no NPC near")
+			return
+		}
+		cp := ChunkFind_WLwWLc(nearest.cc)
+		cp.Lock()
+		allowed := up.MayModifyChunk_RLg(cp)
+		if allowed {
+			x := uint8(int32(math.Floor(nearest.coord.X)) - cp.Coord.X*CHUNK_SIZE)
+			y := uint8(int32(math.Floor(nearest.coord.Y)) - cp.Coord.Y*CHUNK_SIZE)
+			z := uint8(int32(math.Floor(nearest.coord.Z)) - cp.Coord.Z*CHUNK_SIZE)
+			for i, pl := range cp.npcs {
+				if pl.X == x && pl.Y == y && pl.Z == z {
+					cp.npcs = append(cp.npcs[:i], cp.npcs[i+1:]...)
+					break
+				}
+			}
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+			registerNPCs(cp)
+		}
+		cp.Unlock()
+		if !allowed {
+			up.Printf_Bl("#FAIL !Only the owner can remove NPCs")
+			return
+		}
+		up.Printf_Bl("!The NPC was removed")
+	case args[0] == "list" && len(args) == 1:
+		dialogSem.RLock()
+		var ids []string
+		for id := range dialogs {
+			ids = append(ids, id)
+		}
+		dialogSem.RUnlock()
+		up.Printf_Bl("!Dialogs: %s", strings.Join(ids, ", "))
+	default:
+		up.Printf_Bl("#FAIL !Usage: /npc add [dialog]|remove|list")
+	}
+}
@@ -24,7 +24,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"labix.org/v2/mgo/bson"
 	"log"
+	"time"
 )
 
 type ObjectCode string
@@ -33,6 +35,7 @@ type Object struct {
 	Type  ObjectCode
 	Level uint32
 	Count uint32
+	Inst  *itemInstance `bson:",omitempty"` // Only for equipment, where the count is always 1
 }
 
 type PlayerInv []Object // The slize of objects
@@ -40,6 +43,8 @@ type PlayerInv []Object // The slize of objects
 const (
 	ItemHealthPotionID ObjectCode = "POTH"
 	ItemManaPotionID              = "POTM"
+	ItemRegenPotionID             = "POTR"
+	ItemShieldPotionID            = "POTS"
 	ItemWpnHandsID                = "WEP0"
 	ItemWeapon1ID                 = "WEP1"
 	ItemWeapon2ID                 = "WEP2"
@@ -56,29 +61,20 @@ const (
 	ItemHelmet3ID                 = "HLM3"
 	ItemHelmet4ID                 = "HLM4"
 	ItemScrollRessID              = "S001" // A resurrection scroll
+	ItemBow1ID                    = "BOW1"
+	ItemWand1ID                   = "WND1"
 )
 
 var (
-	// A static list of all objects available. Every object is identified by a unique 4 character string.
-	objectUseTable = map[ObjectCode]func(up *user, t ObjectCode, level uint32) (bool, bool){
-		ItemHealthPotionID: UsePotion_Wlu,
-		"POTM":             UsePotion_Wlu,
-		"WEP0":             UseWeapon_Wlu,
-		"WEP1":             UseWeapon_Wlu,
-		"WEP2":             UseWeapon_Wlu,
-		"WEP3":             UseWeapon_Wlu,
-		"WEP4":             UseWeapon_Wlu,
-		"ARM0":             UseArmor_Wlu,
-		"ARM1":             UseArmor_Wlu,
-		"ARM2":             UseArmor_Wlu,
-		"ARM3":             UseArmor_Wlu,
-		"ARM4":             UseArmor_Wlu,
-		"HLM0":             UseHelmet_Wlu,
-		"HLM1":             UseHelmet_Wlu,
-		"HLM2":             UseHelmet_Wlu,
-		"HLM3":             UseHelmet_Wlu,
-		"HLM4":             UseHelmet_Wlu,
-		"S001":             UseScroll_Wlu, // A resurrection scroll
+	// How to use items of each category. The item definitions are found in the item catalog.
+	itemCategoryUse = map[string]func(up *user, def *itemDef, level uint32) (bool, bool){
+		ItemCategoryPotion:   UsePotion_Wlu,
+		ItemCategoryWeapon:   UseWeapon_Wlu,
+		ItemCategoryArmor:    UseArmor_Wlu,
+		ItemCategoryHelmet:   UseHelmet_Wlu,
+		ItemCategoryScroll:   UseScroll_Wlu,
+		ItemCategoryRanged:   UseRanged_WluBl,
+		ItemCategoryMaterial: UseMaterial_Wlu,
 	}
 )
 
@@ -93,18 +89,102 @@ func (inv *PlayerInv) Find(t ObjectCode, level uint32) int {
 	return -1
 }
 
+// Get the number of items of a type and level. Item instances have one entry each.
+func (inv PlayerInv) Count(t ObjectCode, level uint32) (n uint32) {
+	for _, obj := range inv {
+		if obj.Type == t && obj.Level == level {
+			n += obj.Count
+		}
+	}
+	return
+}
+
 func (inv *PlayerInv) Clear() {
 	*inv = nil
 }
 
+// Add a new item. Equipment gets a new instance.
 func (inv *PlayerInv) AddOneObject(t ObjectCode, level uint32) {
-	for i, old := range *inv {
-		if old.Type == t && old.Level == level {
-			(*inv)[i].Count++
-			return
+	obj := Object{Type: t, Level: level, Count: 1}
+	if def := ItemLookup(t); def != nil && isInstanceItem(def) {
+		obj.Inst = newItemInstance(def)
+	}
+	inv.AddObject(obj)
+}
+
+// Add items that already exist, keeping the instance if there is one
+func (inv *PlayerInv) AddObject(obj Object) {
+	if obj.Count == 0 {
+		return
+	}
+	if obj.Inst == nil {
+		for i, old := range *inv {
+			if old.Type == obj.Type && old.Level == obj.Level && old.Inst == nil {
+				(*inv)[i].Count += obj.Count
+				return
+			}
 		}
 	}
-	*inv = append(*inv, Object{Type: t, Level: level, Count: 1})
+	*inv = append(*inv, obj)
+}
+
+// Remove one item, and return it with the instance. The count of the returned object is 0 if there was
+// no such item.
+func (inv *PlayerInv) Take(t ObjectCode, lvl uint32) Object {
+	for _, obj := range *inv {
+		if obj.Type == t && obj.Level == lvl {
+			obj.Count = 1
+			inv.Remove(t, lvl)
+			return obj
+		}
+	}
+	return Object{}
+}
+
+// Remove 'count' items, and return the instances, if there are any.
+func (inv *PlayerInv) takeInstances(t ObjectCode, lvl uint32, count uint32) (list []*itemInstance) {
+	for i := uint32(0); i < count; i++ {
+		if obj := inv.Take(t, lvl); obj.Inst != nil {
+			list = append(list, obj.Inst)
+		}
+	}
+	return
+}
+
+// Add 'count' items, with the instances from takeInstances. Missing instances are created.
+func (inv *PlayerInv) addInstances(t ObjectCode, lvl uint32, count uint32, list []*itemInstance) {
+	for i := uint32(0); i < count; i++ {
+		if i < uint32(len(list)) {
+			inv.AddObject(Object{Type: t, Level: lvl, Count: 1, Inst: list[i]})
+		} else {
+			inv.AddOneObject(t, lvl)
+		}
+	}
+}
+
+// The number of new entries needed to add 'n' items of a type and level. Every item instance needs one.
+func (inv PlayerInv) slotsNeeded(t ObjectCode, lvl uint32, n uint32) uint32 {
+	if def := ItemLookup(t); def != nil && isInstanceItem(def) {
+		return n
+	}
+	if inv.Count(t, lvl) > 0 {
+		return 0
+	}
+	return 1
+}
+
+// Make an item instance the next one to be used, sold or moved, of the items with the same type and level.
+// Return false if there is no such instance.
+func (inv PlayerInv) Select(id bson.ObjectId) bool {
+	for i, obj := range inv {
+		if obj.Inst == nil || obj.Inst.Id != id {
+			continue
+		}
+		first := inv.Find(obj.Type, obj.Level)
+		inv[first], inv[i] = inv[i], inv[first]
+		return true
+	}
+	return false
 }
 
 // Decrement the counter for one object, and remove it from the list when count is zero
@@ -114,7 +194,7 @@ func (inv *PlayerInv) Remove(t ObjectCode, lvl uint32) {
 			continue
 		}
 		(*inv)[i].Count--
-		if obj.Count == 0 {
+		if (*inv)[i].Count == 0 {
 			inv.RemoveIndex(i)
 		}
 		return
@@ -139,8 +219,12 @@ func (inv *PlayerInv) Use_WluBl(up *user, t ObjectCode, lvl uint32) {
 		up.Printf_Bl("#FAIL")
 		return // No such object in inventory
 	}
-	f := objectUseTable[t]
-	consumed, broadcast := f(up, t, lvl)
+	def := ItemLookup(t)
+	if def == nil {
+		up.Printf_Bl("#FAIL")
+		return // Not in the catalog (anymore)
+	}
+	consumed, broadcast := itemCategoryUse[def.Category](up, def, lvl)
 	if broadcast {
 		ReportEquipmentToNear_Bl(up)
 	}
@@ -159,143 +243,189 @@ func (this *PlayerInv) Report(wr io.Writer) {
 	return
 }
 
-// Compute the experience point value of dropping an item. The value is normalized, giving 1 for
-// an item of the same level as the player and of the lowest grade.
-// The type of the item has to be of the form "XXXN".
+// Compute the value of selling an item to a vendor. The value is normalized, giving 1 for
+// an item of the same level as the player and of the lowest grade, and then scaled by the drop value
+// from the item catalog.
 func ItemValueAsDrop(playerLevel, itemLevel uint32, t ObjectCode) float32 {
-	if len(t) != 4 || t[3] > '9' || t[3] < '0' {
+	def := ItemLookup(t)
+	if def == nil || def.DropValue == 0 {
 		return 0
 	}
-	itemType := t[3] - '0'
+	itemType := def.Grade
 	diff := 1 + (float32(itemLevel)-float32(playerLevel)+float32(itemType))/2
 	if diff < 0 {
 		diff = 0
 	} else if diff > 3 {
 		diff = 3
 	}
-	return diff
+	return diff * def.DropValue
 }
 
 func ConvertWeaponTypeToID(weapongrade uint8) ObjectCode {
+	if def := ItemByGrade(ItemCategoryWeapon, weapongrade); def != nil {
+		return def.Code
+	}
 	code := []byte(ItemWpnHandsID)
 	code[3] += weapongrade
 	return ObjectCode(code)
 }
 
 func ConvertArmorTypeToID(armorgrade uint8) ObjectCode {
+	if def := ItemByGrade(ItemCategoryArmor, armorgrade); def != nil {
+		return def.Code
+	}
 	code := []byte(ItemArmorNoneId)
 	code[3] += armorgrade
 	return ObjectCode(code)
 }
 
 func ConvertHelmetTypeToID(helmetgrade uint8) ObjectCode {
+	if def := ItemByGrade(ItemCategoryHelmet, helmetgrade); def != nil {
+		return def.Code
+	}
 	code := []byte(ItemHelmetNoneId)
 	code[3] += helmetgrade
 	return ObjectCode(code)
 }
 
-// Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
+// Use a item of type 'def' and level 'lvl'.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
-func UsePotion_Wlu(up *user, t ObjectCode, lvl uint32) (consumed, broadcast bool) {
+func UsePotion_Wlu(up *user, def *itemDef, lvl uint32) (consumed, broadcast bool) {
 	pl := &up.player
 	if pl.Dead {
 		return false, false
 	}
-	switch t {
-	case ItemHealthPotionID:
+	switch def.Use {
+	case ItemUseHeal:
 		up.Lock()
 		// TODO: The amount should depend on the level
-		if up.Heal(0.3, 0) {
-			pl.Inventory.Remove(ItemHealthPotionID, lvl)
+		if up.Heal(def.Amount, 0) {
+			pl.Inventory.Remove(def.Code, lvl)
 			consumed = true
 		}
 		up.Unlock()
-	case ItemManaPotionID:
+	case ItemUseMana:
 		up.Lock()
 		// TODO: The amount should depend on the level
-		if up.AddMana(0.3) {
-			pl.Inventory.Remove(ItemManaPotionID, lvl)
+		if up.AddMana(def.Amount) {
+			pl.Inventory.Remove(def.Code, lvl)
 			consumed = true
 		}
 		up.Unlock()
+	case ItemUseEffect:
+		kind, _ := FindEffectKind(def.Effect) // Verified when the catalog was loaded
+		up.ApplyEffect_WLu(kind, def.Amount, time.Duration(def.Duration*1e9), up.Id)
+		up.Lock()
+		pl.Inventory.Remove(def.Code, lvl)
+		up.Unlock()
+		consumed = true
 	}
 	return
 }
 
-// Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
+// Use a item of type 'def' and level 'lvl'.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
-func UseWeapon_Wlu(up *user, t ObjectCode, lvl uint32) (bool, bool) {
+func UseWeapon_Wlu(up *user, def *itemDef, lvl uint32) (bool, bool) {
 	replaced := false
-	grade := t[3] - '0'
+	grade := def.Grade
 	pl := &up.player
 	up.Lock()
-	if pl.WeaponLvl+uint32(pl.WeaponGrade) < lvl+uint32(grade) {
+	if replacesEquipment(pl.WeaponLvl+uint32(pl.WeaponGrade), lvl+uint32(grade), pl.WeaponInst, def) {
+		obj := pl.Inventory.Take(def.Code, lvl)
 		// Move the old item back to the inventory
-		pl.Inventory.AddOneObject(ConvertWeaponTypeToID(pl.WeaponGrade), pl.WeaponLvl)
+		pl.Inventory.AddObject(Object{Type: ConvertWeaponTypeToID(pl.WeaponGrade), Level: pl.WeaponLvl, Count: 1, Inst: pl.WeaponInst})
 		// Update current item type
 		pl.WeaponGrade = grade
 		pl.WeaponLvl = lvl
-		pl.Inventory.Remove(t, lvl)
+		pl.WeaponInst = obj.Inst
 		replaced = true
 	}
 	up.Unlock()
 	return replaced, replaced
 }
 
-// Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
+// Use a item of type 'def' and level 'lvl'. A ranged weapon is equipped in addition to the melee weapon.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
-func UseArmor_Wlu(up *user, t ObjectCode, lvl uint32) (bool, bool) {
+func UseRanged_WluBl(up *user, def *itemDef, lvl uint32) (bool, bool) {
+	pl := &up.player
+	up.Lock()
+	old, oldLvl := pl.Ranged, pl.RangedLvl
+	obj := pl.Inventory.Take(def.Code, lvl)
+	if old != "" {
+		// Move the old item back to the inventory
+		pl.Inventory.AddObject(Object{Type: old, Level: oldLvl, Count: 1, Inst: pl.RangedInst})
+	}
+	pl.Ranged = def.Code
+	pl.RangedLvl = lvl
+	pl.RangedInst = obj.Inst
+	up.Unlock()
+	if old != "" {
+		ReportOneInventoryItem_WluBl(up, old, oldLvl)
+	}
+	return true, false
+}
+
+// Use a item of type 'def' and level 'lvl'.
+// Return first flag for being consumed, and teh second to broadcast the action to other players
+func UseArmor_Wlu(up *user, def *itemDef, lvl uint32) (bool, bool) {
 	replaced := false
-	grade := t[3] - '0'
+	grade := def.Grade
 	pl := &up.player
 	up.Lock()
-	if pl.ArmorLvl+uint32(pl.ArmorGrade) < lvl+uint32(grade) {
+	if replacesEquipment(pl.ArmorLvl+uint32(pl.ArmorGrade), lvl+uint32(grade), pl.ArmorInst, def) {
+		obj := pl.Inventory.Take(def.Code, lvl)
 		// Move the old item back to the inventory
-		pl.Inventory.AddOneObject(ConvertArmorTypeToID(pl.ArmorGrade), pl.ArmorLvl)
+		pl.Inventory.AddObject(Object{Type: ConvertArmorTypeToID(pl.ArmorGrade), Level: pl.ArmorLvl, Count: 1, Inst: pl.ArmorInst})
 		// Update current item type
 		pl.ArmorGrade = grade
 		pl.ArmorLvl = lvl
-		pl.Inventory.Remove(t, lvl)
+		pl.ArmorInst = obj.Inst
 		replaced = true
 	}
 	up.Unlock()
 	return replaced, replaced
 }
 
-// Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
+// Use a item of type 'def' and level 'lvl'.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
-func UseScroll_Wlu(up *user, t ObjectCode, lvl uint32) (consumed, broadcast bool) {
+func UseScroll_Wlu(up *user, def *itemDef, lvl uint32) (consumed, broadcast bool) {
 	pl := &up.player
 	if pl.Dead {
 		return
 	}
-	switch t {
-	case ItemScrollRessID:
+	switch def.Use {
+	case ItemUseRevivePoint:
 		up.Lock()
 		pl.ReviveSP = pl.Coord
-		pl.Inventory.Remove(t, lvl)
+		pl.Inventory.Remove(def.Code, lvl)
 		up.Unlock()
 		consumed = true
 	}
 	return
 }
 
-// Use a item of type 't' and level 'lvl'. The type can be counted on being 4 characters.
+// Use a item of type 'def' and level 'lvl'.
 // Return first flag for being consumed, and teh second to broadcast the action to other players
-func UseHelmet_Wlu(up *user, t ObjectCode, lvl uint32) (bool, bool) {
+func UseHelmet_Wlu(up *user, def *itemDef, lvl uint32) (bool, bool) {
 	replaced := false
-	grade := t[3] - '0'
+	grade := def.Grade
 	pl := &up.player
 	up.Lock()
-	if pl.HelmetLvl+uint32(pl.HelmetGrade) < lvl+uint32(grade) {
+	if replacesEquipment(pl.HelmetLvl+uint32(pl.HelmetGrade), lvl+uint32(grade), pl.HelmetInst, def) {
+		obj := pl.Inventory.Take(def.Code, lvl)
 		// Move the old item back to the inventory
-		pl.Inventory.AddOneObject(ConvertHelmetTypeToID(pl.HelmetGrade), pl.HelmetLvl)
+		pl.Inventory.AddObject(Object{Type: ConvertHelmetTypeToID(pl.HelmetGrade), Level: pl.HelmetLvl, Count: 1, Inst: pl.HelmetInst})
 		// Update current item type
 		pl.HelmetGrade = grade
 		pl.HelmetLvl = lvl
-		pl.Inventory.Remove(t, lvl)
+		pl.HelmetInst = obj.Inst
 		replaced = true
 	}
 	up.Unlock()
 	return replaced, replaced
 }
+
+// Materials can't be used directly, only for building and crafting. See crafting.go.
+func UseMaterial_Wlu(up *user, def *itemDef, lvl uint32) (bool, bool) {
+	return false, false
+}
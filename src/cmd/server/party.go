@@ -0,0 +1,379 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Management of parties. A party is a group of players that share experience and loot
+// from killed monsters. Parties are not saved, they are dissolved when the players log out.
+//
+// A party has its own lock. To prevent dead locks, the party must not be locked while locking a user,
+// and no party function may be called with the user locked. The party of a player, and the invitation,
+// are protected by the user lock. The party is created when the first invitation is accepted.
+//
+
+import (
+	"client_prot"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"strings"
+)
+
+// Loot rules used for a party
+const (
+	PartyLootFreeForAll = iota // The player that made the kill gets the loot
+	PartyLootRoundRobin        // The loot is given to the near party members in turn
+)
+
+type party struct {
+	leader     *user
+	members    []*user // The leader is also a member
+	lootRule   uint8   // One of PartyLoot*
+	nextLooter int     // Used for round robin
+	sync.Mutex
+}
+
+// Create a new party, with 'up' as the leader. The caller is responsible for setting up.party.
+func NewParty(up *user) *party {
+	return &party{leader: up, members: []*user{up}, lootRule: PartyLootFreeForAll}
+}
+
+// Get the party of the player, or nil
+func (up *user) Party_RLu() *party {
+	up.RLock()
+	defer up.RUnlock()
+	return up.party
+}
+
+// The player is no longer a member of 'pp'. Nothing is done if the player has joined another party.
+func (up *user) clearParty_WLu(pp *party) {
+	up.Lock()
+	if up.party == pp {
+		up.party = nil
+	}
+	up.Unlock()
+}
+
+// Get a copy of the list of members
+func (pp *party) Members() []*user {
+	pp.Lock()
+	ret := make([]*user, len(pp.members))
+	copy(ret, pp.members)
+	pp.Unlock()
+	return ret
+}
+
+func (pp *party) Leader() *user {
+	pp.Lock()
+	defer pp.Unlock()
+	return pp.leader
+}
+
+// Add a player to the party. Return false if the party is full, or dissolved. The caller is responsible
+// for setting up.party.
+func (pp *party) Add(up *user) bool {
+	pp.Lock()
+	defer pp.Unlock()
+	if len(pp.members) >= CnfgMaxPartySize || pp.leader == nil {
+		return false
+	}
+	pp.members = append(pp.members, up)
+	return true
+}
+
+// Remove a player from the party. If it was the leader, a new leader is selected. The remaining
+// members are returned. A party with only one member left is dissolved. The caller is responsible
+// for clearing the party of the players.
+func (pp *party) Remove(up *user) (remaining []*user) {
+	pp.Lock()
+	for i, other := range pp.members {
+		if other == up {
+			pp.members = append(pp.members[:i], pp.members[i+1:]...)
+			break
+		}
+	}
+	if pp.leader == up && len(pp.members) > 0 {
+		pp.leader = pp.members[0]
+	}
+	remaining = make([]*user, len(pp.members))
+	copy(remaining, pp.members)
+	if len(pp.members) <= 1 {
+		pp.members = nil
+		pp.leader = nil
+	}
+	pp.Unlock()
+	return
+}
+
+// Find all party members that are near enough to 'up' to share a kill. 'up' is always included, also if not
+// being part of a party.
+func (up *user) PartyMembersNear_RLu() []*user {
+	pp := up.Party_RLu()
+	if pp == nil {
+		return []*user{up}
+	}
+	ret := make([]*user, 0, CnfgMaxPartySize)
+	for _, other := range pp.Members() {
+		if other != up {
+			if other.Dead || other.connState != PlayerConnStateIn {
+				continue
+			}
+			dx := other.Coord.X - up.Coord.X
+			dy := other.Coord.Y - up.Coord.Y
+			dz := other.Coord.Z - up.Coord.Z
+			if dx*dx+dy*dy+dz*dz > CnfgPartyShareDistance*CnfgPartyShareDistance {
+				continue
+			}
+		}
+		ret = append(ret, other)
+	}
+	return ret
+}
+
+// Select what player shall receive the next loot item from a kill by 'up'.
+func (up *user) LootReceiver_RLu() *user {
+	pp := up.Party_RLu()
+	if pp == nil {
+		return up
+	}
+	near := up.PartyMembersNear_RLu()
+	pp.Lock()
+	defer pp.Unlock()
+	if pp.lootRule != PartyLootRoundRobin {
+		return up
+	}
+	pp.nextLooter++
+	return near[pp.nextLooter%len(near)]
+}
+
+// Send a text message to all members of the party.
+func (pp *party) Printf(format string, a ...interface{}) {
+	for _, other := range pp.Members() {
+		other.Printf(format, a...)
+	}
+}
+
+// Build the CMD_PARTY_LIST message. An empty list means there is no party.
+func (pp *party) ListMessage() []byte {
+	const entryLen = 10
+	var members []*user
+	var leader *user
+	if pp != nil {
+		pp.Lock()
+		members = make([]*user, len(pp.members))
+		copy(members, pp.members)
+		leader = pp.leader
+		pp.Unlock()
+	}
+	msgLen := 3 + len(members)*entryLen
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_PARTY_LIST
+	for i, other := range members {
+		p := b[3+i*entryLen:]
+		EncodeUint32(other.Id, p[0:4])
+		if other == leader {
+			p[4] = 1
+		}
+		p[5] = byte(other.HitPoints*255 + 0.5)
+		EncodeUint32(other.Level, p[6:10])
+	}
+	return b
+}
+
+// Tell all players in the list about the party members.
+func (pp *party) ReportMembers(list []*user) {
+	msg := pp.ListMessage()
+	for _, other := range list {
+		other.writeNonBlocking(msg)
+	}
+}
+
+// Report the current party to the player. Used regularly, to keep hit points of the members up to date.
+func (up *user) ReportParty_RLuBl() {
+	if pp := up.Party_RLu(); pp != nil {
+		up.writeBlocking_Bl(pp.ListMessage())
+	}
+}
+
+// Leave the current party, if any.
+func (up *user) LeaveParty_WLu() {
+	pp := up.Party_RLu()
+	if pp == nil {
+		return
+	}
+	remaining := pp.Remove(up)
+	up.clearParty_WLu(pp)
+	up.writeNonBlocking((*party)(nil).ListMessage())
+	for _, other := range remaining {
+		other.Printf("!%s left the party", up.Name)
+	}
+	if len(remaining) == 1 {
+		// The last member is no longer in a party
+		remaining[0].clearParty_WLu(pp)
+		remaining[0].Printf("!The party was dissolved")
+		remaining[0].writeNonBlocking((*party)(nil).ListMessage())
+		return
+	}
+	pp.ReportMembers(remaining)
+}
+
+// Decode the /party command
+func (up *user) PartyCommand_RLaWLuBl(arg string) {
+	cmd := strings.SplitN(arg, " ", 2)
+	pp := up.Party_RLu()
+	switch cmd[0] {
+	case "invite":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /party invite [name]")
+			return
+		}
+		if pp != nil && pp.Leader() != up {
+			up.Printf_Bl("#FAIL !Only the party leader can invite")
+			return
+		}
+		allPlayersSem.RLock()
+		other, ok := allPlayerNameMap[strings.ToLower(cmd[1])]
+		allPlayersSem.RUnlock()
+		if !ok || other.connState != PlayerConnStateIn {
+			up.Printf_Bl("#FAIL !%v must be logged in to be invited", cmd[1])
+			return
+		}
+		if other == up {
+			up.Printf_Bl("#FAIL !Can't invite self")
+			return
+		}
+		other.Lock()
+		busy := other.party != nil
+		if !busy {
+			other.partyInvite = up
+		}
+		other.Unlock()
+		if busy {
+			up.Printf_Bl("#FAIL !%v is already in a party", other.Name)
+			return
+		}
+		other.Printf("!%s invites you to a party. Use '/party accept' to join.", up.Name)
+		up.Printf_Bl("!%s invited to the party", other.Name)
+	case "accept":
+		up.Lock()
+		inviter := up.partyInvite
+		up.partyInvite = nil
+		up.Unlock()
+		if inviter == nil || inviter.connState != PlayerConnStateIn {
+			up.Printf_Bl("#FAIL !No party invitation")
+			return
+		}
+		// Create the party of the inviter now, if there is none
+		inviter.Lock()
+		invite := inviter.party
+		if invite == nil {
+			invite = NewParty(inviter)
+			inviter.party = invite
+		}
+		inviter.Unlock()
+		if invite.Leader() != inviter {
+			up.Printf_Bl("#FAIL !%s is no longer the party leader", inviter.Name)
+			return
+		}
+		if pp != nil {
+			up.LeaveParty_WLu()
+		}
+		if !invite.Add(up) {
+			up.Printf_Bl("#FAIL !The party is full")
+			return
+		}
+		up.Lock()
+		up.party = invite
+		up.Unlock()
+		invite.Printf("!%s joined the party", up.Name)
+		invite.ReportMembers(invite.Members())
+	case "leave":
+		if pp == nil {
+			up.Printf_Bl("#FAIL !Not in a party")
+			return
+		}
+		up.LeaveParty_WLu()
+		up.Printf_Bl("!You left the party")
+	case "kick":
+		if len(cmd) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /party kick [name]")
+			return
+		}
+		if pp == nil || pp.Leader() != up {
+			up.Printf_Bl("#FAIL !Only the party leader can kick")
+			return
+		}
+		for _, other := range pp.Members() {
+			if strings.ToLower(other.Name) == strings.ToLower(cmd[1]) && other != up {
+				other.LeaveParty_WLu()
+				other.Printf("!You were kicked from the party")
+				return
+			}
+		}
+		up.Printf_Bl("#FAIL !%v is not in the party", cmd[1])
+	case "loot":
+		if pp == nil || pp.Leader() != up {
+			up.Printf_Bl("#FAIL !Only the party leader can change loot rules")
+			return
+		}
+		var rule uint8
+		switch {
+		case len(cmd) == 2 && cmd[1] == "ffa":
+			rule = PartyLootFreeForAll
+		case len(cmd) == 2 && cmd[1] == "rr":
+			rule = PartyLootRoundRobin
+		default:
+			up.Printf_Bl("#FAIL !Usage: /party loot [ffa|rr]")
+			return
+		}
+		pp.Lock()
+		pp.lootRule = rule
+		pp.Unlock()
+		pp.Printf("!Loot rule is now %s", cmd[1])
+	case "say":
+		if len(cmd) != 2 {
+			return
+		}
+		up.PartySay_RLu(cmd[1])
+	case "show":
+		if pp == nil {
+			up.Printf_Bl("!Not in a party")
+			return
+		}
+		leader := pp.Leader()
+		for _, other := range pp.Members() {
+			if other == leader {
+				up.Printf_Bl("!%s (leader), level %d", other.Name, other.Level)
+			} else {
+				up.Printf_Bl("!%s, level %d", other.Name, other.Level)
+			}
+		}
+	default:
+		up.Printf_Bl("#FAIL !Usage: /party invite|accept|leave|kick|loot|say|show")
+	}
+}
+
+// Send a chat message to all members of the party
+func (up *user) PartySay_RLu(msg string) {
+	pp := up.Party_RLu()
+	if pp == nil {
+		up.Printf_Bl("#FAIL !Not in a party")
+		return
+	}
+	pp.Printf("[Party] %s: %s", up.Name, msg)
+}
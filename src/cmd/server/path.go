@@ -0,0 +1,138 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Monster path finding. A path is computed when a monster is pursuing a player or going home, and it is
+// kept until the target has moved away from the goal. The total number of nodes that may be searched is
+// limited every time the monster states are updated, and monsters that are out of budget head straight
+// for the target instead.
+//
+// The path is only used by the monster state update and the monster movement. They never run at the same
+// time, as the state update has a write lock on the monster data. As the search is done with that lock,
+// it only uses chunks that are already in the cache. Chunks that are not loaded are impassable.
+//
+
+import (
+	"math"
+	"pathfind"
+	"time"
+)
+
+// The world as seen by the path finder
+type monsterWorld struct{}
+
+func pointToCoord(p pathfind.Point) user_coord {
+	return user_coord{float64(p.X) + 0.5, float64(p.Y) + 0.5, float64(p.Z)}
+}
+
+func coordToPoint(uc *user_coord) pathfind.Point {
+	return pathfind.Point{X: int32(math.Floor(uc.X)), Y: int32(math.Floor(uc.Y)), Z: int32(math.Floor(uc.Z))}
+}
+
+func (monsterWorld) Passable(p pathfind.Point) bool {
+	bl, ok := DBGetBlockIfLoaded_RLw(pointToCoord(p))
+	return ok && blockIsPermeable[bl]
+}
+
+// It is possible to climb when there is a ladder next to the feet or the head.
+func (monsterWorld) Climbable(p pathfind.Point) bool {
+	for _, dz := range []int32{0, 1} {
+		for _, d := range [4][2]int32{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+			if bl, _ := DBGetBlockIfLoaded_RLw(pointToCoord(pathfind.Point{X: p.X + d[0], Y: p.Y + d[1], Z: p.Z + dz})); bl == BT_Ladder {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The options used for the path search of a monster
+func (mp *monster) pathOptions(budget int) pathfind.Options {
+	height := int32(math.Ceil(float64(mp.size)))
+	if height < 1 {
+		height = 1
+	}
+	if height > CnfgPathMaxHeight {
+		height = CnfgPathMaxHeight // Big monsters have to squeeze through
+	}
+	if budget > CnfgPathMaxNodes {
+		budget = CnfgPathMaxNodes
+	}
+	return pathfind.Options{Height: height, JumpHeight: 1, MaxDrop: CnfgPathMaxDrop, MaxNodes: budget}
+}
+
+// Make the monster head towards 'target', following a path if there is one. A new path is computed if the
+// target has moved too far from the goal of the current path. 'budget' is the number of nodes that may
+// still be searched in this update, and it is decreased by what is used.
+func (mp *monster) steerTowards_RLw(target *user_coord, budget *int) {
+	goal := coordToPoint(target)
+	dx, dy := goal.X-mp.pathGoal.X, goal.Y-mp.pathGoal.Y
+	if mp.path == nil || dx*dx+dy*dy > CnfgPathGoalTolerance*CnfgPathGoalTolerance {
+		mp.path = nil
+		if *budget > 0 {
+			res := pathfind.Find(monsterWorld{}, coordToPoint(&mp.Coord), goal, mp.pathOptions(*budget))
+			*budget -= res.Expanded
+			if len(res.Path) > 0 {
+				mp.path = res.Path
+				mp.pathGoal = goal
+			}
+		}
+	}
+	if len(mp.path) == 0 {
+		// No path available, go straight for it
+		mp.dirHor = directionTo(target.X-mp.Coord.X, target.Y-mp.Coord.Y)
+		return
+	}
+	mp.steerAlongPath(0)
+}
+
+// Remove waypoints that have been reached, and turn towards the next one. 'step' is the distance the
+// monster is about to move.
+func (mp *monster) steerAlongPath(step float64) {
+	for len(mp.path) > 0 {
+		next := pointToCoord(mp.path[0])
+		dx, dy := next.X-mp.Coord.X, next.Y-mp.Coord.Y
+		if math.Hypot(dx, dy) > step+CnfgPathWaypointDist || mp.Coord.Z < next.Z-0.5 {
+			mp.dirHor = directionTo(dx, dy)
+			return
+		}
+		mp.path = mp.path[1:]
+	}
+	mp.path = nil // Arrived at the end of the path, a new one will be needed
+}
+
+// Climb if the next waypoint is straight above. Return true if the monster is climbing.
+func (mp *monster) climb_RLw(deltaTime time.Duration) bool {
+	if len(mp.path) == 0 {
+		return false
+	}
+	next := mp.path[0]
+	here := coordToPoint(&mp.Coord)
+	if next.X != here.X || next.Y != here.Y || float64(next.Z) <= mp.Coord.Z || !(monsterWorld{}).Climbable(here) {
+		return false
+	}
+	mp.Coord.Z += float64(mp.speed) * float64(deltaTime) / 1e9
+	if mp.Coord.Z >= float64(next.Z) {
+		mp.Coord.Z = float64(next.Z)
+		mp.path = mp.path[1:]
+	}
+	mp.ZSpeed = 0
+	mp.updatedStats = true
+	return true
+}
@@ -53,6 +53,15 @@ var (
 	inhibitCreateChunks = flag.Bool("nocreate", false, "Only load modified chunks, and save no changes")
 	configFileName      = flag.String("configfile", "config.ini", "General configuration file")
 	createuser          = flag.String("createuser", "", "Create user from argument 'email,password,avatar'")
+	itemFileName        = flag.String("items", "items.json", "The item catalog")
+	lootFileName        = flag.String("loot", "loot.json", "The loot tables for monster drops")
+	monsterFileName     = flag.String("monsters", "monsters.json", "The monster species")
+	bossFileName        = flag.String("bosses", "bosses.json", "The boss monsters")
+	abilityFileName     = flag.String("abilities", "abilities.json", "The player abilities")
+	dialogFileName      = flag.String("dialogs", "dialogs.json", "The NPC dialogs")
+	craftingFileName    = flag.String("crafting", "crafting.json", "The materials and crafting recipes")
+	survivalMode        = flag.Bool("survival", false, "Building blocks consumes materials")
+	achievementFileName = flag.String("achievements", "achievements.json", "The achievements")
 	bootDate            = time.Now()
 
 	trafficStatistics = traffic.New()
@@ -113,6 +122,30 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile() // Also done from special command /shutdown
 	}
+	if err := LoadItemCatalog(*itemFileName); err != nil {
+		log.Println("Using built-in item catalog:", err)
+	}
+	if err := LoadLootTables(*lootFileName); err != nil {
+		log.Println("Using built-in loot tables:", err)
+	}
+	if err := LoadMonsterSpecies(*monsterFileName); err != nil {
+		log.Println("Using built-in monster species:", err)
+	}
+	if err := LoadBosses(*bossFileName); err != nil {
+		log.Println("No bosses:", err)
+	}
+	if err := LoadAbilities(*abilityFileName); err != nil {
+		log.Println("Using built-in abilities:", err)
+	}
+	if err := LoadDialogs(*dialogFileName); err != nil {
+		log.Println("No NPC dialogs:", err)
+	}
+	if err := LoadCrafting(*craftingFileName); err != nil {
+		log.Println("No crafting:", err)
+	}
+	if err := LoadAchievements(*achievementFileName); err != nil {
+		log.Println("No achievements:", err)
+	}
 	if *tflag {
 		DoTest()
 		return
@@ -140,6 +173,8 @@ func main() {
 		os.Exit(1)
 	}
 	go ProcAutosave_RLu()
+	go ProcGoldLog()
+	go ProcAuctionExpiry()
 	go ProcPurgeOldChunks_WLw()
 	go CatchSig()
 	ManageMonsters_WLwWLuWLqWLmBlWLc() // Will not return
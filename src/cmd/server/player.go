@@ -49,6 +49,8 @@ type player struct {
 	WeaponLvl   uint32       // The level where the weapon was found.
 	ArmorLvl    uint32       // The level where the armor was found.
 	HelmetLvl   uint32       // The level where the helmet was found.
+	Ranged      ObjectCode   // The ranged weapon, if any.
+	RangedLvl   uint32       // The level where the ranged weapon was found.
 	DirHor      float32      // The horistonal direction the player is looking at. 0 radians means looking to the north. This is controlled by the client.
 	DirVert     float32      // The vertical direction the player is looking at. 0 radians means horisontal This is controlled by the client.
 	Level       uint32       // The player level
@@ -69,7 +71,24 @@ type player struct {
 	Body        uint16       // Body type
 	Keys        keys.KeyRing // The list of keys that the player has
 	Lastseen    time.Time    // When player weas last seen in the game
+	Abilities   []uint8      // The abilities learned by this player
+	Quests      questLog     // Quests in progress and completed
+	Vars        scriptVars   // Activator script variables, by owner and name
+	Gold        uint32       // The currency, see gold.go
+	PvPKills    uint32       // Players killed in arenas. Monster kills are counted in NumKill.
+	PvPDeaths   uint32       // Number of times killed by another player
+	DuelWins    uint32
+	DuelLosses  uint32
 	Inventory   PlayerInv
+	Guild       uint32 // The guild this player is a member of, 0 if none.
+
+	// The instances of the equipped items, see instances.go
+	WeaponInst *itemInstance `bson:",omitempty"`
+	ArmorInst  *itemInstance `bson:",omitempty"`
+	HelmetInst *itemInstance `bson:",omitempty"`
+	RangedInst *itemInstance `bson:",omitempty"`
+
+	Achievements achievementLog // Progress and unlocked achievements, see achievements.go
 }
 
 func (up *user) String() string {
@@ -97,6 +116,9 @@ func (up *user) Load_WLwBlWLc(email string) bool {
 		up.Maxchunks = CnfgMaxOwnChunk
 	}
 
+	// Equipment saved before there were item instances
+	up.upgradeInstances()
+
 	up.logonTimer = time.Now()
 
 	if up.ReviveSP.X == 0 && up.ReviveSP.Y == 0 && up.ReviveSP.Z == 0 {
@@ -73,7 +73,7 @@ func ProcPurgeOldChunks_WLw() {
 	}
 }
 
-func ProcUpdateMonsterState() {
+func ProcUpdateMonsterState_WLwWLc() {
 	var elapsed time.Duration
 	timerstats.Add("ProcUpdateMonsterState", MonstersUpdateDirPeriod, &elapsed)
 	lastTime := time.Now()
@@ -83,7 +83,7 @@ func ProcUpdateMonsterState() {
 		if start.Sub(lastTime) > 4e9 {
 			lastTime = start
 		}
-		UpdateAllMonstersState()
+		UpdateAllMonstersState_WLwWLc()
 		elapsed = time.Now().Sub(start)
 	}
 }
@@ -102,6 +102,9 @@ func ProcUpdateMonsterPos_RLmWLwWLqBlWLuWLc() {
 			lastTime = start
 		}
 		UpdateAllMonsterPos_RLmWLwWLqWLuWLc(fullReport)
+		if fullReport {
+			ReportAllNPCs_RLqWLu()
+		}
 		elapsed = time.Now().Sub(start)
 	}
 }
@@ -135,6 +138,7 @@ func ProcSpawnMonsters_WLwWLuWLqWLmBlWLc() {
 		start := time.Now()
 		time.Sleep(SPAWN_MONSTER_PERIOD)
 		CmdSpawnMonsters_WLwWLuWLqWLmWLc()
+		CmdSpawnerMonsters_WLwWLuWLqWLmWLc()
 		elapsed = time.Now().Sub(start)
 	}
 }
@@ -151,6 +155,32 @@ func ProcMonsterMelee_RLmBl() {
 	}
 }
 
+func ProcUpdateBosses_RLmWLqWLm() {
+	var elapsed time.Duration
+	timerstats.Add("ProcUpdateBosses", CnfgAttackPeriod, &elapsed)
+	for {
+		start := time.Now()
+		time.Sleep(CnfgAttackPeriod)
+		UpdateAllBosses_RLmWLqWLm()
+		elapsed = time.Now().Sub(start)
+	}
+}
+
+// Move the projectiles and manage hits
+func ProcUpdateProjectiles_WLwWLcRLq() {
+	var elapsed time.Duration
+	timerstats.Add("ProcUpdateProjectiles", ObjectsUpdatePeriod, &elapsed)
+	last := time.Now()
+	for {
+		start := time.Now()
+		time.Sleep(ObjectsUpdatePeriod)
+		now := time.Now()
+		UpdateAllProjectiles_WLwWLcRLq(now.Sub(last).Seconds())
+		last = now
+		elapsed = time.Now().Sub(start)
+	}
+}
+
 var ClientCurrentMajorVersion, ClientCurrentMinorVersion int
 
 // Autosave of players
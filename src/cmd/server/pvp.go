@@ -0,0 +1,334 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Player versus player combat. Players can fight each other in two ways:
+// * In a duel, which both players have agreed to. A duel is not lethal, it ends when one of the players
+//   is nearly dead, yields, or moves too far away.
+// * In arena chunks, designated by the territory owner. Both players have to be in an arena, and the
+//   fight is lethal. A killed player is revived at the revive point, as when killed by a monster.
+//
+// A player attacks another player with CMD_ATTACK_PLAYER. The damage is applied by the client process
+// of the player being hit. The duel has its own lock, which must not be locked while locking a user.
+//
+
+import (
+	"client_prot"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"strings"
+	"time"
+)
+
+// How two players may fight
+const (
+	PvPNotAllowed = iota
+	PvPDuel       // Not lethal
+	PvPArena      // Lethal
+)
+
+type duelSession struct {
+	players [2]*user // The first player is the one that challenged
+	over    bool
+	sync.Mutex
+}
+
+// Get the opponent in the duel
+func (ds *duelSession) opponent(up *user) *user {
+	if ds.players[0] == up {
+		return ds.players[1]
+	}
+	return ds.players[0]
+}
+
+// End the duel, with 'winner' as the winner. A nil winner means the duel was cancelled.
+// Return false if the duel was already over.
+func (ds *duelSession) end(winner *user, reason string) bool {
+	ds.Lock()
+	over := ds.over
+	ds.over = true
+	ds.Unlock()
+	if over {
+		return false
+	}
+	for _, up := range ds.players {
+		up.Lock()
+		if up.duel == ds {
+			up.duel = nil
+		}
+		if up.pvpTarget == ds.opponent(up) {
+			up.pvpTarget = nil
+		}
+		switch {
+		case winner == nil:
+		case up == winner:
+			up.DuelWins++
+		default:
+			up.DuelLosses++
+		}
+		up.Unlock()
+		if winner == nil {
+			up.Printf("!The duel is over: %s", reason)
+		} else {
+			up.Printf("!%s won the duel: %s", winner.Name, reason)
+		}
+	}
+	return true
+}
+
+// Return true if the player is in an arena chunk
+func (up *user) inArena_WLwWLc() bool {
+	cp := ChunkFindCached_WLwWLc(up.Coord.GetChunkCoord())
+	return cp != nil && cp.flag&CHF_ARENA != 0
+}
+
+// Decide how 'up' may fight 'other'. Duel and arena conditions are given as arguments.
+func pvpMode(dueling bool, upInArena, otherInArena bool) int {
+	switch {
+	case dueling:
+		return PvPDuel
+	case upInArena && otherInArena:
+		return PvPArena
+	}
+	return PvPNotAllowed
+}
+
+// Decide how 'up' may fight 'other' now
+func (up *user) pvpMode_WLwWLc(other *user) int {
+	if other == nil || other == up || other.Dead || up.Dead || other.connState != PlayerConnStateIn {
+		return PvPNotAllowed
+	}
+	ds := up.duel
+	return pvpMode(ds != nil && ds == other.duel, up.inArena_WLwWLc(), other.inArena_WLwWLc())
+}
+
+// The damage done by player 'a' hitting player 'd', using the same multipliers as for monsters.
+func pvpDamage(a, d *player, weaponDmg float32) float32 {
+	dmg := weaponDmg *
+		PlayerLevelDiffMultiplier(d.Level, a.Level) *
+		a.weaponMultiplier() /
+		d.armorDivisor() *
+		CnfgPvPDamageFactor
+	if dmg > 1 {
+		dmg = 1
+	}
+	return dmg
+}
+
+// Tell a player about a PvP hit
+func pvpHitMessage(attacker, defender uint32, dmg float32) []byte {
+	var b [12]byte
+	b[0] = byte(len(b))
+	b[1] = 0
+	b[2] = client_prot.CMD_PVP_HIT
+	EncodeUint32(attacker, b[3:7])
+	EncodeUint32(defender, b[7:11])
+	b[11] = byte(dmg*255 + 0.5)
+	return b[:]
+}
+
+// The current player attacks 'other'. Must be called from the client process.
+func (up *user) HitPlayer_WLuBl(other *user, mode int, weaponDmg float32) {
+	up.RLock()
+	dmg := pvpDamage(&up.player, &other.player, weaponDmg) * up.effects.damageDone(time.Now())
+	up.RUnlock()
+	up.writeBlocking_Bl(pvpHitMessage(up.Id, other.Id, dmg))
+	attacker := up
+	// The damage is managed by the process of the player being hit
+	other.SendCommand(func(up *user) {
+		if up.Dead {
+			return
+		}
+		ds := up.duel
+		if mode == PvPDuel && (ds == nil || ds.opponent(up) != attacker) {
+			return // The duel ended before the hit arrived
+		}
+		up.Lock()
+		now := time.Now()
+		dmg := up.effects.absorb(dmg*up.effects.damageTaken(now), now)
+		up.HitPoints -= dmg
+		up.updatedStats = true
+		killed := false
+		if mode == PvPDuel && up.HitPoints < CnfgDuelEndHitPoints {
+			up.HitPoints = CnfgDuelEndHitPoints // A duel is not lethal
+		} else if up.HitPoints <= 0 {
+			up.HitPoints = 0
+			up.Dead = true
+			up.PvPDeaths++
+			up.pvpTarget = nil
+			killed = true
+		}
+		hp := up.HitPoints
+		up.Unlock()
+		up.writeBlocking_Bl(pvpHitMessage(attacker.Id, up.Id, dmg))
+		if mode == PvPDuel && hp <= CnfgDuelEndHitPoints {
+			ds.end(attacker, up.Name+" is defeated")
+		}
+		if killed {
+			attacker.Lock()
+			attacker.PvPKills++
+			if attacker.pvpTarget == up {
+				attacker.pvpTarget = nil
+			}
+			attacker.Unlock()
+			attacker.Printf("!You killed %s", up.Name)
+			up.Printf_Bl("!You were killed by %s. Use /revive to return to your revive point.", attacker.Name)
+			up.Emit_WLu(EventDeath, 1, attacker.Level)
+		}
+	})
+}
+
+// Manage the PvP attack every attack period. Return true if there is a PvP fight going on.
+func (up *user) ManagePvP_WLuBl() bool {
+	other := up.pvpTarget
+	if other == nil {
+		return false
+	}
+	mode := up.pvpMode_WLwWLc(other)
+	dx := up.Coord.X - other.Coord.X
+	dy := up.Coord.Y - other.Coord.Y
+	dz := up.Coord.Z - other.Coord.Z
+	dist2 := dx*dx + dy*dy + dz*dz
+	if ds := up.duel; ds != nil && ds.opponent(up) == other && dist2 > CnfgDuelMaxDistance*CnfgDuelMaxDistance {
+		ds.end(nil, "too far apart")
+		mode = PvPNotAllowed
+	}
+	if mode == PvPNotAllowed {
+		up.Lock()
+		up.pvpTarget = nil
+		up.flags &= ^client_prot.UserFlagInFight
+		up.Unlock()
+		up.updatedStats = true
+		return false
+	}
+	if dist2 <= CnfgMeleeDistLimit*CnfgMeleeDistLimit && !up.effects.has(EffectStun, time.Now()) {
+		up.HitPlayer_WLuBl(other, mode, 1)
+	}
+	return true
+}
+
+// Initiate an attack on another player, using the uid of the player.
+func (up *user) CmdAttackPlayer_WLuBl(b []byte) {
+	uid, _, ok := ParseUint32(b)
+	if !ok {
+		return
+	}
+	allPlayersSem.RLock()
+	other := allPlayerIdMap[uid]
+	allPlayersSem.RUnlock()
+	up.AttackPlayer_WLuBl(other)
+}
+
+func (up *user) AttackPlayer_WLuBl(other *user) {
+	if up.Dead {
+		up.Printf_Bl("Can't attack when dead")
+		return
+	}
+	if up.pvpMode_WLwWLc(other) == PvPNotAllowed {
+		up.Printf_Bl("#FAIL !You can only fight other players in a duel or in an arena")
+		return
+	}
+	up.Lock()
+	up.aggro = nil
+	up.pvpTarget = other
+	up.flags |= client_prot.UserFlagInFight
+	up.updatedStats = true
+	up.Unlock()
+	up.Printf_Bl("You attack %s", other.Name)
+}
+
+// Cancel the duel, if any. Used when the player logs out.
+func (up *user) DuelCancel() {
+	if ds := up.duel; ds != nil {
+		ds.end(nil, up.Name+" left")
+	}
+}
+
+// Manage the "/duel" command
+func (up *user) DuelCommand_RLaWLuBl(arg string) {
+	cmd := strings.SplitN(arg, " ", 2)
+	switch cmd[0] {
+	case "accept":
+		up.Lock()
+		ds := up.duelInvite
+		up.duelInvite = nil
+		up.Unlock()
+		if ds == nil || ds.players[0].connState != PlayerConnStateIn {
+			up.Printf_Bl("#FAIL !No duel challenge")
+			return
+		}
+		// The challenger may have started another duel in the meantime. Both players are locked, always
+		// in the same order to prevent dead locks, so the test and the change are done together.
+		other := ds.players[0]
+		first, second := up, other
+		if second.Id < first.Id {
+			first, second = second, first
+		}
+		first.Lock()
+		second.Lock()
+		busy, otherBusy := up.duel != nil, other.duel != nil
+		if !busy && !otherBusy {
+			other.duel = ds
+			up.duel = ds
+		}
+		second.Unlock()
+		first.Unlock()
+		if busy {
+			up.Printf_Bl("#FAIL !You are already in a duel")
+			return
+		}
+		if otherBusy {
+			up.Printf_Bl("#FAIL !No duel challenge")
+			return
+		}
+		// Both players attack each other directly
+		other.SendCommand(func(up *user) { up.AttackPlayer_WLuBl(ds.opponent(up)) })
+		up.AttackPlayer_WLuBl(other)
+		other.Printf("!%s accepted the duel!", up.Name)
+	case "yield":
+		ds := up.duel
+		if ds == nil {
+			up.Printf_Bl("#FAIL !Not in a duel")
+			return
+		}
+		ds.end(ds.opponent(up), up.Name+" yields")
+	case "stats":
+		up.Printf_Bl("!Duels won %d, lost %d. Arena kills %d, deaths %d", up.DuelWins, up.DuelLosses, up.PvPKills, up.PvPDeaths)
+	default:
+		allPlayersSem.RLock()
+		other, ok := allPlayerNameMap[strings.ToLower(cmd[0])]
+		allPlayersSem.RUnlock()
+		if !ok || other.connState != PlayerConnStateIn {
+			up.Printf_Bl("#FAIL !%v must be logged in to be challenged", cmd[0])
+			return
+		}
+		if other == up {
+			up.Printf_Bl("#FAIL !Can't challenge self")
+			return
+		}
+		if up.duel != nil || other.duel != nil {
+			up.Printf_Bl("#FAIL !Already in a duel")
+			return
+		}
+		other.Lock()
+		other.duelInvite = &duelSession{players: [2]*user{up, other}}
+		other.Unlock()
+		other.Printf("!%s challenges you to a duel. Use '/duel accept' to fight.", up.Name)
+		up.Printf_Bl("!%s challenged to a duel", other.Name)
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Quests are authored by territory owners, using text activators. A quest is identified by the owner
+// and a quest number, the same way as keys. The quest is started by the activator modifier
+//
+//   /quest:<id>:<steps>:<rewards> <title>
+//
+// where the steps and the rewards are comma separated lists. The steps are done in order:
+// * "talk": Trig a text activator of the owner with the modifier "/questtalk:<id>".
+// * "kill<count>x<level>": Kill monsters of at least the given level.
+// * "item<count>x<code>": Collect items. They are taken from the inventory when the step is done.
+// * "reach": Walk into a BT_Quest block in a chunk of the owner.
+// The rewards are given when all steps are done:
+// * "exp<amount>": Experience, as a fraction of a level.
+// * "item<code>": An item, paid by the owner in the same way as for "/invadd".
+// * "key<id>x<view>": A key, named from the quest title.
+// * "gold<amount>": Gold, paid by the owner with territory score.
+//
+// A BT_Quest block is also a trigger, so quests can be started from it.
+// The quest progress is saved in the avatar, and is only changed by the client process.
+//
+
+import (
+	"fmt"
+	"keys"
+	"log"
+	"quadtree"
+	"strconv"
+	"strings"
+)
+
+// The kinds of quest steps
+const (
+	QuestStepTalk  = 0
+	QuestStepKill  = 1
+	QuestStepItem  = 2
+	QuestStepReach = 3
+)
+
+// The kinds of quest rewards
+const (
+	QuestRewardExp  = 0
+	QuestRewardItem = 1
+	QuestRewardKey  = 2
+	QuestRewardGold = 3
+)
+
+type questStep struct {
+	Kind  uint8
+	Count uint32     // Number of kills or items, 1 for other steps
+	Level uint32     // Kill steps: the lowest monster level that counts
+	Item  ObjectCode // Item steps: the item to collect
+}
+
+type questReward struct {
+	Kind uint8
+	Exp  float32
+	Item ObjectCode
+	Key  uint
+	View uint
+	Gold uint32
+}
+
+// A quest, with the progress of a player. The definition is copied into the avatar when the quest is started,
+// so it can be completed even if the activator is changed.
+type quest struct {
+	Owner   uint32
+	Id      uint
+	Title   string
+	Steps   []questStep
+	Rewards []questReward
+	Step    int    // The current step
+	Count   uint32 // The progress of the current step
+	Done    bool
+}
+
+type questLog []quest
+
+// Find a quest in the log, or nil
+func (ql questLog) find(owner uint32, id uint) *quest {
+	for i := range ql {
+		if ql[i].Owner == owner && ql[i].Id == id {
+			return &ql[i]
+		}
+	}
+	return nil
+}
+
+// The number of quests not yet done
+func (ql questLog) active() (n int) {
+	for _, q := range ql {
+		if !q.Done {
+			n++
+		}
+	}
+	return
+}
+
+// Verify that the items used by the quest are found in the item catalog
+func (q *quest) verifyItems(cat *itemCatalog) error {
+	for _, s := range q.Steps {
+		if s.Kind == QuestStepItem && cat.byCode[s.Item] == nil {
+			return fmt.Errorf("quest '%s': unknown item '%s'", q.Title, s.Item)
+		}
+	}
+	for _, r := range q.Rewards {
+		if r.Kind == QuestRewardItem && cat.byCode[r.Item] == nil {
+			return fmt.Errorf("quest '%s': unknown item '%s'", q.Title, r.Item)
+		}
+	}
+	return nil
+}
+
+// Verify the items of the active quests of all logged in players. There is no list of the quests in
+// activators, as they are parsed when trigged. An unknown item then only stops the quest from starting.
+func verifyQuestItems_RLaRLu(cat *itemCatalog) error {
+	allPlayersSem.RLock()
+	defer allPlayersSem.RUnlock()
+	for _, up := range allPlayerIdMap {
+		var err error
+		up.RLock()
+		for i := range up.Quests {
+			if q := &up.Quests[i]; !q.Done {
+				if err = q.verifyItems(cat); err != nil {
+					break
+				}
+			}
+		}
+		up.RUnlock()
+		if err != nil {
+			return fmt.Errorf("player %s: %v", up.Name, err)
+		}
+	}
+	return nil
+}
+
+// Parse "<count>x<arg>" of a step
+func parseQuestCount(s string) (count uint32, arg string, err error) {
+	args := strings.SplitN(s, "x", 2)
+	if len(args) != 2 {
+		return 0, "", fmt.Errorf("expected <count>x<arg> in '%s'", s)
+	}
+	c, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || c == 0 {
+		return 0, "", fmt.Errorf("bad count in '%s'", s)
+	}
+	return uint32(c), args[1], nil
+}
+
+func parseQuestStep(s string) (step questStep, err error) {
+	step.Count = 1
+	switch {
+	case s == "talk":
+		step.Kind = QuestStepTalk
+	case s == "reach":
+		step.Kind = QuestStepReach
+	case strings.HasPrefix(s, "kill"):
+		step.Kind = QuestStepKill
+		var lvl string
+		if step.Count, lvl, err = parseQuestCount(s[4:]); err != nil {
+			return
+		}
+		var l uint64
+		if l, err = strconv.ParseUint(lvl, 10, 32); err != nil {
+			err = fmt.Errorf("bad level in '%s'", s)
+			return
+		}
+		step.Level = uint32(l)
+	case strings.HasPrefix(s, "item"):
+		step.Kind = QuestStepItem
+		var code string
+		if step.Count, code, err = parseQuestCount(s[4:]); err != nil {
+			return
+		}
+		if ItemLookup(ObjectCode(code)) == nil {
+			err = fmt.Errorf("unknown item '%s'", code)
+			return
+		}
+		step.Item = ObjectCode(code)
+	default:
+		err = fmt.Errorf("unknown quest step '%s'", s)
+	}
+	return
+}
+
+func parseQuestReward(s string) (reward questReward, err error) {
+	switch {
+	case strings.HasPrefix(s, "exp"):
+		reward.Kind = QuestRewardExp
+		var e float64
+		if e, err = strconv.ParseFloat(s[3:], 32); err != nil || e <= 0 {
+			err = fmt.Errorf("bad experience in '%s'", s)
+			return
+		}
+		if e > CnfgQuestMaxExp {
+			e = CnfgQuestMaxExp
+		}
+		reward.Exp = float32(e)
+	case strings.HasPrefix(s, "item"):
+		reward.Kind = QuestRewardItem
+		reward.Item = ObjectCode(s[4:])
+		if ItemLookup(reward.Item) == nil {
+			err = fmt.Errorf("unknown item '%s'", s[4:])
+		}
+	case strings.HasPrefix(s, "key"):
+		reward.Kind = QuestRewardKey
+		args := strings.SplitN(s[3:], "x", 2)
+		if len(args) != 2 {
+			err = fmt.Errorf("expected key<id>x<view> in '%s'", s)
+			return
+		}
+		key, err1 := strconv.ParseUint(args[0], 10, 0)
+		view, err2 := strconv.ParseUint(args[1], 10, 0)
+		if err1 != nil || err2 != nil {
+			err = fmt.Errorf("bad key in '%s'", s)
+			return
+		}
+		reward.Key, reward.View = uint(key), uint(view)
+	case strings.HasPrefix(s, "gold"):
+		reward.Kind = QuestRewardGold
+		var g uint64
+		if g, err = strconv.ParseUint(s[4:], 10, 32); err != nil || g == 0 {
+			err = fmt.Errorf("bad gold in '%s'", s)
+			return
+		}
+		if g > CnfgQuestMaxGold {
+			g = CnfgQuestMaxGold
+		}
+		reward.Gold = uint32(g)
+	default:
+		err = fmt.Errorf("unknown quest reward '%s'", s)
+	}
+	return
+}
+
+// Parse the argument of the activator modifier "/quest:<id>:<steps>:<rewards>". The rewards are optional.
+func parseQuestModifier(owner uint32, modifier string, title string) (*quest, error) {
+	args := strings.Split(modifier, ":")
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("quest '%s': expected id:steps:rewards", modifier)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 0)
+	if err != nil {
+		return nil, fmt.Errorf("quest '%s': bad id", modifier)
+	}
+	q := &quest{Owner: owner, Id: uint(id), Title: title}
+	if q.Title == "" {
+		q.Title = fmt.Sprintf("Quest %d", id)
+	}
+	for _, s := range strings.Split(args[1], ",") {
+		step, err := parseQuestStep(s)
+		if err != nil {
+			return nil, err
+		}
+		q.Steps = append(q.Steps, step)
+	}
+	if len(args) == 3 && args[2] != "" {
+		for _, s := range strings.Split(args[2], ",") {
+			reward, err := parseQuestReward(s)
+			if err != nil {
+				return nil, err
+			}
+			q.Rewards = append(q.Rewards, reward)
+		}
+	}
+	return q, nil
+}
+
+// Describe the current step of the quest
+func (q *quest) stepDescr() string {
+	if q.Done {
+		return "Completed"
+	}
+	s := &q.Steps[q.Step]
+	switch s.Kind {
+	case QuestStepTalk:
+		return "Talk to the quest giver"
+	case QuestStepKill:
+		return fmt.Sprintf("Kill monsters of level %d or higher (%d/%d)", s.Level, q.Count, s.Count)
+	case QuestStepItem:
+		name := string(s.Item)
+		if def := ItemLookup(s.Item); def != nil {
+			name = def.Name
+		}
+		return fmt.Sprintf("Collect %d %s", s.Count, name)
+	case QuestStepReach:
+		return "Find the quest location"
+	}
+	return ""
+}
+
+// Count the items of a type, at all levels
+func (inv PlayerInv) countAll(t ObjectCode) (n uint32) {
+	for _, obj := range inv {
+		if obj.Type == t {
+			n += obj.Count
+		}
+	}
+	return
+}
+
+// Remove 'count' items of a type, at any level. Return the levels that were changed.
+func (inv *PlayerInv) removeAll(t ObjectCode, count uint32) (levels []uint32) {
+	for count > 0 {
+		i := 0
+		for i < len(*inv) && (*inv)[i].Type != t {
+			i++
+		}
+		if i == len(*inv) {
+			break
+		}
+		lvl := (*inv)[i].Level
+		inv.Remove(t, lvl)
+		levels = append(levels, lvl)
+		count--
+	}
+	return
+}
+
+// Start a quest, unless it is already in the log. Must be called from the client process.
+func (up *user) StartQuest_WLuBl(def *quest) {
+	up.Lock()
+	q := up.Quests.find(def.Owner, def.Id)
+	full := up.Quests.active() >= CnfgQuestMaxActive
+	if q == nil && !full {
+		nq := *def
+		up.Quests = append(up.Quests, nq)
+	}
+	var msg string
+	switch {
+	case q != nil && q.Done:
+		// Nothing to tell, the quest can only be done once
+	case q != nil:
+		msg = fmt.Sprintf("!%s: %s", q.Title, q.stepDescr())
+	case full:
+		msg = "#FAIL !Your quest log is full"
+	default:
+		msg = fmt.Sprintf("!New quest '%s': %s", def.Title, def.stepDescr())
+	}
+	up.Unlock()
+	if msg != "" {
+		up.Printf_Bl("%s", msg)
+	}
+	up.ManageQuests_WLuBl() // The player may already have the items
+}
+
+// Advance the quests of the player. 'progress' is called for the current step of every active quest,
+// with the player locked, and returns the progress made. Rewards are given for completed quests.
+// Must be called from the client process.
+func (up *user) advanceQuests_WLuBl(progress func(q *quest, s *questStep) uint32) {
+	type removedItem struct {
+		code ObjectCode
+		lvl  uint32
+	}
+	var msgs []string
+	var completed []quest
+	var removed []removedItem
+	up.Lock()
+	for i := range up.Quests {
+		q := &up.Quests[i]
+		if q.Done {
+			continue
+		}
+		s := &q.Steps[q.Step]
+		n := progress(q, s)
+		if n == 0 {
+			continue
+		}
+		q.Count += n
+		if q.Count < s.Count {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", q.Title, q.stepDescr()))
+			continue
+		}
+		if s.Kind == QuestStepItem {
+			for _, lvl := range up.Inventory.removeAll(s.Item, s.Count) {
+				removed = append(removed, removedItem{s.Item, lvl})
+			}
+		}
+		q.Step++
+		q.Count = 0
+		if q.Step == len(q.Steps) {
+			q.Done = true
+			completed = append(completed, *q)
+			msgs = append(msgs, fmt.Sprintf("!Quest '%s' completed!", q.Title))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("!%s: %s", q.Title, q.stepDescr()))
+		}
+	}
+	up.Unlock()
+	for _, r := range removed {
+		ReportOneInventoryItem_WluBl(up, r.code, r.lvl)
+	}
+	for _, msg := range msgs {
+		up.Printf_Bl("%s", msg)
+	}
+	for i := range completed {
+		up.questRewards_WLuBl(&completed[i])
+		up.Emit_WLu(EventQuest, 1, 0)
+	}
+}
+
+// Give the rewards of a completed quest
+func (up *user) questRewards_WLuBl(q *quest) {
+	for _, r := range q.Rewards {
+		switch r.Kind {
+		case QuestRewardExp:
+			if ownerPays(q.Owner, up, float64(r.Exp)*CnfgExpRewardCost) {
+				up.Lock()
+				up.AddExperience(r.Exp) // Must be locked
+				up.Unlock()
+			} else {
+				up.Printf_Bl("!The quest giver can't afford the experience")
+			}
+		case QuestRewardItem:
+			if ownerPays(q.Owner, up, itemRewardCost(r.Item)) {
+				AddOneObjectToUser_WLuBl(up, r.Item)
+			} else {
+				up.Printf_Bl("!The quest giver can't afford %s", r.Item)
+			}
+		case QuestRewardKey:
+			key := keys.Make(q.Owner, r.Key, q.Title, r.View)
+			up.Lock()
+			up.Keys = up.Keys.Add(key)
+			up.Unlock()
+		case QuestRewardGold:
+			if ownerPays(q.Owner, up, float64(r.Gold)*CnfgGoldRewardCost) {
+				up.AddGold_WLu(int64(r.Gold), "quest")
+			} else {
+				up.Printf_Bl("!The quest giver can't afford %d gold", r.Gold)
+			}
+		}
+	}
+	if *verboseFlag > 0 {
+		log.Println("Quest", q.Owner, q.Id, "completed by", up.Name)
+	}
+}
+
+// The player trigged a "/questtalk:<id>" activator of 'owner'
+func (up *user) QuestTalk_WLuBl(owner uint32, id uint) {
+	up.advanceQuests_WLuBl(func(q *quest, s *questStep) uint32 {
+		if q.Owner == owner && q.Id == id && s.Kind == QuestStepTalk {
+			return 1
+		}
+		return 0
+	})
+}
+
+// The player walked into a BT_Quest block in a chunk of 'owner'
+func (up *user) QuestReach_WLuBl(owner uint32) {
+	up.advanceQuests_WLuBl(func(q *quest, s *questStep) uint32 {
+		if q.Owner == owner && s.Kind == QuestStepReach {
+			return 1
+		}
+		return 0
+	})
+}
+
+// The player killed a monster
+func (up *user) QuestKill_WLuBl(level uint32) {
+	up.advanceQuests_WLuBl(func(q *quest, s *questStep) uint32 {
+		if s.Kind == QuestStepKill && level >= s.Level {
+			return 1
+		}
+		return 0
+	})
+}
+
+// Check collect steps. This is called every attack period, as items can be found in many ways.
+func (up *user) ManageQuests_WLuBl() {
+	if up.Quests.active() == 0 {
+		return
+	}
+	up.advanceQuests_WLuBl(func(q *quest, s *questStep) uint32 {
+		if s.Kind == QuestStepItem && up.Inventory.countAll(s.Item) >= s.Count {
+			return s.Count
+		}
+		return 0
+	})
+}
+
+// Start a quest for all recepients. The modifier is "<id>:<steps>:<rewards>".
+func (trigger *user) ActivatorMessageQuest_WLuBl(recepients []quadtree.Object, owner uint32, modifier string, title string, ac *user_coord) {
+	def, err := parseQuestModifier(owner, modifier, title)
+	if err != nil {
+		if *verboseFlag > 1 {
+			log.Println("Quest error", err, "at", ac)
+		}
+		return
+	}
+	f := func(up *user) {
+		up.StartQuest_WLuBl(def)
+	}
+	activatorCommand(trigger, f, recepients)
+}
+
+// A "/questtalk:<id>" activator was trigged
+func (trigger *user) ActivatorMessageQuestTalk_WLuBl(recepients []quadtree.Object, owner uint32, modifier string, ac *user_coord) {
+	id, err := strconv.ParseUint(modifier, 10, 0)
+	if err != nil {
+		if *verboseFlag > 1 {
+			log.Println("Quest talk error", err, "at", ac)
+		}
+		return
+	}
+	f := func(up *user) {
+		up.QuestTalk_WLuBl(owner, uint(id))
+	}
+	activatorCommand(trigger, f, recepients)
+}
+
+// The quest progress is only changed by the client process, so recepients other than the player 'trigger'
+// that trigged the activator are sent a command.
+func activatorCommand(trigger *user, f func(*user), recepients []quadtree.Object) {
+	ActivatorIterator(func(up *user) {
+		if up == trigger {
+			f(up)
+		} else {
+			up.SendCommand(f)
+		}
+	}, recepients)
+}
+
+// Manage the "/quest" command
+func (up *user) QuestCommand_WLuBl(args []string) {
+	switch {
+	case len(args) == 0 || args[0] == "log":
+		up.RLock()
+		var lines []string
+		done := 0
+		for i, q := range up.Quests {
+			if q.Done {
+				done++
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("!%d. %s: %s", i+1, q.Title, q.stepDescr()))
+		}
+		up.RUnlock()
+		for _, line := range lines {
+			up.Printf_Bl("%s", line)
+		}
+		up.Printf_Bl("!%d active quests, %d completed", len(lines), done)
+	case args[0] == "abandon" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		up.Lock()
+		ok := err == nil && n >= 1 && n <= len(up.Quests) && !up.Quests[n-1].Done
+		var title string
+		if ok {
+			title = up.Quests[n-1].Title
+			up.Quests = append(up.Quests[:n-1], up.Quests[n:]...)
+		}
+		up.Unlock()
+		if !ok {
+			up.Printf_Bl("#FAIL !No such active quest")
+			return
+		}
+		up.Printf_Bl("!Quest '%s' abandoned", title)
+	default:
+		up.Printf_Bl("#FAIL !Usage: /quest [log|abandon n]")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Ranged combat. A player with a ranged weapon equipped, that is too far away from the target for melee,
+// fires projectiles instead. The projectiles are simulated by the server. They travel in a straight line,
+// and hit the first block or monster in the way.
+//
+// Clients are told about a new projectile with CMD_PROJECTILE, and when it is gone with CMD_PROJECTILE_END.
+//
+
+import (
+	"client_prot"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"math"
+	. "twof"
+)
+
+// The reason a projectile ended, sent in CMD_PROJECTILE_END
+const (
+	ProjectileEndRange   = 0 // Travelled too far
+	ProjectileEndBlock   = 1 // Hit a block
+	ProjectileEndMonster = 2 // Hit a monster
+)
+
+type projectile struct {
+	id     uint32
+	owner  *user
+	model  uint8
+	pos    user_coord
+	vel    [3]float64 // Blocks per second
+	left   float64    // The remaining distance
+	dmg    float32    // Weapon damage
+	wepMul float32    // Weapon level and grade multiplier
+}
+
+var projectiles struct {
+	nextId     uint32
+	list       []*projectile
+	sync.Mutex // Only used when accessing the list
+}
+
+// Return true if there are only permeable blocks on the line between the two points.
+func lineOfSight_WLwWLc(from, to user_coord) bool {
+	return lineOfSightWith(from, to, func(uc user_coord) bool {
+		return blockIsPermeable[DBGetBlockCached_WLwWLc(uc)]
+	})
+}
+
+// As lineOfSight_WLwWLc, but only chunks already in the cache are used. Chunks that are not loaded block
+// the sight. Used by the monster processes, that must not wait for the disk.
+func lineOfSightLoaded_RLw(from, to user_coord) bool {
+	return lineOfSightWith(from, to, func(uc user_coord) bool {
+		bl, ok := DBGetBlockIfLoaded_RLw(uc)
+		return ok && blockIsPermeable[bl]
+	})
+}
+
+func lineOfSightWith(from, to user_coord, permeable func(user_coord) bool) bool {
+	dx, dy, dz := to.X-from.X, to.Y-from.Y, to.Z-from.Z
+	dist := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	steps := int(dist/CnfgProjectileStep) + 1
+	for i := 1; i < steps; i++ {
+		f := float64(i) / float64(steps)
+		if !permeable(user_coord{from.X + dx*f, from.Y + dy*f, from.Z + dz*f}) {
+			return false
+		}
+	}
+	return true
+}
+
+// The point a projectile is aimed at
+func (mp *monster) aimPoint() user_coord {
+	return user_coord{mp.Coord.X, mp.Coord.Y, mp.Coord.Z + float64(mp.size)/2}
+}
+
+// Return true if the projectile position is inside the monster
+func (mp *monster) hitBy(pos *user_coord) bool {
+	if pos.Z < mp.Coord.Z || pos.Z > mp.Coord.Z+float64(mp.size) {
+		return false
+	}
+	dx, dy := pos.X-mp.Coord.X, pos.Y-mp.Coord.Y
+	r := CnfgProjectileHitRadius + float64(mp.size)*0.2
+	return dx*dx+dy*dy <= r*r
+}
+
+// Fire a projectile at the monster, if the player has a ranged weapon and the monster can be reached.
+// Return true if a projectile was fired.
+func (up *user) FireProjectile_WLuBl(mp *monster) bool {
+	def := ItemLookup(up.Ranged)
+	if def == nil || def.Category != ItemCategoryRanged {
+		return false
+	}
+	from := up.Coord
+	from.Z += CnfgProjectileLaunchHeight
+	to := mp.aimPoint()
+	dx, dy, dz := to.X-from.X, to.Y-from.Y, to.Z-from.Z
+	dist := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if dist > def.Range || dist == 0 || up.Mana < def.ManaCost || !lineOfSight_WLwWLc(from, to) {
+		return false
+	}
+	// The mana is only changed from the client process, no lock needed.
+	up.Mana -= def.ManaCost
+	up.updatedStats = true
+	p := &projectile{
+		owner:  up,
+		model:  def.Projectile,
+		pos:    from,
+		vel:    [3]float64{dx / dist * def.Speed, dy / dist * def.Speed, dz / dist * def.Speed},
+		left:   def.Range * CnfgProjectileRangeFactor,
+		dmg:    def.Modifier,
+		wepMul: up.rangedMultiplier(def),
+	}
+	projectiles.Lock()
+	p.id = projectiles.nextId
+	projectiles.nextId++
+	projectiles.list = append(projectiles.list, p)
+	projectiles.Unlock()
+	p.report(up)
+	up.Wear_WLu(EquipSlotRanged)
+	return true
+}
+
+// Tell near players about a new projectile. 'self' is the current client process, or nil.
+func (p *projectile) report(self *user) {
+	for _, o := range playerQuadtree.FindNearObjects_RLq(&TwoF{p.pos.X, p.pos.Y}, client_prot.NEAR_OBJECTS) {
+		other, ok := o.(*user)
+		if !ok {
+			continue
+		}
+		var b [22]byte
+		b[0] = byte(len(b))
+		b[1] = 0
+		b[2] = client_prot.CMD_PROJECTILE
+		EncodeUint32(p.id, b[3:7])
+		b[7] = p.model
+		EncodeUint16(uint16(int16((p.pos.X-other.Coord.X)*client_prot.BLOCK_COORD_RES)), b[8:10])
+		EncodeUint16(uint16(int16((p.pos.Y-other.Coord.Y)*client_prot.BLOCK_COORD_RES)), b[10:12])
+		EncodeUint16(uint16(int16((p.pos.Z-other.Coord.Z)*client_prot.BLOCK_COORD_RES)), b[12:14])
+		for i, v := range p.vel {
+			EncodeUint16(uint16(int16(v*client_prot.BLOCK_COORD_RES)), b[14+2*i:16+2*i])
+		}
+		speed := math.Sqrt(p.vel[0]*p.vel[0] + p.vel[1]*p.vel[1] + p.vel[2]*p.vel[2])
+		EncodeUint16(uint16(p.left/speed*1000), b[20:22]) // Max flight time in ms
+		if other == self {
+			other.writeBlocking_Bl(b[:])
+		} else {
+			other.writeNonBlocking(b[:])
+		}
+	}
+}
+
+// Tell near players that a projectile is gone
+func (p *projectile) reportEnd(reason uint8) {
+	for _, o := range playerQuadtree.FindNearObjects_RLq(&TwoF{p.pos.X, p.pos.Y}, client_prot.NEAR_OBJECTS) {
+		other, ok := o.(*user)
+		if !ok {
+			continue
+		}
+		var b [14]byte
+		b[0] = byte(len(b))
+		b[1] = 0
+		b[2] = client_prot.CMD_PROJECTILE_END
+		EncodeUint32(p.id, b[3:7])
+		b[7] = reason
+		EncodeUint16(uint16(int16((p.pos.X-other.Coord.X)*client_prot.BLOCK_COORD_RES)), b[8:10])
+		EncodeUint16(uint16(int16((p.pos.Y-other.Coord.Y)*client_prot.BLOCK_COORD_RES)), b[10:12])
+		EncodeUint16(uint16(int16((p.pos.Z-other.Coord.Z)*client_prot.BLOCK_COORD_RES)), b[12:14])
+		other.writeNonBlocking(b[:])
+	}
+}
+
+// Move the projectile. Return true, and the reason, if the projectile is gone. If a monster was hit,
+// it is also returned.
+func (p *projectile) move_WLwWLc(seconds float64) (gone bool, reason uint8, target *monster) {
+	dist := seconds * math.Sqrt(p.vel[0]*p.vel[0]+p.vel[1]*p.vel[1]+p.vel[2]*p.vel[2])
+	if dist > p.left {
+		dist = p.left
+	}
+	steps := int(dist/CnfgProjectileStep) + 1
+	f := dist / float64(steps) / math.Sqrt(p.vel[0]*p.vel[0]+p.vel[1]*p.vel[1]+p.vel[2]*p.vel[2])
+	for i := 0; i < steps; i++ {
+		p.pos.X += p.vel[0] * f
+		p.pos.Y += p.vel[1] * f
+		p.pos.Z += p.vel[2] * f
+		p.left -= dist / float64(steps)
+		if !blockIsPermeable[DBGetBlockCached_WLwWLc(p.pos)] {
+			return true, ProjectileEndBlock, nil
+		}
+		for _, o := range monsterQuadtree.FindNearObjects_RLq(&TwoF{p.pos.X, p.pos.Y}, CnfgProjectileSearchRadius) {
+			if mp, ok := o.(*monster); ok && !mp.dead && mp.hitBy(&p.pos) {
+				return true, ProjectileEndMonster, mp
+			}
+		}
+	}
+	if p.left <= 0 {
+		return true, ProjectileEndRange, nil
+	}
+	return false, 0, nil
+}
+
+// Move all projectiles, and manage hits.
+func UpdateAllProjectiles_WLwWLcRLq(seconds float64) {
+	projectiles.Lock()
+	list := projectiles.list
+	projectiles.Unlock()
+	var done map[*projectile]bool
+	for _, p := range list {
+		gone, reason, mp := p.move_WLwWLc(seconds)
+		if !gone {
+			continue
+		}
+		if done == nil {
+			done = make(map[*projectile]bool)
+		}
+		done[p] = true
+		p.reportEnd(reason)
+		if mp != nil {
+			owner, dmg, wepMul := p.owner, p.dmg, p.wepMul
+			// The damage must be managed by the client process of the owner
+			owner.SendCommand(func(up *user) {
+				if up.Dead || mp.dead {
+					return
+				}
+				if mp.aggro == nil {
+					mp.aggro = up
+					mp.speed = ASSAULT_FACTOR * mp.maxSpeed
+					mp.state = MD_DEFENDING
+					mp.callPack_RLq(up)
+				}
+				mp.HitWith_WLuBl(up, dmg, wepMul)
+			})
+		}
+	}
+	if done == nil {
+		return
+	}
+	projectiles.Lock()
+	remain := projectiles.list[:0]
+	for _, p := range projectiles.list {
+		if !done[p] {
+			remain = append(remain, p)
+		}
+	}
+	projectiles.list = remain
+	projectiles.Unlock()
+}
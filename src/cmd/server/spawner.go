@@ -0,0 +1,346 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Monster spawners. A spawner is a BT_Spawn block that has been configured with the "/spawner" command.
+// The configuration is saved with the chunk in the PART_SPAWNERS partition. When a player is near enough,
+// the spawner creates a wave of monsters every interval, until the cap is reached.
+//
+// Owners can also stop the random monster spawns in their territory, using "/territory nospawn on".
+//
+// The state of the spawners, that is the monsters that are alive and the time of the next wave, is only
+// used from the monster spawn process. It is not saved, and it is kept until the monsters are gone.
+//
+
+import (
+	"chunkdb"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// There is one instance of this struct for each configured BT_Spawn block. This information is saved with the chunk.
+type monsterSpawner struct {
+	X, Y, Z     uint8  // Position of the BT_Spawn inside the chunk
+	Species     string // The species of the monsters. Empty means the default species.
+	LevelOffset int32  // The level is the monster difficulty at the spawner plus this offset
+	Cap         uint8  // Max number of monsters alive at the same time
+	Wave        uint8  // Number of monsters spawned every interval
+	Interval    uint16 // Seconds between waves
+	Radius      uint8  // The spawner is only active when a player is within this distance
+}
+
+type spawnerKey struct {
+	cc      chunkdb.CC
+	x, y, z uint8
+}
+
+type spawnerRuntime struct {
+	next     time.Time  // The time when the next wave may be spawned
+	monsters []*monster // The monsters alive from this spawner
+}
+
+var spawnerRuntimes = make(map[spawnerKey]*spawnerRuntime)
+
+// Find the spawner at the specified position. Return nil if there is none. The chunk must be locked.
+func (cp *chunk) findSpawner(x, y, z uint8) *monsterSpawner {
+	for i := range cp.spawners {
+		if sp := &cp.spawners[i]; sp.X == x && sp.Y == y && sp.Z == z {
+			return sp
+		}
+	}
+	return nil
+}
+
+// Remove the spawner at the specified position, if there is one. The chunk must be locked.
+func (cp *chunk) removeSpawner(x, y, z uint8) {
+	for i := range cp.spawners {
+		if sp := &cp.spawners[i]; sp.X == x && sp.Y == y && sp.Z == z {
+			cp.spawners = append(cp.spawners[:i], cp.spawners[i+1:]...)
+			break
+		}
+	}
+	if len(cp.spawners) == 0 {
+		cp.spawners = nil
+	}
+}
+
+// Remove spawners where the block is no longer a BT_Spawn. The chunk must be locked.
+func (cp *chunk) pruneSpawners() {
+	remain := cp.spawners[:0]
+	for _, sp := range cp.spawners {
+		if cp.rc[sp.X][sp.Y][sp.Z] == BT_Spawn {
+			remain = append(remain, sp)
+		}
+	}
+	if len(remain) == 0 {
+		remain = nil
+	}
+	cp.spawners = remain
+}
+
+// Return true if random monsters may be spawned in the chunk. It is not allowed in chunks where the
+// owner has stopped it, or next to such chunks.
+func ambientSpawnAllowed_WLwWLc(cc chunkdb.CC) bool {
+	for dx := int32(-1); dx <= 1; dx++ {
+		for dy := int32(-1); dy <= 1; dy++ {
+			cp := ChunkFind_WLwWLc(chunkdb.CC{X: cc.X + dx, Y: cc.Y + dy, Z: cc.Z})
+			if cp.flag&CHF_NO_AMBIENT != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Forget monsters that are no longer alive
+func (rt *spawnerRuntime) prune() {
+	remain := rt.monsters[:0]
+	for _, mp := range rt.monsters {
+		if !mp.dead && !mp.purge && !mp.invalid {
+			remain = append(remain, mp)
+		}
+	}
+	rt.monsters = remain
+}
+
+// Return true if the spawner has no monsters alive, and the next wave is due. The state can then be
+// forgotten, as a new state would give the same result.
+func (rt *spawnerRuntime) idle(now time.Time) bool {
+	return len(rt.monsters) == 0 && !now.Before(rt.next)
+}
+
+// Return the number of monsters that shall be spawned now, and prepare for the next wave.
+func (rt *spawnerRuntime) due(now time.Time, sp *monsterSpawner) int {
+	if now.Before(rt.next) {
+		return 0
+	}
+	n := int(sp.Cap) - len(rt.monsters)
+	if n > int(sp.Wave) {
+		n = int(sp.Wave)
+	}
+	if n <= 0 {
+		return 0
+	}
+	rt.next = now.Add(time.Duration(sp.Interval) * time.Second)
+	return n
+}
+
+// The position of a spawner, where the monsters are created
+func spawnerCoord(cc chunkdb.CC, sp *monsterSpawner) user_coord {
+	return user_coord{
+		float64(cc.X)*CHUNK_SIZE + float64(sp.X) + 0.5,
+		float64(cc.Y)*CHUNK_SIZE + float64(sp.Y) + 0.5,
+		float64(cc.Z)*CHUNK_SIZE + float64(sp.Z)}
+}
+
+// Walk through all players, and spawn monsters from the spawners near them. Only spawners within one
+// chunk from a player are tested, which limits the activation radius.
+func CmdSpawnerMonsters_WLwWLuWLqWLmWLc() {
+	var players []user_coord
+	chunks := make(map[chunkdb.CC]bool)
+	for i := 0; i < MAX_PLAYERS; i++ {
+		up := allPlayers[i]
+		if up == nil || up.connState != PlayerConnStateIn || up.Dead {
+			continue
+		}
+		coord := up.Coord
+		players = append(players, coord)
+		cc := coord.GetChunkCoord()
+		for dx := int32(-1); dx <= 1; dx++ {
+			for dy := int32(-1); dy <= 1; dy++ {
+				for dz := int32(-1); dz <= 1; dz++ {
+					chunks[chunkdb.CC{X: cc.X + dx, Y: cc.Y + dy, Z: cc.Z + dz}] = true
+				}
+			}
+		}
+	}
+	now := time.Now()
+	active := make(map[spawnerKey]bool)
+	for cc := range chunks {
+		cp := ChunkFind_WLwWLc(cc)
+		cp.RLock()
+		list := append([]monsterSpawner(nil), cp.spawners...) // Make a copy, to be used without lock
+		cp.RUnlock()
+		for i := range list {
+			sp := &list[i]
+			coord := spawnerCoord(cc, sp)
+			near := false
+			for _, pl := range players {
+				dx, dy, dz := pl.X-coord.X, pl.Y-coord.Y, pl.Z-coord.Z
+				if dx*dx+dy*dy+dz*dz <= float64(sp.Radius)*float64(sp.Radius) {
+					near = true
+					break
+				}
+			}
+			if !near {
+				continue
+			}
+			key := spawnerKey{cc, sp.X, sp.Y, sp.Z}
+			active[key] = true
+			rt := spawnerRuntimes[key]
+			if rt == nil {
+				rt = &spawnerRuntime{}
+				spawnerRuntimes[key] = rt
+			}
+			rt.prune()
+			n := rt.due(now, sp)
+			if n == 0 {
+				continue
+			}
+			species := FindMonsterSpecies(sp.Species)
+			if species == nil {
+				log.Println("Spawner at", coord, "unknown species", sp.Species)
+				continue
+			}
+			lvl := int32(MonsterDifficulty(&coord)) + sp.LevelOffset
+			if lvl < 0 {
+				lvl = 0
+			}
+			for j := 0; j < n; j++ {
+				rt.monsters = append(rt.monsters, addMonsterOfSpecies_WLuWLqWLm(&coord, uint32(lvl), species))
+			}
+		}
+	}
+	// Spawners without near players keep the state until their monsters are gone and the interval has
+	// passed, or leaving and coming back would give a new wave at once.
+	for key, rt := range spawnerRuntimes {
+		if active[key] {
+			continue
+		}
+		rt.prune()
+		if rt.idle(now) {
+			delete(spawnerRuntimes, key)
+		}
+	}
+}
+
+// Find the nearest block within 'dist' blocks from the player, of a type accepted by 'match'.
+func (up *user) findNearBlock_WLwWLc(dist int, match func(block) bool) (cc chunkdb.CC, x, y, z uint8, ok bool) {
+	best := math.MaxFloat64
+	for dx := -dist; dx <= dist; dx++ {
+		for dy := -dist; dy <= dist; dy++ {
+			for dz := -dist; dz <= dist; dz++ {
+				coord := user_coord{up.Coord.X + float64(dx), up.Coord.Y + float64(dy), up.Coord.Z + float64(dz)}
+				if !match(DBGetBlockCached_WLwWLc(coord)) {
+					continue
+				}
+				if d := float64(dx*dx + dy*dy + dz*dz); d < best {
+					best = d
+					cc = coord.GetChunkCoord()
+					x = uint8(int32(math.Floor(coord.X)) - cc.X*CHUNK_SIZE)
+					y = uint8(int32(math.Floor(coord.Y)) - cc.Y*CHUNK_SIZE)
+					z = uint8(int32(math.Floor(coord.Z)) - cc.Z*CHUNK_SIZE)
+					ok = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// Parse the arguments for "/spawner set", which are cap, wave, interval, radius, level offset and an optional species.
+func parseSpawnerArgs(args []string) (sp monsterSpawner, msg string) {
+	if len(args) < 5 {
+		return sp, "Usage: /spawner set [cap] [wave] [interval] [radius] [level offset] [species]"
+	}
+	var v [4]uint64
+	for i, lim := range []uint64{CnfgSpawnerMaxCap, CnfgSpawnerMaxCap, math.MaxUint16, CnfgSpawnerMaxRadius} {
+		var err error
+		v[i], err = strconv.ParseUint(args[i], 10, 16)
+		if err != nil || v[i] == 0 || v[i] > lim {
+			return sp, "Cap, wave, interval and radius must be positive numbers, where the cap and wave are at most " +
+				strconv.Itoa(CnfgSpawnerMaxCap) + " and the radius at most " + strconv.Itoa(CnfgSpawnerMaxRadius)
+		}
+	}
+	offset, err := strconv.ParseInt(args[4], 10, 32)
+	if err != nil || offset < -CnfgSpawnerMaxLevelOffset || offset > CnfgSpawnerMaxLevelOffset {
+		return sp, "The level offset must be between -" + strconv.Itoa(CnfgSpawnerMaxLevelOffset) + " and " + strconv.Itoa(CnfgSpawnerMaxLevelOffset)
+	}
+	if v[2] < CnfgSpawnerMinInterval {
+		return sp, "The interval must be at least " + strconv.Itoa(CnfgSpawnerMinInterval) + " seconds"
+	}
+	sp = monsterSpawner{Cap: uint8(v[0]), Wave: uint8(v[1]), Interval: uint16(v[2]), Radius: uint8(v[3]), LevelOffset: int32(offset)}
+	sp.Species = strings.Join(args[5:], " ")
+	if FindMonsterSpecies(sp.Species) == nil {
+		return sp, "Unknown species '" + sp.Species + "'"
+	}
+	return sp, ""
+}
+
+// Manage the spawner at the nearest BT_Spawn block.
+func (up *user) SpawnerCommand_WLwWLcBl(args []string) {
+	cc, x, y, z, ok := up.findNearBlock_WLwWLc(CnfgSpawnerEditDistance, func(bl block) bool { return bl == BT_Spawn })
+	if !ok {
+		up.Printf_Bl("#FAIL !There is no spawn block near")
+		return
+	}
+	cp := ChunkFind_WLwWLc(cc)
+	switch args[0] {
+	case "show":
+		cp.RLock()
+		sp := cp.findSpawner(x, y, z)
+		var info monsterSpawner
+		if sp != nil {
+			info = *sp
+		}
+		cp.RUnlock()
+		if sp == nil {
+			up.Printf_Bl("!The spawn block is not a spawner")
+			return
+		}
+		up.Printf_Bl("!Spawner: cap %d, wave %d, interval %ds, radius %d, level offset %d, species '%s'",
+			info.Cap, info.Wave, info.Interval, info.Radius, info.LevelOffset, info.Species)
+	case "set", "remove":
+		var sp monsterSpawner
+		if args[0] == "set" {
+			var msg string
+			sp, msg = parseSpawnerArgs(args[1:])
+			if msg != "" {
+				up.Printf_Bl("#FAIL !%s", msg)
+				return
+			}
+			sp.X, sp.Y, sp.Z = x, y, z
+		}
+		cp.Lock()
+		allowed := up.MayModifyChunk_RLg(cp)
+		if allowed {
+			cp.removeSpawner(x, y, z)
+			if args[0] == "set" {
+				cp.spawners = append(cp.spawners, sp)
+			}
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
+		cp.Unlock()
+		if !allowed {
+			up.Printf_Bl("#FAIL !Only the owner can change spawners")
+			return
+		}
+		if args[0] == "set" {
+			up.Printf_Bl("!Spawner updated")
+		} else {
+			up.Printf_Bl("!Spawner removed")
+		}
+	default:
+		up.Printf_Bl("#FAIL !Usage: /spawner show|set|remove")
+	}
+}
@@ -63,7 +63,7 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 	case "/sethome":
 		cc := up.Coord.GetChunkCoord()
 		cp := ChunkFind_WLwWLc(cc)
-		if cp.owner != up.Id {
+		if !up.MayModifyChunk_RLg(cp) {
 			up.Printf_Bl("#FAIL Not your territory")
 			break
 		}
@@ -131,7 +131,7 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 	case "/inventory":
 		if len(message) == 2 && up.AdminLevel > 8 {
 			code := ObjectCode(message[1])
-			_, ok := objectUseTable[code]
+			ok := ItemLookup(code) != nil
 			if message[1] == "clear" {
 				up.Inventory.Clear() // There is no update message generated, so client won't know.
 				up.WeaponGrade = 0
@@ -140,9 +140,12 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 				up.WeaponLvl = 0
 				up.ArmorLvl = 0
 				up.HelmetLvl = 0
+				up.Ranged = ""
+				up.RangedLvl = 0
+				up.WeaponInst, up.ArmorInst, up.HelmetInst, up.RangedInst = nil, nil, nil, nil
 			} else if !ok {
 				up.Printf_Bl("!Available objects:")
-				for key, _ := range objectUseTable {
+				for _, key := range ItemCodes() {
 					up.Printf_Bl("!%v ", key)
 				}
 			} else {
@@ -151,10 +154,57 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 		} else {
 			up.Inventory.Report(up)
 			up.Printf_Bl("!Equip modifiers: armor %.0f%%, helmet %.0f%%, weapon %.0f%%",
-				(ArmorLevelDiffMultiplier(up.Level, up.ArmorLvl, up.ArmorGrade)-1)*100,
-				(ArmorLevelDiffMultiplier(up.Level, up.HelmetLvl, up.HelmetGrade)-1)*100,
-				(WeaponLevelDiffMultiplier(up.Level, up.WeaponLvl, up.WeaponGrade)-1)*100)
+				(ArmorLevelDiffMultiplier(ItemCategoryArmor, up.Level, up.ArmorLvl, effectiveGrade(up.ArmorGrade, up.ArmorInst))-1)*100,
+				(ArmorLevelDiffMultiplier(ItemCategoryHelmet, up.Level, up.HelmetLvl, effectiveGrade(up.HelmetGrade, up.HelmetInst))-1)*100,
+				(up.weaponMultiplier()-1)*100)
 		}
+	case "/reload":
+		if up.AdminLevel < 8 || len(message) != 2 {
+			up.Printf_Bl("#FAIL !Usage: /reload items|loot|monsters|bosses|abilities|dialogs|crafting|achievements")
+			break
+		}
+		var err error
+		switch message[1] {
+		case "items":
+			err = ReloadItemCatalog_RLaRLu(*itemFileName)
+		case "loot":
+			err = LoadLootTables(*lootFileName)
+		case "monsters":
+			err = LoadMonsterSpecies(*monsterFileName)
+		case "bosses":
+			err = LoadBosses(*bossFileName)
+		case "abilities":
+			err = LoadAbilities(*abilityFileName)
+		case "dialogs":
+			err = LoadDialogs(*dialogFileName)
+		case "crafting":
+			err = LoadCrafting(*craftingFileName)
+		case "achievements":
+			err = LoadAchievements(*achievementFileName)
+		default:
+			err = fmt.Errorf("Unknown data '%s'", message[1])
+		}
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			break
+		}
+		up.Printf_Bl("!Reloaded %s", message[1])
+	case "/loot":
+		// Simulate expected drop rates: /loot [player level] [monster level] [monster kind]
+		if up.AdminLevel < 2 && !*allowTestUser {
+			break
+		}
+		var pLevel, mLevel uint32
+		var kind string
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /loot [player level] [monster level] [monster kind]")
+			break
+		}
+		if n, _ := fmt.Sscan(message[1], &pLevel, &mLevel, &kind); n < 2 {
+			up.Printf_Bl("#FAIL !Usage: /loot [player level] [monster level] [monster kind]")
+			break
+		}
+		up.LootSimulate_Bl(pLevel, mLevel, kind)
 	case "/GC":
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
@@ -214,6 +264,126 @@ func (up *user) playerStringMessage_RLuWLwRLqBlWLaWLc(buff []byte) {
 			break
 		}
 		up.TellOthers_RLaBl(message[1])
+	case "/party":
+		if len(message) < 2 {
+			up.PartyCommand_RLaWLuBl("show")
+			break
+		}
+		up.PartyCommand_RLaWLuBl(message[1])
+	case "/p":
+		if len(message) < 2 {
+			break
+		}
+		up.PartySay_RLu(message[1])
+	case "/guild":
+		if len(message) < 2 {
+			up.GuildCommand_WLgBlWLwWLcWLu("show")
+			break
+		}
+		up.GuildCommand_WLgBlWLwWLcWLu(message[1])
+	case "/g":
+		if len(message) < 2 || up.Guild == 0 {
+			break
+		}
+		up.GuildSay_RLgRLa(message[1])
+	case "/channel":
+		if len(message) < 2 {
+			up.ChannelCommand_WLhRLaBl("list")
+			break
+		}
+		up.ChannelCommand_WLhRLaBl(message[1])
+	case "/c":
+		if len(message) < 2 {
+			break
+		}
+		up.ChannelSay_WLhRLaBl(message[1])
+	case "/mail":
+		if len(message) < 2 {
+			break
+		}
+		up.SendMail_RLaBl(message[1])
+	case "/craft":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /craft list|[recipe] [count]")
+			break
+		}
+		up.CraftCommand_WLuBl(strings.Split(message[1], " "))
+	case "/achievements":
+		up.AchievementsCommand_RLuBl()
+	case "/repair":
+		var args []string
+		if len(message) == 2 {
+			args = strings.Split(message[1], " ")
+		}
+		up.RepairCommand_WLuBl(args)
+	case "/auction":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /auction search|sell|buy|cancel")
+			break
+		}
+		up.AuctionCommand_WLuBl(strings.Split(message[1], " "))
+	case "/trade":
+		if len(message) < 2 {
+			up.TradeCommand_WLuRLaBl("show")
+			break
+		}
+		up.TradeCommand_WLuRLaBl(message[1])
+	case "/chest":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /chest key|get|put")
+			break
+		}
+		up.ChestCommand_WLwWLcBl(message[1])
+	case "/ability":
+		var args []string
+		if len(message) > 1 {
+			args = strings.Split(message[1], " ")
+		}
+		up.AbilityCommand_WLuBl(args)
+	case "/quest":
+		var args []string
+		if len(message) > 1 {
+			args = strings.Split(message[1], " ")
+		}
+		up.QuestCommand_WLuBl(args)
+	case "/duel":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /duel name|accept|yield|stats")
+			break
+		}
+		up.DuelCommand_RLaWLuBl(message[1])
+	case "/door":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /door key [key id], where 0 means no key")
+			break
+		}
+		up.DoorCommand_WLwWLcBl(strings.Split(message[1], " "))
+	case "/npc":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /npc add [dialog]|remove|list")
+			break
+		}
+		up.NPCCommand_WLwWLcWLqBl(strings.Split(message[1], " "))
+	case "/vendor":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /vendor list|buy [code] [count]|sell [code] [level] [count]")
+			break
+		}
+		up.VendorCommand_WLuBl(strings.Split(message[1], " "))
+	case "/gold":
+		up.Printf_Bl("!You have %d gold", up.Gold)
+	case "/logic":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /logic show|set [param]")
+			break
+		}
+		up.LogicCommand_WLwWLcBl(strings.Split(message[1], " "))
+	case "/spawner":
+		if len(message) < 2 {
+			up.Printf_Bl("#FAIL !Usage: /spawner show|set|remove")
+			break
+		}
+		up.SpawnerCommand_WLwWLcBl(strings.Split(message[1], " "))
 	case "/friend":
 		if len(message) < 2 {
 			break
@@ -259,6 +429,33 @@ func (up *user) TerritoryCommand_WLwWLcBl(msg []string) {
 		}
 	case "claim":
 		up.TerritoryClaim_WLwWLc(msg[1:])
+	case "nospawn", "arena":
+		if len(msg) != 2 || (msg[1] != "on" && msg[1] != "off") {
+			up.Printf_Bl("#FAIL !Usage: /territory %s on|off", msg[0])
+			return
+		}
+		flag, descr := uint32(CHF_NO_AMBIENT), "Random monster spawns"
+		if msg[0] == "arena" {
+			flag, descr = CHF_ARENA, "PvP arena"
+		}
+		cp := ChunkFind_WLwWLc(up.Coord.GetChunkCoord())
+		cp.Lock()
+		allowed := up.MayModifyChunk_RLg(cp)
+		if allowed {
+			if msg[1] == "on" {
+				cp.flag |= flag
+			} else {
+				cp.flag &^= flag
+			}
+			cp.flag |= CHF_MODIFIED
+			cp.Write()
+		}
+		cp.Unlock()
+		if !allowed {
+			up.Printf_Bl("#FAIL !Not your territory")
+			return
+		}
+		up.Printf_Bl("!%s turned %s for this chunk", descr, msg[1])
 	case "grant":
 		if up.AdminLevel < 5 || len(msg) != 2 {
 			up.Printf_Bl("#FAIL")
@@ -302,7 +499,6 @@ func (up *user) TerritoryGrant(arg string) {
 }
 
 func (up *user) TerritoryClaim_WLwWLc(arg []string) {
-	const usage = "Usage: /territory claim [up/down]"
 	if up.AdminLevel < 1 && len(up.Territory) >= up.Maxchunks {
 		up.Printf_Bl("#FAIL !You are not allowed more chunks than %d", up.Maxchunks)
 		return
@@ -315,30 +511,10 @@ func (up *user) TerritoryClaim_WLwWLc(arg []string) {
 		up.Printf_Bl("#FAIL !You are too low level for this area")
 		return
 	}
-	if len(arg) > 1 {
-		up.Printf_Bl(usage)
+	cc, ok := up.territoryClaimCoord(arg)
+	if !ok {
 		return
 	}
-	cc := up.Coord.GetChunkCoord()
-	if len(arg) > 0 {
-		switch arg[0] {
-		case "up":
-			cc.Z++
-		case "down":
-			cc.Z--
-		case "west":
-			cc.X--
-		case "east":
-			cc.X++
-		case "south":
-			cc.Y--
-		case "north":
-			cc.Y++
-		default:
-			up.Printf_Bl(usage)
-			return
-		}
-	}
 	cp := ChunkFind_WLwWLc(cc)
 	cp.Lock()
 	if cp.owner != OWNER_NONE {
@@ -379,9 +555,40 @@ func (up *user) TerritoryClaim_WLwWLc(arg []string) {
 		}
 		up.Territory = append(up.Territory, cc)
 	}
+	up.Emit_WLu(EventTerritory, uint32(len(up.Territory)), 0)
 	up.Save_Bl()
 }
 
+// Get the chunk coordinate to claim, which is the current chunk or a chunk adjacent to it.
+func (up *user) territoryClaimCoord(arg []string) (cc chunkdb.CC, ok bool) {
+	const usage = "Usage: /territory claim [up/down]"
+	if len(arg) > 1 {
+		up.Printf_Bl(usage)
+		return
+	}
+	cc = up.Coord.GetChunkCoord()
+	if len(arg) > 0 {
+		switch arg[0] {
+		case "up":
+			cc.Z++
+		case "down":
+			cc.Z--
+		case "west":
+			cc.X--
+		case "east":
+			cc.X++
+		case "south":
+			cc.Y--
+		case "north":
+			cc.Y++
+		default:
+			up.Printf_Bl(usage)
+			return
+		}
+	}
+	return cc, true
+}
+
 func (up *user) TellOthers_RLaBl(arg string) {
 	message := strings.SplitN(arg, " ", 2)
 	if len(message) != 2 {
@@ -0,0 +1,287 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Monster species. The species are defined in a JSON file, loaded at startup and reloaded with
+// the admin command "/reload monsters". If there is no file, a built-in species is used, that behaves
+// the way all monsters did originally.
+//
+// A species is never changed once loaded, which means a monster can keep a pointer to it without locking.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"io/ioutil"
+	"log"
+	"math/rand"
+)
+
+// Behavior profiles
+const (
+	BehaviorAggressive  = "aggressive"  // Attack players that come near
+	BehaviorPassive     = "passive"     // Never attack, only defend
+	BehaviorTerritorial = "territorial" // Attack players that come near the spawn point, and return home when they leave
+	BehaviorPack        = "pack"        // Spawn in groups, and near members of the same species join an attack
+	BehaviorRanged      = "ranged"      // Keep a distance to the target, and attack from range
+)
+
+type monsterSpecies struct {
+	Name        string   // Also the name of the loot table
+	Model       uint8    // Sent to the client in CMD_OBJECT_LIST, to decide what to draw
+	Behavior    string   // One of Behavior*
+	Size        float32  // Height in blocks. 0 means the size depends on the level, using an algorithm known by the client.
+	Speed       float32  // Max speed, relative to a running player. 0 means it depends on the size.
+	Aggression  float32  // Percent chance to attack a player seen. 0 means it depends on the level.
+	Persistence float32  // How long the monster will chase a target, where 100 is 15s. Default 100.
+	Wander      float32  // The probability to stay still when not in a fight. Default MonsterMovingProb.
+	Damage      float32  // Damage multiplier. Default 1.
+	Toughness   float32  // Damage received is divided by this. Default 1.
+	MinLevel    uint32   // The level band where the species is found
+	MaxLevel    uint32   // 0 means no upper limit
+	MinHeight   float64  // The height band where the species is found. Both 0 means any height.
+	MaxHeight   float64  //
+	Biomes      []string // Preferred biomes, see biomeBlocks. Empty means any.
+	Weight      float32  // Relative spawn frequency. Default 1.
+	PackSize    int      // Number of monsters spawned together, for the pack behavior
+	Range       float64  // Attack distance, for the ranged behavior. Other species use melee distance.
+	Territory   float64  // Radius around the spawn point, for the territorial behavior
+}
+
+// The ground blocks that define every biome
+var biomeBlocks = map[string][]block{
+	"grassland": {BT_Soil, BT_Tuft, BT_Flowers},
+	"desert":    {BT_Sand},
+	"snow":      {BT_Snow},
+	"rock":      {BT_Stone, BT_Gravel, BT_Cobblestone},
+	"forest":    {BT_Tree1, BT_Tree2, BT_Tree3, BT_Logs, BT_Bark},
+	"water":     {BT_Water, BT_BrownWater},
+}
+
+var (
+	speciesSem sync.RWMutex
+	allSpecies = defaultMonsterSpecies
+)
+
+// The species used when there is no species file. It is also used when no other species matches.
+var defaultMonsterSpecies = []*monsterSpecies{
+	{Name: "", Behavior: BehaviorAggressive, Persistence: 100, Wander: MonsterMovingProb, Damage: 1, Toughness: 1, Weight: 1},
+}
+
+// Verify the species, and give default values to undefined attributes.
+func verifyMonsterSpecies(list []*monsterSpecies) error {
+	if len(list) == 0 {
+		return errors.New("no species defined")
+	}
+	for _, sp := range list {
+		switch sp.Behavior {
+		case BehaviorAggressive, BehaviorPassive, BehaviorTerritorial, BehaviorPack, BehaviorRanged:
+		default:
+			return fmt.Errorf("species '%s': unknown behavior '%s'", sp.Name, sp.Behavior)
+		}
+		for _, b := range sp.Biomes {
+			if _, ok := biomeBlocks[b]; !ok {
+				return fmt.Errorf("species '%s': unknown biome '%s'", sp.Name, b)
+			}
+		}
+		if sp.Weight < 0 || sp.Damage < 0 || sp.Toughness < 0 || sp.Persistence < 0 || sp.Wander < 0 {
+			return fmt.Errorf("species '%s': negative attributes not allowed", sp.Name)
+		}
+		// Attributes that are not defined get default values
+		if sp.Weight == 0 {
+			sp.Weight = 1
+		}
+		if sp.Damage == 0 {
+			sp.Damage = 1
+		}
+		if sp.Toughness == 0 {
+			sp.Toughness = 1
+		}
+		if sp.Persistence == 0 {
+			sp.Persistence = 100
+		}
+		if sp.Wander == 0 {
+			sp.Wander = MonsterMovingProb
+		}
+		if sp.Behavior == BehaviorRanged && sp.Range <= CnfgMeleeDistLimit {
+			return fmt.Errorf("species '%s': ranged attack must have a longer range than melee", sp.Name)
+		}
+		if sp.Behavior == BehaviorTerritorial && sp.Territory <= 0 {
+			return fmt.Errorf("species '%s': territory radius missing", sp.Name)
+		}
+	}
+	return nil
+}
+
+// Load the monster species from file. The current species are kept if there is an error.
+func LoadMonsterSpecies(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var list []*monsterSpecies
+	if err = json.Unmarshal(data, &list); err == nil {
+		err = verifyMonsterSpecies(list)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	speciesSem.Lock()
+	allSpecies = list
+	speciesSem.Unlock()
+	log.Println("Loaded", len(list), "monster species from", fileName)
+	return nil
+}
+
+// Find a species by name. Return nil if there is no such species.
+func FindMonsterSpecies(name string) *monsterSpecies {
+	speciesSem.RLock()
+	defer speciesSem.RUnlock()
+	for _, sp := range allSpecies {
+		if sp.Name == name {
+			return sp
+		}
+	}
+	if name == "" {
+		return defaultMonsterSpecies[0]
+	}
+	return nil
+}
+
+// Return true if the species may spawn at the specified level, height and ground. The ground BT_Unused
+// is used when any biome is acceptable.
+func (sp *monsterSpecies) fits(level uint32, z float64, ground block) bool {
+	if level < sp.MinLevel || (sp.MaxLevel != 0 && level > sp.MaxLevel) {
+		return false
+	}
+	if (sp.MinHeight != 0 || sp.MaxHeight != 0) && (z < sp.MinHeight || z > sp.MaxHeight) {
+		return false
+	}
+	if len(sp.Biomes) == 0 || ground == BT_Unused {
+		return true
+	}
+	for _, b := range sp.Biomes {
+		for _, bl := range biomeBlocks[b] {
+			if bl == ground {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Select a species for a new monster, using the spawn weights of all species that fits.
+func SelectMonsterSpecies(level uint32, z float64, ground block) *monsterSpecies {
+	speciesSem.RLock()
+	list := allSpecies
+	speciesSem.RUnlock()
+	var total float32
+	candidates := make([]*monsterSpecies, 0, len(list))
+	for _, sp := range list {
+		if sp.fits(level, z, ground) {
+			candidates = append(candidates, sp)
+			total += sp.Weight
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultMonsterSpecies[0]
+	}
+	r := rand.Float32() * total
+	for _, sp := range candidates {
+		r -= sp.Weight
+		if r < 0 {
+			return sp
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// The distance from where the monster attacks
+func (sp *monsterSpecies) attackDistance() float64 {
+	if sp.Behavior == BehaviorRanged {
+		return sp.Range
+	}
+	return CnfgMeleeDistLimit
+}
+
+// Return true if the monster can see the target, where 'dist2' is the square of the distance. It is always
+// true within melee distance. A ranged attack needs a line of sight, or the monster has to come closer.
+func (mp *monster) canSee_RLw(target *user_coord, dist2 float64) bool {
+	if dist2 <= CnfgMeleeDistLimit*CnfgMeleeDistLimit {
+		return true
+	}
+	to := *target
+	to.Z += CnfgProjectileLaunchHeight
+	return lineOfSightLoaded_RLw(mp.aimPoint(), to)
+}
+
+// Return true if the monster shall take the initiative to attack a player at the specified position.
+func (mp *monster) wantsToAttack(pl *player) bool {
+	switch mp.species.Behavior {
+	case BehaviorPassive:
+		return false
+	case BehaviorTerritorial:
+		return mp.inTerritory(&pl.Coord)
+	}
+	return true
+}
+
+// Return true if the coordinate is inside the territory of a territorial monster
+func (mp *monster) inTerritory(coord *user_coord) bool {
+	dx := coord.X - mp.spawnCoord.X
+	dy := coord.Y - mp.spawnCoord.Y
+	r := mp.species.Territory
+	return dx*dx+dy*dy <= r*r
+}
+
+// Initialize the monster traits from the species
+func (mp *monster) setSpecies(sp *monsterSpecies) {
+	mp.species = sp
+	mp.kind = sp.Name
+	if sp.Size != 0 {
+		mp.size = sp.Size
+	}
+	mp.maxSpeed = RUNNING_SPEED // Running speed of player
+	if sp.Speed != 0 {
+		mp.maxSpeed *= sp.Speed
+	} else {
+		mp.maxSpeed *= -mp.size*0.1 + 1.35
+	}
+	mp.persistence = sp.Persistence
+	mp.aggression = sp.Aggression
+	if sp.Aggression == 0 {
+		mp.aggression = 50.0 + float32(mp.Level%5)*10.0
+	}
+}
+
+// Make near members of the same pack join an attack on 'up'.
+func (mp *monster) callPack_RLq(up *user) {
+	if mp.species.Behavior != BehaviorPack {
+		return
+	}
+	for _, o := range monsterQuadtree.FindNearObjects_RLq(mp.GetPreviousPos(), CnfgMonsterPackRadius) {
+		other, ok := o.(*monster)
+		if !ok || other == mp || other.dead || other.species != mp.species || other.aggro != nil {
+			continue
+		}
+		other.startAttack(up)
+	}
+}
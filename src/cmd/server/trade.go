@@ -0,0 +1,460 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Trading of items between two players.
+//
+// One player requests a trade, and the other accepts by requesting a trade back. Both players then
+// offer items from the inventory. Any change of an offer clears the confirmations. When both have
+// confirmed, the items are exchanged with both players locked. Both players are saved, and an audit
+// record is stored in the "tradelog" collection.
+//
+// The session has its own lock. A user may be locked before the session, but never the other way around.
+// The current session of a player, user.trade, is protected by the player lock.
+//
+
+import (
+	"client_prot"
+	"ephenationdb"
+	sync "github.com/larspensjo/Go-sync-evaluation/evalsync"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sub commands of CMD_TRADE
+const (
+	TradeRequest = 0 // Followed by the uid of the other player
+	TradeOffer   = 1 // Followed by item code (4 bytes), level (4 bytes) and count (4 bytes).
+	TradeConfirm = 2
+	TradeCancel  = 3
+)
+
+type tradeSession struct {
+	players   [2]*user     // The first player is the one that requested the trade
+	offers    [2]PlayerInv // What each player is offering
+	confirmed [2]bool
+	accepted  bool // True when the second player has accepted the request
+	closed    bool
+	sync.Mutex
+}
+
+// The audit record of a trade
+type tradeLog struct {
+	Time   time.Time
+	Ids    [2]uint32
+	Names  [2]string
+	Offers [2]PlayerInv
+}
+
+// Get the index of a player in the session
+func (ts *tradeSession) index(up *user) int {
+	if ts.players[0] == up {
+		return 0
+	}
+	return 1
+}
+
+// Build the CMD_TRADE_STATE message for one of the players. The session must be locked.
+// A message with an uid of 0 means that the session is closed.
+func (ts *tradeSession) stateMessage(i int) []byte {
+	const itemLen = 12
+	var own, other PlayerInv
+	var uid uint32
+	var flags byte
+	if ts != nil && !ts.closed {
+		own, other = ts.offers[i], ts.offers[1-i]
+		uid = ts.players[1-i].Id
+		if ts.confirmed[i] {
+			flags |= 1
+		}
+		if ts.confirmed[1-i] {
+			flags |= 2
+		}
+		if ts.accepted {
+			flags |= 4
+		}
+	}
+	msgLen := 10 + (len(own)+len(other))*itemLen
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_TRADE_STATE
+	EncodeUint32(uid, b[3:7])
+	b[7] = flags
+	b[8] = byte(len(own))
+	b[9] = byte(len(other))
+	p := b[10:]
+	for _, list := range []PlayerInv{own, other} {
+		for _, obj := range list {
+			copy(p[0:4], obj.Type)
+			EncodeUint32(obj.Level, p[4:8])
+			EncodeUint32(obj.Count, p[8:12])
+			p = p[itemLen:]
+		}
+	}
+	return b
+}
+
+// Tell both players about the current state. The session must not be locked.
+func (ts *tradeSession) report() {
+	ts.Lock()
+	msgs := [2][]byte{ts.stateMessage(0), ts.stateMessage(1)}
+	players := ts.players
+	ts.Unlock()
+	for i, up := range players {
+		if up != nil {
+			up.writeNonBlocking(msgs[i])
+		}
+	}
+}
+
+// Close the session, and tell both players.
+func (ts *tradeSession) close(reason string) {
+	ts.Lock()
+	if ts.closed {
+		ts.Unlock()
+		return
+	}
+	ts.closed = true
+	ts.Unlock()
+	ts.finish(reason)
+}
+
+// Tell both players that the session is closed. The session must already be marked as closed.
+func (ts *tradeSession) finish(reason string) {
+	ts.Lock()
+	players := ts.players
+	ts.Unlock()
+	for _, up := range players {
+		if up != nil {
+			up.Lock()
+			if up.trade == ts {
+				up.trade = nil
+			}
+			up.Unlock()
+		}
+	}
+	ts.report()
+	for _, up := range players {
+		if up != nil && reason != "" {
+			up.Printf("!%s", reason)
+		}
+	}
+}
+
+// Get the current trade session of the player, or nil.
+func (up *user) currentTrade_RLu() *tradeSession {
+	up.RLock()
+	defer up.RUnlock()
+	return up.trade
+}
+
+// Make 'ts' the current trade session of the player, and return the previous one. A session that has
+// already been closed is not used, as the closing may have cleared the player before this.
+func (up *user) setTrade_WLu(ts *tradeSession) *tradeSession {
+	up.Lock()
+	defer up.Unlock()
+	prev := up.trade
+	ts.Lock()
+	if ts.closed {
+		up.trade = nil
+	} else {
+		up.trade = ts
+	}
+	ts.Unlock()
+	return prev
+}
+
+// Return true if two players are near enough to trade
+func tradeDistanceOk(up, other *user) bool {
+	dx := up.Coord.X - other.Coord.X
+	dy := up.Coord.Y - other.Coord.Y
+	dz := up.Coord.Z - other.Coord.Z
+	return dx*dx+dy*dy+dz*dz <= CnfgTradeMaxDistance*CnfgTradeMaxDistance
+}
+
+// Request a trade with another player. If the other player has already requested a trade with
+// 'up', the request is accepted.
+func (up *user) TradeRequest_RLaBl(other *user) {
+	if other == nil || other == up || other.connState != PlayerConnStateIn {
+		up.Printf_Bl("#FAIL !No such player")
+		return
+	}
+	if !tradeDistanceOk(up, other) {
+		up.Printf_Bl("#FAIL !%s is too far away", other.Name)
+		return
+	}
+	if ts := other.currentTrade_RLu(); ts != nil {
+		ts.Lock()
+		accept := !ts.accepted && !ts.closed && ts.players[1] == up
+		if accept {
+			ts.accepted = true
+		}
+		ts.Unlock()
+		if !accept {
+			up.Printf_Bl("#FAIL !%s is busy", other.Name)
+			return
+		}
+		if prev := up.setTrade_WLu(ts); prev != nil && prev != ts {
+			prev.close("Trade cancelled")
+		}
+		ts.report()
+		return
+	}
+	ts := &tradeSession{players: [2]*user{up, other}}
+	if prev := up.setTrade_WLu(ts); prev != nil {
+		prev.close("Trade cancelled")
+	}
+	other.Printf("!%s wants to trade with you. Use '/trade %s' to accept.", up.Name, up.Name)
+	up.Printf_Bl("!Trade requested with %s", other.Name)
+}
+
+// Change the offered amount of an item. A count of 0 removes the item from the offer.
+func (up *user) TradeOffer_RLuBl(code ObjectCode, lvl uint32, count uint32) {
+	ts := up.currentTrade_RLu()
+	if ts == nil {
+		up.Printf_Bl("#FAIL !Not trading")
+		return
+	}
+	up.RLock()
+	available := up.Inventory.Count(code, lvl)
+	up.RUnlock()
+	if count > available {
+		up.Printf_Bl("#FAIL !You don't have %d of %s", count, code)
+		return
+	}
+	ts.Lock()
+	if !ts.accepted || ts.closed {
+		ts.Unlock()
+		up.Printf_Bl("#FAIL !The trade has not been accepted")
+		return
+	}
+	offer := &ts.offers[ts.index(up)]
+	i := -1
+	for j, obj := range *offer {
+		if obj.Type == code && obj.Level == lvl {
+			i = j
+		}
+	}
+	switch {
+	case i >= 0 && count == 0:
+		offer.RemoveIndex(i)
+	case i >= 0:
+		(*offer)[i].Count = count
+	case count > 0:
+		*offer = append(*offer, Object{Type: code, Level: lvl, Count: count})
+	}
+	ts.confirmed = [2]bool{false, false} // Any change has to be confirmed again
+	ts.Unlock()
+	ts.report()
+}
+
+// Confirm the trade. When both players have confirmed, the exchange is done.
+func (up *user) TradeConfirm_WLuBl() {
+	ts := up.currentTrade_RLu()
+	if ts == nil {
+		up.Printf_Bl("#FAIL !Not trading")
+		return
+	}
+	ts.Lock()
+	if !ts.accepted || ts.closed {
+		ts.Unlock()
+		up.Printf_Bl("#FAIL !The trade has not been accepted")
+		return
+	}
+	ts.confirmed[ts.index(up)] = true
+	done := ts.confirmed[0] && ts.confirmed[1]
+	if done {
+		ts.closed = true // Prevents changes, and makes sure the exchange is only done once
+	}
+	ts.Unlock()
+	if !done {
+		ts.report()
+		return
+	}
+	if ok, reason := ts.exchange_WLu(); ok {
+		ts.finish("Trade completed")
+	} else {
+		ts.finish("Trade failed: " + reason)
+	}
+}
+
+// Do the actual exchange. Both players are locked, always in the same order to prevent dead locks.
+// Nothing is changed unless both players still have all offered items, and both have room for what
+// they get.
+func (ts *tradeSession) exchange_WLu() (bool, string) {
+	ts.Lock()
+	players := ts.players
+	offers := [2]PlayerInv{append(PlayerInv(nil), ts.offers[0]...), append(PlayerInv(nil), ts.offers[1]...)}
+	ts.Unlock()
+	if !tradeDistanceOk(players[0], players[1]) {
+		return false, "too far away"
+	}
+	first, second := players[0], players[1]
+	if second.Id < first.Id {
+		first, second = second, first
+	}
+	first.Lock()
+	second.Lock()
+	for i, up := range players {
+		for _, obj := range offers[i] {
+			if up.Inventory.Count(obj.Type, obj.Level) < obj.Count {
+				second.Unlock()
+				first.Unlock()
+				return false, up.Name + " no longer has the items"
+			}
+		}
+	}
+	// The exchange is done on copies, which replace the inventories when there is room for everything
+	invs := [2]PlayerInv{append(PlayerInv(nil), players[0].Inventory...), append(PlayerInv(nil), players[1].Inventory...)}
+	var given [2][]Object // The items given by each player, with the instances
+	for i := range players {
+		for _, obj := range offers[i] {
+			for n := uint32(0); n < obj.Count; n++ {
+				given[i] = append(given[i], invs[i].Take(obj.Type, obj.Level))
+			}
+		}
+	}
+	for i, up := range players {
+		for _, obj := range offers[1-i] {
+			if !invs[i].Room(obj.Type, obj.Level, obj.Count) {
+				second.Unlock()
+				first.Unlock()
+				return false, up.Name + " has no room for the items"
+			}
+		}
+	}
+	for i, up := range players {
+		for _, obj := range given[1-i] {
+			invs[i].AddObject(obj)
+		}
+		up.Inventory = invs[i]
+	}
+	// Save both while still locked, to make sure what is saved is consistent.
+	players[0].saveIfPersistent_Bl()
+	players[1].saveIfPersistent_Bl()
+	second.Unlock()
+	first.Unlock()
+
+	rec := tradeLog{Time: time.Now(), Ids: [2]uint32{players[0].Id, players[1].Id},
+		Names: [2]string{players[0].Name, players[1].Name}, Offers: offers}
+	log.Printf("Trade %v\n", rec)
+	if db := ephenationdb.New(); db != nil {
+		if err := db.C("tradelog").Insert(&rec); err != nil {
+			log.Println("Trade log", err)
+		}
+	}
+	for i := range players {
+		for _, obj := range offers[i] {
+			ReportOneInventoryItem_WluBl(players[0], obj.Type, obj.Level)
+			ReportOneInventoryItem_WluBl(players[1], obj.Type, obj.Level)
+		}
+	}
+	return true, ""
+}
+
+// Save the player, unless it is a test player that has no representation in the DB.
+func (up *user) saveIfPersistent_Bl() {
+	if up.Email != "" {
+		up.Save_Bl()
+	}
+}
+
+// Cancel the current trade, if any.
+func (up *user) TradeCancel_WLu() {
+	if ts := up.currentTrade_RLu(); ts != nil {
+		ts.close("Trade cancelled by " + up.Name)
+	}
+}
+
+// Decode the CMD_TRADE message. The argument starts with the sub command.
+func (up *user) CmdTrade_WLuBl(b []byte) {
+	if len(b) < 1 {
+		return
+	}
+	switch b[0] {
+	case TradeRequest:
+		uid, _, ok := ParseUint32(b[1:])
+		if !ok {
+			return
+		}
+		allPlayersSem.RLock()
+		other := allPlayerIdMap[uid]
+		allPlayersSem.RUnlock()
+		up.TradeRequest_RLaBl(other)
+	case TradeOffer:
+		if len(b) != 13 {
+			return
+		}
+		lvl, _, _ := ParseUint32(b[5:9])
+		count, _, _ := ParseUint32(b[9:13])
+		up.TradeOffer_RLuBl(ObjectCode(b[1:5]), lvl, count)
+	case TradeConfirm:
+		up.TradeConfirm_WLuBl()
+	case TradeCancel:
+		up.TradeCancel_WLu()
+	}
+}
+
+// Decode the /trade command, which is an alternative to CMD_TRADE.
+func (up *user) TradeCommand_WLuRLaBl(arg string) {
+	cmd := strings.Split(arg, " ")
+	switch cmd[0] {
+	case "offer":
+		if len(cmd) != 4 {
+			up.Printf_Bl("#FAIL !Usage: /trade offer [item] [level] [count]")
+			return
+		}
+		lvl, err1 := strconv.ParseUint(cmd[2], 10, 32)
+		count, err2 := strconv.ParseUint(cmd[3], 10, 32)
+		if len(cmd[1]) != 4 || err1 != nil || err2 != nil {
+			up.Printf_Bl("#FAIL !Usage: /trade offer [item] [level] [count]")
+			return
+		}
+		up.TradeOffer_RLuBl(ObjectCode(cmd[1]), uint32(lvl), uint32(count))
+	case "confirm":
+		up.TradeConfirm_WLuBl()
+	case "cancel":
+		up.TradeCancel_WLu()
+	case "show":
+		ts := up.currentTrade_RLu()
+		if ts == nil {
+			up.Printf_Bl("!Not trading")
+			return
+		}
+		ts.Lock()
+		i := ts.index(up)
+		own, other, name := ts.offers[i], ts.offers[1-i], ts.players[1-i].Name
+		ts.Unlock()
+		up.Printf_Bl("!!Trade with %s", name)
+		for _, obj := range own {
+			up.Printf_Bl("!You offer %d %s level %d", obj.Count, obj.Type, obj.Level)
+		}
+		for _, obj := range other {
+			up.Printf_Bl("!%s offers %d %s level %d", name, obj.Count, obj.Type, obj.Level)
+		}
+	default:
+		allPlayersSem.RLock()
+		other := allPlayerNameMap[strings.ToLower(cmd[0])]
+		allPlayersSem.RUnlock()
+		up.TradeRequest_RLaBl(other)
+	}
+}
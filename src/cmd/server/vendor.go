@@ -0,0 +1,271 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+//
+// Vendors are NPCs with a stock, defined in the dialog file. A dialog choice with "Trade" shows the stock
+// with CMD_VENDOR_STOCK, and the client buys with CMD_VENDOR_BUY. Items are sold to the nearest vendor
+// with CMD_DROP_ITEM. The vendor pays a fraction of the price for items in the stock, and gold depending
+// on the drop value for other items. Items without a drop value can't be sold.
+//
+// Vendors have an unlimited supply of gold and items, so the owner of the NPC does not pay anything.
+//
+
+import (
+	"client_prot"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// An item sold by a vendor
+type vendorItem struct {
+	Code  string
+	Level uint32 // The level of the item. 0 means the level of the buyer.
+	Price uint32 // The price in gold
+}
+
+// Verify the stock of a vendor, and give default values to undefined attributes.
+func (def *dialogDef) verifyStock() error {
+	if def.BuyBack == 0 {
+		def.BuyBack = CnfgVendorBuyBack
+	}
+	if def.BuyBack < 0 || def.BuyBack > 1 {
+		return fmt.Errorf("dialog '%s': buy back %v must be between 0 and 1", def.Id, def.BuyBack)
+	}
+	for _, it := range def.Stock {
+		if it.Price == 0 {
+			return fmt.Errorf("dialog '%s': no price for '%s'", def.Id, it.Code)
+		}
+	}
+	return nil
+}
+
+// Find an item in the stock. Return nil if the vendor doesn't sell it.
+func (def *dialogDef) stockItem(code ObjectCode) *vendorItem {
+	for i := range def.Stock {
+		if ObjectCode(def.Stock[i].Code) == code {
+			return &def.Stock[i]
+		}
+	}
+	return nil
+}
+
+// The gold the vendor pays for an item. 0 means the vendor doesn't buy it.
+func (def *dialogDef) sellPrice(code ObjectCode, playerLevel, itemLevel uint32) uint32 {
+	if it := def.stockItem(code); it != nil {
+		return uint32(float32(it.Price) * def.BuyBack)
+	}
+	return uint32(ItemValueAsDrop(playerLevel, itemLevel, code) * CnfgGoldPerDropValue * def.BuyBack)
+}
+
+// Find the nearest vendor. Return nil if there is none near enough.
+func (up *user) nearestVendor_RLq() (*npc, *dialogDef) {
+	var def *dialogDef
+	n := up.nearestNPC_RLq(func(n *npc) bool {
+		d := FindDialog(n.dialog)
+		return d != nil && len(d.Stock) > 0
+	})
+	if n != nil {
+		def = FindDialog(n.dialog)
+	}
+	if def == nil {
+		// The dialogs were reloaded in the meantime
+		return nil, nil
+	}
+	return n, def
+}
+
+// Build the CMD_VENDOR_STOCK message, for a buyer at level 'level'. Every item is the code, the level
+// and the price.
+func stockMessage(id uint32, def *dialogDef, level uint32) []byte {
+	stock := def.Stock
+	if len(stock) > math.MaxUint8 {
+		stock = stock[:math.MaxUint8]
+	}
+	msgLen := 8 + 12*len(stock)
+	b := make([]byte, msgLen)
+	b[0] = byte(msgLen)
+	b[1] = byte(msgLen >> 8)
+	b[2] = client_prot.CMD_VENDOR_STOCK
+	EncodeUint32(id, b[3:7])
+	b[7] = byte(len(stock))
+	p := b[8:]
+	for _, it := range stock {
+		lvl := it.Level
+		if lvl == 0 {
+			lvl = level
+		}
+		copy(p[0:4], it.Code)
+		EncodeUint32(lvl, p[4:8])
+		EncodeUint32(it.Price, p[8:12])
+		p = p[12:]
+	}
+	return b
+}
+
+// Show the stock of a vendor to the player
+func (up *user) showStock_Bl(n *npc, def *dialogDef) {
+	up.writeBlocking_Bl(stockMessage(n.id, def, up.Level))
+}
+
+// Buy items from a vendor
+func (up *user) BuyItem_WLuBl(id uint32, code ObjectCode, count uint32) {
+	n := findNPC(id)
+	if n == nil || count == 0 {
+		return
+	}
+	if !up.nearNPC(n) {
+		up.Printf_Bl("#FAIL !Too far away")
+		return
+	}
+	def := FindDialog(n.dialog)
+	var it *vendorItem
+	if def != nil {
+		it = def.stockItem(code)
+	}
+	if it == nil {
+		up.Printf_Bl("#FAIL !%s is not for sale", code)
+		return
+	}
+	cost := int64(it.Price) * int64(count)
+	var failure string
+	up.Lock()
+	lvl := it.Level
+	if lvl == 0 {
+		lvl = up.Level
+	}
+	switch {
+	case !up.Inventory.Room(code, lvl, count):
+		failure = fmt.Sprintf("You can't carry more of %v", code)
+	case !up.changeGold(-cost):
+		failure = fmt.Sprintf("You need %d gold", cost)
+	default:
+		for i := uint32(0); i < count; i++ {
+			up.Inventory.AddOneObject(code, lvl)
+		}
+	}
+	balance := up.Gold
+	up.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	up.reportGold(-cost, balance, fmt.Sprintf("buy %dx%s", count, code))
+	ReportOneInventoryItem_WluBl(up, code, lvl)
+}
+
+// Sell items to the nearest vendor
+func (up *user) SellItem_WLuBl(code ObjectCode, lvl uint32, count uint32) {
+	_, def := up.nearestVendor_RLq()
+	if def == nil {
+		up.Printf_Bl("#FAIL !There is no vendor near")
+		return
+	}
+	var failure string
+	var income int64
+	up.Lock()
+	price := def.sellPrice(code, up.Level, lvl)
+	income = int64(price) * int64(count)
+	switch {
+	case price == 0:
+		failure = fmt.Sprintf("The vendor doesn't buy %s", code)
+	case up.Inventory.Count(code, lvl) < count:
+		failure = fmt.Sprintf("You don't have %d of %s", count, code)
+	case !up.changeGold(income):
+		failure = "You can't carry more gold"
+	default:
+		for i := uint32(0); i < count; i++ {
+			up.Inventory.Remove(code, lvl)
+		}
+	}
+	balance := up.Gold
+	up.Unlock()
+	if failure != "" {
+		up.Printf_Bl("#FAIL !%s", failure)
+		return
+	}
+	up.reportGold(income, balance, fmt.Sprintf("sell %dx%s", count, code))
+	ReportOneInventoryItem_WluBl(up, code, lvl)
+}
+
+// Drop one item. It is sold if there is a vendor near that buys it, otherwise it is discarded.
+func (up *user) DropItem_WLuBl(code ObjectCode, lvl uint32) {
+	if _, def := up.nearestVendor_RLq(); def != nil {
+		up.RLock()
+		price := def.sellPrice(code, up.Level, lvl)
+		up.RUnlock()
+		if price > 0 {
+			up.SellItem_WLuBl(code, lvl, 1)
+			return
+		}
+	}
+	up.Lock()
+	up.Inventory.Remove(code, lvl)
+	up.Unlock()
+	ReportOneInventoryItem_WluBl(up, code, lvl)
+}
+
+// Decode CMD_VENDOR_BUY
+func (up *user) CmdVendorBuy_WLuBl(b []byte) {
+	if len(b) != 9 {
+		return
+	}
+	id, _, _ := ParseUint32(b[0:4])
+	up.BuyItem_WLuBl(id, ObjectCode(b[4:8]), uint32(b[8]))
+}
+
+// Manage the "/vendor" command, for the nearest vendor
+func (up *user) VendorCommand_WLuBl(args []string) {
+	n, def := up.nearestVendor_RLq()
+	if n == nil {
+		up.Printf_Bl("#FAIL !There is no vendor near")
+		return
+	}
+	count := uint64(1)
+	var err error
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		up.showStock_Bl(n, def)
+		up.Printf_Bl("!%s sells:", def.Name)
+		for _, it := range def.Stock {
+			up.Printf_Bl("!%s for %d gold", it.Code, it.Price)
+		}
+	case args[0] == "buy" && (len(args) == 2 || len(args) == 3):
+		if len(args) == 3 {
+			count, err = strconv.ParseUint(args[2], 10, 8)
+		}
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		up.BuyItem_WLuBl(n.id, ObjectCode(args[1]), uint32(count))
+	case args[0] == "sell" && (len(args) == 3 || len(args) == 4):
+		lvl, err := strconv.ParseUint(args[2], 10, 32)
+		if err == nil && len(args) == 4 {
+			count, err = strconv.ParseUint(args[3], 10, 32)
+		}
+		if err != nil {
+			up.Printf_Bl("#FAIL !%v", err)
+			return
+		}
+		up.SellItem_WLuBl(ObjectCode(args[1]), uint32(lvl), uint32(count))
+	default:
+		up.Printf_Bl("#FAIL !Usage: /vendor list|buy [code] [count]|sell [code] [level] [count]")
+	}
+}
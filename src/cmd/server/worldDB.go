@@ -91,11 +91,24 @@ const (
 	BT_RedLight      = block(31) // Add red light
 	BT_GreenLight    = block(32) // Add green light
 	BT_BlueLight     = block(33) // Add blue light
+	BT_Chest         = block(34) // A storage chest, see chest.go
+	BT_Door          = block(35) // A closed door, see doors.go
+	BT_DoorOpen      = block(36) // An open door
+	BT_Lever         = block(37) // A lever in the off position
+	BT_LeverOn       = block(38) // A lever in the on position
+	BT_Plate         = block(39) // A pressure plate, active when a player stands on it
 
 	BT_Stone2   = block(127)
 	BT_Topsoil  = block(128) // This block is never stored in a chunk.
 	BT_Teleport = block(129) // This block is never stored in a chunk.
 
+	BT_Latch     = block(244) // Logic gate, toggle the output when the input rises
+	BT_Pulse     = block(245) // Logic gate, a pulse of fixed length when the input rises
+	BT_Counter   = block(246) // Logic gate, a pulse for every n:th time the input rises
+	BT_Delay     = block(247) // Logic gate, the output is the input delayed
+	BT_Not       = block(248) // Logic gate
+	BT_Or        = block(249) // Logic gate
+	BT_And       = block(250) // Logic gate
 	BT_Text      = block(251) // Generate a text message to anyone near
 	BT_DeTrigger = block(252) // The opposite of a trigger. Will reset activator blocks.
 	BT_Spawn     = block(253) // Spawn a monster. Activated from a trig block.
@@ -106,7 +119,9 @@ const (
 // Flag for chunks, to be used as bits in a 32-bit unsigned integer.
 // These are saved with the chunk to external files, do not change the value of them.
 const (
-	CHF_MODIFIED = 1 << 0 // True if the chunk is modified compared to the automatically generated original
+	CHF_MODIFIED   = 1 << 0 // True if the chunk is modified compared to the automatically generated original
+	CHF_NO_AMBIENT = 1 << 1 // The owner has stopped random monster spawns in and near this chunk
+	CHF_ARENA      = 1 << 2 // Players may fight each other in this chunk
 )
 
 // This const group defines partition types (sections saved for every chunk on the file).
@@ -116,6 +131,11 @@ type TPartition uint16
 const (
 	PART_COMP_CHUNK      = TPartition(iota) // A compressed chunk
 	PART_TEXT_ACTIVATORS = TPartition(iota) // List of text messages associated with text activators in this chunk
+	PART_CHESTS          = TPartition(iota) // List of storage chests and their content in this chunk
+	PART_SPAWNERS        = TPartition(iota) // List of monster spawners in this chunk
+	PART_LOGIC           = TPartition(iota) // List of logic gates in this chunk
+	PART_DOOR_LOCKS      = TPartition(iota) // List of key requirements for doors in this chunk
+	PART_NPCS            = TPartition(iota) // List of NPCs placed in this chunk
 )
 
 // This structure is used to associate a trigger with an activation block. It is a many-to-many association.
@@ -128,11 +148,12 @@ type BlockTrigger struct {
 }
 
 // There is one instance of this struct for each BT_Text block in the chunk. This information is saved with the chunk
-// on the file, and only modified when a text block is added or removed.
+// on the file, and only modified when a text block is added or removed, or when a script changes the variables.
 type textMsgActivator struct {
-	X, Y, Z uint8     // Position of the BT_Text inside the chunk
-	Message []string  // The multi line message
-	inhibit time.Time // The activator is inhibited until this time. Need not be saved with the chunk (thus using lowercase letter).
+	X, Y, Z uint8      // Position of the BT_Text inside the chunk
+	Message []string   // The multi line message
+	inhibit time.Time  // The activator is inhibited until this time. Need not be saved with the chunk (thus using lowercase letter).
+	Vars    scriptVars // Variables used by the activator script, if any
 }
 
 // A jelly block is a block inside a chunk that temporarily turns into air. There is a timer that specifies when the block reverts to
@@ -158,6 +179,12 @@ type chunk struct {
 	touched      bool               // Flag used to determine if a chunk can be discarded
 	triggerMsgs  []textMsgActivator // List of all activators and their text messages. This list is saved and restored from file.
 	jellyBlocks  []jellyBlock       // The current list of jelly blocks. nil when empty. It is sorted in time order, with the first being the oldest.
+	chests       []storageChest     // List of all storage chests in this chunk. This list is saved and restored from file.
+	spawners     []monsterSpawner   // List of all monster spawners in this chunk. This list is saved and restored from file.
+	gates        []logicGate        // List of all logic gates in this chunk. This list is saved and restored from file.
+	doorLocks    []doorLock         // List of doors that require a key. This list is saved and restored from file.
+	npcs         []npcPlacement     // List of NPCs placed in this chunk. This list is saved and restored from file.
+	logic        *logicGraph        // The logic nets and gates, nil if none. This is recomputed when chunk is restored from file.
 }
 
 const (
@@ -269,6 +296,82 @@ func (ch *chunk) WriteFS(file io.Writer) bool {
 			return false
 		}
 	}
+
+	if len(ch.chests) > 0 {
+		// Save the storage chests, using the same method as for the activator messages.
+		var buffer bytes.Buffer
+		encoder := gob.NewEncoder(&buffer)
+		err = encoder.Encode(&ch.chests)
+		if err != nil {
+			log.Printf("WriteFS: encode chests failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+		err = ch.WritePartition(file, buffer.Bytes(), PART_CHESTS)
+		if err != nil {
+			log.Printf("WriteFS: PART_CHESTS write failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+	}
+
+	if len(ch.spawners) > 0 {
+		var buffer bytes.Buffer
+		encoder := gob.NewEncoder(&buffer)
+		err = encoder.Encode(&ch.spawners)
+		if err != nil {
+			log.Printf("WriteFS: encode spawners failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+		err = ch.WritePartition(file, buffer.Bytes(), PART_SPAWNERS)
+		if err != nil {
+			log.Printf("WriteFS: PART_SPAWNERS write failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+	}
+
+	if len(ch.gates) > 0 {
+		var buffer bytes.Buffer
+		encoder := gob.NewEncoder(&buffer)
+		err = encoder.Encode(&ch.gates)
+		if err != nil {
+			log.Printf("WriteFS: encode logic gates failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+		err = ch.WritePartition(file, buffer.Bytes(), PART_LOGIC)
+		if err != nil {
+			log.Printf("WriteFS: PART_LOGIC write failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+	}
+
+	if len(ch.doorLocks) > 0 {
+		var buffer bytes.Buffer
+		encoder := gob.NewEncoder(&buffer)
+		err = encoder.Encode(&ch.doorLocks)
+		if err != nil {
+			log.Printf("WriteFS: encode door locks failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+		err = ch.WritePartition(file, buffer.Bytes(), PART_DOOR_LOCKS)
+		if err != nil {
+			log.Printf("WriteFS: PART_DOOR_LOCKS write failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+	}
+
+	if len(ch.npcs) > 0 {
+		var buffer bytes.Buffer
+		encoder := gob.NewEncoder(&buffer)
+		err = encoder.Encode(&ch.npcs)
+		if err != nil {
+			log.Printf("WriteFS: encode NPCs failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+		err = ch.WritePartition(file, buffer.Bytes(), PART_NPCS)
+		if err != nil {
+			log.Printf("WriteFS: PART_NPCS write failed %v (for chunk %v)\n", err, ch.Coord)
+			return false
+		}
+	}
 	return true
 }
 
@@ -404,6 +507,46 @@ func dBReadChunk(c chunkdb.CC, file io.Reader, size int64) *chunk {
 				return dBCreateAndSaveChunk(c)
 			}
 			// fmt.Printf("DBReadChunk ch(%v) activator messages: %v\n", ch.Coord, ch.triggerMsgs)
+		case PART_CHESTS:
+			buffer := bytes.NewBuffer(b[0:pLength])
+			decoder := gob.NewDecoder(buffer)
+			err := decoder.Decode(&ch.chests)
+			if err != nil {
+				log.Printf("DBReadChunk: decode chests failed %v (from %v)\n", err, b[0:pLength])
+				return dBCreateAndSaveChunk(c)
+			}
+		case PART_SPAWNERS:
+			buffer := bytes.NewBuffer(b[0:pLength])
+			decoder := gob.NewDecoder(buffer)
+			err := decoder.Decode(&ch.spawners)
+			if err != nil {
+				log.Printf("DBReadChunk: decode spawners failed %v (from %v)\n", err, b[0:pLength])
+				return dBCreateAndSaveChunk(c)
+			}
+		case PART_LOGIC:
+			buffer := bytes.NewBuffer(b[0:pLength])
+			decoder := gob.NewDecoder(buffer)
+			err := decoder.Decode(&ch.gates)
+			if err != nil {
+				log.Printf("DBReadChunk: decode logic gates failed %v (from %v)\n", err, b[0:pLength])
+				return dBCreateAndSaveChunk(c)
+			}
+		case PART_DOOR_LOCKS:
+			buffer := bytes.NewBuffer(b[0:pLength])
+			decoder := gob.NewDecoder(buffer)
+			err := decoder.Decode(&ch.doorLocks)
+			if err != nil {
+				log.Printf("DBReadChunk: decode door locks failed %v (from %v)\n", err, b[0:pLength])
+				return dBCreateAndSaveChunk(c)
+			}
+		case PART_NPCS:
+			buffer := bytes.NewBuffer(b[0:pLength])
+			decoder := gob.NewDecoder(buffer)
+			err := decoder.Decode(&ch.npcs)
+			if err != nil {
+				log.Printf("DBReadChunk: decode NPCs failed %v (from %v)\n", err, b[0:pLength])
+				return dBCreateAndSaveChunk(c)
+			}
 		default:
 			log.Printf("DBReadChunk: bad partition type %d or partition length %d (%d)\n", pType, pLength, len(b))
 			return dBCreateAndSaveChunk(c)
@@ -411,6 +554,9 @@ func dBReadChunk(c chunkdb.CC, file io.Reader, size int64) *chunk {
 		b = b[pLength:] // the next partition
 	}
 	ch.ComputeLinks() // No lock needed yet as the chunk is not available anywhere else
+	if ch.npcs != nil {
+		registerNPCs(ch)
+	}
 	ch.touched = true // Prevent this chunk from being discarded too soon
 	delta := time.Now().Sub(start)
 	DBStats.NumRead++
@@ -507,6 +653,22 @@ func DBGetBlockCached_WLwWLc(uc user_coord) block {
 	return rc[x_off][y_off][z_off]
 }
 
+// Get the block type at the specified coordinate, if the chunk is in the cache. Return false if it isn't.
+// The chunk is never loaded, so this can be used where waiting for the disk isn't acceptable.
+func DBGetBlockIfLoaded_RLw(uc user_coord) (block, bool) {
+	cc := uc.GetChunkCoord()
+	worldCacheLock.RLock()
+	cp := chunkFindRO(cc)
+	worldCacheLock.RUnlock()
+	if cp == nil {
+		return BT_Stone, false
+	}
+	x_off := int32(math.Floor(uc.X)) - cc.X*CHUNK_SIZE
+	y_off := int32(math.Floor(uc.Y)) - cc.Y*CHUNK_SIZE
+	z_off := int32(math.Floor(uc.Z)) - cc.Z*CHUNK_SIZE
+	return cp.rc[x_off][y_off][z_off], true
+}
+
 // Update a block in a chunks. The changed block must be air before or after.
 // Return true if successful.
 // The update of the chunk should possibly be done by a worldDB process.
@@ -522,8 +684,21 @@ func (cp *chunk) UpdateBlock_WLcWLw(x_off, y_off, z_off uint8, blType block) boo
 		log.Printf("UpdateBlock (%d,%d,%d) chunk %v had type %d already\n", x_off, y_off, z_off, cp.Coord, blType)
 		return false
 	}
+	if rc[x_off][y_off][z_off] == BT_Chest && cp.chestHasItems(x_off, y_off, z_off) {
+		// The content would be lost
+		return false
+	}
 
 	rc[x_off][y_off][z_off] = blType
+	if cp.chests != nil {
+		cp.pruneChests()
+	}
+	if cp.spawners != nil {
+		cp.pruneSpawners()
+	}
+	if cp.doorLocks != nil {
+		cp.pruneDoorLocks()
+	}
 	cp.compressAndChecksum() // Create the compressed copy
 	cp.flag |= CHF_MODIFIED
 	// Save it permanently. TODO: Use delayed write to improve performance.
@@ -607,6 +782,13 @@ func init() {
 	blockIsInvisible[BT_Link] = true
 	blockIsInvisible[BT_Trigger] = true
 	blockIsInvisible[BT_Text] = true
+	blockIsInvisible[BT_Latch] = true
+	blockIsInvisible[BT_Pulse] = true
+	blockIsInvisible[BT_Counter] = true
+	blockIsInvisible[BT_Delay] = true
+	blockIsInvisible[BT_Not] = true
+	blockIsInvisible[BT_Or] = true
+	blockIsInvisible[BT_And] = true
 	blockIsInvisible[BT_SmallFog] = true
 	blockIsInvisible[BT_BigFog] = true
 	blockIsInvisible[BT_RedLight] = true
@@ -619,6 +801,13 @@ func init() {
 	blockIsPermeable[BT_Link] = true
 	blockIsPermeable[BT_Trigger] = true
 	blockIsPermeable[BT_Text] = true
+	blockIsPermeable[BT_Latch] = true
+	blockIsPermeable[BT_Pulse] = true
+	blockIsPermeable[BT_Counter] = true
+	blockIsPermeable[BT_Delay] = true
+	blockIsPermeable[BT_Not] = true
+	blockIsPermeable[BT_Or] = true
+	blockIsPermeable[BT_And] = true
 	blockIsPermeable[BT_Water] = true
 	blockIsPermeable[BT_BrownWater] = true
 	blockIsPermeable[BT_Tree1] = true
@@ -635,6 +824,8 @@ func init() {
 	blockIsPermeable[BT_RedLight] = true
 	blockIsPermeable[BT_GreenLight] = true
 	blockIsPermeable[BT_BlueLight] = true
+	blockIsPermeable[BT_DoorOpen] = true
+	blockIsPermeable[BT_Plate] = true
 }
 
 // Update the Z position of an object, taking into account ground level and z speed. The argument is updated,
@@ -684,15 +875,23 @@ func dBGetAdjacentChunks(cc *chunkdb.CC) []*chunk {
 }
 
 // Set a teleport in the specified chunk.
-func (cp *chunk) SetTeleport(cc chunkdb.CC, up *user, x, y, z uint8) {
-	if cp == nil || (cp.owner != up.Id && up.AdminLevel == 0) {
+func (cp *chunk) SetTeleport_RLg(cc chunkdb.CC, up *user, x, y, z uint8) {
+	if cp == nil || !up.MayModifyChunk_RLg(cp) {
 		up.Printf_Bl("#FAIL")
 		return
 	}
 
-	// Count the number of teleports in other chunks that the player already has
+	// Count the number of teleports in other chunks that the player, or the guild, already has
+	territory := up.Territory
+	if IsGuildOwner(cp.owner) {
+		guildSem.RLock()
+		if gp := allGuilds[cp.owner-GuildOwnerOffset]; gp != nil {
+			territory = append([]chunkdb.CC(nil), gp.Territory...)
+		}
+		guildSem.RUnlock()
+	}
 	numTeleports := 0
-	for _, terr := range up.Territory {
+	for _, terr := range territory {
 		_, _, _, found := superChunkManager.GetTeleport(&terr)
 		if found && terr != cc {
 			numTeleports++
@@ -113,6 +113,7 @@ func RemoveChunkFromHashTable(pc *chunk) {
 			*ppc = pc.next
 			pc.next = nil
 			worldCacheNumChunks--
+			unregisterLogicChunk(pc) // The logic of the chunk is resumed when it is loaded again
 			return
 		}
 	}
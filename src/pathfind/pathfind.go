@@ -0,0 +1,200 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// A* path finding on a block grid.
+//
+// A position is the block where the feet are. A creature can walk to the four horizontally adjacent
+// blocks, step up a limited height, fall down a limited height and climb vertically where there are ladders.
+// The search is limited by a budget, and if the goal isn't found, a path to the node closest
+// to the goal is returned instead.
+package pathfind
+
+import (
+	"container/heap"
+)
+
+type Point struct {
+	X, Y, Z int32
+}
+
+// The world that a path is searched in.
+type World interface {
+	Passable(p Point) bool  // True if the block can be occupied, e.g. air or water
+	Climbable(p Point) bool // True if it is possible to climb vertically at this position
+}
+
+type Options struct {
+	Height     int32 // Number of passable blocks needed above the feet
+	JumpHeight int32 // Max number of blocks to step up
+	MaxDrop    int32 // Max number of blocks to fall down
+	MaxNodes   int   // Max number of nodes to expand, the budget
+}
+
+type Result struct {
+	Path     []Point // The path, not including the start position. Empty if already at the goal.
+	Complete bool    // True if the path leads to the goal. Otherwise, it leads to the closest position found.
+	Expanded int     // Number of nodes expanded, to be used for budget calculations
+}
+
+type node struct {
+	p      Point
+	cost   int32 // The cost so far
+	prio   int32 // Cost plus heuristic
+	parent *node
+	index  int // Index in the heap, -1 when closed
+}
+
+type nodeQueue []*node
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(i, j int) bool  { return q[i].prio < q[j].prio }
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i]; q[i].index = i; q[j].index = j }
+func (q *nodeQueue) Push(x interface{}) { n := x.(*node); n.index = len(*q); *q = append(*q, n) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := old[len(old)-1]
+	*q = old[:len(old)-1]
+	n.index = -1
+	return n
+}
+
+func abs(a int32) int32 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// The heuristic. Every move costs at least as much as the manhattan distance it covers.
+func distance(a, b Point) int32 {
+	return abs(a.X-b.X) + abs(a.Y-b.Y) + abs(a.Z-b.Z)
+}
+
+// Return true if a creature fits at 'p'
+func fits(w World, p Point, height int32) bool {
+	for i := int32(0); i < height; i++ {
+		if !w.Passable(Point{p.X, p.Y, p.Z + i}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return true if a creature can stay at 'p' without falling
+func supported(w World, p Point) bool {
+	return !w.Passable(Point{p.X, p.Y, p.Z - 1}) || w.Climbable(p)
+}
+
+var directions = [4]Point{{1, 0, 0}, {-1, 0, 0}, {0, 1, 0}, {0, -1, 0}}
+
+// Call 'f' for every position reachable in one move from 'p', with the cost of the move.
+func neighbours(w World, p Point, opt *Options, f func(q Point, cost int32)) {
+	for _, d := range directions {
+		q := Point{p.X + d.X, p.Y + d.Y, p.Z}
+		if fits(w, q, opt.Height) {
+			// Walk, and possibly fall down
+			for drop := int32(0); drop <= opt.MaxDrop; drop++ {
+				if supported(w, q) {
+					f(q, 1+drop)
+					break
+				}
+				q.Z--
+				if !w.Passable(q) {
+					break
+				}
+			}
+			continue
+		}
+		// Step up, if there is room above the head
+		for j := int32(1); j <= opt.JumpHeight; j++ {
+			if !w.Passable(Point{p.X, p.Y, p.Z + opt.Height + j - 1}) {
+				break
+			}
+			up := Point{q.X, q.Y, q.Z + j}
+			if fits(w, up, opt.Height) && supported(w, up) {
+				f(up, 1+j)
+				break
+			}
+		}
+	}
+	if w.Climbable(p) {
+		if up := (Point{p.X, p.Y, p.Z + 1}); fits(w, up, opt.Height) {
+			f(up, 1)
+		}
+		if down := (Point{p.X, p.Y, p.Z - 1}); w.Passable(down) {
+			f(down, 1)
+		}
+	}
+}
+
+// Return true if 'p' is near enough to be considered the goal. The goal may be a flying or jumping
+// creature, so the height is not required to be exact.
+func atGoal(p, goal Point) bool {
+	return p.X == goal.X && p.Y == goal.Y && abs(p.Z-goal.Z) <= 1
+}
+
+// Find a path from 'from' to 'to'.
+func Find(w World, from, to Point, opt Options) (res Result) {
+	nodes := map[Point]*node{}
+	start := &node{p: from, prio: distance(from, to)}
+	nodes[from] = start
+	open := nodeQueue{start}
+	best := start // The node closest to the goal found so far
+	var goal *node
+	for len(open) > 0 && res.Expanded < opt.MaxNodes {
+		current := heap.Pop(&open).(*node)
+		res.Expanded++
+		if atGoal(current.p, to) {
+			goal = current
+			break
+		}
+		if h := current.prio - current.cost; h < best.prio-best.cost {
+			best = current
+		}
+		neighbours(w, current.p, &opt, func(q Point, cost int32) {
+			c := current.cost + cost
+			n, ok := nodes[q]
+			if !ok {
+				n = &node{p: q, cost: c, prio: c + distance(q, to), parent: current}
+				nodes[q] = n
+				heap.Push(&open, n)
+				return
+			}
+			if c < n.cost && n.index >= 0 {
+				n.prio += c - n.cost
+				n.cost = c
+				n.parent = current
+				heap.Fix(&open, n.index)
+			}
+		})
+	}
+	if goal != nil {
+		res.Complete = true
+		best = goal
+	}
+	// Build the path backwards
+	length := 0
+	for n := best; n.parent != nil; n = n.parent {
+		length++
+	}
+	res.Path = make([]Point, length)
+	for n := best; n.parent != nil; n = n.parent {
+		length--
+		res.Path[length] = n.p
+	}
+	return
+}
@@ -0,0 +1,122 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package pathfind
+
+import (
+	"testing"
+)
+
+// A test world with a flat floor at z = -1, where solid blocks and ladders can be added.
+type testWorld struct {
+	solid  map[Point]bool
+	ladder map[Point]bool
+}
+
+func newTestWorld() *testWorld {
+	return &testWorld{solid: map[Point]bool{}, ladder: map[Point]bool{}}
+}
+
+func (w *testWorld) Passable(p Point) bool {
+	return p.Z >= 0 && !w.solid[p]
+}
+
+func (w *testWorld) Climbable(p Point) bool {
+	return w.ladder[p]
+}
+
+// Add a wall along x = 'x', from y = y1 to y2, of height h
+func (w *testWorld) wall(x, y1, y2, h int32) {
+	for y := y1; y <= y2; y++ {
+		for z := int32(0); z < h; z++ {
+			w.solid[Point{x, y, z}] = true
+		}
+	}
+}
+
+var opt = Options{Height: 2, JumpHeight: 1, MaxDrop: 3, MaxNodes: 1000}
+
+func TestStraight(t *testing.T) {
+	w := newTestWorld()
+	res := Find(w, Point{0, 0, 0}, Point{5, 0, 0}, opt)
+	if !res.Complete || len(res.Path) != 5 || res.Path[4] != (Point{5, 0, 0}) {
+		t.Error("Straight path failed", res)
+	}
+	res = Find(w, Point{0, 0, 0}, Point{0, 0, 0}, opt)
+	if !res.Complete || len(res.Path) != 0 {
+		t.Error("Already at goal", res)
+	}
+}
+
+func TestAroundWall(t *testing.T) {
+	w := newTestWorld()
+	w.wall(2, -3, 3, 3) // Too high to step over
+	res := Find(w, Point{0, 0, 0}, Point{4, 0, 0}, opt)
+	if !res.Complete {
+		t.Fatal("No path around wall", res)
+	}
+	for _, p := range res.Path {
+		if p.X == 2 && p.Y >= -3 && p.Y <= 3 {
+			t.Error("Path goes through wall", res.Path)
+		}
+	}
+	if len(res.Path) != 12 {
+		t.Error("Path not shortest", len(res.Path), res.Path)
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	w := newTestWorld()
+	w.wall(2, -20, 20, 1) // A step of one block
+	res := Find(w, Point{0, 0, 0}, Point{2, 0, 1}, opt)
+	if !res.Complete || len(res.Path) != 2 || res.Path[1] != (Point{2, 0, 1}) {
+		t.Error("Step up failed", res)
+	}
+	w.wall(2, -20, 20, 2) // Now too high
+	res = Find(w, Point{0, 0, 0}, Point{3, 0, 0}, opt)
+	for _, p := range res.Path {
+		if p.X == 2 && p.Y >= -20 && p.Y <= 20 {
+			t.Error("Found path over too high wall", res.Path)
+		}
+	}
+}
+
+func TestLadder(t *testing.T) {
+	w := newTestWorld()
+	w.wall(2, -20, 20, 5)
+	for z := int32(0); z < 5; z++ {
+		w.ladder[Point{1, 0, z}] = true
+	}
+	res := Find(w, Point{0, 0, 0}, Point{2, 0, 5}, opt)
+	if !res.Complete {
+		t.Error("Ladder not used", res)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	w := newTestWorld()
+	w.wall(5, -100, 100, 3)
+	limited := opt
+	limited.MaxNodes = 20
+	res := Find(w, Point{0, 0, 0}, Point{10, 0, 0}, limited)
+	if res.Complete || res.Expanded > 20 {
+		t.Error("Budget not respected", res)
+	}
+	if len(res.Path) == 0 || res.Path[len(res.Path)-1].X != 4 {
+		t.Error("Partial path should lead to the closest position", res.Path)
+	}
+}
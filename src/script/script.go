@@ -0,0 +1,809 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// A small scripting language for text activators.
+//
+// There is one statement on every line. Empty lines and lines starting with '#' are ignored.
+//
+//	set <var> = <expr>
+//	if <expr> ... [elif <expr> ...] [else ...] end
+//	while <expr> ... end
+//	stop
+//	<action> [<arg>, ...]
+//
+// All values are integers, and a condition is true if it is not 0. A variable is local to one run of
+// the script, unless it has the prefix "a." (the activator) or "p." (the player), which are managed by the host.
+// Undefined variables are 0. Expressions use the operators || && == != < <= > >= + - * / % ! and
+// parentheses, and may call functions "name(args)" provided by the host.
+//
+// The arguments of actions are expressions or strings. A string may include the value of a variable
+// with "{var}". Actions and functions are implemented by the host, so the language can't do anything
+// by itself. Every executed statement and loop test costs one instruction, and a run is stopped when the
+// instruction budget is exhausted.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The scope of a variable
+type Scope uint8
+
+const (
+	Local     Scope = iota // Only valid during one run
+	Activator              // Prefix "a."
+	Player                 // Prefix "p."
+)
+
+// The host implements everything that has an effect outside of the script.
+type Host interface {
+	Get(scope Scope, name string) int64
+	Set(scope Scope, name string, value int64) error
+	Call(name string, args []int64) (int64, error)
+	Action(name string, args []string) error
+}
+
+var ErrBudget = errors.New("instruction budget exhausted")
+
+// A compiled script
+type Program struct {
+	code []stmt
+}
+
+// Compile the lines of a script
+func Compile(lines []string) (*Program, error) {
+	c := compiler{lines: lines}
+	code, end, err := c.block()
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, &Error{c.pos, fmt.Errorf("'%s' without matching statement", end)}
+	}
+	return &Program{code}, nil
+}
+
+// Run the program. Return the number of instructions used.
+func (p *Program) Run(h Host, budget int) (int, error) {
+	m := machine{host: h, locals: make(map[string]int64), budget: budget}
+	_, err := m.exec(p.code)
+	return m.steps, err
+}
+
+//
+// Tokens
+//
+
+type tokKind uint8
+
+const (
+	tEnd tokKind = iota
+	tNum
+	tIdent
+	tStr
+	tOp
+)
+
+type token struct {
+	kind tokKind
+	s    string
+	n    int64
+}
+
+// Two character operators are tested first
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ",", "="}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lex(line string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case isDigit(c):
+			j := i
+			for j < len(line) && isDigit(line[j]) {
+				j++
+			}
+			n, err := strconv.ParseInt(line[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number '%s'", line[i:j])
+			}
+			toks = append(toks, token{kind: tNum, n: n})
+			i = j
+		case isLetter(c):
+			j := i
+			for j < len(line) && (isLetter(line[j]) || isDigit(line[j]) || line[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{kind: tIdent, s: line[i:j]})
+			i = j
+		case c == '"':
+			var s []byte
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+				}
+				s = append(s, line[j])
+			}
+			if j == len(line) {
+				return nil, errors.New("string not terminated")
+			}
+			toks = append(toks, token{kind: tStr, s: string(s)})
+			i = j + 1
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(line[i:], op) {
+					toks = append(toks, token{kind: tOp, s: op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+		}
+	}
+	return toks, nil
+}
+
+//
+// Syntax tree
+//
+
+type machine struct {
+	host   Host
+	locals map[string]int64
+	budget int
+	steps  int
+}
+
+type expr interface {
+	eval(m *machine) (int64, error)
+}
+
+type stmt interface {
+	exec(m *machine) (stop bool, err error)
+}
+
+type number int64
+
+func (n number) eval(m *machine) (int64, error) {
+	return int64(n), nil
+}
+
+type variable struct {
+	scope Scope
+	name  string
+}
+
+func (v *variable) eval(m *machine) (int64, error) {
+	if v.scope == Local {
+		return m.locals[v.name], nil
+	}
+	return m.host.Get(v.scope, v.name), nil
+}
+
+type unary struct {
+	op string
+	e  expr
+}
+
+func (u *unary) eval(m *machine) (int64, error) {
+	v, err := u.e.eval(m)
+	if err != nil {
+		return 0, err
+	}
+	if u.op == "-" {
+		return -v, nil
+	}
+	return truth(v == 0), nil
+}
+
+type binary struct {
+	op   string
+	l, r expr
+}
+
+func truth(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (b *binary) eval(m *machine) (int64, error) {
+	l, err := b.l.eval(m)
+	if err != nil {
+		return 0, err
+	}
+	// Short circuit evaluation
+	switch {
+	case b.op == "&&" && l == 0:
+		return 0, nil
+	case b.op == "||" && l != 0:
+		return 1, nil
+	}
+	r, err := b.r.eval(m)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case "&&", "||":
+		return truth(r != 0), nil
+	case "==":
+		return truth(l == r), nil
+	case "!=":
+		return truth(l != r), nil
+	case "<":
+		return truth(l < r), nil
+	case "<=":
+		return truth(l <= r), nil
+	case ">":
+		return truth(l > r), nil
+	case ">=":
+		return truth(l >= r), nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if b.op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	}
+	return 0, fmt.Errorf("unknown operator '%s'", b.op)
+}
+
+type call struct {
+	name string
+	args []expr
+}
+
+func (c *call) eval(m *machine) (int64, error) {
+	args := make([]int64, len(c.args))
+	for i, a := range c.args {
+		v, err := a.eval(m)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return m.host.Call(c.name, args)
+}
+
+// A string, where some parts may be variables
+type text struct {
+	lits []string
+	vars []*variable // vars[i] follows lits[i]. The last part is always a literal.
+}
+
+func (t *text) eval(m *machine) (string, error) {
+	s := t.lits[0]
+	for i, v := range t.vars {
+		n, err := v.eval(m)
+		if err != nil {
+			return "", err
+		}
+		s += strconv.FormatInt(n, 10) + t.lits[i+1]
+	}
+	return s, nil
+}
+
+// The argument of an action is either an expression or a string
+type argument struct {
+	e expr
+	t *text
+}
+
+type setStmt struct {
+	line int
+	v    *variable
+	e    expr
+}
+
+type ifStmt struct {
+	line   int
+	conds  []expr
+	blocks [][]stmt // One for every condition, and one more if there is an 'else'
+}
+
+type whileStmt struct {
+	line int
+	cond expr
+	body []stmt
+}
+
+type actionStmt struct {
+	line int
+	name string
+	args []argument
+}
+
+type stopStmt struct{}
+
+//
+// Compiler
+//
+
+// An error, with the line number in the script
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Add the line number to an error, unless it already has one
+func lineError(line int, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{line, err}
+}
+
+type compiler struct {
+	lines   []string
+	pos     int    // The current line, counting from 1
+	pending parser // The rest of the line that ended a block
+}
+
+// Compile statements until the end of the script, or until one of "end", "else" or "elif".
+// Return the statement that ended the block. The rest of that line is kept in 'pending'.
+func (c *compiler) block() (code []stmt, end string, err error) {
+	for c.pos < len(c.lines) {
+		line := strings.TrimSpace(c.lines[c.pos])
+		c.pos++
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		toks, err := lex(line)
+		if err != nil {
+			return nil, "", lineError(c.pos, err)
+		}
+		p := parser{toks: toks}
+		first := p.next()
+		if first.kind != tIdent {
+			return nil, "", lineError(c.pos, errors.New("expected a statement"))
+		}
+		var s stmt
+		switch first.s {
+		case "end", "else", "elif":
+			c.pending = p
+			return code, first.s, nil
+		case "set":
+			s, err = c.set(&p)
+		case "if":
+			s, err = c.ifStmt(&p)
+		case "while":
+			s, err = c.while(&p)
+		case "stop":
+			s = stopStmt{}
+		default:
+			s, err = c.action(&p, first.s)
+		}
+		if err == nil && p.peek().kind != tEnd {
+			err = fmt.Errorf("unexpected '%s'", p.peek().str())
+		}
+		if err != nil {
+			return nil, "", lineError(c.pos, err)
+		}
+		code = append(code, s)
+	}
+	return code, "", nil
+}
+
+func (c *compiler) set(p *parser) (stmt, error) {
+	line := c.pos
+	t := p.next()
+	if t.kind != tIdent {
+		return nil, errors.New("expected a variable")
+	}
+	v, err := parseVariable(t.s)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.kind != tOp || t.s != "=" {
+		return nil, errors.New("expected '='")
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &setStmt{line, v, e}, nil
+}
+
+func (c *compiler) ifStmt(p *parser) (stmt, error) {
+	s := &ifStmt{line: c.pos}
+	for {
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind != tEnd {
+			return nil, fmt.Errorf("unexpected '%s'", t.str())
+		}
+		s.conds = append(s.conds, cond)
+		body, end, err := c.block()
+		if err != nil {
+			return nil, err
+		}
+		s.blocks = append(s.blocks, body)
+		*p = c.pending
+		switch end {
+		case "elif":
+			continue
+		case "else":
+			body, end, err = c.block()
+			if err != nil {
+				return nil, err
+			}
+			s.blocks = append(s.blocks, body)
+			*p = c.pending
+			if end != "end" {
+				return nil, &Error{s.line, errors.New("'else' without 'end'")}
+			}
+		case "":
+			return nil, &Error{s.line, errors.New("'if' without 'end'")}
+		}
+		return s, nil
+	}
+}
+
+func (c *compiler) while(p *parser) (stmt, error) {
+	s := &whileStmt{line: c.pos}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEnd {
+		return nil, fmt.Errorf("unexpected '%s'", t.str())
+	}
+	s.cond = cond
+	body, end, err := c.block()
+	if err != nil {
+		return nil, err
+	}
+	*p = c.pending
+	if end != "end" {
+		return nil, &Error{s.line, errors.New("'while' without 'end'")}
+	}
+	s.body = body
+	return s, nil
+}
+
+func (c *compiler) action(p *parser, name string) (stmt, error) {
+	s := &actionStmt{line: c.pos, name: name}
+	for p.peek().kind != tEnd {
+		if len(s.args) > 0 {
+			if t := p.next(); t.kind != tOp || t.s != "," {
+				return nil, errors.New("expected ','")
+			}
+		}
+		if t := p.peek(); t.kind == tStr {
+			p.next()
+			txt, err := parseText(t.s)
+			if err != nil {
+				return nil, err
+			}
+			s.args = append(s.args, argument{t: txt})
+			continue
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		s.args = append(s.args, argument{e: e})
+	}
+	return s, nil
+}
+
+// Parse a variable name, with an optional scope prefix
+func parseVariable(s string) (*variable, error) {
+	v := &variable{name: s}
+	switch {
+	case strings.HasPrefix(s, "a."):
+		v.scope, v.name = Activator, s[2:]
+	case strings.HasPrefix(s, "p."):
+		v.scope, v.name = Player, s[2:]
+	}
+	if v.name == "" || strings.Contains(v.name, ".") || !isLetter(v.name[0]) {
+		return nil, fmt.Errorf("bad variable '%s'", s)
+	}
+	return v, nil
+}
+
+// Parse a string, where variables are given as "{var}"
+func parseText(s string) (*text, error) {
+	t := &text{}
+	for {
+		i := strings.Index(s, "{")
+		if i == -1 {
+			t.lits = append(t.lits, s)
+			return t, nil
+		}
+		j := strings.Index(s[i:], "}")
+		if j == -1 {
+			return nil, errors.New("missing '}'")
+		}
+		v, err := parseVariable(s[i+1 : i+j])
+		if err != nil {
+			return nil, err
+		}
+		t.lits = append(t.lits, s[:i])
+		t.vars = append(t.vars, v)
+		s = s[i+j+1:]
+	}
+}
+
+//
+// Expression parser
+//
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (t token) str() string {
+	switch t.kind {
+	case tEnd:
+		return "end of line"
+	case tNum:
+		return strconv.FormatInt(t.n, 10)
+	case tStr:
+		return strconv.Quote(t.s)
+	}
+	return t.s
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{kind: tEnd}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if t.kind != tEnd {
+		p.pos++
+	}
+	return t
+}
+
+// Binary operators, in order of increasing precedence
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.binary(0)
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		found := false
+		if t.kind == tOp {
+			for _, op := range precedence[level] {
+				if t.s == op {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return l, nil
+		}
+		p.next()
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{t.s, l, r}
+	}
+}
+
+func (p *parser) unary() (expr, error) {
+	if t := p.peek(); t.kind == tOp && (t.s == "-" || t.s == "!") {
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{t.s, e}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch {
+	case t.kind == tNum:
+		return number(t.n), nil
+	case t.kind == tIdent:
+		if n := p.peek(); n.kind != tOp || n.s != "(" {
+			return parseVariable(t.s)
+		}
+		p.next()
+		c := &call{name: t.s}
+		if n := p.peek(); n.kind == tOp && n.s == ")" {
+			p.next()
+			return c, nil
+		}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, e)
+			n := p.next()
+			if n.kind == tOp && n.s == ")" {
+				return c, nil
+			}
+			if n.kind != tOp || n.s != "," {
+				return nil, errors.New("expected ',' or ')'")
+			}
+		}
+	case t.kind == tOp && t.s == "(":
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if n := p.next(); n.kind != tOp || n.s != ")" {
+			return nil, errors.New("expected ')'")
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", t.str())
+}
+
+//
+// Execution
+//
+
+// Count one instruction
+func (m *machine) step() error {
+	m.steps++
+	if m.steps > m.budget {
+		return ErrBudget
+	}
+	return nil
+}
+
+// Execute a block of statements. Return true if the script was stopped.
+func (m *machine) exec(code []stmt) (bool, error) {
+	for _, s := range code {
+		if err := m.step(); err != nil {
+			return true, err
+		}
+		stop, err := s.exec(m)
+		if stop || err != nil {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+func (s *setStmt) exec(m *machine) (bool, error) {
+	v, err := s.e.eval(m)
+	if err != nil {
+		return true, lineError(s.line, err)
+	}
+	if s.v.scope == Local {
+		m.locals[s.v.name] = v
+		return false, nil
+	}
+	if err := m.host.Set(s.v.scope, s.v.name, v); err != nil {
+		return true, lineError(s.line, err)
+	}
+	return false, nil
+}
+
+func (s *ifStmt) exec(m *machine) (bool, error) {
+	for i, cond := range s.conds {
+		v, err := cond.eval(m)
+		if err != nil {
+			return true, lineError(s.line, err)
+		}
+		if v != 0 {
+			return m.exec(s.blocks[i])
+		}
+	}
+	if len(s.blocks) > len(s.conds) {
+		return m.exec(s.blocks[len(s.conds)])
+	}
+	return false, nil
+}
+
+func (s *whileStmt) exec(m *machine) (bool, error) {
+	for {
+		v, err := s.cond.eval(m)
+		if err != nil {
+			return true, lineError(s.line, err)
+		}
+		if v == 0 {
+			return false, nil
+		}
+		if stop, err := m.exec(s.body); stop || err != nil {
+			return true, err
+		}
+		if err := m.step(); err != nil {
+			return true, err
+		}
+	}
+}
+
+func (s *actionStmt) exec(m *machine) (bool, error) {
+	args := make([]string, len(s.args))
+	for i, a := range s.args {
+		if a.t != nil {
+			str, err := a.t.eval(m)
+			if err != nil {
+				return true, lineError(s.line, err)
+			}
+			args[i] = str
+			continue
+		}
+		v, err := a.e.eval(m)
+		if err != nil {
+			return true, lineError(s.line, err)
+		}
+		args[i] = strconv.FormatInt(v, 10)
+	}
+	if err := m.host.Action(s.name, args); err != nil {
+		return true, lineError(s.line, err)
+	}
+	return false, nil
+}
+
+func (s stopStmt) exec(m *machine) (bool, error) {
+	return true, nil
+}
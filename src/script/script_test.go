@@ -0,0 +1,160 @@
+// Copyright 2013 The Ephenation Authors
+//
+// This file is part of Ephenation.
+//
+// Ephenation is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// Ephenation is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Ephenation.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package script
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// A test host, that records the actions
+type testHost struct {
+	vars    map[Scope]map[string]int64
+	actions []string
+}
+
+func newTestHost() *testHost {
+	return &testHost{vars: map[Scope]map[string]int64{Activator: {}, Player: {}}}
+}
+
+func (h *testHost) Get(scope Scope, name string) int64 {
+	return h.vars[scope][name]
+}
+
+func (h *testHost) Set(scope Scope, name string, value int64) error {
+	h.vars[scope][name] = value
+	return nil
+}
+
+func (h *testHost) Call(name string, args []int64) (int64, error) {
+	if name == "max" && len(args) == 2 {
+		if args[0] > args[1] {
+			return args[0], nil
+		}
+		return args[1], nil
+	}
+	return 0, errors.New("unknown function " + name)
+}
+
+func (h *testHost) Action(name string, args []string) error {
+	if name == "fail" {
+		return errors.New("failed")
+	}
+	h.actions = append(h.actions, name+" "+strings.Join(args, ","))
+	return nil
+}
+
+func run(t *testing.T, h *testHost, src string) error {
+	p, err := Compile(strings.Split(src, "\n"))
+	if err != nil {
+		t.Fatal("Compile", err)
+	}
+	_, err = p.Run(h, 100)
+	return err
+}
+
+func TestExpressions(t *testing.T) {
+	h := newTestHost()
+	err := run(t, h, `
+set a = 1 + 2 * 3
+set b = (1 + 2) * 3 - -1
+set c = 7 / 2 + 7 % 2
+set d = a == 7 && b >= 10 || 0
+set e = !d + max(a, b)
+say a, b, c, d, e`)
+	if err != nil || len(h.actions) != 1 || h.actions[0] != "say 7,10,4,1,10" {
+		t.Error("Expressions", err, h.actions)
+	}
+	if err := run(t, h, "set a = 1 / 0"); err == nil {
+		t.Error("No division by zero error")
+	}
+}
+
+func TestBranches(t *testing.T) {
+	src := `# A comment
+if p.visits == 0
+	say "Welcome"
+elif p.visits < 3
+	say "Again"
+else
+	say "Visit {p.visits}"
+end
+set p.visits = p.visits + 1`
+	h := newTestHost()
+	for i := 0; i < 4; i++ {
+		if err := run(t, h, src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []string{"say Welcome", "say Again", "say Again", "say Visit 3"}
+	if strings.Join(h.actions, ";") != strings.Join(expect, ";") || h.vars[Player]["visits"] != 4 {
+		t.Error("Branches", h.actions, h.vars)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	h := newTestHost()
+	err := run(t, h, `
+set i = 0
+while i < 3
+	monster i
+	set i = i + 1
+	if a.count > 1
+		stop
+	end
+	set a.count = a.count + 1
+end
+say "not reached"`)
+	if err != nil || len(h.actions) != 3 || h.vars[Activator]["count"] != 2 {
+		t.Error("Loop", err, h.actions, h.vars)
+	}
+	err = run(t, h, "while 1\nend")
+	if err != ErrBudget {
+		t.Error("Infinite loop not stopped", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	bad := []string{
+		"if 1",
+		"end",
+		"while 1\nelse\nend",
+		"set = 1",
+		"set x 1",
+		"say \"x",
+		"say 1 2",
+		"set p.a.b = 1",
+		"say \"{x\"",
+		"set x = (1",
+		"if 1\nset x = 1 +\nend",
+	}
+	for _, src := range bad {
+		if _, err := Compile(strings.Split(src, "\n")); err == nil {
+			t.Errorf("No compile error for %q", src)
+		}
+	}
+	_, err := Compile([]string{"say 1", "if 1", "set x = ]", "end"})
+	if e, ok := err.(*Error); !ok || e.Line != 3 {
+		t.Error("Wrong line", err)
+	}
+	h := newTestHost()
+	if err := run(t, h, "say 1\nfail\nsay 2"); err == nil || len(h.actions) != 1 {
+		t.Error("Action error", err, h.actions)
+	}
+}